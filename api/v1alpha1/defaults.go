@@ -26,6 +26,8 @@ var (
 	DexMetricsPort     = int32(5557)
 	MariaDBStorageSize = "5Gi"
 	MariaDBImage       = config.MariaDBImage
+	DSProxyImage       = config.DSProxyImage
+	DSProxyPolicy      = "p, system:cluster-admins, *, */*, read\n"
 	DataSourceMcoo     = []DataSource{
 		{
 			Name:    "Prometheus (MCOO)",
@@ -18,8 +18,10 @@ package v1alpha1
 
 import (
 	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -60,6 +62,32 @@ type GrafanaSpec struct {
 	// DataSources is the configuration for the DataSources
 	// +kubebuilder:validation:Optional
 	DataSources []DataSource `json:"datasources,omitempty"`
+	// DSProxy is the configuration for the dsproxy sidecar enforcing per-user query scoping on the DataSources
+	// +kubebuilder:validation:Optional
+	DSProxy *DSProxy `json:"dsproxy,omitempty"`
+}
+
+type DSProxy struct {
+	// Enabled is a flag to enable or disable the dsproxy sidecar in the Grafana deployment
+	// +kubebuilder:validation:Required
+	Enabled bool `json:"enabled,omitempty"`
+	// Image is the image to use for the dsproxy sidecar and its init container
+	// +kubebuilder:validation:Optional
+	Image string `json:"image,omitempty"`
+	// Policy is the Casbin policy (policy.csv) deciding which cluster/namespace pairs users and groups may query per DataSource
+	// +kubebuilder:validation:Optional
+	Policy string `json:"policy,omitempty"`
+	// InjectionLabel is the label injected into PromQL queries
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:default="namespace"
+	InjectionLabel string `json:"injectionLabel,omitempty"`
+	// TokenReview authenticates tokens not issued by Dex, e.g. of service accounts querying Grafana's datasources through dsproxy, with the TokenReview API
+	// +kubebuilder:validation:Optional
+	TokenReview bool `json:"tokenReview,omitempty"`
+	// AccessPolicyWildcards allows the GrafanaAccessPolicies selecting the instance to grant clusters and namespaces with wildcards, e.g. */* or */team-*.
+	// Otherwise they may only grant explicit cluster/namespace pairs, as anyone allowed to create GrafanaAccessPolicies in the namespace could grant all namespaces.
+	// +kubebuilder:validation:Optional
+	AccessPolicyWildcards bool `json:"accessPolicyWildcards,omitempty"`
 }
 
 type MariaDB struct {
@@ -81,11 +109,14 @@ type Dex struct {
 	// Image is the image to use for the Dex OIDC provider
 	// +kubebuilder:validation:Optional
 	Image string `json:"image,omitempty"`
+	// TLSSkipVerify disables the verification of Dex's TLS certificate by Grafana's OAuth client, which is otherwise verified with the OpenShift service and ingress CAs
+	// +kubebuilder:validation:Optional
+	TLSSkipVerify bool `json:"tlsSkipVerify,omitempty"`
 }
 
 // DataSourceType defines the type of the data source
 //
-// +kubebuilder:validation:Enum=prometheus-incluster;loki-incluster;tempo-incluster;prometheus-mcoo
+// +kubebuilder:validation:Enum=prometheus-incluster;loki-incluster;tempo-incluster;prometheus-mcoo;custom
 type DataSourceType string
 
 // ToString converts the DataSourceType to a string
@@ -102,6 +133,8 @@ const (
 	TempoInCluster DataSourceType = "tempo-incluster"
 	// PrometheusMcoo is the MCOO data source type
 	PrometheusMcoo DataSourceType = "prometheus-mcoo"
+	// Custom is the data source type of any Grafana data source
+	Custom DataSourceType = "custom"
 )
 
 type DataSource struct {
@@ -110,7 +143,7 @@ type DataSource struct {
 	Name string `json:"name,omitempty"`
 	// +required
 	// +kubebuilder:validation:Required
-	// +operator-sdk:csv:customresourcedefinitions:type=spec,xDescriptors={"urn:alm:descriptor:com.tectonic.ui:select:tempo-incluster","urn:alm:descriptor:com.tectonic.ui:select:loki-incluster","urn:alm:descriptor:com.tectonic.ui:select:prometheus-incluster","urn:alm:descriptor:com.tectonic.ui:select:prometheus-mcoo"},displayName="DataSource type"
+	// +operator-sdk:csv:customresourcedefinitions:type=spec,xDescriptors={"urn:alm:descriptor:com.tectonic.ui:select:tempo-incluster","urn:alm:descriptor:com.tectonic.ui:select:loki-incluster","urn:alm:descriptor:com.tectonic.ui:select:prometheus-incluster","urn:alm:descriptor:com.tectonic.ui:select:prometheus-mcoo","urn:alm:descriptor:com.tectonic.ui:select:custom"},displayName="DataSource type"
 	Type DataSourceType `json:"type,omitempty"`
 	// +kubebuilder:validation:Required
 	Enabled bool `json:"enabled,omitempty"`
@@ -123,21 +156,31 @@ type DataSource struct {
 	// Prometheus is the configuration for the Prometheus DataSource
 	// +kubebuilder:validation:Optional
 	Prometheus *PrometheusDS `json:"prometheus,omitempty"`
+	// Custom is the configuration for the custom DataSource
+	// +kubebuilder:validation:Optional
+	Custom *CustomDS `json:"custom,omitempty"`
+	// TLSSkipVerify disables the verification of the DataSource's TLS certificate, which is otherwise verified with the OpenShift service and ingress CAs
+	// +kubebuilder:validation:Optional
+	TLSSkipVerify bool `json:"tlsSkipVerify,omitempty"`
 }
 
 type LokiDS struct {
 	// URL is the URL for the Loki DataSource
 	// +kubebuilder:validation:Optional
 	URL string `json:"url,omitempty"`
+	// LokiStack references a LokiStack to create a DataSource per tenant of its gateway for, instead of the URL
 	// +kubebuilder:validation:Optional
 	LokiStack *LokiStack `json:"lokiStack,omitempty"`
+	// Discover creates a DataSource per tenant of the gateway of every LokiStack in the cluster
+	// +kubebuilder:validation:Optional
+	Discover bool `json:"discover,omitempty"`
 }
 
 type LokiStack struct {
 	// Name is the name of the Loki Stack
 	// +kubebuilder:validation:Optional
 	Name string `json:"name,omitempty"`
-	// Namespace is the namespace of the Loki Stack
+	// Namespace is the namespace of the Loki Stack, defaults to the namespace of the Grafana
 	// +kubebuilder:validation:Optional
 	Namespace string `json:"namespace,omitempty"`
 }
@@ -146,16 +189,22 @@ type TempoDS struct {
 	// URL is the URL for the Tempo DataSource
 	// +kubebuilder:validation:Optional
 	URL string `json:"url,omitempty"`
-	// TempoStack is the configuration for the Tempo Stack
+	// TempoStack references a TempoStack to create a DataSource per tenant of its gateway for, instead of the URL
 	// +kubebuilder:validation:Optional
 	TempoStack *TempoStack `json:"tempoStack,omitempty"`
+	// Discover creates a DataSource per tenant of the gateway of every TempoStack in the cluster
+	// +kubebuilder:validation:Optional
+	Discover bool `json:"discover,omitempty"`
+	// Tenant is the tenant of the Tempo gateway the traces are read from, parsed from the URL (/api/traces/v1/<tenant>/) when empty
+	// +kubebuilder:validation:Optional
+	Tenant string `json:"tenant,omitempty"`
 }
 
 type TempoStack struct {
 	// Name is the name of the Tempo Stack
 	// +kubebuilder:validation:Optional
 	Name string `json:"name,omitempty"`
-	// Namespace is the namespace of the Tempo Stack
+	// Namespace is the namespace of the Tempo Stack, defaults to the namespace of the Grafana
 	// +kubebuilder:validation:Optional
 	Namespace string `json:"namespace,omitempty"`
 }
@@ -166,10 +215,68 @@ type PrometheusDS struct {
 	URL string `json:"url,omitempty"`
 }
 
+type CustomDS struct {
+	// Type is the Grafana type of the DataSource, e.g. elasticsearch, grafana-postgresql-datasource or jaeger
+	// +kubebuilder:validation:Required
+	Type string `json:"type,omitempty"`
+	// URL is the URL for the DataSource
+	// +kubebuilder:validation:Optional
+	URL string `json:"url,omitempty"`
+	// Database is the database of the DataSource
+	// +kubebuilder:validation:Optional
+	Database string `json:"database,omitempty"`
+	// User is the user of the DataSource
+	// +kubebuilder:validation:Optional
+	User string `json:"user,omitempty"`
+	// BasicAuth enables basic authentication, its password is set as basicAuthPassword in SecureJSONData
+	// +kubebuilder:validation:Optional
+	BasicAuth bool `json:"basicAuth,omitempty"`
+	// BasicAuthUser is the user for the basic authentication
+	// +kubebuilder:validation:Optional
+	BasicAuthUser string `json:"basicAuthUser,omitempty"`
+	// JSONData is passed through as the jsonData of the DataSource
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Schemaless
+	// +kubebuilder:pruning:PreserveUnknownFields
+	// +kubebuilder:validation:Type=object
+	JSONData json.RawMessage `json:"jsonData,omitempty"`
+	// SecureJSONData sets each key of the secureJsonData of the DataSource to the value of a Secret key in the namespace of the Grafana
+	// +kubebuilder:validation:Optional
+	SecureJSONData map[string]corev1.SecretKeySelector `json:"secureJsonData,omitempty"`
+}
+
 func (ds *DataSource) GetDataSourceNameHash() string {
 	return fmt.Sprintf("%x", sha256.Sum256([]byte(ds.Name)))[0:6]
 }
 
+// DataSourceStatus is the health of a DataSource, as probed by the operator
+type DataSourceStatus struct {
+	// Name is the name of the DataSource
+	Name string `json:"name"`
+	// Type is the type of the DataSource
+	Type DataSourceType `json:"type"`
+	// URL is the URL the DataSource was probed at
+	// +optional
+	URL string `json:"url,omitempty"`
+	// Reachable is true when the last probe got a successful response
+	Reachable bool `json:"reachable"`
+	// Reason is why the DataSource is not probed, e.g. as its type has no known health endpoint
+	// +optional
+	Reason string `json:"reason,omitempty"`
+	// HTTPStatus is the HTTP status code of the last probe
+	// +optional
+	HTTPStatus int32 `json:"httpStatus,omitempty"`
+	// Latency is the duration of the last probe
+	// +optional
+	Latency *metav1.Duration `json:"latency,omitempty"`
+	// LastError is the error of the last probe, empty when it succeeded
+	// +optional
+	LastError string `json:"lastError,omitempty"`
+	// LastProbeTime is the time of the last probe
+	// +optional
+	LastProbeTime *metav1.Time `json:"lastProbeTime,omitempty"`
+}
+
 // GrafanaStatus defines the observed state of Grafana
 type GrafanaStatus struct {
 	// TokenExpirationTime is the time when the token will expire
@@ -183,6 +290,10 @@ type GrafanaStatus struct {
 	Phase               string       `json:"phase,omitempty"`
 	// +operator-sdk:csv:customresourcedefinitions:type=status
 	Conditions []metav1.Condition `json:"conditions"`
+	// DataSources is the health of the enabled DataSources
+	// +optional
+	// +operator-sdk:csv:customresourcedefinitions:type=status,displayName="DataSources"
+	DataSources []DataSourceStatus `json:"datasources,omitempty"`
 }
 
 // +kubebuilder:object:root=true
@@ -18,6 +18,7 @@ package v1alpha1
 
 import (
 	"context"
+	"encoding/json"
 
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -68,6 +69,18 @@ func (r *GrafooCustomDefaulter) Default(ctx context.Context, obj runtime.Object)
 			Image:       MariaDBImage,
 		}
 	}
+	// dsproxy
+	if grafoo.Spec.DSProxy != nil && grafoo.Spec.DSProxy.Enabled {
+		if grafoo.Spec.DSProxy.Image == "" {
+			grafoo.Spec.DSProxy.Image = DSProxyImage
+		}
+		if grafoo.Spec.DSProxy.Policy == "" {
+			grafoo.Spec.DSProxy.Policy = DSProxyPolicy
+		}
+		if grafoo.Spec.DSProxy.InjectionLabel == "" {
+			grafoo.Spec.DSProxy.InjectionLabel = "namespace"
+		}
+	}
 	// replicas
 	if grafoo.Spec.Replicas == nil {
 		grafoo.Spec.Replicas = &GrafanaReplicas
@@ -111,7 +124,7 @@ func (r *Grafana) validateGrafana() error {
 // validateGrafanaDatasources validates the datasources
 func (r *Grafana) validateGrafanaDatasources() *field.Error {
 	for _, ds := range r.Spec.DataSources {
-		if ds.Type != "prometheus-incluster" && ds.Type != "loki-incluster" && ds.Type != "tempo-incluster" {
+		if ds.Type != "prometheus-incluster" && ds.Type != "loki-incluster" && ds.Type != "tempo-incluster" && ds.Type != Custom {
 			return field.Invalid(field.NewPath("spec").Child("dataSources"), ds.Type, "invalid datasource type")
 		}
 	}
@@ -134,8 +147,11 @@ func (r *Grafana) validateGrafanaDatasources() *field.Error {
 			if ds.Loki == nil {
 				return field.Invalid(field.NewPath("spec").Child("dataSources"), ds.Type, "missing loki config")
 			}
-			if ds.Loki.URL == "" {
-				return field.Invalid(field.NewPath("spec").Child("dataSources"), ds.Type, "missing loki url")
+			if ds.Loki.URL == "" && ds.Loki.LokiStack == nil && !ds.Loki.Discover {
+				return field.Invalid(field.NewPath("spec").Child("dataSources"), ds.Type, "missing loki url, lokiStack or discover")
+			}
+			if ds.Loki.LokiStack != nil && ds.Loki.LokiStack.Name == "" {
+				return field.Invalid(field.NewPath("spec").Child("dataSources"), ds.Type, "missing lokiStack name")
 			}
 			if ds.Prometheus != nil {
 				return field.Invalid(field.NewPath("spec").Child("dataSources"), ds.Type, "prometheus config is not allowed")
@@ -148,8 +164,11 @@ func (r *Grafana) validateGrafanaDatasources() *field.Error {
 			if ds.Tempo == nil {
 				return field.Invalid(field.NewPath("spec").Child("dataSources"), ds.Type, "missing tempo config")
 			}
-			if ds.Tempo.URL == "" {
-				return field.Invalid(field.NewPath("spec").Child("dataSources"), ds.Type, "missing tempo url")
+			if ds.Tempo.URL == "" && ds.Tempo.TempoStack == nil && !ds.Tempo.Discover {
+				return field.Invalid(field.NewPath("spec").Child("dataSources"), ds.Type, "missing tempo url, tempoStack or discover")
+			}
+			if ds.Tempo.TempoStack != nil && ds.Tempo.TempoStack.Name == "" {
+				return field.Invalid(field.NewPath("spec").Child("dataSources"), ds.Type, "missing tempoStack name")
 			}
 			if ds.Prometheus != nil {
 				return field.Invalid(field.NewPath("spec").Child("dataSources"), ds.Type, "prometheus config is not allowed")
@@ -158,6 +177,25 @@ func (r *Grafana) validateGrafanaDatasources() *field.Error {
 				return field.Invalid(field.NewPath("spec").Child("dataSources"), ds.Type, "loki config is not allowed")
 			}
 		}
+		if ds.Type == Custom {
+			if ds.Custom == nil {
+				return field.Invalid(field.NewPath("spec").Child("dataSources"), ds.Type, "missing custom config")
+			}
+			if ds.Custom.Type == "" {
+				return field.Invalid(field.NewPath("spec").Child("dataSources"), ds.Type, "missing custom type")
+			}
+			if ds.Prometheus != nil || ds.Loki != nil || ds.Tempo != nil {
+				return field.Invalid(field.NewPath("spec").Child("dataSources"), ds.Type, "only custom config is allowed")
+			}
+			if len(ds.Custom.JSONData) > 0 {
+				var jsonData map[string]any
+				if err := json.Unmarshal(ds.Custom.JSONData, &jsonData); err != nil {
+					return field.Invalid(field.NewPath("spec").Child("dataSources"), ds.Type, "custom jsonData must be an object")
+				}
+			}
+		} else if ds.Custom != nil {
+			return field.Invalid(field.NewPath("spec").Child("dataSources"), ds.Type, "custom config is not allowed")
+		}
 	}
 	return nil
 }
@@ -1,8 +1,11 @@
 package v1alpha1
 
 import (
+	"encoding/json"
+
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
 )
 
 var _ = Describe("Grafana Webhook", func() {
@@ -126,6 +129,82 @@ var _ = Describe("Grafana Webhook", func() {
 			Expect(warn).To(BeNil())
 		})
 
+		It("Should deny if a custom data source has no type", func() {
+			g := &Grafana{
+				Spec: GrafanaSpec{
+					DataSources: []DataSource{
+						{
+							Name:    "foo-name",
+							Type:    Custom,
+							Enabled: true,
+							Custom: &CustomDS{
+								URL: "http://elasticsearch.logging.svc:9200",
+							},
+						},
+					},
+				},
+			}
+			warn, err := g.ValidateCreate(ctx, g)
+			Expect(err).NotTo(BeNil())
+			Expect(warn).To(BeNil())
+		})
+
+		It("Should admit a custom data source", func() {
+			g := &Grafana{
+				Spec: GrafanaSpec{
+					DataSources: []DataSource{
+						{
+							Name:    "foo-name",
+							Type:    Custom,
+							Enabled: true,
+							Custom: &CustomDS{
+								Type:     "elasticsearch",
+								URL:      "http://elasticsearch.logging.svc:9200",
+								JSONData: json.RawMessage(`{"index": "logs-*", "timeField": "@timestamp"}`),
+								SecureJSONData: map[string]corev1.SecretKeySelector{
+									"basicAuthPassword": {
+										LocalObjectReference: corev1.LocalObjectReference{Name: "elasticsearch"},
+										Key:                  "password",
+									},
+								},
+							},
+						},
+					},
+				},
+			}
+			warn, err := g.ValidateCreate(ctx, g)
+			Expect(err).To(BeNil())
+			Expect(warn).To(BeNil())
+		})
+
+		It("Should admit a loki data source referencing a LokiStack", func() {
+			g := &Grafana{
+				Spec: GrafanaSpec{
+					DataSources: []DataSource{
+						{
+							Name:    "Loki",
+							Type:    "loki-incluster",
+							Enabled: true,
+							Loki: &LokiDS{
+								LokiStack: &LokiStack{Name: "logging-loki", Namespace: "openshift-logging"},
+							},
+						},
+						{
+							Name:    "Tempo",
+							Type:    "tempo-incluster",
+							Enabled: true,
+							Tempo: &TempoDS{
+								Discover: true,
+							},
+						},
+					},
+				},
+			}
+			warn, err := g.ValidateCreate(ctx, g)
+			Expect(err).To(BeNil())
+			Expect(warn).To(BeNil())
+		})
+
 		It("Should add prometheus-mcoo datasource if GrafooDefaultEnableMCOO is true", func() {
 			g := &Grafana{
 				Spec: GrafanaSpec{
@@ -0,0 +1,77 @@
+/*
+Copyright 2024 Magnus Bengtsson <magnus@cloudmonkey.org>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// GrafanaAccessPolicySpec defines the access granted through the dsproxy of Grafana instances
+type GrafanaAccessPolicySpec struct {
+	// InstanceSelector selects the Grafana instances in the namespace of the policy it applies to.
+	// All Grafana instances in the namespace are selected when empty.
+	// +kubebuilder:validation:Optional
+	InstanceSelector *metav1.LabelSelector `json:"instanceSelector,omitempty"`
+	// Rules are the access rules of the policy
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinItems=1
+	Rules []AccessRule `json:"rules"`
+}
+
+// AccessRule grants subjects and groups read access to cluster/namespace
+// pairs through a set of datasources
+type AccessRule struct {
+	// Subjects are the identities granted access, as authenticated by dsproxy: the value of its identity claim
+	// (--identity-claim, sub by default) or, for service account tokens, the TokenReview username,
+	// e.g. system:serviceaccount:<namespace>:<name>
+	// +kubebuilder:validation:Optional
+	Subjects []string `json:"subjects,omitempty"`
+	// Groups are the groups granted access, as authenticated by dsproxy: the values of its groups claim
+	// (--groups-claim), mapped by --group-mapping or prefixed by --groups-prefix, or, for service account tokens, the TokenReview groups
+	// +kubebuilder:validation:Optional
+	Groups []string `json:"groups,omitempty"`
+	// DataSources are the datasources access is granted through, by their name in the Grafana, e.g. Prometheus or Loki (application),
+	// by their name in spec.datasources of the Grafana for all datasources resolved from it, by their UID (X-Datasource-Uid),
+	// or * for all datasources. All datasources when empty.
+	// +kubebuilder:validation:Optional
+	DataSources []string `json:"datasources,omitempty"`
+	// Namespaces are the cluster/namespace pairs access is granted to.
+	// Supports keyMatch2 wildcards, e.g. */dev-* or prod-cluster/*, if the selected Grafana instances set spec.dsproxy.accessPolicyWildcards.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinItems=1
+	Namespaces []string `json:"namespaces"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:shortName=gap
+type GrafanaAccessPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec GrafanaAccessPolicySpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+type GrafanaAccessPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []GrafanaAccessPolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&GrafanaAccessPolicy{}, &GrafanaAccessPolicyList{})
+}
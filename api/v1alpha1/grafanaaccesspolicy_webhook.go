@@ -0,0 +1,217 @@
+/*
+Copyright 2024 Magnus Bengtsson <magnus@cloudmonkey.org>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// log is for logging in this package.
+var grafanaaccesspolicylog = logf.Log.WithName("grafanaaccesspolicy-resource")
+
+// patternSegment matches a cluster or namespace of a keyMatch2 pattern:
+// "*" or a DNS-1123 name in which "*" matches any characters
+var patternSegment = regexp.MustCompile(`^(\*|[a-z0-9*]([-a-z0-9.*]*[a-z0-9*])?)$`)
+
+func (r *GrafanaAccessPolicy) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		WithValidator(&GrafanaAccessPolicyCustomValidator{Client: mgr.GetClient()}).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/validate-grafoo-cloudmonkey-org-v1alpha1-grafanaaccesspolicy,mutating=false,failurePolicy=fail,sideEffects=None,groups=grafoo.cloudmonkey.org,resources=grafanaaccesspolicies,verbs=create;update,versions=v1alpha1,name=vgrafanaaccesspolicy.kb.io,admissionReviewVersions=v1
+
+// GrafanaAccessPolicyCustomValidator validates GrafanaAccessPolicies against
+// the Grafana instances they select
+type GrafanaAccessPolicyCustomValidator struct {
+	Client client.Reader
+}
+
+var _ webhook.CustomValidator = &GrafanaAccessPolicyCustomValidator{}
+
+// ValidateCreate implements webhook.CustomValidator so a webhook will be registered for the type
+func (v *GrafanaAccessPolicyCustomValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	policy := obj.(*GrafanaAccessPolicy)
+	grafanaaccesspolicylog.Info("validate create", "name", policy.Name)
+	return nil, v.validate(ctx, policy)
+}
+
+// ValidateUpdate implements webhook.CustomValidator so a webhook will be registered for the type
+func (v *GrafanaAccessPolicyCustomValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	policy := newObj.(*GrafanaAccessPolicy)
+	grafanaaccesspolicylog.Info("validate update", "name", policy.Name)
+	return nil, v.validate(ctx, policy)
+}
+
+// ValidateDelete implements webhook.CustomValidator so a webhook will be registered for the type
+func (v *GrafanaAccessPolicyCustomValidator) ValidateDelete(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+// validate validates the policy, whose wildcards must be allowed by all
+// Grafana instances in its namespace it selects
+func (v *GrafanaAccessPolicyCustomValidator) validate(ctx context.Context, policy *GrafanaAccessPolicy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	if !policy.HasWildcards() {
+		return nil
+	}
+	grafanas := &GrafanaList{}
+	if err := v.Client.List(ctx, grafanas, client.InNamespace(policy.Namespace)); err != nil {
+		return apierrors.NewInternalError(err)
+	}
+	var denied []string
+	for _, grafana := range grafanas.Items {
+		if policy.Selects(&grafana) && (grafana.Spec.DSProxy == nil || !grafana.Spec.DSProxy.AccessPolicyWildcards) {
+			denied = append(denied, grafana.Name)
+		}
+	}
+	if len(denied) == 0 {
+		return nil
+	}
+	var allErrs field.ErrorList
+	for i, rule := range policy.Spec.Rules {
+		for j, pattern := range rule.Namespaces {
+			if strings.Contains(pattern, "*") {
+				allErrs = append(allErrs, field.Forbidden(field.NewPath("spec").Child("rules").Index(i).Child("namespaces").Index(j),
+					"wildcards are not allowed by spec.dsproxy.accessPolicyWildcards of the Grafana instances "+strings.Join(denied, ", ")))
+			}
+		}
+	}
+	return apierrors.NewInvalid(
+		schema.GroupKind{
+			Group: "grafoo.cloudmonkey.org", Kind: "GrafanaAccessPolicy",
+		}, policy.Name, allErrs)
+}
+
+// HasWildcards returns true if a rule of the policy grants clusters or
+// namespaces with wildcards
+func (r *GrafanaAccessPolicy) HasWildcards() bool {
+	for _, rule := range r.Spec.Rules {
+		for _, pattern := range rule.Namespaces {
+			if strings.Contains(pattern, "*") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Selects returns true if the policy applies to the Grafana instance, which
+// must be in the namespace of the policy. Policies with an invalid instance
+// selector select no instance.
+func (r *GrafanaAccessPolicy) Selects(grafana *Grafana) bool {
+	if grafana.Namespace != r.Namespace {
+		return false
+	}
+	if r.Spec.InstanceSelector == nil {
+		return true
+	}
+	selector, err := metav1.LabelSelectorAsSelector(r.Spec.InstanceSelector)
+	return err == nil && selector.Matches(labels.Set(grafana.Labels))
+}
+
+// Validate validates the rules of the policy. The controller validates
+// policies as well before rendering them into policy.csv, as the webhook
+// may be disabled.
+func (r *GrafanaAccessPolicy) Validate() error {
+	var allErrs field.ErrorList
+	if r.Spec.InstanceSelector != nil {
+		if _, err := metav1.LabelSelectorAsSelector(r.Spec.InstanceSelector); err != nil {
+			allErrs = append(allErrs, field.Invalid(field.NewPath("spec").Child("instanceSelector"), r.Spec.InstanceSelector, err.Error()))
+		}
+	}
+	for i, rule := range r.Spec.Rules {
+		path := field.NewPath("spec").Child("rules").Index(i)
+		if len(rule.Subjects) == 0 && len(rule.Groups) == 0 {
+			allErrs = append(allErrs, field.Required(path, "at least one subject or group is required"))
+		}
+		for j, subject := range rule.Subjects {
+			if err := validatePolicyValue(subject); err != "" {
+				allErrs = append(allErrs, field.Invalid(path.Child("subjects").Index(j), subject, err))
+			}
+		}
+		for j, group := range rule.Groups {
+			if err := validatePolicyValue(group); err != "" {
+				allErrs = append(allErrs, field.Invalid(path.Child("groups").Index(j), group, err))
+			}
+		}
+		for j, datasource := range rule.DataSources {
+			if err := validatePolicyValue(datasource); err != "" {
+				allErrs = append(allErrs, field.Invalid(path.Child("datasources").Index(j), datasource, err))
+			}
+		}
+		if len(rule.Namespaces) == 0 {
+			allErrs = append(allErrs, field.Required(path.Child("namespaces"), "at least one cluster/namespace pattern is required"))
+		}
+		for j, pattern := range rule.Namespaces {
+			if err := validateNamespacePattern(pattern); err != "" {
+				allErrs = append(allErrs, field.Invalid(path.Child("namespaces").Index(j), pattern, err))
+			}
+		}
+	}
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(
+		schema.GroupKind{
+			Group: "grafoo.cloudmonkey.org", Kind: "GrafanaAccessPolicy",
+		}, r.Name, allErrs)
+}
+
+// validatePolicyValue validates a subject, group or datasource rendered into
+// a policy.csv line, which must not be able to break out of its field
+func validatePolicyValue(value string) string {
+	if value == "" || strings.TrimSpace(value) != value {
+		return "must be non-empty without leading or trailing whitespace"
+	}
+	if strings.ContainsAny(value, ",\"\r\n") {
+		return "must not contain commas, quotes or line breaks"
+	}
+	return ""
+}
+
+// validateNamespacePattern validates a keyMatch2 cluster/namespace pattern
+func validateNamespacePattern(pattern string) string {
+	cluster, namespace, ok := strings.Cut(pattern, "/")
+	if !ok || strings.Contains(namespace, "/") {
+		return "must be of the form cluster/namespace"
+	}
+	if !patternSegment.MatchString(cluster) {
+		return "cluster must be * or a name with optional * wildcards"
+	}
+	if !patternSegment.MatchString(namespace) {
+		return "namespace must be * or a name with optional * wildcards"
+	}
+	return ""
+}
@@ -0,0 +1,121 @@
+package v1alpha1
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var _ = Describe("GrafanaAccessPolicy Webhook", func() {
+	Context("When creating GrafanaAccessPolicy under Validating Webhook", func() {
+		var v *GrafanaAccessPolicyCustomValidator
+
+		BeforeEach(func() {
+			scheme := runtime.NewScheme()
+			Expect(AddToScheme(scheme)).To(Succeed())
+			restricted := &Grafana{Spec: GrafanaSpec{DSProxy: &DSProxy{Enabled: true}}}
+			restricted.Name = "restricted"
+			restricted.Namespace = "restricted"
+			restricted.Labels = map[string]string{"env": "prod"}
+			wildcards := &Grafana{Spec: GrafanaSpec{DSProxy: &DSProxy{Enabled: true, AccessPolicyWildcards: true}}}
+			wildcards.Name = "wildcards"
+			wildcards.Namespace = "restricted"
+			wildcards.Labels = map[string]string{"env": "dev"}
+			v = &GrafanaAccessPolicyCustomValidator{Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(restricted, wildcards).Build()}
+		})
+
+		It("Should admit valid keyMatch2 patterns", func() {
+			p := &GrafanaAccessPolicy{
+				Spec: GrafanaAccessPolicySpec{
+					Rules: []AccessRule{
+						{
+							Subjects:    []string{"alice@example.com"},
+							Groups:      []string{"system:cluster-admins"},
+							DataSources: []string{"*", "grafana-1a2b3c", "Loki (application)"},
+							Namespaces:  []string{"*/*", "prod-cluster/backend-*", "local-cluster/monitoring"},
+						},
+					},
+				},
+			}
+			warn, err := v.ValidateCreate(ctx, p)
+			Expect(err).To(BeNil())
+			Expect(warn).To(BeNil())
+		})
+
+		It("Should deny wildcards unless the selected Grafana instances allow them", func() {
+			p := &GrafanaAccessPolicy{
+				Spec: GrafanaAccessPolicySpec{
+					Rules: []AccessRule{{Groups: []string{"team"}, Namespaces: []string{"local-cluster/team", "*/*"}}},
+				},
+			}
+			p.Namespace = "restricted"
+			_, err := v.ValidateCreate(ctx, p)
+			Expect(err).To(MatchError(ContainSubstring("spec.rules[0].namespaces[1]")))
+			Expect(err).To(MatchError(ContainSubstring("restricted")))
+
+			p.Spec.InstanceSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"env": "dev"}}
+			_, err = v.ValidateUpdate(ctx, nil, p)
+			Expect(err).To(BeNil())
+
+			p.Spec.InstanceSelector = nil
+			p.Spec.Rules[0].Namespaces = []string{"local-cluster/team"}
+			_, err = v.ValidateCreate(ctx, p)
+			Expect(err).To(BeNil())
+		})
+
+		It("Should deny namespaces which are not cluster/namespace patterns", func() {
+			for _, pattern := range []string{"monitoring", "a/b/c", "/ns", "cluster/", "cluster/Team", "cluster/:ns", "cluster/ns[0-9]"} {
+				p := &GrafanaAccessPolicy{
+					Spec: GrafanaAccessPolicySpec{
+						Rules: []AccessRule{{Groups: []string{"team"}, Namespaces: []string{pattern}}},
+					},
+				}
+				_, err := v.ValidateCreate(ctx, p)
+				Expect(err).NotTo(BeNil(), pattern)
+			}
+		})
+
+		It("Should deny subjects and groups breaking out of the policy line", func() {
+			for _, subject := range []string{"", " alice", "alice, *, */*, read", "alice\np, bob", `"alice"`} {
+				p := &GrafanaAccessPolicy{
+					Spec: GrafanaAccessPolicySpec{
+						Rules: []AccessRule{{Subjects: []string{subject}, Namespaces: []string{"*/*"}}},
+					},
+				}
+				_, err := v.ValidateCreate(ctx, p)
+				Expect(err).NotTo(BeNil(), subject)
+			}
+		})
+
+		It("Should deny rules without subjects, groups or namespaces", func() {
+			p := &GrafanaAccessPolicy{
+				Spec: GrafanaAccessPolicySpec{
+					Rules: []AccessRule{{Namespaces: []string{"*/*"}}, {Groups: []string{"team"}}},
+				},
+			}
+			_, err := v.ValidateCreate(ctx, p)
+			Expect(err).NotTo(BeNil())
+		})
+
+		It("Should deny invalid datasources and instance selectors", func() {
+			p := &GrafanaAccessPolicy{
+				Spec: GrafanaAccessPolicySpec{
+					Rules: []AccessRule{{Groups: []string{"team"}, DataSources: []string{"prom,*"}, Namespaces: []string{"*/*"}}},
+				},
+			}
+			_, err := v.ValidateCreate(ctx, p)
+			Expect(err).NotTo(BeNil())
+
+			p = &GrafanaAccessPolicy{
+				Spec: GrafanaAccessPolicySpec{
+					InstanceSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "app", Operator: "Bogus"}}},
+					Rules:            []AccessRule{{Groups: []string{"team"}, Namespaces: []string{"*/*"}}},
+				},
+			}
+			_, err = v.ValidateUpdate(ctx, nil, p)
+			Expect(err).NotTo(BeNil())
+		})
+	})
+})
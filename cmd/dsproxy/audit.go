@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	mathrand "math/rand/v2"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audit decisions
+const (
+	auditDecisionAllow           = "allow"
+	auditDecisionDeny            = "deny"
+	auditDecisionUnauthenticated = "unauthenticated"
+	auditDecisionError           = "error"
+)
+
+// auditMaxBodyBytes bounds the form bodies read for the audit log, as
+// net/http bounds those parsed by Request.ParseForm
+const auditMaxBodyBytes = 10 << 20
+
+// auditMinRedactKeyBytes is the shortest key accepted for redaction
+const auditMinRedactKeyBytes = 16
+
+// auditedParams are the request parameters holding queries: PromQL and
+// LogQL query, series matchers and TraceQL q
+var auditedParams = []string{"query", "match[]", "q"}
+
+// audit is the audit logger of the proxied requests, nil when disabled
+var audit *auditLogger
+
+// auditRecord is a JSON line of the audit log. The middlewares of the chain
+// fill in the fields they know about as the request passes through.
+type auditRecord struct {
+	Time              time.Time           `json:"time"`
+	Subject           string              `json:"subject,omitempty"`
+	Groups            []string            `json:"groups,omitempty"`
+	Datasource        string              `json:"datasource,omitempty"`
+	DatasourceType    string              `json:"datasourceType,omitempty"`
+	Method            string              `json:"method"`
+	Path              string              `json:"path"`
+	Query             map[string][]string `json:"query,omitempty"`
+	RewrittenQuery    map[string][]string `json:"rewrittenQuery,omitempty"`
+	AllowedNamespaces []string            `json:"allowedNamespaces,omitempty"`
+	Decision          string              `json:"decision"`
+	Reason            string              `json:"reason,omitempty"`
+	Status            int                 `json:"status"`
+	DurationSeconds   float64             `json:"durationSeconds"`
+}
+
+// auditLogger writes audit records as JSON lines
+type auditLogger struct {
+	mu  sync.Mutex
+	out io.Writer
+	// sampleRate is the fraction of allowed requests recorded, other
+	// decisions are always recorded
+	sampleRate float64
+	// redact are the fields whose values are replaced by a hash
+	redact map[string]bool
+	// redactKey is the HMAC key of the redacted values
+	redactKey []byte
+}
+
+// auditRedactableFields are the fields --audit-redact accepts
+var auditRedactableFields = []string{"subject", "groups", "query"}
+
+// newAuditLogger creates an audit logger writing to out. The redacted fields
+// are hashed with redactKey, or with a random key when it is empty, so that
+// records only correlate until dsproxy restarts.
+func newAuditLogger(out io.Writer, sampleRate float64, redact []string, redactKey []byte) (*auditLogger, error) {
+	if sampleRate < 0 || sampleRate > 1 {
+		return nil, fmt.Errorf("sample rate %v is not between 0 and 1", sampleRate)
+	}
+	fields := map[string]bool{}
+	for _, field := range redact {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		known := false
+		for _, f := range auditRedactableFields {
+			known = known || f == field
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown audit field %q, expected one of %s", field, strings.Join(auditRedactableFields, ", "))
+		}
+		fields[field] = true
+	}
+	if len(fields) > 0 && len(redactKey) == 0 {
+		redactKey = make([]byte, 32)
+		if _, err := rand.Read(redactKey); err != nil {
+			return nil, fmt.Errorf("failed to generate redaction key: %w", err)
+		}
+		log.Println("[audit] no redaction key given, redacted values only correlate until restart")
+	}
+	return &auditLogger{out: out, sampleRate: sampleRate, redact: fields, redactKey: redactKey}, nil
+}
+
+// readAuditRedactKey reads the redaction key from a file, e.g. a mounted
+// Secret. Surrounding whitespace is not part of the key.
+func readAuditRedactKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read redaction key: %w", err)
+	}
+	key := bytes.TrimSpace(data)
+	if len(key) < auditMinRedactKeyBytes {
+		return nil, fmt.Errorf("redaction key %s is shorter than %d bytes", path, auditMinRedactKeyBytes)
+	}
+	return key, nil
+}
+
+// openAuditLog opens the audit log destination: "-" for stdout or a file
+// that is appended to
+func openAuditLog(path string) (io.Writer, error) {
+	if path == "-" {
+		return os.Stdout, nil
+	}
+	return os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+}
+
+// middleware records every request served by next. It is the outermost
+// middleware of the chain, so that requests rejected by authentication or
+// authorization are recorded as well.
+func (a *auditLogger) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		record := &auditRecord{
+			Time:           time.Now().UTC(),
+			Datasource:     r.Header.Get("X-Datasource-Uid"),
+			DatasourceType: r.Header.Get("X-Datasource-Type"),
+			Method:         r.Method,
+			Path:           r.URL.Path,
+		}
+		recorder := &statusRecorder{ResponseWriter: w}
+		query, err := auditQuery(recorder, r)
+		record.Query = query
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			record.Decision = auditDecisionError
+			record.Reason = err.Error()
+			http.Error(recorder, "Request body too large", http.StatusRequestEntityTooLarge)
+		} else {
+			if err != nil {
+				log.Printf("[audit] failed to read query: %v", err)
+			}
+			next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), ContextKeyAudit, record)))
+		}
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		record.Status = recorder.status
+		record.DurationSeconds = time.Since(record.Time).Seconds()
+		if record.Decision == "" {
+			record.Decision = auditDecisionError
+		}
+		a.write(record)
+	})
+}
+
+func (a *auditLogger) write(record *auditRecord) {
+	if record.Decision == auditDecisionAllow && a.sampleRate < 1 && mathrand.Float64() >= a.sampleRate {
+		return
+	}
+	if a.redact["subject"] && record.Subject != "" {
+		record.Subject = a.redactValue(record.Subject)
+	}
+	if a.redact["groups"] {
+		for i, group := range record.Groups {
+			record.Groups[i] = a.redactValue(group)
+		}
+	}
+	if a.redact["query"] {
+		for _, query := range []map[string][]string{record.Query, record.RewrittenQuery} {
+			for _, values := range query {
+				for i, value := range values {
+					values[i] = a.redactValue(value)
+				}
+			}
+		}
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("[audit] failed to marshal record: %v", err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.out.Write(append(line, '\n')); err != nil {
+		log.Printf("[audit] failed to write record: %v", err)
+	}
+}
+
+// redactValue replaces a value by its HMAC, so that records of the same
+// value can still be correlated, but low entropy values such as user names
+// cannot be recovered by hashing candidates without the key
+func (a *auditLogger) redactValue(value string) string {
+	mac := hmac.New(sha256.New, a.redactKey)
+	mac.Write([]byte(value))
+	return "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// auditRecordFrom returns the audit record of the request, nil when the
+// audit log is disabled
+func auditRecordFrom(ctx context.Context) *auditRecord {
+	record, _ := ctx.Value(ContextKeyAudit).(*auditRecord)
+	return record
+}
+
+// auditQuery returns the audited parameters of the URL query string and
+// the form body of r. The body is restored so that it can be read again.
+// Bodies over auditMaxBodyBytes fail with an *http.MaxBytesError; w, when
+// not nil, is told to close the connection.
+func auditQuery(w http.ResponseWriter, r *http.Request) (map[string][]string, error) {
+	params := map[string][]string{}
+	collect := func(values url.Values) {
+		for _, param := range auditedParams {
+			if v, ok := values[param]; ok {
+				params[param] = append(params[param], v...)
+			}
+		}
+	}
+	collect(r.URL.Query())
+
+	if r.Body != nil && r.Body != http.NoBody && r.Method == http.MethodPost {
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/x-www-form-urlencoded" {
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, auditMaxBodyBytes))
+			_ = r.Body.Close()
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			if err != nil {
+				return params, err
+			}
+			form, err := url.ParseQuery(string(body))
+			if err != nil {
+				return params, err
+			}
+			collect(form)
+		}
+	}
+	if len(params) == 0 {
+		return nil, nil
+	}
+	return params, nil
+}
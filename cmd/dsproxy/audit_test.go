@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MicahParks/keyfunc/v2"
+	"github.com/golang-jwt/jwt/v5"
+	. "github.com/onsi/gomega"
+)
+
+// TestAuditLog tests that the audit middleware records allowed, denied and
+// unauthenticated requests along with the query rewritten by the proxy
+func TestAuditLog(t *testing.T) {
+	RegisterTestingT(t)
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	useGivenJWKS(t, "https://dex.example.com", map[string]keyfunc.GivenKey{"test": keyfunc.NewGivenHMAC(key, keyfunc.GivenKeyOptions{Algorithm: "HS256"})})
+	origAlgorithms := f_jwtAlgorithms
+	f_jwtAlgorithms = "HS256"
+	defer func() { f_jwtAlgorithms = origAlgorithms }()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub":    "alice",
+		"iss":    "https://dex.example.com",
+		"aud":    f_jwtAudience,
+		"exp":    time.Now().Add(time.Hour).Unix(),
+		"groups": []string{"team-a"},
+	})
+	token.Header["kid"] = "test"
+	tokenStr, err := token.SignedString(key)
+	Expect(err).ToNot(HaveOccurred())
+
+	var upstreamQuery string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamQuery = r.FormValue("query")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer upstream.Close()
+	promProxy, err := newPrometheusProxy(upstream.URL, "namespace", newUpstreamTransport(http.DefaultTransport))
+	Expect(err).ToNot(HaveOccurred())
+
+	var out bytes.Buffer
+	origAudit := audit
+	defer func() { audit = origAudit }()
+	serve := func(authorizer Authorizer, req *http.Request) auditRecord {
+		out.Reset()
+		handler := proxyHandler(&AuthzService{authorizer: authorizer}, promProxy)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		var record auditRecord
+		Expect(json.Unmarshal(out.Bytes(), &record)).To(Succeed())
+		return record
+	}
+	newRequest := func(query string, authorized bool) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query="+url.QueryEscape(query), nil)
+		req.Header.Set("X-Datasource-Uid", "prom-1")
+		if authorized {
+			req.Header.Set("Authorization", "Bearer "+tokenStr)
+		}
+		return req
+	}
+
+	audit, err = newAuditLogger(&out, 1, nil, nil)
+	Expect(err).ToNot(HaveOccurred())
+
+	t.Run("Allow", func(t *testing.T) {
+		RegisterTestingT(t)
+		record := serve(fakeAuthorizer{pairs: [][2]string{{"local", "team-a"}}}, newRequest("up", true))
+		Expect(record.Subject).To(Equal("alice"))
+		Expect(record.Groups).To(Equal([]string{"team-a"}))
+		Expect(record.Datasource).To(Equal("prom-1"))
+		Expect(record.Path).To(Equal("/api/v1/query"))
+		Expect(record.Query).To(Equal(map[string][]string{"query": {"up"}}))
+		Expect(record.RewrittenQuery).To(Equal(map[string][]string{"query": {upstreamQuery}}))
+		Expect(upstreamQuery).To(ContainSubstring(`namespace="team-a"`))
+		Expect(record.AllowedNamespaces).To(Equal([]string{"local/team-a"}))
+		Expect(record.Decision).To(Equal(auditDecisionAllow))
+		Expect(record.Status).To(Equal(http.StatusOK))
+	})
+
+	t.Run("AllowFormBody", func(t *testing.T) {
+		RegisterTestingT(t)
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/query", strings.NewReader(url.Values{"query": {"up"}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+tokenStr)
+		record := serve(fakeAuthorizer{pairs: [][2]string{{"local", "team-a"}}}, req)
+		Expect(record.Query).To(Equal(map[string][]string{"query": {"up"}}))
+		Expect(upstreamQuery).To(ContainSubstring(`namespace="team-a"`))
+		Expect(record.RewrittenQuery).To(Equal(map[string][]string{"query": {upstreamQuery}}))
+	})
+
+	t.Run("Deny", func(t *testing.T) {
+		RegisterTestingT(t)
+		record := serve(fakeAuthorizer{}, newRequest("up", true))
+		Expect(record.Subject).To(Equal("alice"))
+		Expect(record.Decision).To(Equal(auditDecisionDeny))
+		Expect(record.Status).To(Equal(http.StatusForbidden))
+		Expect(record.RewrittenQuery).To(BeNil())
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		RegisterTestingT(t)
+		record := serve(fakeAuthorizer{err: errors.New("backend down")}, newRequest("up", true))
+		Expect(record.Decision).To(Equal(auditDecisionError))
+		Expect(record.Reason).To(Equal("backend down"))
+		Expect(record.Status).To(Equal(http.StatusInternalServerError))
+	})
+
+	t.Run("Unauthenticated", func(t *testing.T) {
+		RegisterTestingT(t)
+		record := serve(fakeAuthorizer{}, newRequest("up", false))
+		Expect(record.Subject).To(BeEmpty())
+		Expect(record.Decision).To(Equal(auditDecisionUnauthenticated))
+		Expect(record.Reason).To(Equal("missing_token"))
+		Expect(record.Status).To(Equal(http.StatusUnauthorized))
+	})
+
+	t.Run("Redact", func(t *testing.T) {
+		RegisterTestingT(t)
+		audit, err = newAuditLogger(&out, 1, []string{"subject", "query"}, []byte("0123456789abcdef"))
+		Expect(err).ToNot(HaveOccurred())
+		record := serve(fakeAuthorizer{pairs: [][2]string{{"local", "team-a"}}}, newRequest("up", true))
+		Expect(record.Subject).To(Equal(audit.redactValue("alice")))
+		Expect(record.Subject).To(HavePrefix("hmac-sha256:"))
+		Expect(record.Groups).To(Equal([]string{"team-a"}))
+		Expect(record.Query).To(Equal(map[string][]string{"query": {audit.redactValue("up")}}))
+		Expect(record.RewrittenQuery["query"][0]).To(HavePrefix("hmac-sha256:"))
+
+		// The same value redacted with another key cannot be correlated
+		other, err := newAuditLogger(&out, 1, []string{"subject"}, []byte("fedcba9876543210"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(other.redactValue("alice")).ToNot(Equal(record.Subject))
+		audit, err = newAuditLogger(&out, 1, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	t.Run("BodyTooLarge", func(t *testing.T) {
+		RegisterTestingT(t)
+		body := "query=" + strings.Repeat("a", auditMaxBodyBytes)
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/query", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+tokenStr)
+		out.Reset()
+		rec := httptest.NewRecorder()
+		proxyHandler(&AuthzService{authorizer: fakeAuthorizer{pairs: [][2]string{{"local", "team-a"}}}}, promProxy).ServeHTTP(rec, req)
+		Expect(rec.Code).To(Equal(http.StatusRequestEntityTooLarge))
+		var record auditRecord
+		Expect(json.Unmarshal(out.Bytes(), &record)).To(Succeed())
+		Expect(record.Decision).To(Equal(auditDecisionError))
+		Expect(record.Status).To(Equal(http.StatusRequestEntityTooLarge))
+	})
+
+	t.Run("Sampling", func(t *testing.T) {
+		RegisterTestingT(t)
+		audit, err = newAuditLogger(&out, 0, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		out.Reset()
+		proxyHandler(&AuthzService{authorizer: fakeAuthorizer{pairs: [][2]string{{"local", "team-a"}}}}, promProxy).
+			ServeHTTP(httptest.NewRecorder(), newRequest("up", true))
+		Expect(out.Len()).To(BeZero())
+
+		// Denials are recorded regardless of the sample rate
+		record := serve(fakeAuthorizer{}, newRequest("up", true))
+		Expect(record.Decision).To(Equal(auditDecisionDeny))
+	})
+}
+
+// TestNewAuditLogger tests the validation of the audit log options
+func TestNewAuditLogger(t *testing.T) {
+	RegisterTestingT(t)
+
+	_, err := newAuditLogger(&bytes.Buffer{}, 1.5, nil, nil)
+	Expect(err).To(HaveOccurred())
+	_, err = newAuditLogger(&bytes.Buffer{}, 1, []string{"password"}, nil)
+	Expect(err).To(MatchError(ContainSubstring(`unknown audit field "password"`)))
+	a, err := newAuditLogger(&bytes.Buffer{}, 0.5, []string{" subject", "groups", ""}, nil)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(a.redact).To(Equal(map[string]bool{"subject": true, "groups": true}))
+	// Without a key, redacted values are keyed by a random one
+	Expect(a.redactKey).To(HaveLen(32))
+	b, err := newAuditLogger(&bytes.Buffer{}, 1, []string{"subject"}, nil)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(b.redactValue("alice")).ToNot(Equal(a.redactValue("alice")))
+}
+
+// TestReadAuditRedactKey tests the loading of the redaction key
+func TestReadAuditRedactKey(t *testing.T) {
+	RegisterTestingT(t)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "key")
+	Expect(os.WriteFile(path, []byte("0123456789abcdef\n"), 0o600)).To(Succeed())
+	key, err := readAuditRedactKey(path)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(key).To(Equal([]byte("0123456789abcdef")))
+
+	Expect(os.WriteFile(path, []byte("short\n"), 0o600)).To(Succeed())
+	_, err = readAuditRedactKey(path)
+	Expect(err).To(MatchError(ContainSubstring("shorter than 16 bytes")))
+
+	_, err = readAuditRedactKey(filepath.Join(dir, "missing"))
+	Expect(err).To(HaveOccurred())
+}
@@ -2,92 +2,77 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"path/filepath"
+	"regexp"
 	"strings"
-
-	"github.com/casbin/casbin/v2"
-	fileadapter "github.com/casbin/casbin/v2/persist/file-adapter"
-	"github.com/fsnotify/fsnotify"
 )
 
+// Authorizer decides which cluster/namespace pairs a subject and its groups
+// may access through a datasource. Both elements of a pair may contain the
+// glob wildcard "*". An empty result denies the request.
+type Authorizer interface {
+	AllowedPairs(ctx context.Context, subject string, groups []string, datasource, action string) ([][2]string, error)
+}
+
 type AuthzService struct {
-	Enforcer    *casbin.Enforcer
-	policyFile  string
-	policyModel string
+	authorizer Authorizer
 }
 
+// NewAuthzService creates an AuthzService backed by the Casbin policy and
+// model in policyPath.
 func NewAuthzService(ctx context.Context, policyPath string) (*AuthzService, error) {
-	policyFile := filepath.Join(policyPath, "policy.csv")
-	policyModel := filepath.Join(policyPath, "model.conf")
-	adapter := fileadapter.NewAdapter(policyFile)
-	enforcer, err := casbin.NewEnforcer(policyModel, adapter)
+	authorizer, err := newCasbinAuthorizer(ctx, policyPath, false)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create enforcer: %w", err)
+		return nil, err
 	}
-	if err := enforcer.LoadPolicy(); err != nil {
-		return nil, fmt.Errorf("failed to load policy: %w", err)
-	}
-
-	authz := &AuthzService{Enforcer: enforcer, policyFile: policyFile, policyModel: policyModel}
-	go authz.watchPolicyAndModel(ctx)
-	return authz, nil
+	return &AuthzService{authorizer: authorizer}, nil
 }
 
-func (a *AuthzService) Authorize(subject string, groups []string, domain, cluster, namespace, action string) bool {
-	resource := fmt.Sprintf("%s/%s", cluster, namespace)
-
-	if ok, _ := a.Enforcer.Enforce(subject, domain, resource, action); ok {
-		return true
-	}
-	for _, group := range groups {
-		if ok, _ := a.Enforcer.Enforce(group, domain, resource, action); ok {
-			return true
+// newAuthorizer creates the authorizer for the comma separated list of
+// backends, combined with combine (union or intersection) when more than one
+// backend is given.
+func newAuthorizer(ctx context.Context, backends, combine string) (Authorizer, error) {
+	var authorizers []Authorizer
+	for _, backend := range strings.Split(backends, ",") {
+		var (
+			authorizer Authorizer
+			err        error
+		)
+		switch backend = strings.TrimSpace(backend); backend {
+		case "casbin":
+			log.Printf("Authorizing with the Casbin policy in %s", f_policyPath)
+			authorizer, err = newCasbinAuthorizer(ctx, f_policyPath, f_policyRejectEmpty)
+		case "sar":
+			if !sarIdentityConfigured() {
+				return nil, errors.New("the sar backend reviews the identity as the Kubernetes user name: set --identity-claim to the claim the API server takes user names from, e.g. email")
+			}
+			log.Printf("Authorizing with SubjectAccessReviews: cluster=%s, cache ttl=%s, max namespaces=%d", f_sarCluster, f_sarCacheTTL, f_sarMaxNamespaces)
+			authorizer, err = newClusterSARAuthorizer(f_sarCluster, f_sarCacheTTL, f_sarMaxNamespaces)
+		case "static":
+			log.Printf("Authorizing with the static rules in %s", f_authzStaticPath)
+			authorizer, err = newStaticAuthorizer(f_authzStaticPath)
+		default:
+			return nil, fmt.Errorf("unknown authorization backend %q", backend)
 		}
-	}
-	return false
-}
-
-func (a *AuthzService) watchPolicyAndModel(ctx context.Context) {
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		log.Printf("[authz] failed to initialize watcher: %v", err)
-		return
-	}
-	defer watcher.Close()
-
-	for _, file := range []string{a.policyModel, a.policyFile} {
-		if err := watcher.Add(file); err != nil {
-			log.Printf("[authz] failed to watch file %s: %v", file, err)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s authorizer: %w", backend, err)
 		}
-		log.Printf("[authz] watching file: %s", file)
+		authorizers = append(authorizers, authorizer)
 	}
 
-	for {
-		select {
-		case <-ctx.Done():
-			log.Println("[authz] stopping policy watcher")
-			return
-		case event, ok := <-watcher.Events:
-			if !ok {
-				return
-			}
-			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 && (strings.HasSuffix(event.Name, ".csv") || strings.HasSuffix(event.Name, ".conf")) {
-				log.Println("[authz] detected policy or model change, reloading...")
-				if err := a.Enforcer.LoadPolicy(); err != nil {
-					log.Printf("[authz] failed to reload policy: %v", err)
-				} else {
-					log.Println("[authz] policy reloaded")
-				}
-			}
-		case err, ok := <-watcher.Errors:
-			if !ok {
-				return
-			}
-			log.Printf("[authz] watcher error: %v", err)
-		}
+	if len(authorizers) == 1 {
+		return authorizers[0], nil
+	}
+	switch combine {
+	case "union":
+		return unionAuthorizer(authorizers), nil
+	case "intersection":
+		return intersectionAuthorizer(authorizers), nil
+	default:
+		return nil, fmt.Errorf("unknown authorization combination %q", combine)
 	}
 }
 
@@ -100,78 +85,139 @@ func (a *AuthzService) authzMiddleware(action string) func(http.Handler) http.Ha
 			groups, _ := ctx.Value(ContextKeyGroups).([]string)
 			datasourceID, _ := ctx.Value(ContextDataSourceID).(string)
 
-			// Get all policies and check which resources the user can access
-			allPolicies, err := a.Enforcer.GetPolicy()
+			record := auditRecordFrom(ctx)
+			allowedPairs, err := a.authorizer.AllowedPairs(ctx, email, groups, datasourceID, action)
 			if err != nil {
-				log.Printf("[authz] error getting policies: %v", err)
+				log.Printf("[authz] authorization failed for %s: %v", email, err)
+				if record != nil {
+					record.Decision = auditDecisionError
+					record.Reason = err.Error()
+				}
 				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 				return
 			}
-
-			subjects := append(groups, email)
-			allowed := map[string]struct{}{}
-
-			// Check each policy to see if it applies to our subjects and datasource
-			for _, policy := range allPolicies {
-				if len(policy) < 4 {
-					continue
-				}
-
-				policySub := policy[0]
-				policyDom := policy[1]
-				policyObj := policy[2]
-				policyAct := policy[3]
-
-				// Check if action matches
-				if policyAct != action {
-					continue
-				}
-
-				// Check if datasource matches (handle wildcards)
-				datasourceMatches := policyDom == "*" || policyDom == datasourceID
-				if !datasourceMatches {
-					continue
-				}
-
-				// Check if subject matches (direct or via role)
-				subjectMatches := false
-				for _, sub := range subjects {
-					if policySub == sub {
-						subjectMatches = true
-						break
-					}
-					// Check role inheritance
-					if ok, _ := a.Enforcer.HasRoleForUser(sub, policySub); ok {
-						subjectMatches = true
-						break
-					}
-				}
-
-				if subjectMatches {
-					// This policy grants access to this resource
-					log.Printf("[authz] allowing resource %s for subject %s", policyObj, policySub)
-					allowed[policyObj] = struct{}{}
-				}
-			}
-
-			if len(allowed) == 0 {
+			if len(allowedPairs) == 0 {
 				log.Printf("[authz] no resources allowed for %s with datasource %s", email, datasourceID)
+				datasourceLabel, _ := metricLabels(r)
+				authzDenialsTotal.WithLabelValues(datasourceLabel).Inc()
+				if record != nil {
+					record.Decision = auditDecisionDeny
+				}
 				http.Error(w, "Forbidden", http.StatusForbidden)
 				return
 			}
 
-			// Convert to list of [cluster, namespace]
-			var allowedPairs [][2]string
-			for res := range allowed {
-				parts := strings.SplitN(res, "/", 2)
-				if len(parts) == 2 {
-					allowedPairs = append(allowedPairs, [2]string{parts[0], parts[1]})
+			log.Printf("[authz] allowed cluster/namespace pairs: %v", allowedPairs)
+			if record != nil {
+				record.Decision = auditDecisionAllow
+				for _, pair := range allowedPairs {
+					record.AllowedNamespaces = append(record.AllowedNamespaces, pair[0]+"/"+pair[1])
 				}
 			}
-
-			log.Printf("[authz] allowed cluster/namespace pairs: %v", allowedPairs)
 			ctx = context.WithValue(ctx, ContextKeyAllowedClusters, allowedPairs)
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
+
+// unionAuthorizer allows the pairs allowed by any of its authorizers
+type unionAuthorizer []Authorizer
+
+func (u unionAuthorizer) AllowedPairs(ctx context.Context, subject string, groups []string, datasource, action string) ([][2]string, error) {
+	var pairs [][2]string
+	seen := map[[2]string]struct{}{}
+	for _, authorizer := range u {
+		allowed, err := authorizer.AllowedPairs(ctx, subject, groups, datasource, action)
+		if err != nil {
+			return nil, err
+		}
+		for _, pair := range allowed {
+			if _, ok := seen[pair]; ok {
+				continue
+			}
+			seen[pair] = struct{}{}
+			pairs = append(pairs, pair)
+		}
+	}
+	return pairs, nil
+}
+
+// intersectionAuthorizer allows the pairs allowed by all of its authorizers.
+// Patterns are intersected per cluster and namespace: the narrower of two
+// patterns is kept when one matches the other, e.g. */dev-* and prod/dev-api
+// intersect to prod/dev-api, while overlapping patterns neither of which
+// matches the other, e.g. dev-* and *-api, are dropped.
+type intersectionAuthorizer []Authorizer
+
+func (i intersectionAuthorizer) AllowedPairs(ctx context.Context, subject string, groups []string, datasource, action string) ([][2]string, error) {
+	var pairs [][2]string
+	for n, authorizer := range i {
+		allowed, err := authorizer.AllowedPairs(ctx, subject, groups, datasource, action)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			pairs = allowed
+			continue
+		}
+		pairs = intersectPairs(pairs, allowed)
+		if len(pairs) == 0 {
+			return nil, nil
+		}
+	}
+	return pairs, nil
+}
+
+func intersectPairs(a, b [][2]string) [][2]string {
+	var pairs [][2]string
+	seen := map[[2]string]struct{}{}
+	for _, x := range a {
+		for _, y := range b {
+			cluster, ok := intersectPattern(x[0], y[0])
+			if !ok {
+				continue
+			}
+			namespace, ok := intersectPattern(x[1], y[1])
+			if !ok {
+				continue
+			}
+			pair := [2]string{cluster, namespace}
+			if _, ok := seen[pair]; ok {
+				continue
+			}
+			seen[pair] = struct{}{}
+			pairs = append(pairs, pair)
+		}
+	}
+	return pairs
+}
+
+// intersectPattern returns the narrower of two glob patterns if one of them
+// matches the other.
+func intersectPattern(x, y string) (string, bool) {
+	switch {
+	case x == y:
+		return x, true
+	case globMatch(x, y):
+		return y, true
+	case globMatch(y, x):
+		return x, true
+	}
+	return "", false
+}
+
+// globMatch reports whether value matches pattern, in which "*" matches any
+// characters.
+func globMatch(pattern, value string) bool {
+	if pattern == "*" {
+		return true
+	}
+	if !strings.Contains(pattern, "*") {
+		return pattern == value
+	}
+	parts := strings.Split(pattern, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return regexp.MustCompile("^" + strings.Join(parts, ".*") + "$").MatchString(value)
+}
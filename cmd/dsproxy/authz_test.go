@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeAuthorizer allows fixed pairs, or fails with err
+type fakeAuthorizer struct {
+	pairs [][2]string
+	err   error
+}
+
+func (f fakeAuthorizer) AllowedPairs(ctx context.Context, subject string, groups []string, datasource, action string) ([][2]string, error) {
+	return f.pairs, f.err
+}
+
+// TestStaticAuthorizer tests the static YAML authorization backend
+func TestStaticAuthorizer(t *testing.T) {
+	RegisterTestingT(t)
+
+	path := filepath.Join(t.TempDir(), "static.yaml")
+	Expect(os.WriteFile(path, []byte(`
+rules:
+  - groups: [team-frontend]
+    namespaces: ["*/frontend-*"]
+  - subjects: [alice@example.com]
+    datasources: [prometheus-prod]
+    namespaces: [prod-cluster/backend, prod-cluster/db]
+  - groups: [team-frontend]
+    datasources: ["*"]
+    namespaces: ["*/frontend-*", "*/shared"]
+`), 0644)).To(Succeed())
+
+	static, err := newStaticAuthorizer(path)
+	Expect(err).To(BeNil())
+
+	pairs, err := static.AllowedPairs(context.Background(), "bob@example.com", []string{"team-frontend"}, "prometheus-prod", "read")
+	Expect(err).To(BeNil())
+	Expect(pairs).To(Equal([][2]string{{"*", "frontend-*"}, {"*", "shared"}}))
+
+	pairs, err = static.AllowedPairs(context.Background(), "alice@example.com", nil, "prometheus-prod", "read")
+	Expect(err).To(BeNil())
+	Expect(pairs).To(Equal([][2]string{{"prod-cluster", "backend"}, {"prod-cluster", "db"}}))
+
+	pairs, err = static.AllowedPairs(context.Background(), "alice@example.com", nil, "loki-prod", "read")
+	Expect(err).To(BeNil())
+	Expect(pairs).To(BeEmpty())
+
+	pairs, err = static.AllowedPairs(context.Background(), "bob@example.com", []string{"team-frontend"}, "prometheus-prod", "write")
+	Expect(err).To(BeNil())
+	Expect(pairs).To(BeEmpty())
+
+	Expect(os.WriteFile(path, []byte("rules:\n  - groups: [a]\n    namespaces: [frontend]\n"), 0644)).To(Succeed())
+	_, err = newStaticAuthorizer(path)
+	Expect(err).NotTo(BeNil())
+}
+
+// TestCombinedAuthorizers tests the union and intersection of backends
+func TestCombinedAuthorizers(t *testing.T) {
+	casbin := fakeAuthorizer{pairs: [][2]string{{"*", "dev-*"}, {"prod", "backend"}, {"prod", "frontend"}}}
+	sar := fakeAuthorizer{pairs: [][2]string{{"prod", "dev-api"}, {"prod", "backend"}, {"prod", "db"}}}
+	failing := fakeAuthorizer{err: errors.New("unavailable")}
+
+	t.Run("Union", func(t *testing.T) {
+		RegisterTestingT(t)
+		pairs, err := unionAuthorizer{casbin, sar}.AllowedPairs(context.Background(), "alice", nil, "prometheus", "read")
+		Expect(err).To(BeNil())
+		Expect(pairs).To(Equal([][2]string{{"*", "dev-*"}, {"prod", "backend"}, {"prod", "frontend"}, {"prod", "dev-api"}, {"prod", "db"}}))
+	})
+
+	t.Run("Intersection", func(t *testing.T) {
+		RegisterTestingT(t)
+		pairs, err := intersectionAuthorizer{casbin, sar}.AllowedPairs(context.Background(), "alice", nil, "prometheus", "read")
+		Expect(err).To(BeNil())
+		Expect(pairs).To(Equal([][2]string{{"prod", "dev-api"}, {"prod", "backend"}}))
+
+		pairs, err = intersectionAuthorizer{casbin, fakeAuthorizer{pairs: [][2]string{{"*", "*-api"}}}}.AllowedPairs(context.Background(), "alice", nil, "prometheus", "read")
+		Expect(err).To(BeNil())
+		Expect(pairs).To(BeEmpty())
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		RegisterTestingT(t)
+		_, err := unionAuthorizer{casbin, failing}.AllowedPairs(context.Background(), "alice", nil, "prometheus", "read")
+		Expect(err).NotTo(BeNil())
+		_, err = intersectionAuthorizer{casbin, failing}.AllowedPairs(context.Background(), "alice", nil, "prometheus", "read")
+		Expect(err).NotTo(BeNil())
+	})
+
+	t.Run("Backends", func(t *testing.T) {
+		RegisterTestingT(t)
+		_, err := newAuthorizer(context.Background(), "opa", "union")
+		Expect(err).To(MatchError(ContainSubstring(`unknown authorization backend "opa"`)))
+
+		path := filepath.Join(t.TempDir(), "static.yaml")
+		Expect(os.WriteFile(path, []byte("rules: []\n"), 0644)).To(Succeed())
+		f_authzStaticPath = path
+		defer func() { f_authzStaticPath = "/etc/dsproxy/policy/static.yaml" }()
+
+		authorizer, err := newAuthorizer(context.Background(), "static", "union")
+		Expect(err).To(BeNil())
+		Expect(authorizer).To(BeAssignableToTypeOf(&staticAuthorizer{}))
+
+		authorizer, err = newAuthorizer(context.Background(), "static, static", "intersection")
+		Expect(err).To(BeNil())
+		Expect(authorizer).To(BeAssignableToTypeOf(intersectionAuthorizer{}))
+
+		_, err = newAuthorizer(context.Background(), "static,static", "xor")
+		Expect(err).NotTo(BeNil())
+
+		// The sar backend needs the claim holding the Kubernetes user name
+		_, err = newAuthorizer(context.Background(), "sar", "union")
+		Expect(err).To(MatchError(ContainSubstring("set --identity-claim")))
+	})
+}
+
+// TestCasbinReload tests validating policy and model changes before swapping them in
+func TestCasbinReload(t *testing.T) {
+	RegisterTestingT(t)
+
+	model, err := os.ReadFile(filepath.Join("authz", "model.conf"))
+	Expect(err).To(BeNil())
+	dir := t.TempDir()
+	write := func(name, content string) {
+		Expect(os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)).To(Succeed())
+	}
+	write(casbinModelFile, string(model))
+	write(casbinPolicyFile, "p, alice, *, cluster1/ns1, read\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	authorizer, err := newCasbinAuthorizer(ctx, dir, false)
+	Expect(err).To(BeNil())
+	allowed := func() [][2]string {
+		pairs, err := authorizer.AllowedPairs(context.Background(), "alice", nil, "prometheus", "read")
+		Expect(err).To(BeNil())
+		return pairs
+	}
+	Expect(allowed()).To(Equal([][2]string{{"cluster1", "ns1"}}))
+
+	failures := testutil.ToFloat64(policyReloadsTotal.WithLabelValues("failure"))
+	for name, broken := range map[string][2]string{
+		"invalid model":       {"[request_definition]\nr = sub, dom, obj, act\n", "p, alice, *, cluster1/ns2, read\n"},
+		"truncated policy":    {string(model), "p, alice, *, cluster1/ns2\n"},
+		"unknown policy type": {string(model), "x, alice, *, cluster1/ns2, read\n"},
+		"unsupported effect":  {strings.Replace(string(model), "some(where (p.eft == allow))", "!some(where (p.eft == deny))", 1), "p, alice, *, cluster1/ns2, read\n"},
+	} {
+		write(casbinModelFile, broken[0])
+		write(casbinPolicyFile, broken[1])
+		Expect(authorizer.reload()).NotTo(Succeed(), name)
+		Expect(allowed()).To(Equal([][2]string{{"cluster1", "ns1"}}), name)
+	}
+	Expect(testutil.ToFloat64(policyReloadsTotal.WithLabelValues("failure"))).To(Equal(failures + 4))
+	Expect(testutil.ToFloat64(policyLastReloadSuccessful)).To(Equal(0.0))
+
+	// Assertions reject a policy that does not grant what they expect
+	write(casbinModelFile, string(model))
+	write(casbinAssertionsFile, "- subject: alice\n  resource: cluster1/ns2\n  allow: true\n- subject: bob\n  resource: cluster1/ns2\n  allow: false\n")
+	write(casbinPolicyFile, "p, alice, *, cluster1/ns3, read\n")
+	Expect(authorizer.reload()).To(MatchError(ContainSubstring("assertion 0 failed")))
+	write(casbinPolicyFile, "p, alice, *, cluster1/*, read\np, bob, *, cluster1/*, read\n")
+	Expect(authorizer.reload()).To(MatchError(ContainSubstring("assertion 1 failed")))
+	write(casbinPolicyFile, "p, alice, *, cluster1/ns2, read\n")
+	Expect(authorizer.reload()).To(Succeed())
+	Expect(allowed()).To(Equal([][2]string{{"cluster1", "ns2"}}))
+	Expect(testutil.ToFloat64(policyLastReloadSuccessful)).To(Equal(1.0))
+
+	// Model changes are loaded together with the policy
+	write(casbinAssertionsFile, "[]\n")
+	write(casbinModelFile, strings.NewReplacer(
+		"p = sub, dom, obj, act", "p = sub, dom, obj, act, eft",
+		"some(where (p.eft == allow))", "some(where (p.eft == allow)) && !some(where (p.eft == deny))").Replace(string(model)))
+	write(casbinPolicyFile, "p, alice, *, cluster1/*, read, allow\np, alice, *, cluster1/ns2, read, deny\np, alice, *, cluster2/ns1, read, allow\n")
+	Expect(authorizer.reload()).To(Succeed())
+	Expect(allowed()).To(Equal([][2]string{{"cluster2", "ns1"}}))
+
+	// Removing the last rule revokes every grant
+	write(casbinPolicyFile, "")
+	Expect(authorizer.reload()).To(Succeed())
+	Expect(allowed()).To(BeEmpty())
+}
+
+// TestCasbinReloadRejectEmpty tests keeping the policy when a reload has no rules
+func TestCasbinReloadRejectEmpty(t *testing.T) {
+	RegisterTestingT(t)
+
+	model, err := os.ReadFile(filepath.Join("authz", "model.conf"))
+	Expect(err).To(BeNil())
+	dir := t.TempDir()
+	Expect(os.WriteFile(filepath.Join(dir, casbinModelFile), model, 0644)).To(Succeed())
+	Expect(os.WriteFile(filepath.Join(dir, casbinPolicyFile), []byte("p, alice, *, cluster1/ns1, read\n"), 0644)).To(Succeed())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	authorizer, err := newCasbinAuthorizer(ctx, dir, true)
+	Expect(err).To(BeNil())
+
+	Expect(os.WriteFile(filepath.Join(dir, casbinPolicyFile), []byte("# being written\n"), 0644)).To(Succeed())
+	Expect(authorizer.reload()).To(MatchError("policy has no rules"))
+	pairs, err := authorizer.AllowedPairs(context.Background(), "alice", nil, "prometheus", "read")
+	Expect(err).To(BeNil())
+	Expect(pairs).To(Equal([][2]string{{"cluster1", "ns1"}}))
+}
+
+// TestCasbinReloadConfigMap tests following the ..data symlink swap of a ConfigMap volume
+func TestCasbinReloadConfigMap(t *testing.T) {
+	RegisterTestingT(t)
+
+	model, err := os.ReadFile(filepath.Join("authz", "model.conf"))
+	Expect(err).To(BeNil())
+	dir := t.TempDir()
+	// writeVersion lays out the files the way the kubelet does: in a
+	// timestamped directory that the ..data symlink is atomically renamed to
+	writeVersion := func(version, policy string) {
+		Expect(os.Mkdir(filepath.Join(dir, version), 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, version, casbinModelFile), model, 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, version, casbinPolicyFile), []byte(policy), 0644)).To(Succeed())
+		Expect(os.Symlink(version, filepath.Join(dir, "..data_tmp"))).To(Succeed())
+		Expect(os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data"))).To(Succeed())
+	}
+	writeVersion("..2024_01_01_00_00_00.1", "p, alice, *, cluster1/ns1, read\n")
+	for _, name := range []string{casbinModelFile, casbinPolicyFile} {
+		Expect(os.Symlink(filepath.Join("..data", name), filepath.Join(dir, name))).To(Succeed())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	authorizer, err := newCasbinAuthorizer(ctx, dir, false)
+	Expect(err).To(BeNil())
+	allowed := func() [][2]string {
+		pairs, err := authorizer.AllowedPairs(context.Background(), "alice", nil, "prometheus", "read")
+		Expect(err).To(BeNil())
+		return pairs
+	}
+	Expect(allowed()).To(Equal([][2]string{{"cluster1", "ns1"}}))
+
+	// Give the watcher time to start before swapping
+	time.Sleep(100 * time.Millisecond)
+	writeVersion("..2024_01_01_00_01_00.2", "p, alice, *, cluster1/ns2, read\n")
+	Eventually(allowed, 5*time.Second, 50*time.Millisecond).Should(Equal([][2]string{{"cluster1", "ns2"}}))
+}
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/casbin/casbin/v2"
+	"github.com/casbin/casbin/v2/constant"
+	"github.com/casbin/casbin/v2/effector"
+	"github.com/casbin/casbin/v2/model"
+	"github.com/casbin/casbin/v2/persist"
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	casbinModelFile      = "model.conf"
+	casbinPolicyFile     = "policy.csv"
+	casbinAssertionsFile = "assertions.yaml"
+	// casbinReloadDelay coalesces the events of a single update, e.g. the
+	// several renames of a ConfigMap volume update
+	casbinReloadDelay = 200 * time.Millisecond
+)
+
+// casbinAuthorizer authorizes with the Casbin model.conf and policy.csv in
+// a policy directory. Changes are loaded into a fresh enforcer, which only
+// replaces the current one once it is valid, so a broken or half-written
+// policy leaves the last good one in place.
+type casbinAuthorizer struct {
+	policyPath string
+	// rejectEmpty keeps the current state when a policy without rules is
+	// loaded over one with rules
+	rejectEmpty bool
+	state       atomic.Pointer[casbinState]
+	// checksum of the files the current state was loaded from
+	checksum [sha256.Size]byte
+}
+
+// casbinState is an enforcer with the model properties dsproxy evaluates.
+// It is never modified once loaded.
+type casbinState struct {
+	enforcer *casbin.Enforcer
+	// resources are the cluster/namespace patterns of the policies, the
+	// candidates evaluated by allowedPairs
+	resources [][2]string
+	effect    string
+}
+
+// policyAssertion is an entry of the optional assertions.yaml, checked
+// against a policy before it is loaded. Example assertions.yaml:
+//
+//   - subject: alice@example.com
+//     groups: [team-backend]
+//     datasource: prometheus-prod
+//     resource: prod-cluster/backend-api
+//     allow: true
+//   - subject: mallory@example.com
+//     resource: prod-cluster/backend-api
+//     allow: false
+type policyAssertion struct {
+	Subject    string   `yaml:"subject"`
+	Groups     []string `yaml:"groups"`
+	Datasource string   `yaml:"datasource"`
+	Resource   string   `yaml:"resource"`
+	// Action defaults to read
+	Action string `yaml:"action"`
+	Allow  bool   `yaml:"allow"`
+}
+
+func newCasbinAuthorizer(ctx context.Context, policyPath string, rejectEmpty bool) (*casbinAuthorizer, error) {
+	a := &casbinAuthorizer{policyPath: policyPath, rejectEmpty: rejectEmpty}
+	if err := a.reload(); err != nil {
+		return nil, err
+	}
+	go a.watchPolicyAndModel(ctx)
+	return a, nil
+}
+
+// reload loads the policy directory into a new state and swaps it in if it
+// is valid and differs from the current one.
+func (a *casbinAuthorizer) reload() error {
+	modelData, err := os.ReadFile(filepath.Join(a.policyPath, casbinModelFile))
+	if err != nil {
+		return a.reloadFailed(fmt.Errorf("failed to read model: %w", err))
+	}
+	policyData, err := os.ReadFile(filepath.Join(a.policyPath, casbinPolicyFile))
+	if err != nil {
+		return a.reloadFailed(fmt.Errorf("failed to read policy: %w", err))
+	}
+	assertionsData, err := os.ReadFile(filepath.Join(a.policyPath, casbinAssertionsFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return a.reloadFailed(fmt.Errorf("failed to read assertions: %w", err))
+	}
+
+	checksum := sha256.Sum256(bytes.Join([][]byte{modelData, policyData, assertionsData}, []byte{0}))
+	current := a.state.Load()
+	if current != nil && checksum == a.checksum {
+		return nil
+	}
+
+	state, err := loadCasbinState(modelData, policyData)
+	if err != nil {
+		return a.reloadFailed(err)
+	}
+	if a.rejectEmpty && current != nil && len(current.enforcer.GetModel()["p"]["p"].Policy) > 0 && len(state.enforcer.GetModel()["p"]["p"].Policy) == 0 {
+		return a.reloadFailed(errors.New("policy has no rules"))
+	}
+	if err := state.checkAssertions(assertionsData); err != nil {
+		return a.reloadFailed(err)
+	}
+
+	a.state.Store(state)
+	a.checksum = checksum
+	policyReloadsTotal.WithLabelValues("success").Inc()
+	policyLastReloadSuccessful.Set(1)
+	policyLastReloadSuccessTimestamp.SetToCurrentTime()
+	return nil
+}
+
+func (a *casbinAuthorizer) reloadFailed(err error) error {
+	policyReloadsTotal.WithLabelValues("failure").Inc()
+	policyLastReloadSuccessful.Set(0)
+	return err
+}
+
+// loadCasbinState parses the model and the policy into a new enforcer
+func loadCasbinState(modelData, policyData []byte) (*casbinState, error) {
+	m, err := model.NewModelFromString(string(modelData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse model: %w", err)
+	}
+	enforcer, err := casbin.NewEnforcer(m, policyAdapter(policyData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load policy: %w", err)
+	}
+
+	if tokens := enforcer.GetModel()["r"]["r"].Tokens; len(tokens) != 4 {
+		return nil, fmt.Errorf("model request_definition has %d fields, expected sub, dom, obj, act", len(tokens))
+	}
+	obj, err := enforcer.GetFieldIndex("p", constant.ObjectIndex)
+	if err != nil {
+		return nil, fmt.Errorf("model policy_definition has no %s field", constant.ObjectIndex)
+	}
+
+	state := &casbinState{enforcer: enforcer}
+	state.effect = enforcer.GetModel()["e"]["e"].Value
+	switch state.effect {
+	case constant.AllowOverrideEffect, constant.AllowAndDenyEffect, constant.PriorityEffect:
+	default:
+		return nil, fmt.Errorf("unsupported policy_effect %q", state.effect)
+	}
+
+	seen := map[[2]string]struct{}{}
+	for _, policy := range enforcer.GetModel()["p"]["p"].Policy {
+		pair, ok := policyPair(policy[obj])
+		if !ok {
+			log.Printf("[authz] ignoring policy with resource %s, not of the form cluster/namespace", policy[obj])
+			continue
+		}
+		if _, ok := seen[pair]; !ok {
+			seen[pair] = struct{}{}
+			state.resources = append(state.resources, pair)
+		}
+	}
+	if err := state.checkPolicies(); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// checkPolicies enforces the request of each policy against every policy, so
+// that policies the matchers fail on, e.g. keyMatch2 patterns that are not
+// valid regular expressions, are rejected rather than failing the requests
+// they are evaluated for.
+func (s *casbinState) checkPolicies() error {
+	s.enforcer.SetEffector(evaluateAllEffector{})
+	defer s.enforcer.SetEffector(effector.NewDefaultEffector())
+
+	var fields []int
+	for _, token := range s.enforcer.GetModel()["r"]["r"].Tokens {
+		index, err := s.enforcer.GetFieldIndex("p", strings.TrimPrefix(token, "r_"))
+		if err != nil {
+			// The request cannot be derived from the policies
+			return nil
+		}
+		fields = append(fields, index)
+	}
+	for _, policy := range s.enforcer.GetModel()["p"]["p"].Policy {
+		request := make([]interface{}, len(fields))
+		for i, index := range fields {
+			request[i] = policy[index]
+		}
+		if _, err := s.enforcer.Enforce(request...); err != nil {
+			// Drop the stack trace of recovered panics
+			message, _, _ := strings.Cut(err.Error(), "\n")
+			return fmt.Errorf("failed to evaluate the policies for the request of %s: %s", strings.Join(policy, ", "), message)
+		}
+	}
+	return nil
+}
+
+// evaluateAllEffector never decides, so that the enforcer evaluates the
+// matchers against every policy.
+type evaluateAllEffector struct{}
+
+func (evaluateAllEffector) MergeEffects(expr string, effects []effector.Effect, matches []float64, policyIndex int, policyLength int) (effector.Effect, int, error) {
+	return effector.Indeterminate, -1, nil
+}
+
+// checkAssertions checks the assertions of an assertions.yaml
+func (s *casbinState) checkAssertions(data []byte) error {
+	var assertions []policyAssertion
+	if err := yaml.Unmarshal(data, &assertions); err != nil {
+		return fmt.Errorf("failed to parse assertions: %w", err)
+	}
+	for i, assertion := range assertions {
+		cluster, namespace, ok := strings.Cut(assertion.Resource, "/")
+		if !ok {
+			return fmt.Errorf("assertion %d: resource %q is not of the form cluster/namespace", i, assertion.Resource)
+		}
+		action := assertion.Action
+		if action == "" {
+			action = "read"
+		}
+		pairs, err := s.allowedPairs(assertion.Subject, assertion.Groups, assertion.Datasource, action)
+		if err != nil {
+			return fmt.Errorf("assertion %d: %w", i, err)
+		}
+		allowed := false
+		for _, pair := range pairs {
+			if globMatch(pair[0], cluster) && globMatch(pair[1], namespace) {
+				allowed = true
+				break
+			}
+		}
+		if allowed != assertion.Allow {
+			return fmt.Errorf("assertion %d failed: %s %s %s through %q: expected allow=%t", i, assertion.Subject, action, assertion.Resource, assertion.Datasource, assertion.Allow)
+		}
+	}
+	return nil
+}
+
+// AllowedPairs computes the cluster/namespace patterns the model grants
+// action on through the datasource. The candidates are the resources of the
+// policies, each evaluated by the enforcer, and so by the matchers of the
+// model, for the subject and each of its groups. The policy effect decides
+// how their results combine:
+//
+//   - some(where (p.eft == allow)): a candidate allowed for any of them is
+//     granted
+//   - some(where (p.eft == allow)) && !some(where (p.eft == deny)): a deny for
+//     any of them overrides the allows
+//   - priority(p.eft) || deny: the highest priority policy deciding for any
+//     of them wins
+//
+// A granted pattern is dropped as a whole if a candidate overlapping part of
+// it is denied, as the remainder cannot be expressed as patterns, and
+// patterns covered by another granted one are left out.
+func (a *casbinAuthorizer) AllowedPairs(ctx context.Context, subject string, groups []string, datasource, action string) ([][2]string, error) {
+	return a.state.Load().allowedPairs(subject, groups, datasource, action)
+}
+
+// casbinDecision is the combined result of the enforcer for a subject and
+// its groups. deny is set when a deny policy decided, rather than no policy
+// matching.
+type casbinDecision struct {
+	allow, deny bool
+}
+
+func (s *casbinState) allowedPairs(subject string, groups []string, datasource, action string) ([][2]string, error) {
+	var subjects []string
+	for _, sub := range append(append([]string(nil), groups...), subject) {
+		if sub != "" && !slices.Contains(subjects, sub) {
+			subjects = append(subjects, sub)
+		}
+	}
+	if len(subjects) == 0 {
+		return nil, nil
+	}
+
+	decisions := map[[2]string]casbinDecision{}
+	decide := func(pair [2]string) (casbinDecision, error) {
+		if decision, ok := decisions[pair]; ok {
+			return decision, nil
+		}
+		decision, err := s.decide(subjects, datasource, pair[0]+"/"+pair[1], action)
+		if err != nil {
+			return casbinDecision{}, err
+		}
+		decisions[pair] = decision
+		return decision, nil
+	}
+
+	var granted [][2]string
+	for _, pair := range s.resources {
+		decision, err := decide(pair)
+		if err != nil {
+			return nil, err
+		}
+		if !decision.allow {
+			continue
+		}
+		denied, err := s.overlapsDenied(pair, decide)
+		if err != nil {
+			return nil, err
+		}
+		if !denied {
+			granted = append(granted, pair)
+		}
+	}
+
+	var allowedPairs [][2]string
+	for _, pair := range granted {
+		covered := false
+		for _, other := range granted {
+			if other != pair && globCovers(other[0], pair[0]) && globCovers(other[1], pair[1]) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			allowedPairs = append(allowedPairs, pair)
+		}
+	}
+	return allowedPairs, nil
+}
+
+// overlapsDenied reports whether a candidate overlapping part of pair is
+// denied. The overlap is evaluated itself when it can be expressed as a
+// pattern, otherwise the overlapping candidate has to be denied by a policy.
+func (s *casbinState) overlapsDenied(pair [2]string, decide func([2]string) (casbinDecision, error)) (bool, error) {
+	for _, other := range s.resources {
+		if other == pair || !globOverlap(pair[0], other[0]) || !globOverlap(pair[1], other[1]) {
+			continue
+		}
+		cluster, clusterOK := globIntersection(pair[0], other[0])
+		namespace, namespaceOK := globIntersection(pair[1], other[1])
+		overlap := [2]string{cluster, namespace}
+		if clusterOK && namespaceOK && overlap == pair {
+			continue
+		}
+		if !clusterOK || !namespaceOK {
+			overlap = other
+		}
+		decision, err := decide(overlap)
+		if err != nil {
+			return false, err
+		}
+		if decision.deny || (clusterOK && namespaceOK && !decision.allow) {
+			log.Printf("[authz] resource %s/%s overlaps denied %s/%s", pair[0], pair[1], overlap[0], overlap[1])
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// decide enforces the request for each subject and combines the results
+// according to the policy effect.
+func (s *casbinState) decide(subjects []string, datasource, resource, action string) (casbinDecision, error) {
+	var decision casbinDecision
+	// index of the policy deciding the priority effect, policies are sorted
+	// by priority when the model has a priority field
+	deciding := -1
+	for _, sub := range subjects {
+		ok, explain, err := s.enforcer.EnforceEx(sub, datasource, resource, action)
+		if err != nil {
+			return casbinDecision{}, fmt.Errorf("error enforcing %s %s %s through %q: %w", sub, action, resource, datasource, err)
+		}
+		if len(explain) == 0 {
+			continue
+		}
+		switch s.effect {
+		case constant.AllowOverrideEffect:
+			decision.allow = decision.allow || ok
+		case constant.AllowAndDenyEffect:
+			decision.allow = decision.allow || ok
+			decision.deny = decision.deny || !ok
+		case constant.PriorityEffect:
+			index := s.enforcer.GetModel()["p"]["p"].PolicyMap[strings.Join(explain, ",")]
+			if deciding == -1 || index < deciding {
+				deciding = index
+				decision = casbinDecision{allow: ok, deny: !ok}
+			}
+		}
+	}
+	if decision.deny {
+		decision.allow = false
+	}
+	return decision, nil
+}
+
+// policyPair converts the resource of a policy into a cluster/namespace
+// pattern. "*" grants every cluster and namespace, and keyMatch2 parameters
+// such as cluster1/:namespace match any namespace.
+func policyPair(obj string) ([2]string, bool) {
+	if obj == "*" {
+		return [2]string{"*", "*"}, true
+	}
+	cluster, namespace, ok := strings.Cut(obj, "/")
+	if !ok {
+		return [2]string{}, false
+	}
+	pair := [2]string{cluster, namespace}
+	for i, segment := range pair {
+		if strings.HasPrefix(segment, ":") {
+			pair[i] = "*"
+		}
+	}
+	return pair, true
+}
+
+// globIntersection returns the pattern matching the values both glob
+// patterns match, when one of them covers the other.
+func globIntersection(a, b string) (string, bool) {
+	switch {
+	case globCovers(a, b):
+		return b, true
+	case globCovers(b, a):
+		return a, true
+	}
+	return "", false
+}
+
+// globCovers reports whether every value matching glob pattern b matches a.
+func globCovers(a, b string) bool {
+	// The wildcards of b are matched literally, by a wildcard of a
+	return globMatch(a, b)
+}
+
+// globOverlap reports whether some value matches both glob patterns.
+func globOverlap(a, b string) bool {
+	memo := map[[2]int]bool{}
+	var overlap func(i, j int) bool
+	overlap = func(i, j int) bool {
+		key := [2]int{i, j}
+		if result, ok := memo[key]; ok {
+			return result
+		}
+		var result bool
+		switch {
+		case i == len(a) && j == len(b):
+			result = true
+		case i < len(a) && a[i] == '*':
+			result = overlap(i+1, j) || (j < len(b) && overlap(i, j+1))
+		case j < len(b) && b[j] == '*':
+			result = overlap(i, j+1) || (i < len(a) && overlap(i+1, j))
+		case i < len(a) && j < len(b):
+			result = a[i] == b[j] && overlap(i+1, j+1)
+		}
+		memo[key] = result
+		return result
+	}
+	return overlap(0, 0)
+}
+
+// policyAdapter loads a policy.csv, failing on lines the file adapter would
+// skip or misparse instead of silently dropping grants.
+type policyAdapter []byte
+
+func (p policyAdapter) LoadPolicy(m model.Model) error {
+	for i, line := range strings.Split(string(p), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r := csv.NewReader(strings.NewReader(line))
+		r.Comment = '#'
+		r.TrimLeadingSpace = true
+		rule, err := r.Read()
+		if err != nil {
+			return fmt.Errorf("line %d: %w", i+1, err)
+		}
+		ptype := rule[0]
+		if ptype == "" || m[ptype[:1]][ptype] == nil {
+			return fmt.Errorf("line %d: unknown policy type %q", i+1, ptype)
+		}
+		if ptype[:1] == "p" && len(rule)-1 != len(m["p"][ptype].Tokens) {
+			return fmt.Errorf("line %d: expected %d fields, got %d", i+1, len(m["p"][ptype].Tokens), len(rule)-1)
+		}
+		if err := persist.LoadPolicyArray(rule, m); err != nil {
+			return fmt.Errorf("line %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+func (p policyAdapter) SavePolicy(m model.Model) error {
+	return errors.New("not implemented")
+}
+
+func (p policyAdapter) AddPolicy(sec string, ptype string, rule []string) error {
+	return errors.New("not implemented")
+}
+
+func (p policyAdapter) RemovePolicy(sec string, ptype string, rule []string) error {
+	return errors.New("not implemented")
+}
+
+func (p policyAdapter) RemoveFilteredPolicy(sec string, ptype string, fieldIndex int, fieldValues ...string) error {
+	return errors.New("not implemented")
+}
+
+// watchPolicyAndModel watches the policy directory rather than the files,
+// to follow editors replacing files and ConfigMap volumes swapping their
+// ..data symlink.
+func (a *casbinAuthorizer) watchPolicyAndModel(ctx context.Context) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("[authz] failed to initialize watcher: %v", err)
+		return
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(a.policyPath); err != nil {
+		log.Printf("[authz] failed to watch directory %s: %v", a.policyPath, err)
+		return
+	}
+	log.Printf("[authz] watching directory: %s", a.policyPath)
+
+	timer := time.NewTimer(casbinReloadDelay)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("[authz] stopping policy watcher")
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			switch filepath.Base(event.Name) {
+			case casbinModelFile, casbinPolicyFile, casbinAssertionsFile, "..data":
+				timer.Reset(casbinReloadDelay)
+			}
+		case <-timer.C:
+			log.Println("[authz] detected policy or model change, reloading...")
+			if err := a.reload(); err != nil {
+				log.Printf("[authz] failed to reload policy, keeping the previous one: %v", err)
+			} else {
+				log.Println("[authz] policy reloaded")
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("[authz] watcher error: %v", err)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// issuedCertValidity is the validity of the certificates issued for the
+	// intercepted server names, they are reissued an hour before they expire
+	issuedCertValidity = 24 * time.Hour
+	// maxIssuedCerts bounds the cache of issued certificates
+	maxIssuedCerts = 1024
+)
+
+// serverCertificates selects the certificate the HTTPS listener terminates
+// an intercepted connection with. With a CA, a certificate for the server
+// name the client sent (SNI) is issued and cached, so that every
+// intercepted host is served a matching certificate. The certificate of
+// --tls-cert and --tls-key serves the connections without a server name,
+// and all connections without a CA.
+type serverCertificates struct {
+	static *tls.Certificate
+	ca     *x509.Certificate
+	caKey  crypto.Signer
+
+	mu     sync.Mutex
+	issued map[string]*tls.Certificate
+}
+
+// newServerCertificates loads the certificate of certFile and keyFile and the
+// CA of caCertFile and caKeyFile; either may be empty, but not both
+func newServerCertificates(certFile, keyFile, caCertFile, caKeyFile string) (*serverCertificates, error) {
+	c := &serverCertificates{issued: map[string]*tls.Certificate{}}
+	if certFile != "" && keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+		c.static = &cert
+	}
+	if caCertFile != "" && caKeyFile != "" {
+		pair, err := tls.LoadX509KeyPair(caCertFile, caKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS CA: %w", err)
+		}
+		ca, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse TLS CA: %w", err)
+		}
+		if !ca.IsCA {
+			return nil, errors.New("TLS CA certificate is not a CA")
+		}
+		key, ok := pair.PrivateKey.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("TLS CA key cannot sign")
+		}
+		c.ca, c.caKey = ca, key
+	}
+	if c.static == nil && c.ca == nil {
+		return nil, errors.New("neither a TLS certificate nor a CA is configured")
+	}
+	return c, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (c *serverCertificates) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if c.ca == nil || name == "" {
+		if c.static == nil {
+			return nil, errors.New("no server name to issue a certificate for")
+		}
+		return c.static, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cert, ok := c.issued[name]; ok && time.Now().Add(time.Hour).Before(cert.Leaf.NotAfter) {
+		return cert, nil
+	}
+	cert, err := c.issue(name)
+	if err != nil {
+		log.Printf("Failed to issue a certificate for %s: %v", name, err)
+		return nil, err
+	}
+	if len(c.issued) >= maxIssuedCerts {
+		clear(c.issued)
+	}
+	c.issued[name] = cert
+	return cert, nil
+}
+
+// issue issues a certificate for name signed by the CA
+func (c *serverCertificates) issue(name string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(issuedCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{name}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, c.ca, &key.PublicKey, c.caKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Issued a certificate for %s, valid until %s", name, leaf.NotAfter.Format(time.RFC3339))
+	return &tls.Certificate{
+		Certificate: [][]byte{der, c.ca.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
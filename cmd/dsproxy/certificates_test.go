@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+// writeTestCA writes a CA certificate and key to dir and returns their paths
+// and the certificate
+func writeTestCA(dir string) (string, string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dsproxy-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).ToNot(HaveOccurred())
+	ca, err := x509.ParseCertificate(der)
+	Expect(err).ToNot(HaveOccurred())
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	Expect(err).ToNot(HaveOccurred())
+
+	certFile, keyFile := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+	Expect(os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)).To(Succeed())
+	Expect(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)).To(Succeed())
+	return certFile, keyFile, ca
+}
+
+// TestServerCertificates tests the certificates served for the intercepted
+// server names
+func TestServerCertificates(t *testing.T) {
+	caCertFile, caKeyFile, ca := writeTestCA(t.TempDir())
+	certFile, keyFile := generateTempTLSFiles()
+	defer os.Remove(certFile)
+	defer os.Remove(keyFile)
+
+	t.Run("IssuedBySNI", func(t *testing.T) {
+		RegisterTestingT(t)
+		certificates, err := newServerCertificates("", "", caCertFile, caKeyFile)
+		Expect(err).ToNot(HaveOccurred())
+
+		cert, err := certificates.GetCertificate(&tls.ClientHelloInfo{ServerName: "Thanos-Querier.openshift-monitoring.svc."})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cert.Leaf.DNSNames).To(Equal([]string{"thanos-querier.openshift-monitoring.svc"}))
+		Expect(cert.Certificate).To(HaveLen(2))
+		roots := x509.NewCertPool()
+		roots.AddCert(ca)
+		_, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: "thanos-querier.openshift-monitoring.svc", Roots: roots})
+		Expect(err).ToNot(HaveOccurred())
+
+		// Certificates are cached by server name
+		cached, err := certificates.GetCertificate(&tls.ClientHelloInfo{ServerName: "thanos-querier.openshift-monitoring.svc"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cached).To(BeIdenticalTo(cert))
+
+		// Without a server name and a static certificate there is nothing to serve
+		_, err = certificates.GetCertificate(&tls.ClientHelloInfo{})
+		Expect(err).To(MatchError(ContainSubstring("no server name")))
+	})
+
+	t.Run("Static", func(t *testing.T) {
+		RegisterTestingT(t)
+		certificates, err := newServerCertificates(certFile, keyFile, caCertFile, caKeyFile)
+		Expect(err).ToNot(HaveOccurred())
+		cert, err := certificates.GetCertificate(&tls.ClientHelloInfo{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cert).To(BeIdenticalTo(certificates.static))
+
+		certificates, err = newServerCertificates(certFile, keyFile, "", "")
+		Expect(err).ToNot(HaveOccurred())
+		cert, err = certificates.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cert).To(BeIdenticalTo(certificates.static))
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		RegisterTestingT(t)
+		_, err := newServerCertificates("", "", "", "")
+		Expect(err).To(MatchError(ContainSubstring("neither a TLS certificate nor a CA")))
+		_, err = newServerCertificates("", "", certFile, keyFile)
+		Expect(err).To(MatchError("TLS CA certificate is not a CA"))
+		_, err = newServerCertificates("", "", caCertFile, filepath.Join(t.TempDir(), "missing.key"))
+		Expect(err).To(MatchError(ContainSubstring("failed to load TLS CA")))
+	})
+
+	t.Run("Handshake", func(t *testing.T) {
+		RegisterTestingT(t)
+		certificates, err := newServerCertificates("", "", caCertFile, caKeyFile)
+		Expect(err).ToNot(HaveOccurred())
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		server.TLS = &tls.Config{GetCertificate: certificates.GetCertificate}
+		server.StartTLS()
+		defer server.Close()
+
+		// The client connects to the intercepted host, which is dsproxy
+		roots := x509.NewCertPool()
+		roots.AddCert(ca)
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "loki.example.com"},
+		}}
+		resp, err := client.Get(server.URL)
+		Expect(err).ToNot(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusNoContent))
+	})
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gopkg.in/yaml.v3"
+)
+
+// claimMapping maps the JWT claims to the identity and groups authorized by
+// the policy. It is replaced in main according to the flags.
+var claimMapping = &claimMapper{identityPath: []string{"sub"}, groupsPath: []string{"groups"}}
+
+// claimMapper extracts the identity and groups from JWT claims
+type claimMapper struct {
+	// identityPath and groupsPath are the paths of the claims in the token
+	identityPath []string
+	groupsPath   []string
+	// prefix is prepended to the groups without a mapping
+	prefix string
+	// mapping maps group claim values to the group names used in policies
+	mapping map[string]string
+}
+
+// newClaimMapper creates a claim mapper for the identity and groups claim
+// paths. mappingPath is an optional YAML file mapping group claim values to
+// stable group names, e.g. Entra ID group object IDs to team names:
+//
+// 0f3c2c9a-3b8e-4a39-9d0c-8f5a1e6b7c21: team-backend
+// /realm-admins: admins
+func newClaimMapper(identity, groups, prefix, mappingPath string) (*claimMapper, error) {
+	identityPath, err := parseClaimPath(identity)
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity claim: %w", err)
+	}
+	groupsPath, err := parseClaimPath(groups)
+	if err != nil {
+		return nil, fmt.Errorf("invalid groups claim: %w", err)
+	}
+	mapper := &claimMapper{identityPath: identityPath, groupsPath: groupsPath, prefix: prefix}
+	if mappingPath != "" {
+		data, err := os.ReadFile(mappingPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read group mapping: %w", err)
+		}
+		if err := yaml.Unmarshal(data, &mapper.mapping); err != nil {
+			return nil, fmt.Errorf("failed to parse group mapping: %w", err)
+		}
+	}
+	return mapper, nil
+}
+
+// identity returns the identity claim, empty if it is missing or not a string
+func (m *claimMapper) identity(claims jwt.MapClaims) string {
+	identity, _ := lookupClaim(claims, m.identityPath).(string)
+	return identity
+}
+
+// groups returns the groups claim, mapped and prefixed. The claim may be an
+// array of strings or a single string.
+func (m *claimMapper) groups(claims jwt.MapClaims) []string {
+	raw := lookupClaim(claims, m.groupsPath)
+	if group, ok := raw.(string); ok {
+		raw = []string{group}
+	}
+	groups := extractStringSlice(raw)
+	var mapped []string
+	for _, group := range groups {
+		if name, ok := m.mapping[group]; ok {
+			mapped = append(mapped, name)
+			continue
+		}
+		mapped = append(mapped, m.prefix+group)
+	}
+	return mapped
+}
+
+// lookupClaim returns the value at path in claims, nil if it does not exist
+func lookupClaim(claims jwt.MapClaims, path []string) any {
+	var value any = map[string]any(claims)
+	for _, key := range path {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = object[key]
+	}
+	return value
+}
+
+// parseClaimPath parses a JSONPath-style claim path into its keys. Keys are
+// separated by dots, keys containing dots are quoted in brackets, and the
+// root $ is optional, e.g. realm_access.roles, $.realm_access.roles or
+// $['https://example.com/groups'].
+func parseClaimPath(path string) ([]string, error) {
+	rest := strings.TrimPrefix(path, "$")
+	if rest != path {
+		rest = strings.TrimPrefix(rest, ".")
+	}
+	var keys []string
+	for rest != "" {
+		if rest[0] == '[' {
+			if len(rest) < 2 || (rest[1] != '\'' && rest[1] != '"') {
+				return nil, fmt.Errorf("%q: bracket keys must be quoted", path)
+			}
+			end := strings.Index(rest[2:], string(rest[1])+"]")
+			if end < 0 {
+				return nil, fmt.Errorf("%q: unterminated bracket key", path)
+			}
+			keys = append(keys, rest[2:2+end])
+			rest = rest[2+end+2:]
+		} else {
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("%q: empty key", path)
+			}
+			keys = append(keys, rest[:end])
+			rest = rest[end:]
+		}
+		if strings.HasPrefix(rest, ".") {
+			rest = rest[1:]
+			if rest == "" {
+				return nil, fmt.Errorf("%q: empty key", path)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%q: empty path", path)
+	}
+	return keys, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MicahParks/keyfunc/v2"
+	"github.com/golang-jwt/jwt/v5"
+	. "github.com/onsi/gomega"
+)
+
+// TestParseClaimPath tests parsing JSONPath-style claim paths
+func TestParseClaimPath(t *testing.T) {
+	RegisterTestingT(t)
+
+	for path, keys := range map[string][]string{
+		"sub":                              {"sub"},
+		"realm_access.roles":               {"realm_access", "roles"},
+		"$.realm_access.roles":             {"realm_access", "roles"},
+		"$['https://example.com/roles']":   {"https://example.com/roles"},
+		`resource_access["grafana"].roles`: {"resource_access", "grafana", "roles"},
+	} {
+		Expect(parseClaimPath(path)).To(Equal(keys), path)
+	}
+	for _, path := range []string{"", "$", "a..b", "a.", "a[b]", "a['b"} {
+		_, err := parseClaimPath(path)
+		Expect(err).To(HaveOccurred(), path)
+	}
+}
+
+// TestClaimMapper tests extracting the identity and groups of Keycloak and
+// Entra ID style tokens
+func TestClaimMapper(t *testing.T) {
+	RegisterTestingT(t)
+
+	mappingPath := filepath.Join(t.TempDir(), "groups.yaml")
+	Expect(os.WriteFile(mappingPath, []byte("0f3c2c9a-3b8e-4a39-9d0c-8f5a1e6b7c21: team-backend\n"), 0644)).To(Succeed())
+
+	keycloak := jwt.MapClaims{
+		"sub":                "f:1234",
+		"preferred_username": "alice",
+		"realm_access":       map[string]any{"roles": []any{"developers", "offline_access"}},
+	}
+	mapper, err := newClaimMapper("preferred_username", "realm_access.roles", "keycloak:", "")
+	Expect(err).ToNot(HaveOccurred())
+	Expect(mapper.identity(keycloak)).To(Equal("alice"))
+	Expect(mapper.groups(keycloak)).To(Equal([]string{"keycloak:developers", "keycloak:offline_access"}))
+
+	entra := jwt.MapClaims{
+		"oid":    "8d0b0c4e",
+		"roles":  "Grafana.Reader",
+		"groups": []any{"0f3c2c9a-3b8e-4a39-9d0c-8f5a1e6b7c21", "5e2d1b7a-0000-4000-8000-000000000000"},
+	}
+	mapper, err = newClaimMapper("oid", "groups", "entra:", mappingPath)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(mapper.identity(entra)).To(Equal("8d0b0c4e"))
+	Expect(mapper.groups(entra)).To(Equal([]string{"team-backend", "entra:5e2d1b7a-0000-4000-8000-000000000000"}))
+
+	// A single string claim is a single group
+	mapper, err = newClaimMapper("oid", "roles", "", "")
+	Expect(err).ToNot(HaveOccurred())
+	Expect(mapper.groups(entra)).To(Equal([]string{"Grafana.Reader"}))
+
+	// Missing and mistyped claims
+	mapper, err = newClaimMapper("realm_access.name", "realm_access.roles.admin", "", "")
+	Expect(err).ToNot(HaveOccurred())
+	Expect(mapper.identity(keycloak)).To(BeEmpty())
+	Expect(mapper.groups(keycloak)).To(BeEmpty())
+
+	_, err = newClaimMapper("sub", "groups", "", filepath.Join(t.TempDir(), "missing.yaml"))
+	Expect(err).To(MatchError(ContainSubstring("failed to read group mapping")))
+	_, err = newClaimMapper("sub", "a..b", "", "")
+	Expect(err).To(MatchError(ContainSubstring("invalid groups claim")))
+}
+
+// TestAuthMiddlewareClaimMapping tests that authMiddleware authorizes the mapped identity and groups
+func TestAuthMiddlewareClaimMapping(t *testing.T) {
+	RegisterTestingT(t)
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	origAlgorithms, origMapping := f_jwtAlgorithms, claimMapping
+	defer func() { f_jwtAlgorithms, claimMapping = origAlgorithms, origMapping }()
+	useGivenJWKS(t, "https://dex.example.com", map[string]keyfunc.GivenKey{"test": keyfunc.NewGivenHMAC(key, keyfunc.GivenKeyOptions{Algorithm: "HS256"})})
+	f_jwtAlgorithms = "HS256"
+	sign := func(claims jwt.MapClaims) string {
+		claims["iss"] = "https://dex.example.com"
+		claims["aud"] = f_jwtAudience
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		token.Header["kid"] = "test"
+		tokenStr, err := token.SignedString(key)
+		Expect(err).ToNot(HaveOccurred())
+		return tokenStr
+	}
+
+	var err error
+	claimMapping, err = newClaimMapper("preferred_username", "realm_access.roles", "kc:", "")
+	Expect(err).ToNot(HaveOccurred())
+
+	handler := authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Expect(r.Context().Value(ContextKeyEmail)).To(Equal("alice"))
+		Expect(r.Context().Value(ContextKeyGroups)).To(Equal([]string{"kc:developers"}))
+	}))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+sign(jwt.MapClaims{
+		"sub":                "f:1234",
+		"preferred_username": "alice",
+		"realm_access":       map[string]any{"roles": []string{"developers"}},
+	}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	Expect(w.Code).To(Equal(http.StatusOK))
+
+	// Tokens without the identity claim are rejected
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+sign(jwt.MapClaims{"sub": "f:1234"}))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	Expect(w.Code).To(Equal(http.StatusUnauthorized))
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+const (
+	queryParam    = "query"
+	matchersParam = "match[]"
+)
+
+// clusterLabelEnforcer rewrites PromQL so that every series selector is
+// restricted to the authorized cluster/namespace pairs. Pairs are grouped by
+// cluster, and each group becomes one matcher set, e.g.
+//
+//	up  →  (up{cluster="a",namespace=~"x|y"} or up{cluster="b",namespace="z"})
+//
+// This is used for multi-cluster datasources (MCOO rbac-query-proxy / Thanos)
+// where a namespace name alone does not identify a tenant. Without a cluster
+// label only the namespaces are enforced, as one matcher set, e.g.
+//
+//	up  →  up{namespace=~"x|y|z"}
+type clusterLabelEnforcer struct {
+	clusterLabel   string
+	namespaceLabel string
+}
+
+// matcherSets converts the allowed cluster/namespace pairs into one matcher
+// set per cluster. A set without matchers means unrestricted access, in which
+// case nil is returned together with ok=true.
+func (e *clusterLabelEnforcer) matcherSets(pairs [][2]string) (sets [][]*labels.Matcher, ok bool, err error) {
+	if e.clusterLabel == "" {
+		return e.namespaceMatcherSets(pairs)
+	}
+	namespacesByCluster := map[string][]string{}
+	for _, pair := range pairs {
+		cluster, namespace := pair[0], pair[1]
+		if cluster == "" || namespace == "" {
+			continue
+		}
+		namespacesByCluster[cluster] = append(namespacesByCluster[cluster], namespace)
+	}
+	if len(namespacesByCluster) == 0 {
+		return nil, false, nil
+	}
+
+	clusters := make([]string, 0, len(namespacesByCluster))
+	for cluster := range namespacesByCluster {
+		clusters = append(clusters, cluster)
+	}
+	sort.Strings(clusters)
+
+	for _, cluster := range clusters {
+		var set []*labels.Matcher
+		clusterMatcher, err := patternMatcher(e.clusterLabel, []string{cluster})
+		if err != nil {
+			return nil, false, err
+		}
+		if clusterMatcher != nil {
+			set = append(set, clusterMatcher)
+		}
+		namespaceMatcher, err := patternMatcher(e.namespaceLabel, namespacesByCluster[cluster])
+		if err != nil {
+			return nil, false, err
+		}
+		if namespaceMatcher != nil {
+			set = append(set, namespaceMatcher)
+		}
+		if len(set) == 0 {
+			// Access to every namespace in every cluster
+			return nil, true, nil
+		}
+		sets = append(sets, set)
+	}
+	return sets, true, nil
+}
+
+// namespaceMatcherSets converts the namespaces of the allowed pairs into a
+// single matcher set, whatever their cluster. Access to every namespace still
+// requires the namespace label, so that series outside of any namespace, e.g.
+// of nodes, are not revealed.
+func (e *clusterLabelEnforcer) namespaceMatcherSets(pairs [][2]string) ([][]*labels.Matcher, bool, error) {
+	namespaces := make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		if pair[1] != "" {
+			namespaces = append(namespaces, pair[1])
+		}
+	}
+	if len(namespaces) == 0 {
+		return nil, false, nil
+	}
+	matcher, err := patternMatcher(e.namespaceLabel, namespaces)
+	if err != nil {
+		return nil, false, err
+	}
+	if matcher == nil {
+		if matcher, err = labels.NewMatcher(labels.MatchRegexp, e.namespaceLabel, ".+"); err != nil {
+			return nil, false, err
+		}
+	}
+	return [][]*labels.Matcher{{matcher}}, true, nil
+}
+
+// patternMatcher returns a matcher for the given policy patterns. A single
+// literal value becomes an equality matcher, anything else a regex matcher
+// built by namespaceRegex. nil is returned when the patterns match every value.
+func patternMatcher(label string, patterns []string) (*labels.Matcher, error) {
+	re := namespaceRegex(patterns)
+	if re == ".+" {
+		return nil, nil
+	}
+	if len(patterns) == 1 && !strings.Contains(patterns[0], "*") {
+		return labels.NewMatcher(labels.MatchEqual, label, patterns[0])
+	}
+	return labels.NewMatcher(labels.MatchRegexp, label, re)
+}
+
+// enforceQuery parses a PromQL expression and restricts every selector in it
+// to the given matcher sets.
+func enforceQuery(query string, sets [][]*labels.Matcher) (string, error) {
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse query: %w", err)
+	}
+	rewritten, err := rewriteExpr(expr, sets)
+	if err != nil {
+		return "", err
+	}
+	return rewritten.String(), nil
+}
+
+// rewriteExpr walks the AST and replaces every vector selector with the union
+// of the selector restricted to each matcher set. Range vector selectors
+// cannot be combined with "or", so functions taking a range vector are
+// distributed over the matcher sets instead. This is sound because those
+// functions operate on each series independently.
+func rewriteExpr(expr parser.Expr, sets [][]*labels.Matcher) (parser.Expr, error) {
+	switch n := expr.(type) {
+	case *parser.VectorSelector:
+		return union(len(sets), func(i int) parser.Expr {
+			return withMatchers(n, sets[i])
+		}), nil
+	case *parser.MatrixSelector:
+		if len(sets) > 1 {
+			return nil, errors.New("range vector selectors are only supported as function arguments when access spans multiple clusters")
+		}
+		return withRangeMatchers(n, sets[0]), nil
+	case *parser.Call:
+		if n.Func.Name == "info" && len(sets) > 1 {
+			return nil, errors.New("info() is not supported when access spans multiple clusters")
+		}
+		rangeArg := slices.IndexFunc(n.Args, func(arg parser.Expr) bool {
+			_, ok := arg.(*parser.MatrixSelector)
+			return ok
+		})
+		if rangeArg < 0 {
+			args, err := rewriteExprs(n.Args, sets)
+			if err != nil {
+				return nil, err
+			}
+			call := *n
+			call.Args = args
+			return &call, nil
+		}
+		calls := make([]parser.Expr, len(sets))
+		for i, set := range sets {
+			args := make(parser.Expressions, len(n.Args))
+			for j, arg := range n.Args {
+				if j == rangeArg {
+					args[j] = withRangeMatchers(arg.(*parser.MatrixSelector), set)
+					continue
+				}
+				var err error
+				if args[j], err = rewriteExpr(arg, sets); err != nil {
+					return nil, err
+				}
+			}
+			call := *n
+			call.Args = args
+			calls[i] = &call
+		}
+		return union(len(calls), func(i int) parser.Expr { return calls[i] }), nil
+	case *parser.AggregateExpr:
+		inner, err := rewriteExpr(n.Expr, sets)
+		if err != nil {
+			return nil, err
+		}
+		agg := *n
+		agg.Expr = inner
+		if n.Param != nil {
+			if agg.Param, err = rewriteExpr(n.Param, sets); err != nil {
+				return nil, err
+			}
+		}
+		return &agg, nil
+	case *parser.BinaryExpr:
+		lhs, err := rewriteExpr(n.LHS, sets)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := rewriteExpr(n.RHS, sets)
+		if err != nil {
+			return nil, err
+		}
+		bin := *n
+		bin.LHS, bin.RHS = lhs, rhs
+		return &bin, nil
+	case *parser.ParenExpr:
+		inner, err := rewriteExpr(n.Expr, sets)
+		if err != nil {
+			return nil, err
+		}
+		paren := *n
+		paren.Expr = inner
+		return &paren, nil
+	case *parser.UnaryExpr:
+		inner, err := rewriteExpr(n.Expr, sets)
+		if err != nil {
+			return nil, err
+		}
+		unary := *n
+		unary.Expr = inner
+		return &unary, nil
+	case *parser.SubqueryExpr:
+		inner, err := rewriteExpr(n.Expr, sets)
+		if err != nil {
+			return nil, err
+		}
+		subquery := *n
+		subquery.Expr = inner
+		return &subquery, nil
+	case *parser.StepInvariantExpr:
+		inner, err := rewriteExpr(n.Expr, sets)
+		if err != nil {
+			return nil, err
+		}
+		return &parser.StepInvariantExpr{Expr: inner}, nil
+	case *parser.NumberLiteral, *parser.StringLiteral:
+		return expr, nil
+	default:
+		return nil, fmt.Errorf("unsupported expression type %T", expr)
+	}
+}
+
+func rewriteExprs(exprs parser.Expressions, sets [][]*labels.Matcher) (parser.Expressions, error) {
+	rewritten := make(parser.Expressions, len(exprs))
+	for i, expr := range exprs {
+		var err error
+		if rewritten[i], err = rewriteExpr(expr, sets); err != nil {
+			return nil, err
+		}
+	}
+	return rewritten, nil
+}
+
+// union combines n expressions with the "or" set operator. More than one
+// expression is wrapped in parentheses so that operator precedence of the
+// surrounding expression is preserved.
+func union(n int, expr func(i int) parser.Expr) parser.Expr {
+	result := expr(0)
+	for i := 1; i < n; i++ {
+		result = &parser.BinaryExpr{
+			Op:             parser.LOR,
+			LHS:            result,
+			RHS:            expr(i),
+			VectorMatching: &parser.VectorMatching{Card: parser.CardManyToMany},
+		}
+	}
+	if n > 1 {
+		return &parser.ParenExpr{Expr: result}
+	}
+	return result
+}
+
+func withMatchers(vs *parser.VectorSelector, set []*labels.Matcher) *parser.VectorSelector {
+	selector := *vs
+	selector.LabelMatchers = append(slices.Clone(vs.LabelMatchers), set...)
+	return &selector
+}
+
+func withRangeMatchers(ms *parser.MatrixSelector, set []*labels.Matcher) *parser.MatrixSelector {
+	matrix := *ms
+	matrix.VectorSelector = withMatchers(ms.VectorSelector.(*parser.VectorSelector), set)
+	return &matrix
+}
+
+// enforceMatchers restricts series selectors passed as match[] parameters.
+// The series, labels and federate APIs return the union of all match[]
+// selectors, so every selector is expanded into one selector per matcher set.
+func enforceMatchers(selectors []string, sets [][]*labels.Matcher) ([]string, error) {
+	if len(selectors) == 0 {
+		selectors = []string{`{__name__=~".+"}`}
+	}
+	var enforced []string
+	for _, selector := range selectors {
+		matchers, err := parser.ParseMetricSelector(selector)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse selector: %w", err)
+		}
+		for _, set := range sets {
+			enforced = append(enforced, matchersToString(append(slices.Clone(matchers), set...)))
+		}
+	}
+	return enforced, nil
+}
+
+func matchersToString(ms []*labels.Matcher) string {
+	el := make([]string, 0, len(ms))
+	for _, m := range ms {
+		el = append(el, m.String())
+	}
+	return fmt.Sprintf("{%s}", strings.Join(el, ","))
+}
+
+// newClusterAwarePrometheusProxy creates a handler for multi-cluster Prometheus
+// datasources that enforces the full cluster/namespace pairs authorized by the
+// authz middleware rather than namespaces only
+func newClusterAwarePrometheusProxy(upstreamURL, clusterLabel, namespaceLabel string, transport http.RoundTripper) (http.Handler, error) {
+	if clusterLabel == "" || namespaceLabel == "" {
+		return nil, errors.New("cluster and namespace labels are required")
+	}
+	return newEnforcingPrometheusProxy(upstreamURL, &clusterLabelEnforcer{
+		clusterLabel:   clusterLabel,
+		namespaceLabel: namespaceLabel,
+	}, transport)
+}
+
+// newEnforcingPrometheusProxy serves the Prometheus query, series, labels and
+// federate APIs with every selector restricted by enforcer, and forwards the
+// requests to upstreamURL with transport (http.DefaultTransport when nil)
+func newEnforcingPrometheusProxy(upstreamURL string, enforcer *clusterLabelEnforcer, transport http.RoundTripper) (http.Handler, error) {
+	upstream, err := url.Parse(upstreamURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse upstream URL: %w", err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(upstream)
+	proxy.Transport = transport
+
+	mux := http.NewServeMux()
+	for _, path := range []string{"/api/v1/query", "/api/v1/query_range", "/api/v1/query_exemplars"} {
+		mux.Handle(path, enforcer.handler(proxy, queryParam, enforceQueryValue))
+	}
+	for _, path := range []string{"/api/v1/series", "/api/v1/labels", "/api/v1/label/", "/federate"} {
+		mux.Handle(path, enforcer.handler(proxy, matchersParam, enforceMatchers))
+	}
+	return mux, nil
+}
+
+func enforceQueryValue(values []string, sets [][]*labels.Matcher) ([]string, error) {
+	enforced := make([]string, 0, len(values))
+	for _, value := range values {
+		query, err := enforceQuery(value, sets)
+		if err != nil {
+			return nil, err
+		}
+		enforced = append(enforced, query)
+	}
+	return enforced, nil
+}
+
+// handler rewrites the given parameter in both the URL query string and the
+// POST form before forwarding the request upstream
+func (e *clusterLabelEnforcer) handler(next http.Handler, param string, enforce func([]string, [][]*labels.Matcher) ([]string, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+
+		allowedPairs, _ := r.Context().Value(ContextKeyAllowedClusters).([][2]string)
+		sets, ok, err := e.matcherSets(allowedPairs)
+		if err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "No authorized namespaces", http.StatusForbidden)
+			return
+		}
+		if sets == nil {
+			log.Printf("[cluster-injection] unrestricted access, forwarding query unchanged")
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// The query APIs are left alone when no query is given, but a missing
+		// match[] means "all series" and must always be restricted
+		err = rewriteRequestParam(r, param, param == matchersParam, func(values []string) ([]string, error) {
+			return enforce(values, sets)
+		})
+		if err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		log.Printf("[cluster-injection] enforced %s for %s", param, r.URL.Path)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// prometheusAPIError writes an error in the Prometheus HTTP API format
+func prometheusAPIError(w http.ResponseWriter, errorMessage string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	res := map[string]string{"status": "error", "errorType": "dsproxy", "error": errorMessage}
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Printf("error: Failed to encode json: %v", err)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+// TestClusterMatcherSets tests grouping of cluster/namespace pairs into matcher sets
+func TestClusterMatcherSets(t *testing.T) {
+	enforcer := &clusterLabelEnforcer{clusterLabel: "cluster", namespaceLabel: "namespace"}
+
+	testCases := []struct {
+		name         string
+		pairs        [][2]string
+		expectedOK   bool
+		expectedSets []string
+	}{
+		{
+			name:       "NoPairs",
+			pairs:      nil,
+			expectedOK: false,
+		},
+		{
+			name:         "SingleClusterSingleNamespace",
+			pairs:        [][2]string{{"a", "x"}},
+			expectedOK:   true,
+			expectedSets: []string{`{cluster="a",namespace="x"}`},
+		},
+		{
+			name:         "GroupedByCluster",
+			pairs:        [][2]string{{"b", "z"}, {"a", "y"}, {"a", "x"}},
+			expectedOK:   true,
+			expectedSets: []string{`{cluster="a",namespace=~"x|y"}`, `{cluster="b",namespace="z"}`},
+		},
+		{
+			name:         "WildcardCluster",
+			pairs:        [][2]string{{"*", "dev-*"}},
+			expectedOK:   true,
+			expectedSets: []string{`{namespace=~"dev-.*"}`},
+		},
+		{
+			name:         "WildcardNamespace",
+			pairs:        [][2]string{{"a", "*"}, {"b", "z"}},
+			expectedOK:   true,
+			expectedSets: []string{`{cluster="a"}`, `{cluster="b",namespace="z"}`},
+		},
+		{
+			name:         "ClusterPattern",
+			pairs:        [][2]string{{"prod-*", "monitoring"}},
+			expectedOK:   true,
+			expectedSets: []string{`{cluster=~"prod-.*",namespace="monitoring"}`},
+		},
+		{
+			name:         "Unrestricted",
+			pairs:        [][2]string{{"a", "x"}, {"*", "*"}},
+			expectedOK:   true,
+			expectedSets: nil,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			RegisterTestingT(t)
+
+			sets, ok, err := enforcer.matcherSets(tc.pairs)
+			Expect(err).To(BeNil())
+			Expect(ok).To(Equal(tc.expectedOK))
+
+			var got []string
+			for _, set := range sets {
+				got = append(got, matchersToString(set))
+			}
+			Expect(got).To(Equal(tc.expectedSets))
+		})
+	}
+}
+
+// TestEnforceQuery tests rewriting of PromQL expressions against multiple clusters
+func TestEnforceQuery(t *testing.T) {
+	enforcer := &clusterLabelEnforcer{clusterLabel: "cluster", namespaceLabel: "namespace"}
+	multi, _, err := enforcer.matcherSets([][2]string{{"a", "x"}, {"a", "y"}, {"b", "z"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	single, _, err := enforcer.matcherSets([][2]string{{"a", "x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name     string
+		query    string
+		sets     string
+		expected string
+		errorMsg string
+	}{
+		{
+			name:     "SingleClusterSelector",
+			query:    `up`,
+			sets:     "single",
+			expected: `up{cluster="a",namespace="x"}`,
+		},
+		{
+			name:     "SingleClusterRangeSelector",
+			query:    `up[5m]`,
+			sets:     "single",
+			expected: `up{cluster="a",namespace="x"}[5m]`,
+		},
+		{
+			name:     "MultiClusterSelector",
+			query:    `up{job="api"}`,
+			sets:     "multi",
+			expected: `(up{cluster="a",job="api",namespace=~"x|y"} or up{cluster="b",job="api",namespace="z"})`,
+		},
+		{
+			name:     "UserMatchersAreKept",
+			query:    `up{namespace="other"}`,
+			sets:     "multi",
+			expected: `(up{cluster="a",namespace="other",namespace=~"x|y"} or up{cluster="b",namespace="other",namespace="z"})`,
+		},
+		{
+			name:     "Aggregation",
+			query:    `sum by (namespace) (up)`,
+			sets:     "multi",
+			expected: `sum by (namespace) ((up{cluster="a",namespace=~"x|y"} or up{cluster="b",namespace="z"}))`,
+		},
+		{
+			name:     "RangeFunctionIsDistributed",
+			query:    `rate(http_requests_total[5m])`,
+			sets:     "multi",
+			expected: `(rate(http_requests_total{cluster="a",namespace=~"x|y"}[5m]) or rate(http_requests_total{cluster="b",namespace="z"}[5m]))`,
+		},
+		{
+			name:     "RangeFunctionWithScalarArgument",
+			query:    `quantile_over_time(0.9, latency[10m])`,
+			sets:     "multi",
+			expected: `(quantile_over_time(0.9, latency{cluster="a",namespace=~"x|y"}[10m]) or quantile_over_time(0.9, latency{cluster="b",namespace="z"}[10m]))`,
+		},
+		{
+			name:     "BinaryExpression",
+			query:    `a / on(pod) b > 1`,
+			sets:     "multi",
+			expected: `(a{cluster="a",namespace=~"x|y"} or a{cluster="b",namespace="z"}) / on (pod) (b{cluster="a",namespace=~"x|y"} or b{cluster="b",namespace="z"}) > 1`,
+		},
+		{
+			name:     "Subquery",
+			query:    `max_over_time(up[1h:5m])`,
+			sets:     "multi",
+			expected: `max_over_time((up{cluster="a",namespace=~"x|y"} or up{cluster="b",namespace="z"})[1h:5m])`,
+		},
+		{
+			name:     "OffsetIsPreserved",
+			query:    `up offset 5m`,
+			sets:     "multi",
+			expected: `(up{cluster="a",namespace=~"x|y"} offset 5m or up{cluster="b",namespace="z"} offset 5m)`,
+		},
+		{
+			name:     "NumberLiteral",
+			query:    `1 + 1`,
+			sets:     "multi",
+			expected: `1 + 1`,
+		},
+		{
+			name:     "BareRangeSelectorRejected",
+			query:    `up[5m]`,
+			sets:     "multi",
+			errorMsg: "range vector selectors",
+		},
+		{
+			name:     "InvalidQueryRejected",
+			query:    `up{`,
+			sets:     "multi",
+			errorMsg: "failed to parse query",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			RegisterTestingT(t)
+
+			sets := multi
+			if tc.sets == "single" {
+				sets = single
+			}
+			got, err := enforceQuery(tc.query, sets)
+			if tc.errorMsg != "" {
+				Expect(err).ToNot(BeNil())
+				Expect(err.Error()).To(ContainSubstring(tc.errorMsg))
+				return
+			}
+			Expect(err).To(BeNil())
+			Expect(got).To(Equal(tc.expected))
+		})
+	}
+}
+
+// TestEnforceMatchers tests expansion of match[] selectors per cluster
+func TestEnforceMatchers(t *testing.T) {
+	RegisterTestingT(t)
+
+	enforcer := &clusterLabelEnforcer{clusterLabel: "cluster", namespaceLabel: "namespace"}
+	sets, _, err := enforcer.matcherSets([][2]string{{"a", "x"}, {"b", "z"}})
+	Expect(err).To(BeNil())
+
+	got, err := enforceMatchers([]string{`up{job="api"}`}, sets)
+	Expect(err).To(BeNil())
+	Expect(got).To(Equal([]string{
+		`{job="api",__name__="up",cluster="a",namespace="x"}`,
+		`{job="api",__name__="up",cluster="b",namespace="z"}`,
+	}))
+
+	got, err = enforceMatchers(nil, sets)
+	Expect(err).To(BeNil())
+	Expect(got).To(Equal([]string{
+		`{__name__=~".+",cluster="a",namespace="x"}`,
+		`{__name__=~".+",cluster="b",namespace="z"}`,
+	}))
+
+	_, err = enforceMatchers([]string{`up{`}, sets)
+	Expect(err).ToNot(BeNil())
+}
+
+// TestClusterAwarePrometheusProxy tests the cluster-aware proxy end to end against a mock upstream
+func TestClusterAwarePrometheusProxy(t *testing.T) {
+	var received url.Values
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("failed to parse form: %v", err)
+		}
+		received = r.Form
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "success"})
+	}))
+	defer upstreamServer.Close()
+
+	proxy, err := newClusterAwarePrometheusProxy(upstreamServer.URL, "cluster", "namespace", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowedPairs := [][2]string{{"a", "x"}, {"a", "y"}, {"b", "z"}}
+	newRequest := func(method, target string, body string, pairs [][2]string) *http.Request {
+		var req *http.Request
+		if body != "" {
+			req = httptest.NewRequest(method, target, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			req = httptest.NewRequest(method, target, nil)
+		}
+		if pairs != nil {
+			req = req.WithContext(context.WithValue(req.Context(), ContextKeyAllowedClusters, pairs))
+		}
+		return req
+	}
+
+	t.Run("QueryGET", func(t *testing.T) {
+		RegisterTestingT(t)
+		received = nil
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, newRequest("GET", "/api/v1/query?query=up", "", allowedPairs))
+
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(received.Get("query")).To(Equal(`(up{cluster="a",namespace=~"x|y"} or up{cluster="b",namespace="z"})`))
+	})
+
+	t.Run("QueryRangePOST", func(t *testing.T) {
+		RegisterTestingT(t)
+		received = nil
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, newRequest("POST", "/api/v1/query_range", "query=up&start=0&end=100&step=15", allowedPairs))
+
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(received.Get("query")).To(Equal(`(up{cluster="a",namespace=~"x|y"} or up{cluster="b",namespace="z"})`))
+		Expect(received.Get("step")).To(Equal("15"))
+	})
+
+	t.Run("SeriesWithoutMatchers", func(t *testing.T) {
+		RegisterTestingT(t)
+		received = nil
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, newRequest("GET", "/api/v1/series", "", allowedPairs))
+
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(received["match[]"]).To(HaveLen(2))
+	})
+
+	t.Run("InvalidQuery", func(t *testing.T) {
+		RegisterTestingT(t)
+		received = nil
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, newRequest("GET", "/api/v1/query?query="+url.QueryEscape("up[5m]"), "", allowedPairs))
+
+		Expect(w.Code).To(Equal(http.StatusBadRequest))
+		Expect(received).To(BeNil())
+	})
+
+	t.Run("NoAllowedPairs", func(t *testing.T) {
+		RegisterTestingT(t)
+		received = nil
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, newRequest("GET", "/api/v1/query?query=up", "", nil))
+
+		Expect(w.Code).To(Equal(http.StatusForbidden))
+		Expect(received).To(BeNil())
+	})
+
+	t.Run("UnknownPath", func(t *testing.T) {
+		RegisterTestingT(t)
+		received = nil
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, newRequest("GET", "/api/v1/status/config", "", allowedPairs))
+
+		Expect(w.Code).To(Equal(http.StatusNotFound))
+		Expect(received).To(BeNil())
+	})
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// DataSourceTypePrometheus is the X-Datasource-Type header value selecting Prometheus mode
+const DataSourceTypePrometheus = "prometheus"
+
+// DatasourceUpstream routes the requests of a datasource to its own upstream.
+// Entries with a UID match X-Datasource-Uid, entries without a UID are the
+// default for all datasources of their type.
+// Example config.yaml:
+//
+// datasources:
+//   - uid: prometheus-mcoo
+//     type: prometheus
+//     url: https://rbac-query-proxy.open-cluster-management-observability.svc:8443
+//     clusterLabel: cluster
+//     caBundle: /etc/dsproxy/ca/service-ca.crt
+//   - type: loki
+//     url: https://lokistack-gateway-http.openshift-logging.svc:8080
+//     injectionLabel: kubernetes_namespace_name
+//   - uid: tempo-dev
+//     type: tempo
+//     url: https://tempo.example.com
+//     tlsSkipVerify: true
+type DatasourceUpstream struct {
+	UID            string `yaml:"uid"`
+	Type           string `yaml:"type"`
+	URL            string `yaml:"url"`
+	InjectionLabel string `yaml:"injectionLabel"`
+	ClusterLabel   string `yaml:"clusterLabel"`
+	CABundle       string `yaml:"caBundle"`
+	TLSSkipVerify  bool   `yaml:"tlsSkipVerify"`
+}
+
+// datasourceRouter dispatches requests on X-Datasource-Uid and
+// X-Datasource-Type to the upstreams configured in the config file and falls
+// back to the upstreams configured by flags.
+type datasourceRouter struct {
+	mu       sync.RWMutex
+	byUID    map[string]http.Handler
+	byType   map[string]http.Handler
+	fallback http.Handler
+}
+
+func newDatasourceRouter(fallback http.Handler) *datasourceRouter {
+	return &datasourceRouter{
+		byUID:    map[string]http.Handler{},
+		byType:   map[string]http.Handler{},
+		fallback: fallback,
+	}
+}
+
+func (d *datasourceRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	datasourceID, _ := r.Context().Value(ContextDataSourceID).(string)
+	datasourceType, _ := r.Context().Value(ContextDataSourceType).(string)
+	datasourceType = strings.ToLower(datasourceType)
+	if datasourceType == "" {
+		datasourceType = DataSourceTypePrometheus
+	}
+
+	d.mu.RLock()
+	handler, ok := d.byUID[datasourceID]
+	if !ok {
+		handler, ok = d.byType[datasourceType]
+	}
+	d.mu.RUnlock()
+
+	if !ok {
+		d.fallback.ServeHTTP(w, r)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+
+// update builds the handlers for datasources and swaps them in atomically.
+// On error the previous handlers stay in place.
+func (d *datasourceRouter) update(datasources []DatasourceUpstream, transport *upstreamTransport) error {
+	byUID := map[string]http.Handler{}
+	byType := map[string]http.Handler{}
+	transports := map[string]http.RoundTripper{}
+	upstreamTLS := map[string]DatasourceUpstream{}
+	// A nil *upstreamTransport must not become a non-nil http.RoundTripper
+	var roundTripper http.RoundTripper
+	if transport != nil {
+		roundTripper = transport
+	}
+
+	for i, ds := range datasources {
+		dsType := strings.ToLower(ds.Type)
+		if dsType == "" {
+			dsType = DataSourceTypePrometheus
+		}
+		handler, err := newDatasourceHandler(dsType, ds, roundTripper)
+		if err != nil {
+			return fmt.Errorf("datasource %d (uid %q): %w", i, ds.UID, err)
+		}
+
+		if ds.UID != "" {
+			if _, exists := byUID[ds.UID]; exists {
+				return fmt.Errorf("datasource %d: duplicate uid %q", i, ds.UID)
+			}
+			byUID[ds.UID] = handler
+		} else {
+			if _, exists := byType[dsType]; exists {
+				return fmt.Errorf("datasource %d: duplicate default for type %q", i, dsType)
+			}
+			byType[dsType] = handler
+		}
+
+		// Upstream TLS is configured per host, shared by all datasources on it
+		upstream, _ := url.Parse(ds.URL)
+		if previous, exists := upstreamTLS[upstream.Host]; exists {
+			if previous.CABundle != ds.CABundle {
+				return fmt.Errorf("datasource %d: conflicting caBundle for upstream host %s", i, upstream.Host)
+			}
+			if previous.TLSSkipVerify != ds.TLSSkipVerify {
+				return fmt.Errorf("datasource %d: conflicting tlsSkipVerify for upstream host %s", i, upstream.Host)
+			}
+		}
+		upstreamTLS[upstream.Host] = ds
+		if ds.TLSSkipVerify {
+			log.Printf("Datasource %d (uid %q): TLS verification of %s is disabled", i, ds.UID, upstream.Host)
+		}
+		if ds.CABundle != "" || ds.TLSSkipVerify {
+			rt, err := newUpstreamRoundTripper(ds.CABundle, ds.TLSSkipVerify)
+			if err != nil {
+				return fmt.Errorf("datasource %d (uid %q): %w", i, ds.UID, err)
+			}
+			transports[upstream.Host] = rt
+		}
+	}
+
+	if transport != nil {
+		transport.set(transports)
+	}
+	d.mu.Lock()
+	d.byUID, d.byType = byUID, byType
+	d.mu.Unlock()
+	setMetricDatasources(datasources)
+	log.Printf("Datasource routes updated: %d by uid, %d by type", len(byUID), len(byType))
+	return nil
+}
+
+// newDatasourceHandler creates the enforcing proxy for a configured datasource,
+// forwarding its requests with transport. The injection label defaults to the
+// one of the matching flag.
+func newDatasourceHandler(dsType string, ds DatasourceUpstream, transport http.RoundTripper) (http.Handler, error) {
+	upstream, err := url.Parse(ds.URL)
+	if err != nil || upstream.Scheme == "" || upstream.Host == "" {
+		return nil, fmt.Errorf("invalid url %q", ds.URL)
+	}
+
+	label := ds.InjectionLabel
+	switch dsType {
+	case DataSourceTypePrometheus:
+		if label == "" {
+			label = f_injectionLabel
+		}
+		if ds.ClusterLabel != "" {
+			return newClusterAwarePrometheusProxy(ds.URL, ds.ClusterLabel, label, transport)
+		}
+		return newPrometheusProxy(ds.URL, label, transport)
+	case DataSourceTypeLoki:
+		if label == "" {
+			label = f_lokiLabel
+		}
+		return newLokiProxy(ds.URL, label, transport)
+	case DataSourceTypeTempo:
+		if label == "" {
+			label = f_tempoAttribute
+		}
+		return newTempoProxy(ds.URL, label, transport)
+	default:
+		return nil, fmt.Errorf("unsupported type %q", dsType)
+	}
+}
+
+// upstreamTransport selects the round tripper by upstream host, so that
+// datasources can trust their own CA bundle. It is the transport of the
+// reverse proxies of all datasources.
+type upstreamTransport struct {
+	mu       sync.RWMutex
+	hosts    map[string]http.RoundTripper
+	fallback http.RoundTripper
+}
+
+func newUpstreamTransport(fallback http.RoundTripper) *upstreamTransport {
+	return &upstreamTransport{hosts: map[string]http.RoundTripper{}, fallback: fallback}
+}
+
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.RLock()
+	rt, ok := t.hosts[req.URL.Host]
+	t.mu.RUnlock()
+	if !ok {
+		rt = t.fallback
+	}
+	// The upstream request carries the query as rewritten by the proxies
+	if record := auditRecordFrom(req.Context()); record != nil {
+		query, err := auditQuery(nil, req)
+		if err != nil {
+			log.Printf("[audit] failed to read rewritten query: %v", err)
+		}
+		record.RewrittenQuery = query
+	}
+	return rt.RoundTrip(req)
+}
+
+func (t *upstreamTransport) set(hosts map[string]http.RoundTripper) {
+	t.mu.Lock()
+	previous := t.hosts
+	t.hosts = hosts
+	t.mu.Unlock()
+
+	for _, rt := range previous {
+		if tr, ok := rt.(*http.Transport); ok {
+			tr.CloseIdleConnections()
+		}
+	}
+}
+
+// newUpstreamRoundTripper creates a transport trusting the CA bundle at path,
+// or not verifying the upstream certificate at all with skipVerify
+func newUpstreamRoundTripper(caBundle string, skipVerify bool) (http.RoundTripper, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if skipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		return transport, nil
+	}
+	tlsConfig, err := newTLSConfig(caBundle)
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
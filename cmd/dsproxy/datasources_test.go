@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"gopkg.in/yaml.v3"
+)
+
+// TestDatasourceRouter tests dispatching to upstreams configured per datasource
+func TestDatasourceRouter(t *testing.T) {
+	upstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Upstream", name)
+			w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+		}))
+	}
+	mcoo := upstream("mcoo")
+	defer mcoo.Close()
+	prometheus := upstream("prometheus")
+	defer prometheus.Close()
+	loki := upstream("loki")
+	defer loki.Close()
+
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream", "fallback")
+	})
+	router := newDatasourceRouter(fallback)
+
+	var cfg Config
+	err := yaml.Unmarshal([]byte(`
+datasources:
+  - uid: prometheus-mcoo
+    url: `+mcoo.URL+`
+    clusterLabel: cluster
+  - type: prometheus
+    url: `+prometheus.URL+`
+  - type: loki
+    url: `+loki.URL+`
+`), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := router.update(cfg.Datasources, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(path, uid, dsType string) string {
+		req := httptest.NewRequest("GET", path, nil)
+		ctx := context.WithValue(req.Context(), ContextKeyAllowedClusters, [][2]string{{"a", "x"}})
+		if uid != "" {
+			ctx = context.WithValue(ctx, ContextDataSourceID, uid)
+		}
+		if dsType != "" {
+			ctx = context.WithValue(ctx, ContextDataSourceType, dsType)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req.WithContext(ctx))
+		return w.Header().Get("X-Upstream")
+	}
+
+	t.Run("ByUID", func(t *testing.T) {
+		RegisterTestingT(t)
+		Expect(serve("/api/v1/query?query=up", "prometheus-mcoo", "prometheus")).To(Equal("mcoo"))
+	})
+
+	t.Run("ByType", func(t *testing.T) {
+		RegisterTestingT(t)
+		Expect(serve("/api/v1/query?query=up", "prometheus-other", "prometheus")).To(Equal("prometheus"))
+		Expect(serve("/api/v1/query?query=up", "", "")).To(Equal("prometheus"))
+		Expect(serve("/loki/api/v1/query?query={app=\"x\"}", "loki-app", "Loki")).To(Equal("loki"))
+	})
+
+	t.Run("Fallback", func(t *testing.T) {
+		RegisterTestingT(t)
+		Expect(serve("/api/search", "tempo-incluster", "tempo")).To(Equal("fallback"))
+	})
+
+	t.Run("InvalidUpdateKeepsRoutes", func(t *testing.T) {
+		RegisterTestingT(t)
+
+		err := router.update([]DatasourceUpstream{{UID: "broken", Type: "elasticsearch", URL: "http://localhost:9200"}}, nil)
+		Expect(err).ToNot(BeNil())
+		Expect(serve("/api/v1/query?query=up", "prometheus-mcoo", "prometheus")).To(Equal("mcoo"))
+	})
+
+	t.Run("Reload", func(t *testing.T) {
+		RegisterTestingT(t)
+
+		err := router.update([]DatasourceUpstream{{Type: "prometheus", URL: mcoo.URL}}, nil)
+		Expect(err).To(BeNil())
+		Expect(serve("/api/v1/query?query=up", "prometheus-mcoo", "prometheus")).To(Equal("mcoo"))
+		Expect(serve("/loki/api/v1/query?query={app=\"x\"}", "loki-app", "loki")).To(Equal("fallback"))
+	})
+}
+
+// TestDatasourceRouterUpdateValidation tests rejection of invalid datasource configs
+func TestDatasourceRouterUpdateValidation(t *testing.T) {
+	caBundle := filepath.Join(t.TempDir(), "ca.crt")
+	certFile, keyFile := generateTempTLSFiles()
+	defer os.Remove(certFile)
+	defer os.Remove(keyFile)
+	pem, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(caBundle, pem, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name        string
+		datasources []DatasourceUpstream
+		errorMsg    string
+	}{
+		{
+			name:        "InvalidURL",
+			datasources: []DatasourceUpstream{{UID: "a", URL: "localhost"}},
+			errorMsg:    "invalid url",
+		},
+		{
+			name:        "UnsupportedType",
+			datasources: []DatasourceUpstream{{UID: "a", Type: "elasticsearch", URL: "http://es:9200"}},
+			errorMsg:    "unsupported type",
+		},
+		{
+			name: "DuplicateUID",
+			datasources: []DatasourceUpstream{
+				{UID: "a", URL: "http://prom-a:9090"},
+				{UID: "a", URL: "http://prom-b:9090"},
+			},
+			errorMsg: "duplicate uid",
+		},
+		{
+			name: "DuplicateTypeDefault",
+			datasources: []DatasourceUpstream{
+				{Type: "loki", URL: "http://loki-a:3100"},
+				{Type: "loki", URL: "http://loki-b:3100"},
+			},
+			errorMsg: "duplicate default",
+		},
+		{
+			name: "ConflictingCABundle",
+			datasources: []DatasourceUpstream{
+				{UID: "a", URL: "https://prom:9091", CABundle: caBundle},
+				{UID: "b", URL: "https://prom:9091"},
+			},
+			errorMsg: "conflicting caBundle",
+		},
+		{
+			name: "ConflictingTLSSkipVerify",
+			datasources: []DatasourceUpstream{
+				{UID: "a", URL: "https://prom:9091", TLSSkipVerify: true},
+				{UID: "b", URL: "https://prom:9091"},
+			},
+			errorMsg: "conflicting tlsSkipVerify",
+		},
+		{
+			name:        "MissingCABundle",
+			datasources: []DatasourceUpstream{{UID: "a", URL: "https://prom:9091", CABundle: "/nonexistent/ca.crt"}},
+			errorMsg:    "failed to read CA bundle",
+		},
+		{
+			name: "Valid",
+			datasources: []DatasourceUpstream{
+				{UID: "a", URL: "https://prom:9091", CABundle: caBundle},
+				{UID: "b", Type: "tempo", URL: "https://tempo:8080", TLSSkipVerify: true},
+				{Type: "loki", URL: "https://loki:8080"},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			RegisterTestingT(t)
+
+			transport := newUpstreamTransport(http.DefaultTransport)
+			err := newDatasourceRouter(http.NotFoundHandler()).update(tc.datasources, transport)
+			if tc.errorMsg != "" {
+				Expect(err).ToNot(BeNil())
+				Expect(err.Error()).To(ContainSubstring(tc.errorMsg))
+				Expect(transport.hosts).To(BeEmpty())
+				return
+			}
+			Expect(err).To(BeNil())
+			Expect(transport.hosts).To(HaveKey("prom:9091"))
+			Expect(transport.hosts).To(HaveKey("tempo:8080"))
+			Expect(transport.hosts).ToNot(HaveKey("loki:8080"))
+		})
+	}
+}
+
+// TestUpstreamTransport tests that upstream TLS is verified against the datasource CA bundle
+func TestUpstreamTransport(t *testing.T) {
+	RegisterTestingT(t)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	transport := newUpstreamTransport(http.DefaultTransport)
+	req, _ := http.NewRequest("GET", server.URL, nil)
+
+	// Unknown host uses the fallback, which does not trust the test CA
+	_, err := transport.RoundTrip(req)
+	Expect(err).ToNot(BeNil())
+
+	transport.set(map[string]http.RoundTripper{req.URL.Host: server.Client().Transport})
+	resp, err := transport.RoundTrip(req)
+	Expect(err).To(BeNil())
+	Expect(resp.StatusCode).To(Equal(http.StatusNoContent))
+
+	// Datasources opting out of the verification trust any certificate
+	skipVerify, err := newUpstreamRoundTripper("", true)
+	Expect(err).To(BeNil())
+	transport.set(map[string]http.RoundTripper{req.URL.Host: skipVerify})
+	resp, err = transport.RoundTrip(req)
+	Expect(err).To(BeNil())
+	Expect(resp.StatusCode).To(Equal(http.StatusNoContent))
+}
+
+// TestDatasourceRouterUpstreamCABundle tests that the proxies of a datasource
+// forward with the transport trusting its CA bundle
+func TestDatasourceRouterUpstreamCABundle(t *testing.T) {
+	RegisterTestingT(t)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream", "tls")
+	}))
+	defer server.Close()
+	caBundle := filepath.Join(t.TempDir(), "ca.crt")
+	Expect(os.WriteFile(caBundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o600)).To(Succeed())
+
+	serve := func(router *datasourceRouter, dsType string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/loki/api/v1/query?query={app=\"x\"}", nil)
+		ctx := context.WithValue(req.Context(), ContextKeyAllowedClusters, [][2]string{{"a", "x"}})
+		ctx = context.WithValue(ctx, ContextDataSourceType, dsType)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req.WithContext(ctx))
+		return w
+	}
+
+	router := newDatasourceRouter(http.NotFoundHandler())
+	Expect(router.update([]DatasourceUpstream{{Type: "loki", URL: server.URL, CABundle: caBundle}}, newUpstreamTransport(http.DefaultTransport))).To(Succeed())
+	w := serve(router, "loki")
+	Expect(w.Code).To(Equal(http.StatusOK))
+	Expect(w.Header().Get("X-Upstream")).To(Equal("tls"))
+
+	// Without the CA bundle the upstream certificate is not trusted
+	router = newDatasourceRouter(http.NotFoundHandler())
+	Expect(router.update([]DatasourceUpstream{{Type: "loki", URL: server.URL}}, newUpstreamTransport(http.DefaultTransport))).To(Succeed())
+	Expect(serve(router, "loki").Code).To(Equal(http.StatusBadGateway))
+}
@@ -1,14 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"fmt"
+	"errors"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
 
 	"github.com/golang-jwt/jwt/v5"
-	"github.com/prometheus-community/prom-label-proxy/injectproxy"
 )
 
 type contextKey string
@@ -21,61 +26,157 @@ const (
 	ContextDataSourceID       contextKey = "datasourceID"
 	ContextDataSourceType     contextKey = "datasourceType"
 	ContextKeyAllowedClusters contextKey = "allowed_clusters"
+	ContextKeyAudit           contextKey = "audit"
 )
 
 func authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Tokens not issued by the OIDC issuer, e.g. service account tokens,
+		// are authenticated with a TokenReview when enabled
+		if tokenStr, err := bearerToken(r); err == nil && tokenReviewer != nil && !issuedByOIDC(tokenStr) {
+			user, err := tokenReviewer.authenticate(r.Context(), tokenStr)
+			if err != nil {
+				log.Printf("Unauthorized: %v", err)
+				authnFailed(w, r, authnFailureReason(err), "Unauthorized")
+				return
+			}
+			log.Printf("Authenticated user with TokenReview: %s, groups: %v", user.Username, user.Groups)
+			authenticated(w, r, next, user.Username, user.Groups)
+			return
+		}
+
 		token, err := verifyBearerToken(r)
 		if err != nil {
 			log.Printf("Unauthorized: %v", err)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			authnFailed(w, r, authnFailureReason(err), "Unauthorized")
 			return
 		}
 
+		// iss, aud and the token lifetime are checked by verifyBearerToken
 		claims, ok := token.Claims.(jwt.MapClaims)
 		if !ok {
-			http.Error(w, "Invalid token claims", http.StatusUnauthorized)
-			return
-		}
-		// check aud
-		aud, ok := claims["aud"].(string)
-		if !ok || aud != f_jwtAudience {
-			http.Error(w, "Invalid audience", http.StatusUnauthorized)
+			authnFailed(w, r, "invalid_claims", "Invalid token claims")
 			return
 		}
 
-		// Extract sub (user email/identity) from JWT - this is what we'll use for authz
-		sub, _ := claims["sub"].(string)
+		// Extract the identity (sub by default) from JWT - this is what we'll use for authz
+		sub := claimMapping.identity(claims)
 		if sub == "" {
-			http.Error(w, "Missing subject claim", http.StatusUnauthorized)
+			authnFailed(w, r, "missing_subject", "Missing subject claim")
 			return
 		}
 
 		email, _ := claims["email"].(string)
-		groups := extractStringSlice(claims["groups"])
+		groups := claimMapping.groups(claims)
 
 		log.Printf("Authenticated user: %s (sub: %s), groups: %v", email, sub, groups)
+		authenticated(w, r, next, sub, groups)
+	})
+}
+
+// authenticated serves an authenticated request with next, with the
+// identity and groups of the user and the datasource in the context
+func authenticated(w http.ResponseWriter, r *http.Request, next http.Handler, identity string, groups []string) {
+	if record := auditRecordFrom(r.Context()); record != nil {
+		record.Subject = identity
+		record.Groups = append([]string(nil), groups...)
+	}
+
+	ctx := context.WithValue(r.Context(), ContextKeyEmail, identity)
+	ctx = context.WithValue(ctx, ContextKeyGroups, groups)
 
-		ctx := context.WithValue(r.Context(), ContextKeyEmail, sub) // Use sub as primary identity
-		ctx = context.WithValue(ctx, ContextKeyGroups, groups)
+	// Get ds from the header X-Datasource-Uid
+	datasourceID := r.Header.Get("X-Datasource-Uid")
+	if datasourceID != "" {
+		ctx = context.WithValue(ctx, ContextDataSourceID, datasourceID)
+	}
+
+	// Detect datasource type from X-Datasource-Type header
+	datasourceType := r.Header.Get("X-Datasource-Type")
+	if datasourceType != "" {
+		ctx = context.WithValue(ctx, ContextDataSourceType, datasourceType)
+	}
 
-		// Get ds from the header X-Datasource-Uid
-		datasourceID := r.Header.Get("X-Datasource-Uid")
-		if datasourceID != "" {
-			ctx = context.WithValue(ctx, ContextDataSourceID, datasourceID)
+	// Remove authorization header to prevent it from being forwarded, the
+	// upstreams authenticate dsproxy instead when an upstream token is set
+	r.Header.Del("Authorization")
+	if f_upstreamToken != "" {
+		token, err := os.ReadFile(f_upstreamToken)
+		if err != nil || len(bytes.TrimSpace(token)) == 0 {
+			log.Printf("Failed to read upstream token %s: %v", f_upstreamToken, err)
+			http.Error(w, "Upstream token unavailable", http.StatusServiceUnavailable)
+			return
 		}
+		r.Header.Set("Authorization", "Bearer "+string(bytes.TrimSpace(token)))
+	}
+
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// authnFailed rejects an unauthenticated request, recording the reason in
+// the metrics and the audit log
+func authnFailed(w http.ResponseWriter, r *http.Request, reason, message string) {
+	authnFailuresTotal.WithLabelValues(reason).Inc()
+	if record := auditRecordFrom(r.Context()); record != nil {
+		record.Decision = auditDecisionUnauthenticated
+		record.Reason = reason
+	}
+	http.Error(w, message, http.StatusUnauthorized)
+}
 
-		// Detect datasource type from X-Datasource-Type header
-		datasourceType := r.Header.Get("X-Datasource-Type")
-		if datasourceType != "" {
-			ctx = context.WithValue(ctx, ContextDataSourceType, datasourceType)
+// rewriteRequestParam rewrites every value of param in the URL query string
+// and, for POST requests, in the form body. When required is set and the
+// parameter is missing from the request entirely, rewrite is called with no
+// values so that a restricting default can be added to the query string.
+func rewriteRequestParam(r *http.Request, param string, required bool, rewrite func([]string) ([]string, error)) error {
+	q := r.URL.Query()
+	_, inQuery := q[param]
+
+	var form url.Values
+	inForm := false
+	if r.Method == http.MethodPost {
+		if err := r.ParseForm(); err != nil {
+			return err
 		}
+		form = r.PostForm
+		_, inForm = form[param]
+	}
 
-		// Remove authorization header to prevent it from being forwarded
-		r.Header.Del("Authorization")
+	if inQuery || (required && !inForm) {
+		values, err := rewrite(q[param])
+		if err != nil {
+			return err
+		}
+		q[param] = values
+		r.URL.RawQuery = q.Encode()
+	}
 
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
+	if inForm {
+		values, err := rewrite(form[param])
+		if err != nil {
+			return err
+		}
+		form[param] = values
+		// ParseForm ensures the previous body was read fully
+		_ = r.Body.Close()
+		body := form.Encode()
+		r.Body = io.NopCloser(strings.NewReader(body))
+		r.ContentLength = int64(len(body))
+	}
+	return nil
+}
+
+// allowedNamespaces returns the non-empty namespaces of the cluster/namespace
+// pairs populated by authzMiddleware.
+func allowedNamespaces(r *http.Request) []string {
+	allowedPairs, _ := r.Context().Value(ContextKeyAllowedClusters).([][2]string)
+	namespaces := make([]string, 0, len(allowedPairs))
+	for _, pair := range allowedPairs {
+		if pair[1] != "" {
+			namespaces = append(namespaces, pair[1])
+		}
+	}
+	return namespaces
 }
 
 func extractStringSlice(raw any) []string {
@@ -93,68 +194,55 @@ func extractStringSlice(raw any) []string {
 	return result
 }
 
-// contextLabelExtractor extracts namespace labels from allowed resources
-// determined by Casbin authorization and implements the injectproxy.ExtractLabeler interface
-type contextLabelExtractor struct {
-	label string
-}
-
-// ExtractLabel implements the ExtractLabeler interface by extracting allowed namespaces from context
-// The authz middleware populates ContextKeyAllowedClusters with authorized cluster/namespace pairs
-func (e *contextLabelExtractor) ExtractLabel(next http.HandlerFunc) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Get allowed cluster/namespace pairs from authz middleware
-		allowedPairs, ok := r.Context().Value(ContextKeyAllowedClusters).([][2]string)
-		if !ok || len(allowedPairs) == 0 {
-			http.Error(w, "No authorized namespaces", http.StatusForbidden)
-			return
+// namespaceRegex builds a regex alternation matching every given namespace.
+// Namespaces are policy patterns: regex metacharacters are escaped and the
+// glob wildcard "*" is translated to ".*". A bare "*" grants every namespace
+// and is rendered as ".+", so that the namespace label is still required.
+// The result is sorted and deduplicated so that the rewritten query is stable
+// across requests.
+func namespaceRegex(namespaces []string) string {
+	seen := make(map[string]struct{}, len(namespaces))
+	alternatives := make([]string, 0, len(namespaces))
+	for _, namespace := range namespaces {
+		if namespace == "*" {
+			return ".+"
 		}
-
-		// Extract namespaces from the allowed pairs
-		// For now, we'll use the first allowed namespace
-		// TODO: Support multiple namespaces via regex in prom-label-proxy
-		namespaces := make([]string, 0, len(allowedPairs))
-		for _, pair := range allowedPairs {
-			namespace := pair[1] // pair is [cluster, namespace]
-			namespaces = append(namespaces, namespace)
+		parts := strings.Split(namespace, "*")
+		for i, part := range parts {
+			parts[i] = regexp.QuoteMeta(part)
 		}
-
-		if len(namespaces) == 0 {
-			http.Error(w, "No authorized namespaces found", http.StatusForbidden)
-			return
+		alternative := strings.Join(parts, ".*")
+		if _, ok := seen[alternative]; ok {
+			continue
 		}
-
-		log.Printf("[label-injection] Injecting namespaces: %v", namespaces)
-
-		// For single namespace, use it directly
-		// For multiple namespaces, we need to handle OR logic (future enhancement)
-		labelValue := namespaces[0]
-		if len(namespaces) > 1 {
-			// TODO: prom-label-proxy supports regex - could inject namespace=~"ns1|ns2|ns3"
-			log.Printf("[label-injection] Warning: Multiple namespaces authorized, using first: %s", labelValue)
-		}
-
-		// Store label in context using prom-label-proxy's WithLabelValues
-		ctx := injectproxy.WithLabelValues(r.Context(), []string{labelValue})
-		next(w, r.WithContext(ctx))
-	})
-}
-
-// newPrometheusProxy creates a prom-label-proxy handler for Prometheus datasources
-func newPrometheusProxy(upstreamURL string, label string) (http.Handler, error) {
-	upstream, err := url.Parse(upstreamURL)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse upstream URL: %w", err)
-	}
-
-	extractor := &contextLabelExtractor{
-		label: label,
+		seen[alternative] = struct{}{}
+		alternatives = append(alternatives, alternative)
 	}
+	sort.Strings(alternatives)
+	return strings.Join(alternatives, "|")
+}
 
-	routes, err := injectproxy.NewRoutes(upstream, label, extractor)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create proxy routes: %w", err)
+// newPrometheusProxy creates a handler for Prometheus datasources that
+// restricts every selector to the authorized namespaces, e.g.
+// up{namespace=~"ns1|ns2|dev-.*"}, and forwards the requests to upstreamURL
+// with transport (http.DefaultTransport when nil)
+func newPrometheusProxy(upstreamURL, label string, transport http.RoundTripper) (http.Handler, error) {
+	if label == "" {
+		return nil, errors.New("injection label is required")
 	}
+	return newEnforcingPrometheusProxy(upstreamURL, &clusterLabelEnforcer{namespaceLabel: label}, transport)
+}
 
-	return routes, nil
+// newDatasourceTypeRouter dispatches requests to the handler registered for the
+// datasource type detected by authMiddleware (X-Datasource-Type). Requests
+// without a type, or with a type that has no handler, go to fallback.
+func newDatasourceTypeRouter(handlers map[string]http.Handler, fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		datasourceType, _ := r.Context().Value(ContextDataSourceType).(string)
+		if handler, ok := handlers[strings.ToLower(datasourceType)]; ok {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		fallback.ServeHTTP(w, r)
+	})
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
@@ -8,6 +9,8 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -15,8 +18,8 @@ import (
 	. "github.com/onsi/gomega"
 )
 
-// Note: proxyHandler tests removed as we now use prom-label-proxy integration
-// which provides its own proxy implementation with label injection.
+// Note: proxyHandler tests removed as the PromQL enforcement is covered by
+// label_injection_test.go and cluster_injection_test.go.
 // The main functionality is tested through integration tests.
 
 func TestAuthMiddleware_SuccessAndFailure(t *testing.T) {
@@ -37,20 +40,24 @@ func TestAuthMiddleware_SuccessAndFailure(t *testing.T) {
 
 	// Mock OIDC discovery endpoint
 	discoverySrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		resp := map[string]string{"jwks_uri": jwksSrv.URL}
+		resp := map[string]string{"issuer": "https://example.com", "jwks_uri": jwksSrv.URL}
 		_ = json.NewEncoder(w).Encode(resp)
 	}))
 	defer discoverySrv.Close()
 
-	// Patch global jwksURL to point to our mock discovery endpoint
-	origJWKSURL := f_jwksURL
-	f_jwksURL = discoverySrv.URL
-	defer func() { f_jwksURL = origJWKSURL }()
+	origProviders := jwtProviders
+	defer func() { jwtProviders = origProviders }()
+	origAlgorithms := f_jwtAlgorithms
+	f_jwtAlgorithms = "HS256"
+	defer func() { f_jwtAlgorithms = origAlgorithms }()
 
-	// Call initJWKS and expect no error
-	err = initJWKS()
+	// Call initJWKS with our mock discovery endpoint and wait for the keys
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	providers, err := newJWKSProviders([]string{discoverySrv.URL}, "", "", http.DefaultClient)
 	Expect(err).To(BeNil())
-	Expect(jwks).ToNot(BeNil())
+	initJWKS(ctx, providers)
+	Eventually(jwksLoaded.Load).Should(BeTrue())
 
 	// Create a valid JWT signed with the test key
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
@@ -111,3 +118,44 @@ func TestAuthMiddleware_SuccessAndFailure(t *testing.T) {
 	handler.ServeHTTP(w4, req4)
 	Expect(w4.Code).To(Equal(http.StatusUnauthorized))
 }
+
+// TestAuthenticatedUpstreamToken tests replacing the token of the user with
+// the upstream token
+func TestAuthenticatedUpstreamToken(t *testing.T) {
+	RegisterTestingT(t)
+
+	origUpstreamToken := f_upstreamToken
+	defer func() { f_upstreamToken = origUpstreamToken }()
+
+	var authorization string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	})
+	serve := func() *httptest.ResponseRecorder {
+		authorization = ""
+		req := httptest.NewRequest("GET", "/api/v1/query", nil)
+		req.Header.Set("Authorization", "Bearer user-token")
+		w := httptest.NewRecorder()
+		authenticated(w, req, next, "user", nil)
+		return w
+	}
+
+	// Without an upstream token no credential is forwarded
+	f_upstreamToken = ""
+	Expect(serve().Code).To(Equal(http.StatusOK))
+	Expect(authorization).To(BeEmpty())
+
+	f_upstreamToken = filepath.Join(t.TempDir(), "token")
+	Expect(os.WriteFile(f_upstreamToken, []byte("upstream-token\n"), 0600)).To(Succeed())
+	Expect(serve().Code).To(Equal(http.StatusOK))
+	Expect(authorization).To(Equal("Bearer upstream-token"))
+
+	// Rotated tokens are picked up
+	Expect(os.WriteFile(f_upstreamToken, []byte("rotated-token"), 0600)).To(Succeed())
+	serve()
+	Expect(authorization).To(Equal("Bearer rotated-token"))
+
+	Expect(os.Remove(f_upstreamToken)).To(Succeed())
+	Expect(serve().Code).To(Equal(http.StatusServiceUnavailable))
+	Expect(authorization).To(BeEmpty())
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/MicahParks/keyfunc/v2"
+	"github.com/fsnotify/fsnotify"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// jwksRetryInitial and jwksRetryMax bound the backoff of failed JWKS
+	// acquisitions
+	jwksRetryInitial = time.Second
+	jwksRetryMax     = time.Minute
+	// jwksRefreshInterval is how often the keys of an issuer are refreshed
+	jwksRefreshInterval = time.Hour
+	// jwksRefreshRateLimit limits the refreshes triggered by tokens with an
+	// unknown kid
+	jwksRefreshRateLimit = time.Minute
+	// fileReloadDelay debounces the events of watched files
+	fileReloadDelay = 200 * time.Millisecond
+)
+
+// jwtProviders are the issuers whose tokens are accepted
+var jwtProviders []*jwksProvider
+
+// jwksProvider holds the keys of an issuer, fetched from its OIDC discovery
+// document or read from a static JWKS file.
+type jwksProvider struct {
+	// discoveryURL is the OIDC discovery document, empty for a static file
+	discoveryURL string
+	// path is the static JWKS file
+	path string
+	// issuer overrides the issuer of the discovery document, and is the
+	// issuer of the tokens signed with the keys of a static file
+	issuer string
+	client *http.Client
+
+	state atomic.Pointer[jwksState]
+}
+
+// jwksState is the loaded key set of an issuer
+type jwksState struct {
+	issuer string
+	jwks   *keyfunc.JWKS
+}
+
+// newJWKSProviders creates the providers of the discovery URLs and the
+// static JWKS file. issuer is the issuer of the static file, or overrides
+// the issuer of a single discovery URL.
+func newJWKSProviders(discoveryURLs []string, path, issuer string, client *http.Client) ([]*jwksProvider, error) {
+	var providers []*jwksProvider
+	for _, discoveryURL := range discoveryURLs {
+		provider := &jwksProvider{discoveryURL: discoveryURL, client: client}
+		if path == "" && len(discoveryURLs) == 1 {
+			provider.issuer = issuer
+		}
+		providers = append(providers, provider)
+	}
+	if path != "" {
+		if issuer == "" {
+			return nil, errors.New("a static JWKS file requires --jwt-issuer")
+		}
+		providers = append(providers, &jwksProvider{path: path, issuer: issuer})
+	} else if issuer != "" && len(discoveryURLs) > 1 {
+		return nil, errors.New("--jwt-issuer requires a single discovery URL or a static JWKS file")
+	}
+	if len(providers) == 0 {
+		return nil, errors.New("no discovery URL or static JWKS file configured")
+	}
+	return providers, nil
+}
+
+// initJWKS acquires the keys of the providers in the background, retrying
+// with backoff, and marks the JWKS loaded once all of them are.
+func initJWKS(ctx context.Context, providers []*jwksProvider) {
+	jwtProviders = providers
+	jwksLoaded.Store(false)
+	for _, provider := range providers {
+		go provider.run(ctx, providers)
+	}
+}
+
+func (p *jwksProvider) String() string {
+	if p.path != "" {
+		return p.path
+	}
+	return p.discoveryURL
+}
+
+// run loads the keys until it succeeds, marking the JWKS loaded once all
+// providers are, and watches a static file for changes afterwards.
+func (p *jwksProvider) run(ctx context.Context, providers []*jwksProvider) {
+	backoff := jwksRetryInitial
+	for {
+		err := p.load(ctx)
+		if err == nil {
+			break
+		}
+		jwksRefreshesTotal.WithLabelValues("failure").Inc()
+		log.Printf("Failed to load JWKS from %s, retrying in %s: %v", p, backoff, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, jwksRetryMax)
+	}
+	log.Printf("JWKS loaded from %s for issuer %s", p, p.state.Load().issuer)
+	updateJWKSLoaded(providers)
+
+	if p.path != "" {
+		watchFile(ctx, p.path, func() {
+			if err := p.load(ctx); err != nil {
+				jwksRefreshesTotal.WithLabelValues("failure").Inc()
+				log.Printf("Failed to reload JWKS from %s, keeping the previous keys: %v", p, err)
+				return
+			}
+			log.Printf("JWKS reloaded from %s", p)
+		})
+	}
+}
+
+// updateJWKSLoaded marks the JWKS loaded if all providers are
+func updateJWKSLoaded(providers []*jwksProvider) {
+	for _, provider := range providers {
+		if provider.state.Load() == nil {
+			return
+		}
+	}
+	jwksLoaded.Store(true)
+}
+
+// load reads the static JWKS file, or fetches the discovery document and the
+// keys it points to. The keys of a discovery document are refreshed in the
+// background, and when a token with an unknown kid is seen.
+func (p *jwksProvider) load(ctx context.Context) error {
+	if p.path != "" {
+		data, err := os.ReadFile(p.path)
+		if err != nil {
+			return fmt.Errorf("failed to read JWKS file: %w", err)
+		}
+		jwks, err := keyfunc.NewJSON(data)
+		if err != nil {
+			return fmt.Errorf("failed to parse JWKS file: %w", err)
+		}
+		jwksRefreshesTotal.WithLabelValues("success").Inc()
+		jwksLastRefreshSuccessTimestamp.SetToCurrentTime()
+		p.state.Store(&jwksState{issuer: p.issuer, jwks: jwks})
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.discoveryURL, nil)
+	if err != nil {
+		return err
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("discovery document returned %s", res.Status)
+	}
+
+	var config struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&config); err != nil {
+		return err
+	}
+	issuer := config.Issuer
+	switch {
+	case p.issuer != "":
+		if config.Issuer != "" && config.Issuer != p.issuer {
+			log.Printf("Discovery document issuer %s differs from --jwt-issuer %s, using the latter", config.Issuer, p.issuer)
+		}
+		issuer = p.issuer
+	case issuer == "":
+		return errors.New("discovery document has no issuer and --jwt-issuer is not set")
+	}
+
+	jwks, err := keyfunc.Get(config.JWKSURI, keyfunc.Options{
+		Ctx:               ctx,
+		Client:            p.client,
+		RefreshInterval:   jwksRefreshInterval,
+		RefreshRateLimit:  jwksRefreshRateLimit,
+		RefreshTimeout:    10 * time.Second,
+		RefreshUnknownKID: true,
+		ResponseExtractor: func(ctx context.Context, resp *http.Response) (json.RawMessage, error) {
+			raw, err := keyfunc.ResponseExtractorStatusOK(ctx, resp)
+			if err == nil {
+				jwksRefreshesTotal.WithLabelValues("success").Inc()
+				jwksLastRefreshSuccessTimestamp.SetToCurrentTime()
+			}
+			return raw, err
+		},
+		RefreshErrorHandler: func(err error) {
+			jwksRefreshesTotal.WithLabelValues("failure").Inc()
+			log.Printf("Failed to refresh JWKS of %s: %v", issuer, err)
+		},
+	})
+	if err != nil {
+		return err
+	}
+	p.state.Store(&jwksState{issuer: issuer, jwks: jwks})
+	return nil
+}
+
+// jwksFor returns the key set of the issuer of token, which is not verified
+// yet.
+func jwksFor(token string) (*jwksState, error) {
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+	if err != nil {
+		return nil, err
+	}
+	issuer, err := parsed.Claims.GetIssuer()
+	if err != nil {
+		return nil, err
+	}
+
+	loading := false
+	for _, provider := range jwtProviders {
+		state := provider.state.Load()
+		if state == nil {
+			loading = true
+			continue
+		}
+		if state.issuer == issuer {
+			return state, nil
+		}
+	}
+	switch {
+	case loading:
+		return nil, errJWKSNotInitialized
+	case issuer == "":
+		return nil, fmt.Errorf("%w: iss claim is required", jwt.ErrTokenRequiredClaimMissing)
+	default:
+		return nil, fmt.Errorf("%w: %s", jwt.ErrTokenInvalidIssuer, issuer)
+	}
+}
+
+// knownIssuer reports whether issuer is the issuer of one of the providers
+func knownIssuer(issuer string) bool {
+	for _, provider := range jwtProviders {
+		if state := provider.state.Load(); state != nil && state.issuer == issuer {
+			return true
+		}
+		if provider.issuer != "" && provider.issuer == issuer {
+			return true
+		}
+	}
+	return false
+}
+
+// watchFile calls onChange when the file at path changes. It watches the
+// directory rather than the file, to follow editors replacing files and
+// ConfigMap and Secret volumes swapping their ..data symlink.
+func watchFile(ctx context.Context, path string, onChange func()) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("Failed to initialize watcher for %s: %v", path, err)
+		return
+	}
+	defer watcher.Close()
+
+	dir := filepath.Dir(path)
+	if err := watcher.Add(dir); err != nil {
+		log.Printf("Failed to watch directory %s: %v", dir, err)
+		return
+	}
+
+	timer := time.NewTimer(fileReloadDelay)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			switch filepath.Base(event.Name) {
+			case filepath.Base(path), "..data":
+				timer.Reset(fileReloadDelay)
+			}
+		case <-timer.C:
+			onChange()
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("Watcher error for %s: %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testIssuer is a mock OIDC issuer serving a discovery document and a JWKS
+// of HMAC keys by kid
+type testIssuer struct {
+	*httptest.Server
+	issuer string
+	keys   atomic.Pointer[map[string][]byte]
+	// unavailable is the number of discovery requests failing before the
+	// issuer comes up
+	unavailable atomic.Int32
+}
+
+func newTestIssuer(issuer string, keys map[string][]byte) *testIssuer {
+	i := &testIssuer{issuer: issuer}
+	i.keys.Store(&keys)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		if i.unavailable.Add(-1) >= 0 {
+			http.Error(w, "starting", http.StatusServiceUnavailable)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"issuer": i.issuer, "jwks_uri": i.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(jwksJSON(*i.keys.Load()))
+	})
+	i.Server = httptest.NewServer(mux)
+	return i
+}
+
+func (i *testIssuer) discoveryURL() string {
+	return i.URL + "/.well-known/openid-configuration"
+}
+
+// jwksJSON renders HMAC keys by kid as a JWKS
+func jwksJSON(keys map[string][]byte) []byte {
+	type jwk struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		K   string `json:"k"`
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	for kid, key := range keys {
+		set.Keys = append(set.Keys, jwk{Kty: "oct", Kid: kid, K: base64.RawURLEncoding.EncodeToString(key)})
+	}
+	data, _ := json.Marshal(set)
+	return data
+}
+
+// signedRequest returns a request with a token of issuer signed by key
+func signedRequest(issuer, kid string, key []byte) *http.Request {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub": "alice",
+		"iss": issuer,
+		"aud": f_jwtAudience,
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	token.Header["kid"] = kid
+	tokenStr, err := token.SignedString(key)
+	Expect(err).ToNot(HaveOccurred())
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenStr)
+	return req
+}
+
+// TestJWKSProviders tests the background acquisition, rotation and
+// multiple issuers of JWKS providers
+func TestJWKSProviders(t *testing.T) {
+	origProviders, origAlgorithms := jwtProviders, f_jwtAlgorithms
+	defer func() {
+		jwtProviders, f_jwtAlgorithms = origProviders, origAlgorithms
+		jwksLoaded.Store(true)
+	}()
+	f_jwtAlgorithms = "HS256"
+	dexKey := []byte("dex-key-0123456789abcdef01234567")
+	keycloakKey := []byte("keycloak-key-0123456789abcdef012")
+
+	t.Run("RetryUntilAvailable", func(t *testing.T) {
+		RegisterTestingT(t)
+		dex := newTestIssuer("https://dex.example.com", map[string][]byte{"dex-1": dexKey})
+		defer dex.Close()
+		dex.unavailable.Store(1)
+		failures := testutil.ToFloat64(jwksRefreshesTotal.WithLabelValues("failure"))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		providers, err := newJWKSProviders([]string{dex.discoveryURL()}, "", "", http.DefaultClient)
+		Expect(err).ToNot(HaveOccurred())
+		initJWKS(ctx, providers)
+
+		// Not ready, and tokens are rejected as unavailable, until the issuer is up
+		Expect(jwksLoaded.Load()).To(BeFalse())
+		_, err = verifyBearerToken(signedRequest("https://dex.example.com", "dex-1", dexKey))
+		Expect(authnFailureReason(err)).To(Equal("jwks_unavailable"))
+
+		Eventually(jwksLoaded.Load, 5*time.Second).Should(BeTrue())
+		Expect(testutil.ToFloat64(jwksRefreshesTotal.WithLabelValues("failure"))).To(BeNumerically(">", failures))
+		_, err = verifyBearerToken(signedRequest("https://dex.example.com", "dex-1", dexKey))
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	t.Run("UnknownKIDRefresh", func(t *testing.T) {
+		RegisterTestingT(t)
+		dex := newTestIssuer("https://dex.example.com", map[string][]byte{"dex-1": dexKey})
+		defer dex.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		providers, err := newJWKSProviders([]string{dex.discoveryURL()}, "", "", http.DefaultClient)
+		Expect(err).ToNot(HaveOccurred())
+		initJWKS(ctx, providers)
+		Eventually(jwksLoaded.Load).Should(BeTrue())
+
+		// Dex rotates its signing key
+		rotatedKey := []byte("rotated-key-0123456789abcdef0123")
+		dex.keys.Store(&map[string][]byte{"dex-1": dexKey, "dex-2": rotatedKey})
+		_, err = verifyBearerToken(signedRequest("https://dex.example.com", "dex-2", rotatedKey))
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	t.Run("MultipleIssuers", func(t *testing.T) {
+		RegisterTestingT(t)
+		dex := newTestIssuer("https://dex.example.com", map[string][]byte{"dex-1": dexKey})
+		defer dex.Close()
+		keycloak := newTestIssuer("https://keycloak.example.com/realms/ops", map[string][]byte{"kc-1": keycloakKey})
+		defer keycloak.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		providers, err := newJWKSProviders([]string{dex.discoveryURL(), keycloak.discoveryURL()}, "", "", http.DefaultClient)
+		Expect(err).ToNot(HaveOccurred())
+		initJWKS(ctx, providers)
+		Eventually(jwksLoaded.Load).Should(BeTrue())
+
+		_, err = verifyBearerToken(signedRequest("https://dex.example.com", "dex-1", dexKey))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = verifyBearerToken(signedRequest("https://keycloak.example.com/realms/ops", "kc-1", keycloakKey))
+		Expect(err).ToNot(HaveOccurred())
+
+		// The keys of one issuer do not validate tokens claiming another
+		_, err = verifyBearerToken(signedRequest("https://keycloak.example.com/realms/ops", "dex-1", dexKey))
+		Expect(authnFailureReason(err)).To(Equal("invalid_signature"))
+		_, err = verifyBearerToken(signedRequest("https://evil.example.com", "dex-1", dexKey))
+		Expect(authnFailureReason(err)).To(Equal("bad_issuer"))
+	})
+
+	t.Run("StaticFile", func(t *testing.T) {
+		RegisterTestingT(t)
+		path := filepath.Join(t.TempDir(), "jwks.json")
+		Expect(os.WriteFile(path, jwksJSON(map[string][]byte{"static-1": dexKey}), 0644)).To(Succeed())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		providers, err := newJWKSProviders(nil, path, "https://airgap.example.com", nil)
+		Expect(err).ToNot(HaveOccurred())
+		initJWKS(ctx, providers)
+		Eventually(jwksLoaded.Load).Should(BeTrue())
+
+		_, err = verifyBearerToken(signedRequest("https://airgap.example.com", "static-1", dexKey))
+		Expect(err).ToNot(HaveOccurred())
+
+		// The file is reloaded when it changes
+		Expect(os.WriteFile(path, jwksJSON(map[string][]byte{"static-2": keycloakKey}), 0644)).To(Succeed())
+		Eventually(func() error {
+			_, err := verifyBearerToken(signedRequest("https://airgap.example.com", "static-2", keycloakKey))
+			return err
+		}).Should(Succeed())
+
+		// Invalid files keep the previous keys
+		Expect(os.WriteFile(path, []byte("{"), 0644)).To(Succeed())
+		Consistently(func() error {
+			_, err := verifyBearerToken(signedRequest("https://airgap.example.com", "static-2", keycloakKey))
+			return err
+		}, 500*time.Millisecond).Should(Succeed())
+	})
+
+	t.Run("Configuration", func(t *testing.T) {
+		RegisterTestingT(t)
+		_, err := newJWKSProviders(nil, "", "", nil)
+		Expect(err).To(MatchError(ContainSubstring("no discovery URL")))
+		_, err = newJWKSProviders(nil, "/jwks.json", "", nil)
+		Expect(err).To(MatchError(ContainSubstring("requires --jwt-issuer")))
+		_, err = newJWKSProviders([]string{"https://a", "https://b"}, "", "https://a", nil)
+		Expect(err).To(MatchError(ContainSubstring("single discovery URL")))
+
+		providers, err := newJWKSProviders([]string{"https://a"}, "/jwks.json", "https://static", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fmt.Sprint(providers)).To(Equal("[https://a /jwks.json]"))
+		Expect(providers[0].issuer).To(BeEmpty())
+		Expect(providers[1].issuer).To(Equal("https://static"))
+	})
+}
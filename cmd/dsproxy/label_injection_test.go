@@ -9,13 +9,15 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
 	"testing"
 
 	. "github.com/onsi/gomega"
 )
 
 // TestPrometheusProxyIntegration tests the full pipeline:
-// authz middleware → prom-label-proxy → upstream
+// authz middleware → PromQL enforcement → upstream
 func TestPrometheusProxyIntegration(t *testing.T) {
 	RegisterTestingT(t)
 
@@ -64,9 +66,9 @@ g = _, _
 e = some(where (p.eft == allow))
 
 [matchers]
-m = (g(r.sub, p.sub) || r.sub == p.sub) &&
-    (keyMatch2(r.dom, p.dom) || p.dom == "*") &&
-    (keyMatch2(r.obj, p.obj) || p.obj == "*") &&
+m = (g(r.sub, p.sub) || r.sub == p.sub) && \
+    (keyMatch2(r.dom, p.dom) || globMatch(r.dom, p.dom) || p.dom == "*") && \
+    (keyMatch2(r.obj, p.obj) || globMatch(r.obj, p.obj) || p.obj == "*") && \
     r.act == p.act`
 	err = os.WriteFile(modelFile, []byte(modelContent), 0644)
 	Expect(err).To(BeNil())
@@ -76,8 +78,8 @@ m = (g(r.sub, p.sub) || r.sub == p.sub) &&
 	Expect(err).To(BeNil())
 	Expect(authzService).ToNot(BeNil())
 
-	// Create prom-label-proxy
-	promProxy, err := newPrometheusProxy(upstreamServer.URL, "namespace")
+	// Create the enforcing Prometheus proxy
+	promProxy, err := newPrometheusProxy(upstreamServer.URL, "namespace", nil)
 	Expect(err).To(BeNil())
 	Expect(promProxy).ToNot(BeNil())
 
@@ -140,74 +142,6 @@ m = (g(r.sub, p.sub) || r.sub == p.sub) &&
 	})
 }
 
-// TestContextLabelExtractor tests the label extraction logic
-func TestContextLabelExtractor(t *testing.T) {
-	RegisterTestingT(t)
-
-	extractor := &contextLabelExtractor{
-		label: "namespace",
-	}
-
-	// Create a test handler that will be wrapped
-	nextCalled := false
-	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		nextCalled = true
-		w.WriteHeader(http.StatusOK)
-	})
-
-	handler := extractor.ExtractLabel(nextHandler)
-
-	// Test 1: Valid allowed clusters in context
-	t.Run("ValidAllowedClusters", func(t *testing.T) {
-		RegisterTestingT(t)
-		nextCalled = false
-
-		req := httptest.NewRequest("GET", "/test", nil)
-		allowedPairs := [][2]string{
-			{"cluster1", "namespace1"},
-			{"cluster1", "namespace2"},
-		}
-		ctx := context.WithValue(req.Context(), ContextKeyAllowedClusters, allowedPairs)
-		req = req.WithContext(ctx)
-
-		w := httptest.NewRecorder()
-		handler.ServeHTTP(w, req)
-
-		Expect(w.Code).To(Equal(http.StatusOK))
-		Expect(nextCalled).To(BeTrue())
-	})
-
-	// Test 2: No allowed clusters in context
-	t.Run("NoAllowedClusters", func(t *testing.T) {
-		RegisterTestingT(t)
-		nextCalled = false
-
-		req := httptest.NewRequest("GET", "/test", nil)
-		w := httptest.NewRecorder()
-		handler.ServeHTTP(w, req)
-
-		Expect(w.Code).To(Equal(http.StatusForbidden))
-		Expect(nextCalled).To(BeFalse())
-	})
-
-	// Test 3: Empty allowed clusters list
-	t.Run("EmptyAllowedClusters", func(t *testing.T) {
-		RegisterTestingT(t)
-		nextCalled = false
-
-		req := httptest.NewRequest("GET", "/test", nil)
-		allowedPairs := [][2]string{}
-		ctx := context.WithValue(req.Context(), ContextKeyAllowedClusters, allowedPairs)
-		req = req.WithContext(ctx)
-
-		w := httptest.NewRecorder()
-		handler.ServeHTTP(w, req)
-
-		Expect(w.Code).To(Equal(http.StatusForbidden))
-		Expect(nextCalled).To(BeFalse())
-	})
-}
-
 // TestNewPrometheusProxy tests the prometheus proxy creation
 func TestNewPrometheusProxy(t *testing.T) {
 	RegisterTestingT(t)
@@ -216,7 +150,7 @@ func TestNewPrometheusProxy(t *testing.T) {
 	t.Run("ValidUpstreamURL", func(t *testing.T) {
 		RegisterTestingT(t)
 
-		proxy, err := newPrometheusProxy("http://localhost:9090", "namespace")
+		proxy, err := newPrometheusProxy("http://localhost:9090", "namespace", nil)
 		Expect(err).To(BeNil())
 		Expect(proxy).ToNot(BeNil())
 	})
@@ -225,7 +159,7 @@ func TestNewPrometheusProxy(t *testing.T) {
 	t.Run("InvalidUpstreamURL", func(t *testing.T) {
 		RegisterTestingT(t)
 
-		proxy, err := newPrometheusProxy("://invalid-url", "namespace")
+		proxy, err := newPrometheusProxy("://invalid-url", "namespace", nil)
 		Expect(err).ToNot(BeNil())
 		Expect(proxy).To(BeNil())
 	})
@@ -321,16 +255,16 @@ g = _, _
 e = some(where (p.eft == allow))
 
 [matchers]
-m = (g(r.sub, p.sub) || r.sub == p.sub) &&
-    (keyMatch2(r.dom, p.dom) || p.dom == "*") &&
-    (keyMatch2(r.obj, p.obj) || p.obj == "*") &&
+m = (g(r.sub, p.sub) || r.sub == p.sub) && \
+    (keyMatch2(r.dom, p.dom) || globMatch(r.dom, p.dom) || p.dom == "*") && \
+    (keyMatch2(r.obj, p.obj) || globMatch(r.obj, p.obj) || p.obj == "*") && \
     r.act == p.act`
 			os.WriteFile(modelFile, []byte(modelContent), 0644)
 
 			authzService, err := NewAuthzService(context.Background(), tmpDir)
 			Expect(err).To(BeNil())
 
-			promProxy, err := newPrometheusProxy(upstreamServer.URL, "namespace")
+			promProxy, err := newPrometheusProxy(upstreamServer.URL, "namespace", nil)
 			Expect(err).To(BeNil())
 
 			handler := authzService.authzMiddleware("read")(promProxy)
@@ -399,16 +333,16 @@ g = _, _
 e = some(where (p.eft == allow))
 
 [matchers]
-m = (g(r.sub, p.sub) || r.sub == p.sub) &&
-    (keyMatch2(r.dom, p.dom) || p.dom == "*") &&
-    (keyMatch2(r.obj, p.obj) || p.obj == "*") &&
+m = (g(r.sub, p.sub) || r.sub == p.sub) && \
+    (keyMatch2(r.dom, p.dom) || globMatch(r.dom, p.dom) || p.dom == "*") && \
+    (keyMatch2(r.obj, p.obj) || globMatch(r.obj, p.obj) || p.obj == "*") && \
     r.act == p.act`
 	os.WriteFile(modelFile, []byte(modelContent), 0644)
 
 	authzService, err := NewAuthzService(context.Background(), tmpDir)
 	Expect(err).To(BeNil())
 
-	promProxy, err := newPrometheusProxy(upstreamServer.URL, "namespace")
+	promProxy, err := newPrometheusProxy(upstreamServer.URL, "namespace", nil)
 	Expect(err).To(BeNil())
 
 	handler := authzService.authzMiddleware("read")(promProxy)
@@ -440,9 +374,10 @@ m = (g(r.sub, p.sub) || r.sub == p.sub) &&
 func TestMultipleNamespaceScenarios(t *testing.T) {
 	RegisterTestingT(t)
 
+	var receivedQuery string
 	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		query := r.URL.Query().Get("query")
-		t.Logf("Multi-namespace query: %s", query)
+		receivedQuery = r.URL.Query().Get("query")
+		t.Logf("Multi-namespace query: %s", receivedQuery)
 
 		response := map[string]interface{}{
 			"status": "success",
@@ -479,16 +414,16 @@ g = _, _
 e = some(where (p.eft == allow))
 
 [matchers]
-m = (g(r.sub, p.sub) || r.sub == p.sub) &&
-    (keyMatch2(r.dom, p.dom) || p.dom == "*") &&
-    (keyMatch2(r.obj, p.obj) || p.obj == "*") &&
+m = (g(r.sub, p.sub) || r.sub == p.sub) && \
+    (keyMatch2(r.dom, p.dom) || globMatch(r.dom, p.dom) || p.dom == "*") && \
+    (keyMatch2(r.obj, p.obj) || globMatch(r.obj, p.obj) || p.obj == "*") && \
     r.act == p.act`
 	os.WriteFile(modelFile, []byte(modelContent), 0644)
 
 	authzService, err := NewAuthzService(context.Background(), tmpDir)
 	Expect(err).To(BeNil())
 
-	promProxy, err := newPrometheusProxy(upstreamServer.URL, "namespace")
+	promProxy, err := newPrometheusProxy(upstreamServer.URL, "namespace", nil)
 	Expect(err).To(BeNil())
 
 	handler := authzService.authzMiddleware("read")(promProxy)
@@ -502,8 +437,127 @@ m = (g(r.sub, p.sub) || r.sub == p.sub) &&
 	w := httptest.NewRecorder()
 	handler.ServeHTTP(w, req)
 
-	// Should succeed but currently only uses first namespace
-	// TODO: In the future, should inject namespace=~"namespace1|namespace2|namespace3"
+	// Every authorized namespace should be injected as a single regex matcher
 	Expect(w.Code).To(Equal(http.StatusOK))
-	t.Log("Note: Currently only first namespace is injected. Multi-namespace regex support is a TODO.")
+	Expect(receivedQuery).To(Equal(`up{namespace=~"namespace1|namespace2|namespace3"}`))
+}
+
+// TestNamespaceRegex tests the conversion of policy namespaces to a regex matcher value
+func TestNamespaceRegex(t *testing.T) {
+	testCases := []struct {
+		name       string
+		namespaces []string
+		expected   string
+	}{
+		{
+			name:       "SingleNamespace",
+			namespaces: []string{"monitoring"},
+			expected:   "monitoring",
+		},
+		{
+			name:       "MultipleNamespacesSorted",
+			namespaces: []string{"ns3", "ns1", "ns2"},
+			expected:   "ns1|ns2|ns3",
+		},
+		{
+			name:       "DuplicatesRemoved",
+			namespaces: []string{"ns1", "ns2", "ns1"},
+			expected:   "ns1|ns2",
+		},
+		{
+			name:       "RegexMetacharactersEscaped",
+			namespaces: []string{"team.a", "team+b", "team|c", "(d)"},
+			expected:   `\(d\)|team\+b|team\.a|team\|c`,
+		},
+		{
+			name:       "GlobWildcard",
+			namespaces: []string{"dev-*", "monitoring"},
+			expected:   "dev-.*|monitoring",
+		},
+		{
+			name:       "GlobWildcardWithEscaping",
+			namespaces: []string{"team.*.prod"},
+			expected:   `team\..*\.prod`,
+		},
+		{
+			name:       "FullWildcard",
+			namespaces: []string{"monitoring", "*"},
+			expected:   ".+",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			RegisterTestingT(t)
+
+			re := namespaceRegex(tc.namespaces)
+			Expect(re).To(Equal(tc.expected))
+
+			compiled, err := regexp.Compile("^(?:" + re + ")$")
+			Expect(err).To(BeNil())
+			Expect(compiled.MatchString("")).To(BeFalse())
+			for _, ns := range tc.namespaces {
+				if !strings.Contains(ns, "*") {
+					Expect(compiled.MatchString(ns)).To(BeTrue(), "expected %q to match %q", re, ns)
+				}
+			}
+		})
+	}
+}
+
+// TestPrometheusProxyAuthorizedNamespaces tests that the namespaces of every
+// authorized pair, whatever their cluster, are injected as a single matcher
+func TestPrometheusProxyAuthorizedNamespaces(t *testing.T) {
+	var receivedQuery string
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedQuery = r.URL.Query().Get("query")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstreamServer.Close()
+
+	promProxy, err := newPrometheusProxy(upstreamServer.URL, "namespace", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func(pairs [][2]string) int {
+		receivedQuery = ""
+		req := httptest.NewRequest("GET", "/api/v1/query?query=up", nil)
+		if pairs != nil {
+			req = req.WithContext(context.WithValue(req.Context(), ContextKeyAllowedClusters, pairs))
+		}
+		w := httptest.NewRecorder()
+		promProxy.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	t.Run("NoAllowedClusters", func(t *testing.T) {
+		RegisterTestingT(t)
+		Expect(serve(nil)).To(Equal(http.StatusForbidden))
+		Expect(serve([][2]string{})).To(Equal(http.StatusForbidden))
+		Expect(receivedQuery).To(BeEmpty())
+	})
+
+	t.Run("SingleNamespace", func(t *testing.T) {
+		RegisterTestingT(t)
+		Expect(serve([][2]string{{"cluster1", "frontend"}})).To(Equal(http.StatusOK))
+		Expect(receivedQuery).To(Equal(`up{namespace="frontend"}`))
+	})
+
+	t.Run("MultipleClusters", func(t *testing.T) {
+		RegisterTestingT(t)
+		pairs := [][2]string{
+			{"cluster1", "frontend"},
+			{"cluster2", "backend"},
+			{"cluster1", "dev-*"},
+			{"cluster2", "frontend"},
+		}
+		Expect(serve(pairs)).To(Equal(http.StatusOK))
+		Expect(receivedQuery).To(Equal(`up{namespace=~"backend|dev-.*|frontend"}`))
+	})
+
+	t.Run("AllNamespacesRequireTheLabel", func(t *testing.T) {
+		RegisterTestingT(t)
+		Expect(serve([][2]string{{"cluster1", "*"}})).To(Equal(http.StatusOK))
+		Expect(receivedQuery).To(Equal(`up{namespace=~".+"}`))
+	})
 }
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+const (
+	// DataSourceTypeLoki is the X-Datasource-Type header value selecting Loki mode
+	DataSourceTypeLoki = "loki"
+
+	lokiAPIPrefix = "/loki/api/v1/"
+)
+
+// errUnsafeQuery is returned for queries that cannot be rewritten safely
+var errUnsafeQuery = errors.New("query cannot be safely rewritten")
+
+// lokiQueryParams maps Loki API endpoints (relative to /loki/api/v1/) to the
+// parameter holding LogQL and whether the parameter must be present. Endpoints
+// without a required parameter get a bare stream selector injected so that
+// the response is restricted to the authorized namespaces.
+var lokiQueryParams = map[string]struct {
+	param    string
+	required bool
+}{
+	"query":              {queryParam, false},
+	"query_range":        {queryParam, false},
+	"tail":               {queryParam, false},
+	"series":             {matchersParam, true},
+	"labels":             {queryParam, true},
+	"label":              {queryParam, true},
+	"index/stats":        {queryParam, false},
+	"index/volume":       {queryParam, false},
+	"index/volume_range": {queryParam, false},
+}
+
+// newLokiProxy creates a handler for Loki datasources that injects a stream
+// selector matcher for the authorized namespaces into every LogQL query.
+// Requests are accepted below any path prefix, e.g. the LokiStack gateway
+// /api/logs/v1/<tenant>/loki/api/v1/query_range.
+func newLokiProxy(upstreamURL, label string, transport http.RoundTripper) (http.Handler, error) {
+	upstream, err := url.Parse(upstreamURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse upstream URL: %w", err)
+	}
+	if label == "" {
+		return nil, errors.New("loki injection label is required")
+	}
+	proxy := httputil.NewSingleHostReverseProxy(upstream)
+	proxy.Transport = transport
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idx := strings.Index(r.URL.Path, lokiAPIPrefix)
+		if idx < 0 {
+			http.NotFound(w, r)
+			return
+		}
+		endpoint := strings.TrimPrefix(r.URL.Path[idx:], lokiAPIPrefix)
+		if strings.HasPrefix(endpoint, "label/") && strings.HasSuffix(endpoint, "/values") {
+			endpoint = "label"
+		}
+		params, ok := lokiQueryParams[endpoint]
+		if !ok || (r.Method != http.MethodGet && r.Method != http.MethodPost) {
+			http.NotFound(w, r)
+			return
+		}
+
+		namespaces := allowedNamespaces(r)
+		if len(namespaces) == 0 {
+			http.Error(w, "No authorized namespaces", http.StatusForbidden)
+			return
+		}
+		matcher, err := patternMatcher(label, namespaces)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if matcher == nil {
+			log.Printf("[loki] unrestricted access, forwarding query unchanged")
+			proxy.ServeHTTP(w, r)
+			return
+		}
+
+		err = rewriteRequestParam(r, params.param, params.required, func(values []string) ([]string, error) {
+			if len(values) == 0 {
+				return []string{fmt.Sprintf("{%s}", matcher.String())}, nil
+			}
+			enforced := make([]string, 0, len(values))
+			for _, value := range values {
+				query, err := enforceLogQL(value, matcher)
+				if err != nil {
+					return nil, err
+				}
+				enforced = append(enforced, query)
+			}
+			return enforced, nil
+		})
+		if err != nil {
+			log.Printf("[loki] rejecting query: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		log.Printf("[loki] injected %s for %s", matcher.String(), r.URL.Path)
+		proxy.ServeHTTP(w, r)
+	}), nil
+}
+
+// enforceLogQL adds matcher to every stream selector of a LogQL query.
+// Braces outside of string literals only ever open a stream selector in
+// LogQL, so the query is scanned for those while string literals (which may
+// contain line_format templates) are copied verbatim. Every selector is
+// parsed strictly; anything unexpected rejects the whole query.
+func enforceLogQL(query string, matcher *labels.Matcher) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(query); {
+		switch c := query[i]; c {
+		case '"', '`':
+			end, err := stringLiteralEnd(query, i)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(query[i:end])
+			i = end
+		case '#':
+			return "", fmt.Errorf("%w: comments are not supported", errUnsafeQuery)
+		case '}':
+			return "", fmt.Errorf("%w: unexpected '}' at position %d", errUnsafeQuery, i)
+		case '{':
+			matchers, end, err := parseStreamSelector(query, i)
+			if err != nil {
+				return "", err
+			}
+			matchers = append(matchers, matcher)
+			b.WriteString(matchersToString(matchers))
+			i = end
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String(), nil
+}
+
+// parseStreamSelector parses the stream selector starting at query[start],
+// which must be '{', and returns its matchers and the index after the
+// closing brace.
+func parseStreamSelector(query string, start int) ([]*labels.Matcher, int, error) {
+	var matchers []*labels.Matcher
+	i := skipSpace(query, start+1)
+	if i < len(query) && query[i] == '}' {
+		return matchers, i + 1, nil
+	}
+	for {
+		// Label name
+		nameStart := i
+		for i < len(query) && isLabelNameChar(query[i], i == nameStart) {
+			i++
+		}
+		if i == nameStart {
+			return nil, 0, fmt.Errorf("%w: expected label name at position %d", errUnsafeQuery, i)
+		}
+		name := query[nameStart:i]
+		i = skipSpace(query, i)
+
+		// Match operator
+		var matchType labels.MatchType
+		switch {
+		case strings.HasPrefix(query[i:], "=~"):
+			matchType, i = labels.MatchRegexp, i+2
+		case strings.HasPrefix(query[i:], "!~"):
+			matchType, i = labels.MatchNotRegexp, i+2
+		case strings.HasPrefix(query[i:], "!="):
+			matchType, i = labels.MatchNotEqual, i+2
+		case strings.HasPrefix(query[i:], "="):
+			matchType, i = labels.MatchEqual, i+1
+		default:
+			return nil, 0, fmt.Errorf("%w: expected match operator at position %d", errUnsafeQuery, i)
+		}
+		i = skipSpace(query, i)
+
+		// Label value
+		if i >= len(query) || (query[i] != '"' && query[i] != '`') {
+			return nil, 0, fmt.Errorf("%w: expected label value at position %d", errUnsafeQuery, i)
+		}
+		end, err := stringLiteralEnd(query, i)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, err := strconv.Unquote(query[i:end])
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: invalid label value at position %d", errUnsafeQuery, i)
+		}
+		m, err := labels.NewMatcher(matchType, name, value)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: %v", errUnsafeQuery, err)
+		}
+		matchers = append(matchers, m)
+		i = skipSpace(query, end)
+
+		if i >= len(query) {
+			return nil, 0, fmt.Errorf("%w: unterminated stream selector", errUnsafeQuery)
+		}
+		switch query[i] {
+		case ',':
+			i = skipSpace(query, i+1)
+		case '}':
+			return matchers, i + 1, nil
+		default:
+			return nil, 0, fmt.Errorf("%w: unexpected %q at position %d", errUnsafeQuery, query[i], i)
+		}
+	}
+}
+
+// stringLiteralEnd returns the index after the string literal starting at
+// query[start]. Double-quoted strings support backslash escapes, backtick
+// strings are raw.
+func stringLiteralEnd(query string, start int) (int, error) {
+	quote := query[start]
+	for i := start + 1; i < len(query); i++ {
+		switch query[i] {
+		case '\\':
+			if quote == '"' {
+				i++
+			}
+		case quote:
+			return i + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: unterminated string literal at position %d", errUnsafeQuery, start)
+}
+
+func skipSpace(query string, i int) int {
+	for i < len(query) && strings.ContainsRune(" \t\r\n", rune(query[i])) {
+		i++
+	}
+	return i
+}
+
+func isLabelNameChar(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+}
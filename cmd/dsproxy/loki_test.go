@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// TestEnforceLogQL tests stream selector injection into LogQL queries
+func TestEnforceLogQL(t *testing.T) {
+	single := labels.MustNewMatcher(labels.MatchEqual, "kubernetes_namespace_name", "frontend")
+	multi := labels.MustNewMatcher(labels.MatchRegexp, "kubernetes_namespace_name", "backend|frontend")
+
+	testCases := []struct {
+		name     string
+		query    string
+		matcher  *labels.Matcher
+		expected string
+		errorMsg string
+	}{
+		{
+			name:     "SimpleSelector",
+			query:    `{app="web"}`,
+			matcher:  single,
+			expected: `{app="web",kubernetes_namespace_name="frontend"}`,
+		},
+		{
+			name:     "RegexMatcher",
+			query:    `{app="web"}`,
+			matcher:  multi,
+			expected: `{app="web",kubernetes_namespace_name=~"backend|frontend"}`,
+		},
+		{
+			name:     "EmptySelector",
+			query:    `{}`,
+			matcher:  single,
+			expected: `{kubernetes_namespace_name="frontend"}`,
+		},
+		{
+			name:     "ExistingNamespaceMatcherIsKept",
+			query:    `{kubernetes_namespace_name="other"}`,
+			matcher:  single,
+			expected: `{kubernetes_namespace_name="other",kubernetes_namespace_name="frontend"}`,
+		},
+		{
+			name:     "LineFilterAndParser",
+			query:    `{app="web", level!="debug"} |= "error" | json | status >= 500`,
+			matcher:  single,
+			expected: `{app="web",level!="debug",kubernetes_namespace_name="frontend"} |= "error" | json | status >= 500`,
+		},
+		{
+			name:     "MetricQuery",
+			query:    `sum by (pod) (rate({app=~"web|api"} |~ "time[o]ut" [5m]))`,
+			matcher:  single,
+			expected: `sum by (pod) (rate({app=~"web|api",kubernetes_namespace_name="frontend"} |~ "time[o]ut" [5m]))`,
+		},
+		{
+			name:     "BinaryMetricQuery",
+			query:    `count_over_time({a="1"}[1m]) / count_over_time({b="2"}[1m])`,
+			matcher:  single,
+			expected: `count_over_time({a="1",kubernetes_namespace_name="frontend"}[1m]) / count_over_time({b="2",kubernetes_namespace_name="frontend"}[1m])`,
+		},
+		{
+			name:     "LineFormatTemplateIsPreserved",
+			query:    `{app="web"} | line_format "{{.level}} {{.msg}}"`,
+			matcher:  single,
+			expected: `{app="web",kubernetes_namespace_name="frontend"} | line_format "{{.level}} {{.msg}}"`,
+		},
+		{
+			name:     "BacktickStrings",
+			query:    "{app=`web`} | line_format `{{ .msg }}`",
+			matcher:  single,
+			expected: "{app=\"web\",kubernetes_namespace_name=\"frontend\"} | line_format `{{ .msg }}`",
+		},
+		{
+			name:     "EscapedQuoteInFilter",
+			query:    `{app="web"} |= "say \"{hi}\""`,
+			matcher:  single,
+			expected: `{app="web",kubernetes_namespace_name="frontend"} |= "say \"{hi}\""`,
+		},
+		{
+			name:     "NoSelector",
+			query:    `vector(1)`,
+			matcher:  single,
+			expected: `vector(1)`,
+		},
+		{
+			name:     "CommentRejected",
+			query:    `{app="web"} # {}`,
+			matcher:  single,
+			errorMsg: "comments are not supported",
+		},
+		{
+			name:     "UnbalancedBraceRejected",
+			query:    `{app="web"}}`,
+			matcher:  single,
+			errorMsg: "unexpected '}'",
+		},
+		{
+			name:     "UnterminatedSelectorRejected",
+			query:    `{app="web"`,
+			matcher:  single,
+			errorMsg: "unterminated stream selector",
+		},
+		{
+			name:     "UnterminatedStringRejected",
+			query:    `{app="web} |= "x"`,
+			matcher:  single,
+			errorMsg: "cannot be safely rewritten",
+		},
+		{
+			name:     "UnquotedValueRejected",
+			query:    `{app=web}`,
+			matcher:  single,
+			errorMsg: "expected label value",
+		},
+		{
+			name:     "InvalidRegexRejected",
+			query:    `{app=~"("}`,
+			matcher:  single,
+			errorMsg: "cannot be safely rewritten",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			RegisterTestingT(t)
+
+			got, err := enforceLogQL(tc.query, tc.matcher)
+			if tc.errorMsg != "" {
+				Expect(err).ToNot(BeNil())
+				Expect(err.Error()).To(ContainSubstring(tc.errorMsg))
+				return
+			}
+			Expect(err).To(BeNil())
+			Expect(got).To(Equal(tc.expected))
+		})
+	}
+}
+
+// TestLokiProxy tests the Loki proxy end to end against a mock upstream
+func TestLokiProxy(t *testing.T) {
+	var received url.Values
+	var receivedPath string
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("failed to parse form: %v", err)
+		}
+		received = r.Form
+		receivedPath = r.URL.Path
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "success"})
+	}))
+	defer upstreamServer.Close()
+
+	proxy, err := newLokiProxy(upstreamServer.URL, "kubernetes_namespace_name", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowedPairs := [][2]string{{"", "frontend"}, {"", "backend"}}
+	newRequest := func(method, target string, body string, pairs [][2]string) *http.Request {
+		var req *http.Request
+		if body != "" {
+			req = httptest.NewRequest(method, target, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			req = httptest.NewRequest(method, target, nil)
+		}
+		if pairs != nil {
+			req = req.WithContext(context.WithValue(req.Context(), ContextKeyAllowedClusters, pairs))
+		}
+		return req
+	}
+
+	t.Run("QueryRangeBehindGateway", func(t *testing.T) {
+		RegisterTestingT(t)
+		received = nil
+
+		target := "/api/logs/v1/application/loki/api/v1/query_range?query=" + url.QueryEscape(`{app="web"} |= "error"`)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, newRequest("GET", target, "", allowedPairs))
+
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(receivedPath).To(Equal("/api/logs/v1/application/loki/api/v1/query_range"))
+		Expect(received.Get("query")).To(Equal(`{app="web",kubernetes_namespace_name=~"backend|frontend"} |= "error"`))
+	})
+
+	t.Run("QueryPOST", func(t *testing.T) {
+		RegisterTestingT(t)
+		received = nil
+
+		body := "limit=10&query=" + url.QueryEscape(`count_over_time({app="web"}[5m])`)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, newRequest("POST", "/loki/api/v1/query", body, [][2]string{{"", "frontend"}}))
+
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(received.Get("query")).To(Equal(`count_over_time({app="web",kubernetes_namespace_name="frontend"}[5m])`))
+		Expect(received.Get("limit")).To(Equal("10"))
+	})
+
+	t.Run("LabelsWithoutQuery", func(t *testing.T) {
+		RegisterTestingT(t)
+		received = nil
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, newRequest("GET", "/loki/api/v1/label/app/values", "", allowedPairs))
+
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(received.Get("query")).To(Equal(`{kubernetes_namespace_name=~"backend|frontend"}`))
+	})
+
+	t.Run("SeriesWithoutMatchers", func(t *testing.T) {
+		RegisterTestingT(t)
+		received = nil
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, newRequest("GET", "/loki/api/v1/series", "", allowedPairs))
+
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(received["match[]"]).To(Equal([]string{`{kubernetes_namespace_name=~"backend|frontend"}`}))
+	})
+
+	t.Run("UnrestrictedAccess", func(t *testing.T) {
+		RegisterTestingT(t)
+		received = nil
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, newRequest("GET", "/loki/api/v1/query?query="+url.QueryEscape(`{app="web"}`), "", [][2]string{{"", "*"}}))
+
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(received.Get("query")).To(Equal(`{app="web"}`))
+	})
+
+	t.Run("UnsafeQuery", func(t *testing.T) {
+		RegisterTestingT(t)
+		received = nil
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, newRequest("GET", "/loki/api/v1/query?query="+url.QueryEscape(`{app="web"} # }`), "", allowedPairs))
+
+		Expect(w.Code).To(Equal(http.StatusBadRequest))
+		Expect(received).To(BeNil())
+	})
+
+	t.Run("NoAllowedNamespaces", func(t *testing.T) {
+		RegisterTestingT(t)
+		received = nil
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, newRequest("GET", "/loki/api/v1/query?query="+url.QueryEscape(`{app="web"}`), "", nil))
+
+		Expect(w.Code).To(Equal(http.StatusForbidden))
+		Expect(received).To(BeNil())
+	})
+
+	t.Run("UnknownPath", func(t *testing.T) {
+		RegisterTestingT(t)
+		received = nil
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, newRequest("POST", "/loki/api/v1/push", "", allowedPairs))
+
+		Expect(w.Code).To(Equal(http.StatusNotFound))
+		Expect(received).To(BeNil())
+	})
+}
+
+// TestDatasourceTypeRouter tests dispatching on the detected datasource type
+func TestDatasourceTypeRouter(t *testing.T) {
+	RegisterTestingT(t)
+
+	named := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		})
+	}
+	router := newDatasourceTypeRouter(map[string]http.Handler{
+		DataSourceTypeLoki: named("loki"),
+	}, named("prometheus"))
+
+	for datasourceType, expected := range map[string]string{
+		"":           "prometheus",
+		"prometheus": "prometheus",
+		"loki":       "loki",
+		"Loki":       "loki",
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if datasourceType != "" {
+			req = req.WithContext(context.WithValue(req.Context(), ContextDataSourceType, datasourceType))
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		Expect(w.Body.String()).To(Equal(expected), "datasource type %q", datasourceType)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"log"
@@ -9,33 +10,38 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
-	"github.com/coreos/go-iptables/iptables"
 	"github.com/fsnotify/fsnotify"
 	flag "github.com/spf13/pflag"
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	Proxies []ProxyRule `yaml:"proxies"`
+	Proxies     []ProxyRule          `yaml:"proxies"`
+	Datasources []DatasourceUpstream `yaml:"datasources"`
 }
 
 // ProxyRule defines a rule for redirecting traffic
-// to a specific domain and ports.
+// to a specific domain and ports. The traffic of http ports is redirected to
+// the HTTP listener, the traffic of https ports to the HTTPS listener, which
+// terminates TLS with a certificate for the domain.
 // Example config.yaml:
 //
-// proxies:
-//   - domain: example.com
-//     proxies:
-//     http: [80, 8080]
-//     https: [443, 8443]
-//   - domain: another.com
-//     proxies:
-//     http: [80]
-//     https: [443]
+//	proxies:
+//	  - domain: example.com
+//	    proxies:
+//	      - http: [80, 8080]
+//	        https: [443, 8443]
+//	  - domain: another.com
+//	    proxies:
+//	      - http: [80]
+//	        https: [443]
 //
 // Save this as /etc/dsproxy/config.yaml or specify with --config flag.
 type ProxyRule struct {
@@ -44,65 +50,48 @@ type ProxyRule struct {
 }
 
 type Proxies struct {
-	http  []int `yaml:"http"`
-	https []int `yaml:"https"`
+	HTTP  []int `yaml:"http,omitempty"`
+	HTTPS []int `yaml:"https,omitempty"`
+}
+
+// validate rejects ports listed as both http and https of a domain, whose
+// traffic can only be redirected to one of the listeners
+func (c *Config) validate() error {
+	for _, rule := range c.Proxies {
+		protocols := map[int]string{}
+		for _, proxies := range rule.Proxies {
+			for _, port := range proxies.HTTP {
+				protocols[port] = "http"
+			}
+		}
+		for _, proxies := range rule.Proxies {
+			for _, port := range proxies.HTTPS {
+				if protocols[port] == "http" {
+					return fmt.Errorf("port %d of %s is listed as both http and https", port, rule.Domain)
+				}
+			}
+		}
+	}
+	return nil
 }
 
 const (
 	redirectPortHTTP  = 5533
 	redirectPortHTTPS = 5534
-	ipTableTarget     = "nat"
-	ipTableChain      = "OUTPUT"
 )
 
-// Interface for iptables operations
-type iptablesInterface interface {
-	Exists(table, chain string, rulespec ...string) (bool, error)
-	AppendUnique(table, chain string, rulespec ...string) error
-}
-
-var resolveDomainIP = func(domain string) (string, error) {
+// resolveDomainIPs returns all IPv4 and IPv6 addresses of domain, e.g. all
+// endpoints of a headless service, sorted
+var resolveDomainIPs = func(domain string) ([]string, error) {
 	ips, err := net.LookupHost(domain)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	if len(ips) == 0 {
-		return "", fmt.Errorf("no IPs found for %s", domain)
+		return nil, fmt.Errorf("no IPs found for %s", domain)
 	}
-	return ips[0], nil
-}
-
-func iptablesRuleExists(ipt iptablesInterface, ip string, port int) bool {
-	exists, err := ipt.Exists(
-		ipTableTarget,
-		ipTableChain,
-		"-p", "tcp",
-		"-d", ip,
-		"--dport", fmt.Sprintf("%d", port),
-		"-j", "REDIRECT",
-		"--to-port", fmt.Sprintf("%d", redirectPortHTTP),
-	)
-	if err != nil {
-		log.Printf("Error checking for iptables rule %s:%d: %v", ip, port, err)
-		return false // Assume rule doesn't exist if there's an error checking
-	}
-	return exists
-}
-
-func addIptablesRule(ipt iptablesInterface, ip string, port int) error {
-	if iptablesRuleExists(ipt, ip, port) {
-		log.Printf("iptables rule already exists for %s:%d", ip, port)
-		return nil
-	}
-	ruleSpec := []string{
-		"-p", "tcp",
-		"-d", ip,
-		"--dport", fmt.Sprintf("%d", port),
-		"-j", "REDIRECT",
-		"--to-port", fmt.Sprintf("%d", redirectPortHTTP),
-	}
-	log.Printf("Adding iptables rule: %s", strings.Join(ruleSpec, " "))
-	return ipt.AppendUnique(ipTableTarget, ipTableChain, ruleSpec...)
+	slices.Sort(ips)
+	return slices.Compact(ips), nil
 }
 
 func loadConfig() (*Config, error) {
@@ -114,29 +103,135 @@ func loadConfig() (*Config, error) {
 	if err := yaml.Unmarshal(data, &cfg); err != nil {
 		return nil, err
 	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
 	return &cfg, nil
 }
 
-func applyRules(ipt iptablesInterface, cfg *Config) {
+// applyRules reconciles the redirect rules with the proxies of cfg, for all
+// addresses of their domains: missing rules are added and stale rules of
+// removed domains, ports or changed addresses deleted. The rules of domains
+// failing to resolve are kept.
+func applyRules(backend ruleBackend, cfg *Config) {
+	var desired []redirectRule
+	resolved := map[string][]string{}
+	unresolved := map[string]bool{}
 	for _, rule := range cfg.Proxies {
-		ip, err := resolveDomainIP(rule.Domain)
+		ips, err := resolveDomainIPs(rule.Domain)
 		if err != nil {
 			log.Printf("DNS lookup failed for %s: %v", rule.Domain, err)
+			iptablesRuleErrorsTotal.Inc()
+			unresolved[rule.Domain] = true
 			continue
 		}
-		for _, proxies := range rule.Proxies {
-			for _, p := range proxies.http {
-				if err := addIptablesRule(ipt, ip, p); err != nil {
-					log.Printf("Failed to add iptables rule for %s:%d: %v", ip, p, err)
+		resolved[rule.Domain] = ips
+		for _, ip := range ips {
+			for _, proxies := range rule.Proxies {
+				for _, p := range proxies.HTTP {
+					desired = append(desired, redirectRule{Domain: rule.Domain, IP: ip, Port: p})
 				}
-			}
-			for _, p := range proxies.https {
-				if err := addIptablesRule(ipt, ip, p); err != nil {
-					log.Printf("Failed to add iptables rule for %s:%d: %v", ip, p, err)
+				for _, p := range proxies.HTTPS {
+					desired = append(desired, redirectRule{Domain: rule.Domain, IP: ip, Port: p, TLS: true})
 				}
 			}
 		}
 	}
+
+	existing, err := backend.Rules()
+	if err != nil {
+		log.Printf("Failed to list redirect rules: %v", err)
+		iptablesRuleErrorsTotal.Inc()
+		return
+	}
+	installed := map[redirectRule]bool{}
+	installedIPs := map[string][]string{}
+	for _, rule := range existing {
+		installed[rule] = true
+		installedIPs[rule.Domain] = append(installedIPs[rule.Domain], rule.IP)
+	}
+	for domain, ips := range resolved {
+		previous := installedIPs[domain]
+		slices.Sort(previous)
+		previous = slices.Compact(previous)
+		if len(previous) > 0 && !slices.Equal(previous, ips) {
+			log.Printf("Addresses of %s changed from %v to %v", domain, previous, ips)
+			dnsChangesTotal.WithLabelValues(domain).Inc()
+		}
+	}
+	wanted := map[redirectRule]bool{}
+	for _, rule := range desired {
+		wanted[rule] = true
+	}
+
+	rules := 0
+	for rule := range installed {
+		if wanted[rule] {
+			continue
+		}
+		if unresolved[rule.Domain] {
+			rules++
+			continue
+		}
+		log.Printf("Removing stale redirect rule %s", rule)
+		if err := backend.Delete(rule); err != nil {
+			log.Printf("Failed to remove redirect rule %s: %v", rule, err)
+			iptablesRuleErrorsTotal.Inc()
+			rules++
+		}
+	}
+	added := map[redirectRule]bool{}
+	for _, rule := range desired {
+		if added[rule] {
+			continue
+		}
+		added[rule] = true
+		if installed[rule] {
+			rules++
+			continue
+		}
+		if err := backend.Add(rule); err != nil {
+			log.Printf("Failed to add redirect rule %s: %v", rule, err)
+			iptablesRuleErrorsTotal.Inc()
+			continue
+		}
+		rules++
+	}
+	iptablesRules.Set(float64(rules))
+}
+
+// ruleReconciler serializes the reconciliations of the redirect rules on
+// config changes and DNS refreshes
+type ruleReconciler struct {
+	mu      sync.Mutex
+	backend ruleBackend
+	cfg     *Config
+}
+
+// apply reconciles the redirect rules with cfg, or with the last config when
+// cfg is nil
+func (r *ruleReconciler) apply(cfg *Config) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cfg != nil {
+		r.cfg = cfg
+	}
+	applyRules(r.backend, r.cfg)
+}
+
+// resolveEvery calls onTick every interval until ctx is done, to re-resolve
+// the domains of the redirect rules
+func resolveEvery(ctx context.Context, interval time.Duration, onTick func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			onTick()
+		}
+	}
 }
 
 func watchConfig(ctx context.Context, path string, onChange func()) {
@@ -168,16 +263,54 @@ func watchConfig(ctx context.Context, path string, onChange func()) {
 
 // Flags
 var (
-	f_iptables       bool
-	f_configPath     string
-	f_tlsCert        string
-	f_tlsKey         string
-	f_jwksURL        string
-	f_policyPath     string
-	f_upstreamURL    string
-	f_injectionLabel string
-	f_jwtAudience    string
-	f_caBundle       string
+	f_iptables          bool
+	f_init              bool
+	f_firewall          string
+	f_transparent       bool
+	f_cleanupRules      bool
+	f_dnsRefresh        time.Duration
+	f_excludeUID        int
+	f_configPath        string
+	f_tlsCert           string
+	f_tlsKey            string
+	f_tlsCACert         string
+	f_tlsCAKey          string
+	f_jwksURL           string
+	f_jwksFile          string
+	f_policyPath        string
+	f_policyRejectEmpty bool
+	f_upstreamURL       string
+	f_injectionLabel    string
+	f_clusterLabel      string
+	f_lokiUpstream      string
+	f_lokiLabel         string
+	f_tempoUpstream     string
+	f_tempoAttribute    string
+	f_jwtAudience       string
+	f_jwtIssuer         string
+	f_jwtClockSkew      time.Duration
+	f_jwtAlgorithms     string
+	f_identityClaim     string
+	f_groupsClaim       string
+	f_groupsPrefix      string
+	f_groupMapping      string
+	f_tokenReview       bool
+	f_tokenReviewAud    string
+	f_tokenReviewTTL    time.Duration
+	f_caBundle          string
+	f_upstreamToken     string
+	f_authzBackend      string
+	f_authzCombine      string
+	f_authzStaticPath   string
+	f_authzSAR          bool
+	f_sarCluster        string
+	f_sarCacheTTL       time.Duration
+	f_sarMaxNamespaces  int
+	f_metricsAddr       string
+	f_auditLog          string
+	f_auditSampleRate   float64
+	f_auditRedact       string
+	f_auditRedactKey    string
 )
 
 func init() {
@@ -187,7 +320,31 @@ func init() {
 
 	flag.BoolVar(&f_iptables, "iptables",
 		getenvBoolOrDefault("DSPROXY_IPTABLES", true),
-		"Enable iptables support")
+		"Enable the interception of the datasource traffic with firewall redirect rules")
+
+	flag.BoolVar(&f_init, "init",
+		getenvBoolOrDefault("DSPROXY_INIT", false),
+		"Apply the redirect rules from the config file and exit (for use as an init container)")
+
+	flag.StringVar(&f_firewall, "firewall-backend",
+		getenvOrDefault("DSPROXY_FIREWALL_BACKEND", firewallBackendAuto),
+		"Firewall backend of the redirect rules: auto (nftables when the nft command works, iptables otherwise), iptables or nftables")
+
+	flag.BoolVar(&f_transparent, "transparent",
+		getenvBoolOrDefault("DSPROXY_TRANSPARENT", false),
+		"Route the intercepted traffic to dsproxy with TPROXY instead of REDIRECT, keeping its original destination; requires the nftables backend and NET_ADMIN for dsproxy")
+
+	flag.BoolVar(&f_cleanupRules, "cleanup-rules",
+		getenvBoolOrDefault("DSPROXY_CLEANUP_RULES", false),
+		"Remove the redirect rules on shutdown; left in place, the intercepted traffic fails instead of bypassing dsproxy while it restarts")
+
+	flag.DurationVar(&f_dnsRefresh, "dns-refresh-interval",
+		getenvDurationOrDefault("DSPROXY_DNS_REFRESH_INTERVAL", 30*time.Second),
+		"How often the domains of the redirect rules are resolved again, reconciling the rules with their current addresses; disabled when 0")
+
+	flag.IntVar(&f_excludeUID, "exclude-uid",
+		getenvIntOrDefault("DSPROXY_EXCLUDE_UID", -1),
+		"UID whose traffic is not redirected, i.e. the UID dsproxy runs as; disabled when negative")
 
 	flag.StringVar(&f_tlsCert, "tls-cert",
 		getenvOrDefault("DSPROXY_TLS_CERT", "/etc/dsproxy/tls/tls.crt"),
@@ -197,14 +354,59 @@ func init() {
 		getenvOrDefault("DSPROXY_TLS_KEY", "/etc/dsproxy/tls/tls.key"),
 		"Path to TLS key file")
 
+	flag.StringVar(&f_tlsCACert, "tls-ca-cert",
+		getenvOrDefault("DSPROXY_TLS_CA_CERT", ""),
+		"Path to the certificate of a CA issuing the certificates of the intercepted HTTPS hosts by SNI; --tls-cert serves connections without SNI")
+
+	flag.StringVar(&f_tlsCAKey, "tls-ca-key",
+		getenvOrDefault("DSPROXY_TLS_CA_KEY", ""),
+		"Path to the key of the --tls-ca-cert CA")
+
 	flag.StringVar(&f_jwksURL, "jwks-url",
 		getenvOrDefault("DSPROXY_JWKS_URL", "https://oidc/.well-known/openid-configuration"),
-		"OIDC discovery URL")
+		"Comma separated OIDC discovery URLs of the accepted issuers")
+
+	flag.StringVar(&f_jwksFile, "jwks-file",
+		getenvOrDefault("DSPROXY_JWKS_FILE", ""),
+		"Path to a static JWKS file of the --jwt-issuer, e.g. for air-gapped setups; reloaded when it changes")
 
 	flag.StringVar(&f_policyPath, "policy-path",
 		getenvOrDefault("DSPROXY_POLICY_PATH", "/etc/dsproxy/policy"),
 		"Path to policy directory")
 
+	flag.BoolVar(&f_policyRejectEmpty, "policy-reject-empty",
+		getenvBoolOrDefault("DSPROXY_POLICY_REJECT_EMPTY", false),
+		"Keep the previous Casbin policy when a reload has no rules, e.g. to guard against half-written files; disables revoking the last grant")
+
+	flag.StringVar(&f_authzBackend, "authz-backend",
+		getenvOrDefault("DSPROXY_AUTHZ_BACKEND", "casbin"),
+		"Comma separated authorization backends: casbin (--policy-path), sar (SubjectAccessReviews against the Kubernetes API) or static (--authz-static-path)")
+
+	flag.StringVar(&f_authzCombine, "authz-combine",
+		getenvOrDefault("DSPROXY_AUTHZ_COMBINE", "union"),
+		"How multiple --authz-backend results are combined: union or intersection")
+
+	flag.StringVar(&f_authzStaticPath, "authz-static-path",
+		getenvOrDefault("DSPROXY_AUTHZ_STATIC_PATH", "/etc/dsproxy/policy/static.yaml"),
+		"Path to the rules of the static authorization backend")
+
+	flag.BoolVar(&f_authzSAR, "authz-sar",
+		getenvBoolOrDefault("DSPROXY_AUTHZ_SAR", false),
+		"Authorize with SubjectAccessReviews against the Kubernetes API instead of the policy")
+	_ = flag.CommandLine.MarkDeprecated("authz-sar", "use --authz-backend=sar instead")
+
+	flag.StringVar(&f_sarCluster, "sar-cluster",
+		getenvOrDefault("DSPROXY_SAR_CLUSTER", "local-cluster"),
+		"Cluster name the namespaces allowed by the sar backend are granted in")
+
+	flag.DurationVar(&f_sarCacheTTL, "sar-cache-ttl",
+		getenvDurationOrDefault("DSPROXY_SAR_CACHE_TTL", time.Minute),
+		"How long the namespaces allowed by the sar backend are cached per user and groups")
+
+	flag.IntVar(&f_sarMaxNamespaces, "sar-max-namespaces",
+		getenvIntOrDefault("DSPROXY_SAR_MAX_NAMESPACES", 500),
+		"Most namespaces the sar backend reviews per lookup, each costing up to two SubjectAccessReviews; lookups fail in clusters with more namespaces. Unlimited when 0")
+
 	flag.StringVar(&f_upstreamURL, "upstream-url",
 		getenvOrDefault("DSPROXY_UPSTREAM_URL", "http://localhost:9090"),
 		"Upstream Prometheus URL")
@@ -213,13 +415,97 @@ func init() {
 		getenvOrDefault("DSPROXY_INJECTION_LABEL", "namespace"),
 		"Label name to inject for multi-tenancy (e.g., namespace, tenant)")
 
+	flag.StringVar(&f_clusterLabel, "cluster-label",
+		getenvOrDefault("DSPROXY_CLUSTER_LABEL", ""),
+		"Cluster label name to enforce together with --injection-label for multi-cluster datasources (e.g., cluster); disabled when empty")
+
+	flag.StringVar(&f_lokiUpstream, "loki-upstream-url",
+		getenvOrDefault("DSPROXY_LOKI_UPSTREAM_URL", ""),
+		"Upstream Loki URL for datasources with X-Datasource-Type: loki; defaults to --upstream-url when empty")
+
+	flag.StringVar(&f_lokiLabel, "loki-injection-label",
+		getenvOrDefault("DSPROXY_LOKI_INJECTION_LABEL", "kubernetes_namespace_name"),
+		"Stream label name to inject into LogQL queries for multi-tenancy")
+
+	flag.StringVar(&f_tempoUpstream, "tempo-upstream-url",
+		getenvOrDefault("DSPROXY_TEMPO_UPSTREAM_URL", ""),
+		"Upstream Tempo URL for datasources with X-Datasource-Type: tempo; defaults to --upstream-url when empty")
+
+	flag.StringVar(&f_tempoAttribute, "tempo-namespace-attribute",
+		getenvOrDefault("DSPROXY_TEMPO_NAMESPACE_ATTRIBUTE", "resource.k8s.namespace.name"),
+		"Resource attribute holding the namespace, enforced on TraceQL queries and trace responses")
+
 	flag.StringVar(&f_jwtAudience, "jwt-audience",
 		getenvOrDefault("DSPROXY_JWT_AUDIENCE", "example-app"),
-		"Expected JWT audience claim")
+		"Comma separated accepted JWT audiences; the aud claim must contain one of them")
+
+	flag.StringVar(&f_jwtIssuer, "jwt-issuer",
+		getenvOrDefault("DSPROXY_JWT_ISSUER", ""),
+		"Issuer of the --jwks-file keys, or the expected issuer of a single --jwks-url; defaults to the issuer of the OIDC discovery document")
+
+	flag.DurationVar(&f_jwtClockSkew, "jwt-clock-skew",
+		getenvDurationOrDefault("DSPROXY_JWT_CLOCK_SKEW", 30*time.Second),
+		"Clock skew tolerated when checking the exp, nbf and iat claims")
+
+	flag.StringVar(&f_jwtAlgorithms, "jwt-algorithms",
+		getenvOrDefault("DSPROXY_JWT_ALGORITHMS", "RS256,RS384,RS512,PS256,PS384,PS512,ES256,ES384,ES512,EdDSA"),
+		"Comma separated JWT signing algorithms accepted")
+
+	flag.StringVar(&f_identityClaim, "identity-claim",
+		getenvOrDefault("DSPROXY_IDENTITY_CLAIM", "sub"),
+		"JWT claim authorized as the identity, e.g. preferred_username")
+
+	flag.StringVar(&f_groupsClaim, "groups-claim",
+		getenvOrDefault("DSPROXY_GROUPS_CLAIM", "groups"),
+		"JWT claim holding the groups, nested claims as a path, e.g. realm_access.roles or $['https://example.com/groups']")
+
+	flag.StringVar(&f_groupsPrefix, "groups-prefix",
+		getenvOrDefault("DSPROXY_GROUPS_PREFIX", ""),
+		"Prefix prepended to the groups without a group mapping, e.g. oidc:")
+
+	flag.StringVar(&f_groupMapping, "group-mapping",
+		getenvOrDefault("DSPROXY_GROUP_MAPPING", ""),
+		"Path to a YAML file mapping group claim values to the group names used in policies")
+
+	flag.BoolVar(&f_tokenReview, "token-review",
+		getenvBoolOrDefault("DSPROXY_TOKEN_REVIEW", false),
+		"Authenticate bearer tokens not issued by the OIDC issuer, e.g. service account tokens, with the Kubernetes TokenReview API")
+
+	flag.StringVar(&f_tokenReviewAud, "token-review-audiences",
+		getenvOrDefault("DSPROXY_TOKEN_REVIEW_AUDIENCES", ""),
+		"Comma separated audiences TokenReviews require; the API server's when empty")
+
+	flag.DurationVar(&f_tokenReviewTTL, "token-review-cache-ttl",
+		getenvDurationOrDefault("DSPROXY_TOKEN_REVIEW_CACHE_TTL", 5*time.Minute),
+		"How long an authenticated token is cached at most, tokens are cached until they expire otherwise")
+
+	flag.StringVar(&f_metricsAddr, "metrics-addr",
+		getenvOrDefault("DSPROXY_METRICS_ADDR", ":5535"),
+		"Address serving /metrics, /healthz and /readyz; disabled when empty")
+
+	flag.StringVar(&f_auditLog, "audit-log",
+		getenvOrDefault("DSPROXY_AUDIT_LOG", ""),
+		"Path of the JSON lines audit log of the proxied requests, - for stdout; disabled when empty")
+
+	flag.Float64Var(&f_auditSampleRate, "audit-sample-rate",
+		getenvFloatOrDefault("DSPROXY_AUDIT_SAMPLE_RATE", 1),
+		"Fraction of allowed requests recorded in the audit log; denied and failed requests are always recorded")
+
+	flag.StringVar(&f_auditRedact, "audit-redact",
+		getenvOrDefault("DSPROXY_AUDIT_REDACT", ""),
+		"Comma separated audit log fields replaced by their hash: subject, groups, query")
+
+	flag.StringVar(&f_auditRedactKey, "audit-redact-key-file",
+		getenvOrDefault("DSPROXY_AUDIT_REDACT_KEY_FILE", ""),
+		"Path to the HMAC key of the redacted audit log fields, at least 16 bytes; a random key per process when empty")
 
 	flag.StringVar(&f_caBundle, "ca-bundle",
 		getenvOrDefault("DSPROXY_CA_BUNDLE", ""),
-		"Path to CA bundle file for verifying upstream and JWKS certificates")
+		"Path to CA bundle file for verifying the certificates of the JWKS and of the upstreams without a caBundle")
+
+	flag.StringVar(&f_upstreamToken, "upstream-token-file",
+		getenvOrDefault("DSPROXY_UPSTREAM_TOKEN_FILE", ""),
+		"Path to the bearer token sent to the upstreams in place of the token of the user; read on every request so that rotated tokens are used, disabled when empty")
 }
 
 func getenvOrDefault(envVar, fallback string) string {
@@ -229,6 +515,33 @@ func getenvOrDefault(envVar, fallback string) string {
 	return fallback
 }
 
+func getenvIntOrDefault(envVar string, fallback int) int {
+	if val := os.Getenv(envVar); val != "" {
+		if i, err := strconv.Atoi(val); err == nil {
+			return i
+		}
+	}
+	return fallback
+}
+
+func getenvDurationOrDefault(envVar string, fallback time.Duration) time.Duration {
+	if val := os.Getenv(envVar); val != "" {
+		if d, err := time.ParseDuration(val); err == nil {
+			return d
+		}
+	}
+	return fallback
+}
+
+func getenvFloatOrDefault(envVar string, fallback float64) float64 {
+	if val := os.Getenv(envVar); val != "" {
+		if f, err := strconv.ParseFloat(val, 64); err == nil {
+			return f
+		}
+	}
+	return fallback
+}
+
 func getenvBoolOrDefault(envVar string, fallback bool) bool {
 	if val := os.Getenv(envVar); val != "" {
 		return val == "1" || val == "true" || val == "TRUE"
@@ -236,53 +549,102 @@ func getenvBoolOrDefault(envVar string, fallback bool) bool {
 	return fallback
 }
 
-func startServers(authzService *AuthzService, promProxy http.Handler) (httpServer, httpsServer *http.Server) {
-	mux := http.NewServeMux()
-
-	// Middleware chain: auth -> authz -> prom-label-proxy
-	// 1. authMiddleware: validates JWT and extracts sub/groups
-	// 2. authzMiddleware: checks policy.csv and populates allowed cluster/namespace pairs
-	// 3. prom-label-proxy: injects namespace labels based on authorized resources
+// proxyHandler builds the middleware chain: audit -> auth -> authz -> enforcing proxy
+//  1. audit middleware: records the request and its decision, when enabled
+//  2. authMiddleware: validates JWT and extracts sub/groups
+//  3. authzMiddleware: checks policy.csv and populates allowed cluster/namespace pairs
+//  4. label injection proxy: injects namespace labels based on authorized resources,
+//     routed to the Prometheus, Loki or Tempo proxy by datasource type
+func proxyHandler(authzService *AuthzService, promProxy http.Handler) http.Handler {
 	handler := authMiddleware(
 		authzService.authzMiddleware("read")(
 			promProxy,
 		),
 	)
+	if audit != nil {
+		handler = audit.middleware(handler)
+	}
+	return instrumentHandler(handler)
+}
 
-	mux.Handle("/", handler)
+// listenLoopback listens on port of the IPv4 and IPv6 loopback addresses,
+// the destinations of the redirect rules. IPv6 is skipped when unavailable.
+// In transparent mode the sockets accept the connections handed to them by
+// TPROXY.
+func listenLoopback(port int) ([]net.Listener, error) {
+	lc := net.ListenConfig{}
+	if f_transparent {
+		lc.Control = transparentControl
+	}
+	l, err := lc.Listen(context.Background(), "tcp4", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return nil, err
+	}
+	listeners := []net.Listener{l}
+	if l6, err := lc.Listen(context.Background(), "tcp6", fmt.Sprintf("[::1]:%d", port)); err != nil {
+		log.Printf("Not listening on [::1]:%d, IPv6 traffic cannot be redirected: %v", port, err)
+	} else {
+		listeners = append(listeners, l6)
+	}
+	return listeners, nil
+}
+
+// tlsEnabled reports whether a certificate or a CA is configured for the
+// HTTPS listener
+func tlsEnabled() bool {
+	return (f_tlsCert != "" && f_tlsKey != "") || (f_tlsCACert != "" && f_tlsCAKey != "")
+}
+
+// startServers starts the listeners the redirect rules point at. The HTTPS
+// listener terminates the intercepted TLS connections, the upstream
+// connections are TLS again when the upstream URL is https.
+func startServers(authzService *AuthzService, promProxy http.Handler) (httpServer, httpsServer *http.Server) {
+	mux := http.NewServeMux()
+	mux.Handle("/", proxyHandler(authzService, promProxy))
 
 	httpServer = &http.Server{
 		Addr:    fmt.Sprintf("127.0.0.1:%d", redirectPortHTTP),
 		Handler: mux,
 	}
 	log.Println("Starting HTTP server on port", redirectPortHTTP)
+	listeners, err := listenLoopback(redirectPortHTTP)
+	if err != nil {
+		log.Fatalf("HTTP server error: %v", err)
+	}
+	for _, l := range listeners {
+		go func() {
+			if err := httpServer.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("HTTP server error: %v", err)
+			}
+			log.Printf("Stopped serving new HTTP connections on %s.", l.Addr())
+		}()
+	}
 
-	go func() {
-		if err := httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
-			log.Fatalf("HTTP server error: %v", err)
+	if tlsEnabled() {
+		certificates, err := newServerCertificates(f_tlsCert, f_tlsKey, f_tlsCACert, f_tlsCAKey)
+		if err != nil {
+			log.Fatalf("HTTPS server error: %v", err)
 		}
-		log.Println("Stopped serving new HTTP connections.")
-	}()
-
-	if f_tlsCert != "" && f_tlsKey != "" {
 		httpsMux := http.NewServeMux()
-		httpsHandler := authMiddleware(
-			authzService.authzMiddleware("read")(
-				promProxy,
-			),
-		)
-		httpsMux.Handle("/", httpsHandler)
+		httpsMux.Handle("/", proxyHandler(authzService, promProxy))
 		httpsServer = &http.Server{
-			Addr:    fmt.Sprintf("127.0.0.1:%d", redirectPortHTTPS),
-			Handler: httpsMux,
+			Addr:      fmt.Sprintf("127.0.0.1:%d", redirectPortHTTPS),
+			Handler:   httpsMux,
+			TLSConfig: &tls.Config{GetCertificate: certificates.GetCertificate},
 		}
 		log.Println("Starting HTTPS server on port", redirectPortHTTPS)
-		go func() {
-			if err := httpsServer.ListenAndServeTLS(f_tlsCert, f_tlsKey); !errors.Is(err, http.ErrServerClosed) {
-				log.Fatalf("HTTPS server error: %v", err)
-			}
-			log.Println("Stopped serving new HTTPS connections.")
-		}()
+		listeners, err := listenLoopback(redirectPortHTTPS)
+		if err != nil {
+			log.Fatalf("HTTPS server error: %v", err)
+		}
+		for _, l := range listeners {
+			go func() {
+				if err := httpsServer.ServeTLS(l, "", ""); !errors.Is(err, http.ErrServerClosed) {
+					log.Fatalf("HTTPS server error: %v", err)
+				}
+				log.Printf("Stopped serving new HTTPS connections on %s.", l.Addr())
+			}()
+		}
 	}
 	return httpServer, httpsServer
 }
@@ -290,9 +652,9 @@ func startServers(authzService *AuthzService, promProxy http.Handler) (httpServe
 func main() {
 	flag.Parse()
 	if f_iptables {
-		log.Println("Iptables support enabled")
+		log.Printf("Traffic interception enabled: backend=%s, transparent=%t", f_firewall, f_transparent)
 	}
-	if f_tlsCert != "" && f_tlsKey != "" {
+	if tlsEnabled() {
 		log.Println("TLS support enabled")
 	} else {
 		log.Println("TLS support disabled")
@@ -300,7 +662,9 @@ func main() {
 	log.Println("Config file path:", f_configPath)
 	log.Println("TLS certificate path:", f_tlsCert)
 	log.Println("TLS key path:", f_tlsKey)
+	log.Println("TLS CA certificate path:", f_tlsCACert)
 	log.Println("JWKS URL:", f_jwksURL)
+	log.Println("JWKS file:", f_jwksFile)
 	log.Println("Policy path:", f_policyPath)
 	log.Println("Redirect port HTTP:", redirectPortHTTP)
 	log.Println("Redirect port HTTPS:", redirectPortHTTPS)
@@ -310,12 +674,16 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	var ipt iptablesInterface
+	var backend ruleBackend
 	var err error
 
+	if f_init && !f_iptables {
+		log.Fatal("Init mode requires --iptables")
+	}
+
 	if f_iptables {
 		if os.Geteuid() != 0 {
-			log.Fatal("Run as root for iptables support")
+			log.Fatal("Run as root for traffic interception")
 		}
 
 		if f_configPath == "" {
@@ -324,48 +692,173 @@ func main() {
 		if _, err := os.Stat(f_configPath); os.IsNotExist(err) {
 			log.Fatalf("Config file does not exist: %s", f_configPath)
 		}
-		ipt, err = iptables.New()
+		backend, err = newRuleBackend(f_firewall, f_transparent)
 		if err != nil {
-			log.Fatalf("Failed to initialize iptables: %v", err)
+			log.Fatalf("Failed to initialize the firewall backend: %v", err)
 		}
+	}
 
-		cfg, err := loadConfig()
+	// The config file is optional without interception; it may still define datasources
+	var cfg *Config
+	if _, err := os.Stat(f_configPath); err == nil {
+		cfg, err = loadConfig()
 		if err != nil {
 			log.Fatalf("Failed to load config: %v", err)
 		}
-		applyRules(ipt, cfg)
 	}
 
+	if cfg != nil && !f_init && !tlsEnabled() {
+		for _, rule := range cfg.Proxies {
+			for _, proxies := range rule.Proxies {
+				if len(proxies.HTTPS) > 0 {
+					log.Printf("HTTPS ports of %s are intercepted, but TLS support is disabled", rule.Domain)
+				}
+			}
+		}
+	}
+	var rules *ruleReconciler
 	if f_iptables {
-		// Watch for config changes
-		go watchConfig(ctx, f_configPath, func() {
-			newCfg, err := loadConfig()
+		rules = &ruleReconciler{backend: backend}
+		rules.apply(cfg)
+	}
+	if f_init {
+		log.Println("Init mode, redirect rules applied, exiting")
+		return
+	}
+	if rules != nil && f_dnsRefresh > 0 {
+		log.Printf("Resolving the domains of the redirect rules every %s", f_dnsRefresh)
+		go resolveEvery(ctx, f_dnsRefresh, func() { rules.apply(nil) })
+	} else if rules == nil {
+		log.Println("Redirect rules are not managed, e.g. when applied by an init container: they are neither re-resolved nor cleaned up")
+	}
+
+	// Serve health and metrics first, so that readiness fails until the
+	// policy and JWKS are loaded
+	var metricsServer *http.Server
+	if f_metricsAddr != "" {
+		metricsServer = startMetricsServer(f_metricsAddr)
+	}
+
+	if f_authzSAR {
+		f_authzBackend = "sar"
+	}
+	authorizer, err := newAuthorizer(ctx, f_authzBackend, f_authzCombine)
+	if err != nil {
+		log.Fatalf("Failed to initialize authorization service: %v", err)
+	}
+	authzService := &AuthzService{authorizer: authorizer}
+	policyLoaded.Store(true)
+
+	if f_auditLog != "" {
+		out, err := openAuditLog(f_auditLog)
+		if err != nil {
+			log.Fatalf("Failed to open audit log: %v", err)
+		}
+		var redactKey []byte
+		if f_auditRedactKey != "" {
+			redactKey, err = readAuditRedactKey(f_auditRedactKey)
 			if err != nil {
-				log.Printf("Reload failed: %v", err)
-				return
+				log.Fatalf("Failed to initialize audit log: %v", err)
 			}
-			applyRules(ipt, newCfg)
-		})
+		}
+		audit, err = newAuditLogger(out, f_auditSampleRate, strings.Split(f_auditRedact, ","), redactKey)
+		if err != nil {
+			log.Fatalf("Failed to initialize audit log: %v", err)
+		}
+		log.Printf("Audit log: %s, sample rate=%v, redact=%q", f_auditLog, f_auditSampleRate, f_auditRedact)
 	}
 
-	authzService, err := NewAuthzService(ctx, f_policyPath)
+	claimMapping, err = newClaimMapper(f_identityClaim, f_groupsClaim, f_groupsPrefix, f_groupMapping)
 	if err != nil {
-		log.Fatalf("Failed to initialize authorization service: %v", err)
+		log.Fatalf("Failed to initialize claim mapping: %v", err)
 	}
+	log.Printf("Claim mapping: identity=%s, groups=%s, prefix=%q, mapping=%q", f_identityClaim, f_groupsClaim, f_groupsPrefix, f_groupMapping)
 
-	// Initialize JWKS before serving requests
-	if err := initJWKS(); err != nil {
+	if f_tokenReview {
+		client, err := newKubernetesClient()
+		if err != nil {
+			log.Fatalf("Failed to initialize TokenReview authentication: %v", err)
+		}
+		tokenReviewer = newTokenReviewAuthenticator(client, splitList(f_tokenReviewAud), f_tokenReviewTTL)
+		log.Printf("Authenticating tokens not issued by the OIDC issuer with TokenReviews: audiences=%q, cache ttl=%s", f_tokenReviewAud, f_tokenReviewTTL)
+	}
+
+	// Acquire the JWKS in the background, readiness fails until it is loaded
+	caTransport, err := newCABundleTransport(ctx, f_caBundle)
+	if err != nil {
+		log.Fatalf("Failed to load CA bundle: %v", err)
+	}
+	providers, err := newJWKSProviders(splitList(f_jwksURL), f_jwksFile, f_jwtIssuer, &http.Client{Transport: caTransport})
+	if err != nil {
 		log.Fatalf("Failed to initialize JWKS: %v", err)
 	}
+	initJWKS(ctx, providers)
+
+	// All proxies forward with the same transport. Upstreams without a
+	// caBundle of their own are verified with --ca-bundle.
+	transport := newUpstreamTransport(caTransport)
 
 	// Create Prometheus proxy with label injection
-	promProxy, err := newPrometheusProxy(f_upstreamURL, f_injectionLabel)
+	var promProxy http.Handler
+	if f_clusterLabel != "" {
+		promProxy, err = newClusterAwarePrometheusProxy(f_upstreamURL, f_clusterLabel, f_injectionLabel, transport)
+	} else {
+		promProxy, err = newPrometheusProxy(f_upstreamURL, f_injectionLabel, transport)
+	}
 	if err != nil {
 		log.Fatalf("Failed to create Prometheus proxy: %v", err)
 	}
-	log.Printf("Prometheus proxy created: upstream=%s, label=%s", f_upstreamURL, f_injectionLabel)
+	log.Printf("Prometheus proxy created: upstream=%s, label=%s, cluster label=%s", f_upstreamURL, f_injectionLabel, f_clusterLabel)
+
+	// Create Loki proxy with stream selector injection
+	lokiUpstream := f_lokiUpstream
+	if lokiUpstream == "" {
+		lokiUpstream = f_upstreamURL
+	}
+	lokiProxy, err := newLokiProxy(lokiUpstream, f_lokiLabel, transport)
+	if err != nil {
+		log.Fatalf("Failed to create Loki proxy: %v", err)
+	}
+	log.Printf("Loki proxy created: upstream=%s, label=%s", lokiUpstream, f_lokiLabel)
+
+	// Create Tempo proxy with TraceQL and trace-by-ID enforcement
+	tempoUpstream := f_tempoUpstream
+	if tempoUpstream == "" {
+		tempoUpstream = f_upstreamURL
+	}
+	tempoProxy, err := newTempoProxy(tempoUpstream, f_tempoAttribute, transport)
+	if err != nil {
+		log.Fatalf("Failed to create Tempo proxy: %v", err)
+	}
+	log.Printf("Tempo proxy created: upstream=%s, attribute=%s", tempoUpstream, f_tempoAttribute)
+
+	// Datasources from the config file take precedence over the flag upstreams
+	proxy := newDatasourceRouter(newDatasourceTypeRouter(map[string]http.Handler{
+		DataSourceTypeLoki:  lokiProxy,
+		DataSourceTypeTempo: tempoProxy,
+	}, promProxy))
+	if cfg != nil {
+		if err := proxy.update(cfg.Datasources, transport); err != nil {
+			log.Fatalf("Failed to configure datasources: %v", err)
+		}
+
+		// Watch for config changes
+		go watchConfig(ctx, f_configPath, func() {
+			newCfg, err := loadConfig()
+			if err != nil {
+				log.Printf("Reload failed: %v", err)
+				return
+			}
+			if rules != nil {
+				rules.apply(newCfg)
+			}
+			if err := proxy.update(newCfg.Datasources, transport); err != nil {
+				log.Printf("Datasource reload failed, keeping previous routes: %v", err)
+			}
+		})
+	}
 
-	httpServer, httpsServer := startServers(authzService, promProxy)
+	httpServer, httpsServer := startServers(authzService, proxy)
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
@@ -384,5 +877,17 @@ func main() {
 			log.Fatalf("HTTPS shutdown error: %v", err)
 		}
 	}
+	if metricsServer != nil {
+		if err := metricsServer.Shutdown(shutdownCtx); err != nil {
+			log.Fatalf("Metrics shutdown error: %v", err)
+		}
+	}
+	if backend != nil && f_cleanupRules {
+		if err := backend.Cleanup(); err != nil {
+			log.Printf("Failed to remove the redirect rules: %v", err)
+		} else {
+			log.Println("Redirect rules removed")
+		}
+	}
 	log.Println("Graceful shutdown complete.")
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
@@ -14,41 +15,64 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gopkg.in/yaml.v3"
 )
 
-// --- Fake iptables for testing ---
+// --- Fake firewall backend for testing ---
 
-type fakeIPTables struct {
-	existsRules  map[string]bool
-	appendCalled []string
-	appendErr    error
-	existsErr    error
+type fakeRuleBackend struct {
+	rules   map[redirectRule]bool
+	added   []redirectRule
+	deleted []redirectRule
+	addErr  error
+	listErr error
 }
 
-func newFakeIPTables() *fakeIPTables {
-	return &fakeIPTables{
-		existsRules:  make(map[string]bool),
-		appendCalled: []string{},
+func newFakeRuleBackend(rules ...redirectRule) *fakeRuleBackend {
+	f := &fakeRuleBackend{rules: map[redirectRule]bool{}}
+	for _, rule := range rules {
+		f.rules[rule] = true
 	}
+	return f
 }
 
-func (f *fakeIPTables) Exists(table, chain string, rulespec ...string) (bool, error) {
-	key := fmt.Sprintf("%s|%s|%v", table, chain, rulespec)
-	if f.existsErr != nil {
-		return false, f.existsErr
+func (f *fakeRuleBackend) Rules() ([]redirectRule, error) {
+	if f.listErr != nil {
+		return nil, f.listErr
 	}
-	return f.existsRules[key], nil
+	var rules []redirectRule
+	for rule := range f.rules {
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (f *fakeRuleBackend) Add(rule redirectRule) error {
+	f.added = append(f.added, rule)
+	if f.addErr != nil {
+		return f.addErr
+	}
+	f.rules[rule] = true
+	return nil
+}
+
+func (f *fakeRuleBackend) Delete(rule redirectRule) error {
+	f.deleted = append(f.deleted, rule)
+	delete(f.rules, rule)
+	return nil
 }
 
-func (f *fakeIPTables) AppendUnique(table, chain string, rulespec ...string) error {
-	key := fmt.Sprintf("%s|%s|%v", table, chain, rulespec)
-	f.appendCalled = append(f.appendCalled, key)
-	return f.appendErr
+func (f *fakeRuleBackend) Cleanup() error {
+	f.rules = map[redirectRule]bool{}
+	return nil
 }
 
 // Generate a temporary TLS cert and key for testing
@@ -133,6 +157,18 @@ var _ = Describe("startServers", func() {
 	AfterEach(func() {
 		f_tlsCert = origFTlsCert
 		f_tlsKey = origFTlsKey
+
+		// Closing a server closes its listeners once they are served, wait
+		// for the ports to be released before starting the next servers
+		for _, port := range []int{redirectPortHTTP, redirectPortHTTPS} {
+			Eventually(func() error {
+				l, err := net.Listen("tcp4", fmt.Sprintf("127.0.0.1:%d", port))
+				if err != nil {
+					return err
+				}
+				return l.Close()
+			}).Should(Succeed())
+		}
 	})
 
 	It("should return a non-nil HTTP server", func() {
@@ -156,7 +192,6 @@ var _ = Describe("startServers", func() {
 			w.WriteHeader(http.StatusOK)
 		})
 		httpSrv, httpsSrv := startServers(authService, mockProxy)
-		fmt.Fprintf(GinkgoWriter, "httpSrv: %+v, httpsSrv: %+v\n", httpSrv, httpsSrv)
 		Expect(httpSrv).ToNot(BeNil())
 		Expect(httpsSrv).ToNot(BeNil())
 		Expect(httpSrv.Addr).To(ContainSubstring(fmt.Sprintf("%d", redirectPortHTTP)))
@@ -186,148 +221,186 @@ var _ = Describe("startServers", func() {
 	})
 })
 
-var _ = Describe("iptables rule management", func() {
-	var fake *fakeIPTables
+var _ = Describe("loadConfig", func() {
+	var origConfigPath string
 
 	BeforeEach(func() {
-		fake = newFakeIPTables()
-	})
-
-	It("should detect existing iptables rule", func() {
-		ip := "1.2.3.4"
-		port := 80
-		key := fmt.Sprintf("nat|OUTPUT|[%s %s %s %s %s %s %s %s %s %s]",
-			"-p", "tcp", "-d", ip, "--dport", fmt.Sprintf("%d", port), "-j", "REDIRECT", "--to-port", fmt.Sprintf("%d", redirectPortHTTP))
-		fake.existsRules[key] = true
-		Expect(iptablesRuleExists(fake, ip, port)).To(BeTrue())
+		origConfigPath = f_configPath
+		f_configPath = filepath.Join(GinkgoT().TempDir(), "dsproxy.yaml")
 	})
 
-	It("should add iptables rule if not exists", func() {
-		ip := "1.2.3.4"
-		port := 80
-		Expect(addIptablesRule(fake, ip, port)).To(Succeed())
-		Expect(fake.appendCalled).To(HaveLen(1))
+	AfterEach(func() {
+		f_configPath = origConfigPath
 	})
 
-	It("should not add rule if already exists", func() {
-		ip := "1.2.3.4"
-		port := 80
-		key := fmt.Sprintf("nat|OUTPUT|[%s %s %s %s %s %s %s %s %s %s]",
-			"-p", "tcp", "-d", ip, "--dport", fmt.Sprintf("%d", port), "-j", "REDIRECT", "--to-port", fmt.Sprintf("%d", redirectPortHTTP))
-		fake.existsRules[key] = true
-		Expect(addIptablesRule(fake, ip, port)).To(Succeed())
-		Expect(fake.appendCalled).To(HaveLen(0))
+	It("should load the http and https ports of the proxies", func() {
+		Expect(os.WriteFile(f_configPath, []byte(`proxies:
+  - domain: example.com
+    proxies:
+      - http: [80, 8080]
+        https: [443, 8443]
+  - domain: another.com
+    proxies:
+      - https: [443]
+`), 0644)).To(Succeed())
+		cfg, err := loadConfig()
+		Expect(err).To(BeNil())
+		Expect(cfg.Proxies).To(Equal([]ProxyRule{
+			{Domain: "example.com", Proxies: []Proxies{{HTTP: []int{80, 8080}, HTTPS: []int{443, 8443}}}},
+			{Domain: "another.com", Proxies: []Proxies{{HTTPS: []int{443}}}},
+		}))
 	})
 
-	It("should handle error from Exists", func() {
-		ip := "1.2.3.4"
-		port := 80
-		fake.existsErr = errors.New("fail")
-		Expect(iptablesRuleExists(fake, ip, port)).To(BeFalse())
+	It("should round-trip the config", func() {
+		cfg := &Config{
+			Proxies: []ProxyRule{
+				{Domain: "example.com", Proxies: []Proxies{{HTTP: []int{80}, HTTPS: []int{443}}}},
+				{Domain: "another.com", Proxies: []Proxies{{HTTPS: []int{8443}}}},
+			},
+			Datasources: []DatasourceUpstream{
+				{UID: "prometheus", Type: "prometheus", URL: "https://example.com:443", InjectionLabel: "namespace"},
+			},
+		}
+		data, err := yaml.Marshal(cfg)
+		Expect(err).To(BeNil())
+		Expect(os.WriteFile(f_configPath, data, 0644)).To(Succeed())
+		loaded, err := loadConfig()
+		Expect(err).To(BeNil())
+		Expect(loaded).To(Equal(cfg))
 	})
 
-	It("should return error if AppendUnique fails", func() {
-		ip := "1.2.3.4"
-		port := 80
-		fake.appendErr = errors.New("append fail")
-		Expect(addIptablesRule(fake, ip, port)).ToNot(Succeed())
+	It("should reject a port listed as both http and https", func() {
+		Expect(os.WriteFile(f_configPath, []byte(`proxies:
+  - domain: example.com
+    proxies:
+      - http: [9091]
+      - https: [9091]
+`), 0644)).To(Succeed())
+		_, err := loadConfig()
+		Expect(err).To(MatchError(ContainSubstring("port 9091 of example.com is listed as both http and https")))
 	})
 })
 
-var _ = Describe("resolveDomainIP", func() {
+var _ = Describe("resolveDomainIPs", func() {
 	It("should resolve a valid domain", func() {
-		ip, err := resolveDomainIP("localhost")
+		ips, err := resolveDomainIPs("localhost")
 		Expect(err).To(BeNil())
-		Expect(net.ParseIP(ip)).ToNot(BeNil())
+		Expect(ips).ToNot(BeEmpty())
+		for _, ip := range ips {
+			Expect(net.ParseIP(ip)).ToNot(BeNil())
+		}
 	})
 
 	It("should fail for invalid domain", func() {
-		_, err := resolveDomainIP("nonexistent.invalid.domain")
+		_, err := resolveDomainIPs("nonexistent.invalid.domain")
 		Expect(err).ToNot(BeNil())
 	})
 })
 
 var _ = Describe("applyRules", func() {
 	var (
-		fake                *fakeIPTables
-		origResolveDomainIP func(string) (string, error)
+		fake                 *fakeRuleBackend
+		origResolveDomainIPs func(string) ([]string, error)
 	)
 
 	BeforeEach(func() {
-		fake = newFakeIPTables()
-		origResolveDomainIP = resolveDomainIP
+		fake = newFakeRuleBackend()
+		origResolveDomainIPs = resolveDomainIPs
 	})
 
 	AfterEach(func() {
-		resolveDomainIP = origResolveDomainIP
+		resolveDomainIPs = origResolveDomainIPs
 	})
 
 	It("should add rules for all http and https ports", func() {
-		resolveDomainIP = func(domain string) (string, error) {
-			return "1.2.3.4", nil
+		resolveDomainIPs = func(domain string) ([]string, error) {
+			return []string{"1.2.3.4"}, nil
 		}
 		cfg := &Config{
 			Proxies: []ProxyRule{
 				{
 					Domain: "example.com",
 					Proxies: []Proxies{
-						{http: []int{80, 8080}, https: []int{443}},
+						{HTTP: []int{80, 8080}, HTTPS: []int{443}},
 					},
 				},
 			},
 		}
 		applyRules(fake, cfg)
-		Expect(fake.appendCalled).To(HaveLen(3))
+		Expect(fake.added).To(HaveLen(3))
+	})
+
+	It("should redirect the https ports to the HTTPS listener", func() {
+		resolveDomainIPs = func(domain string) ([]string, error) {
+			return []string{"1.2.3.4"}, nil
+		}
+		fake = newFakeRuleBackend(redirectRule{Domain: "example.com", IP: "1.2.3.4", Port: 8443})
+		cfg := &Config{
+			Proxies: []ProxyRule{
+				{
+					Domain: "example.com",
+					Proxies: []Proxies{
+						{HTTP: []int{80}, HTTPS: []int{8443}},
+					},
+				},
+			},
+		}
+		applyRules(fake, cfg)
+		Expect(fake.added).To(ConsistOf(
+			redirectRule{Domain: "example.com", IP: "1.2.3.4", Port: 80},
+			redirectRule{Domain: "example.com", IP: "1.2.3.4", Port: 8443, TLS: true},
+		))
+		Expect(fake.deleted).To(Equal([]redirectRule{{Domain: "example.com", IP: "1.2.3.4", Port: 8443}}))
 	})
 
 	It("should skip rule if DNS fails", func() {
-		resolveDomainIP = func(domain string) (string, error) {
-			return "", errors.New("dns fail")
+		resolveDomainIPs = func(domain string) ([]string, error) {
+			return nil, errors.New("dns fail")
 		}
 		cfg := &Config{
 			Proxies: []ProxyRule{
 				{
 					Domain: "bad.com",
 					Proxies: []Proxies{
-						{http: []int{80}, https: []int{443}},
+						{HTTP: []int{80}, HTTPS: []int{443}},
 					},
 				},
 			},
 		}
 		applyRules(fake, cfg)
-		Expect(fake.appendCalled).To(BeEmpty())
+		Expect(fake.added).To(BeEmpty())
 	})
 
 	It("should continue applying rules for multiple proxies even if one fails DNS", func() {
-		resolveDomainIP = func(domain string) (string, error) {
+		resolveDomainIPs = func(domain string) ([]string, error) {
 			if domain == "fail.com" {
-				return "", errors.New("dns fail")
+				return nil, errors.New("dns fail")
 			}
-			return "5.6.7.8", nil
+			return []string{"5.6.7.8"}, nil
 		}
 		cfg := &Config{
 			Proxies: []ProxyRule{
 				{
 					Domain: "fail.com",
 					Proxies: []Proxies{
-						{http: []int{80}},
+						{HTTP: []int{80}},
 					},
 				},
 				{
 					Domain: "ok.com",
 					Proxies: []Proxies{
-						{http: []int{8080}, https: []int{8443}},
+						{HTTP: []int{8080}, HTTPS: []int{8443}},
 					},
 				},
 			},
 		}
 		applyRules(fake, cfg)
-		Expect(fake.appendCalled).To(HaveLen(2))
+		Expect(fake.added).To(HaveLen(2))
 	})
 
 	It("should handle empty proxies list", func() {
-		resolveDomainIP = func(domain string) (string, error) {
-			return "1.2.3.4", nil
+		resolveDomainIPs = func(domain string) ([]string, error) {
+			return []string{"1.2.3.4"}, nil
 		}
 		cfg := &Config{
 			Proxies: []ProxyRule{
@@ -338,6 +411,322 @@ var _ = Describe("applyRules", func() {
 			},
 		}
 		applyRules(fake, cfg)
-		Expect(fake.appendCalled).To(BeEmpty())
+		Expect(fake.added).To(BeEmpty())
+	})
+
+	It("should not add rules that are already in place", func() {
+		resolveDomainIPs = func(domain string) ([]string, error) {
+			return []string{"1.2.3.4"}, nil
+		}
+		fake = newFakeRuleBackend(redirectRule{Domain: "example.com", IP: "1.2.3.4", Port: 80})
+		cfg := &Config{
+			Proxies: []ProxyRule{
+				{
+					Domain: "example.com",
+					Proxies: []Proxies{
+						{HTTP: []int{80, 80}, HTTPS: []int{443}},
+					},
+				},
+			},
+		}
+		applyRules(fake, cfg)
+		Expect(fake.added).To(Equal([]redirectRule{{Domain: "example.com", IP: "1.2.3.4", Port: 443, TLS: true}}))
+		Expect(fake.deleted).To(BeEmpty())
+	})
+
+	It("should remove the rules of removed domains and ports", func() {
+		resolveDomainIPs = func(domain string) ([]string, error) {
+			return []string{"1.2.3.4"}, nil
+		}
+		fake = newFakeRuleBackend(
+			redirectRule{Domain: "example.com", IP: "1.2.3.4", Port: 80},
+			redirectRule{Domain: "example.com", IP: "1.2.3.4", Port: 8080},
+			redirectRule{Domain: "removed.com", IP: "5.6.7.8", Port: 80},
+		)
+		cfg := &Config{
+			Proxies: []ProxyRule{
+				{
+					Domain: "example.com",
+					Proxies: []Proxies{
+						{HTTP: []int{80}},
+					},
+				},
+			},
+		}
+		applyRules(fake, cfg)
+		Expect(fake.added).To(BeEmpty())
+		Expect(fake.deleted).To(ConsistOf(
+			redirectRule{Domain: "example.com", IP: "1.2.3.4", Port: 8080},
+			redirectRule{Domain: "removed.com", IP: "5.6.7.8", Port: 80},
+		))
 	})
+
+	It("should replace the rules of a domain whose address changed", func() {
+		resolveDomainIPs = func(domain string) ([]string, error) {
+			return []string{"2001:db8::2"}, nil
+		}
+		fake = newFakeRuleBackend(redirectRule{Domain: "example.com", IP: "2001:db8::1", Port: 443, TLS: true})
+		cfg := &Config{
+			Proxies: []ProxyRule{
+				{
+					Domain: "example.com",
+					Proxies: []Proxies{
+						{HTTPS: []int{443}},
+					},
+				},
+			},
+		}
+		applyRules(fake, cfg)
+		Expect(fake.added).To(Equal([]redirectRule{{Domain: "example.com", IP: "2001:db8::2", Port: 443, TLS: true}}))
+		Expect(fake.deleted).To(Equal([]redirectRule{{Domain: "example.com", IP: "2001:db8::1", Port: 443, TLS: true}}))
+	})
+
+	It("should keep the rules of domains failing to resolve", func() {
+		resolveDomainIPs = func(domain string) ([]string, error) {
+			return nil, errors.New("dns fail")
+		}
+		fake = newFakeRuleBackend(redirectRule{Domain: "example.com", IP: "1.2.3.4", Port: 80})
+		cfg := &Config{
+			Proxies: []ProxyRule{
+				{
+					Domain: "example.com",
+					Proxies: []Proxies{
+						{HTTP: []int{80}},
+					},
+				},
+			},
+		}
+		applyRules(fake, cfg)
+		Expect(fake.deleted).To(BeEmpty())
+		Expect(fake.rules).To(HaveLen(1))
+	})
+
+	It("should add rules for all addresses of a domain", func() {
+		resolveDomainIPs = func(domain string) ([]string, error) {
+			return []string{"10.0.0.1", "10.0.0.2", "2001:db8::1"}, nil
+		}
+		cfg := &Config{
+			Proxies: []ProxyRule{
+				{
+					Domain: "headless.example.com",
+					Proxies: []Proxies{
+						{HTTPS: []int{9091}},
+					},
+				},
+			},
+		}
+		applyRules(fake, cfg)
+		Expect(fake.added).To(ConsistOf(
+			redirectRule{Domain: "headless.example.com", IP: "10.0.0.1", Port: 9091, TLS: true},
+			redirectRule{Domain: "headless.example.com", IP: "10.0.0.2", Port: 9091, TLS: true},
+			redirectRule{Domain: "headless.example.com", IP: "2001:db8::1", Port: 9091, TLS: true},
+		))
+	})
+
+	It("should reconcile the rules with the addresses of a domain resolved again", func() {
+		ips := []string{"10.0.0.1", "10.0.0.2"}
+		resolveDomainIPs = func(domain string) ([]string, error) {
+			return ips, nil
+		}
+		cfg := &Config{
+			Proxies: []ProxyRule{
+				{
+					Domain: "headless.example.com",
+					Proxies: []Proxies{
+						{HTTP: []int{80}},
+					},
+				},
+			},
+		}
+		rules := &ruleReconciler{backend: fake}
+		rules.apply(cfg)
+		changes := testutil.ToFloat64(dnsChangesTotal.WithLabelValues("headless.example.com"))
+
+		// Unchanged addresses change nothing
+		fake.added = nil
+		rules.apply(nil)
+		Expect(fake.added).To(BeEmpty())
+		Expect(fake.deleted).To(BeEmpty())
+		Expect(testutil.ToFloat64(dnsChangesTotal.WithLabelValues("headless.example.com"))).To(Equal(changes))
+
+		// An endpoint went away and another one came up
+		ips = []string{"10.0.0.2", "10.0.0.3"}
+		rules.apply(nil)
+		Expect(fake.added).To(Equal([]redirectRule{{Domain: "headless.example.com", IP: "10.0.0.3", Port: 80}}))
+		Expect(fake.deleted).To(Equal([]redirectRule{{Domain: "headless.example.com", IP: "10.0.0.1", Port: 80}}))
+		Expect(testutil.ToFloat64(dnsChangesTotal.WithLabelValues("headless.example.com"))).To(Equal(changes + 1))
+	})
+
+	It("should not change the rules if they cannot be listed", func() {
+		resolveDomainIPs = func(domain string) ([]string, error) {
+			return []string{"1.2.3.4"}, nil
+		}
+		fake.listErr = errors.New("list fail")
+		cfg := &Config{
+			Proxies: []ProxyRule{
+				{
+					Domain: "example.com",
+					Proxies: []Proxies{
+						{HTTP: []int{80}},
+					},
+				},
+			},
+		}
+		applyRules(fake, cfg)
+		Expect(fake.added).To(BeEmpty())
+		Expect(fake.deleted).To(BeEmpty())
+	})
+})
+
+// Casbin models evaluated by the casbin authorizer tests: the shipped allow
+// model, one with deny policies and one with priorities.
+const (
+	denyModel = `[request_definition]
+r = sub, dom, obj, act
+
+[policy_definition]
+p = sub, dom, obj, act, eft
+
+[role_definition]
+g = _, _
+
+[policy_effect]
+e = some(where (p.eft == allow)) && !some(where (p.eft == deny))
+
+[matchers]
+m = g(r.sub, p.sub) && (keyMatch2(r.dom, p.dom) || globMatch(r.dom, p.dom) || p.dom == "*") && (keyMatch2(r.obj, p.obj) || globMatch(r.obj, p.obj) || p.obj == "*") && r.act == p.act
+`
+	priorityModel = `[request_definition]
+r = sub, dom, obj, act
+
+[policy_definition]
+p = priority, sub, dom, obj, act, eft
+
+[role_definition]
+g = _, _
+
+[policy_effect]
+e = priority(p.eft) || deny
+
+[matchers]
+m = g(r.sub, p.sub) && (keyMatch2(r.dom, p.dom) || globMatch(r.dom, p.dom) || p.dom == "*") && (keyMatch2(r.obj, p.obj) || globMatch(r.obj, p.obj) || p.obj == "*") && r.act == p.act
+`
+)
+
+var _ = Describe("casbinAuthorizer", func() {
+	newAuthorizer := func(model, policy string) (*casbinAuthorizer, error) {
+		dir := GinkgoT().TempDir()
+		if model == "" {
+			data, err := os.ReadFile(filepath.Join("authz", "model.conf"))
+			Expect(err).To(BeNil())
+			model = string(data)
+		}
+		Expect(os.WriteFile(filepath.Join(dir, "model.conf"), []byte(model), 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "policy.csv"), []byte(policy), 0644)).To(Succeed())
+		ctx, cancel := context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+		return newCasbinAuthorizer(ctx, dir, false)
+	}
+
+	DescribeTable("allowed cluster/namespace pairs",
+		func(model, policy, subject string, groups []string, datasource, action string, expected [][2]string) {
+			authorizer, err := newAuthorizer(model, policy)
+			Expect(err).To(BeNil())
+			pairs, err := authorizer.AllowedPairs(context.Background(), subject, groups, datasource, action)
+			Expect(err).To(BeNil())
+			if len(expected) == 0 {
+				Expect(pairs).To(BeEmpty())
+			} else {
+				Expect(pairs).To(ConsistOf(expected))
+			}
+		},
+		Entry("direct subject",
+			"", "p, alice, *, cluster1/ns1, read\np, bob, *, cluster1/ns2, read\n",
+			"alice", nil, "prometheus", "read", [][2]string{{"cluster1", "ns1"}}),
+		Entry("JWT group",
+			"", "p, team-backend, prometheus, cluster1/backend-*, read\n",
+			"alice", []string{"team-backend"}, "prometheus", "read", [][2]string{{"cluster1", "backend-*"}}),
+		Entry("other datasource",
+			"", "p, team-backend, prometheus, cluster1/backend-*, read\n",
+			"alice", []string{"team-backend"}, "loki", "read", nil),
+		Entry("other action",
+			"", "p, alice, *, cluster1/ns1, write\n",
+			"alice", nil, "prometheus", "read", nil),
+		Entry("empty subject",
+			"", "p, , *, cluster1/ns1, read\n",
+			"", nil, "prometheus", "read", nil),
+		Entry("role",
+			"", "p, developers, *, */dev-*, read\ng, alice, developers\n",
+			"alice", nil, "prometheus", "read", [][2]string{{"*", "dev-*"}}),
+		Entry("nested roles",
+			"", "p, staff, *, */shared, read\ng, alice, developers\ng, developers, engineering\ng, engineering, staff\n",
+			"alice", nil, "prometheus", "read", [][2]string{{"*", "shared"}}),
+		Entry("nested role of a JWT group",
+			"", "p, staff, *, */shared, read\ng, team-frontend, staff\n",
+			"alice", []string{"team-frontend"}, "prometheus", "read", [][2]string{{"*", "shared"}}),
+		Entry("keyMatch2 domain parameter",
+			"", "p, alice, :uid, cluster1/ns1, read\n",
+			"alice", nil, "prometheus", "read", [][2]string{{"cluster1", "ns1"}}),
+		Entry("leading wildcard keyMatch2 domain",
+			"", "p, alice, *-prod, cluster1/ns1, read\n",
+			"alice", nil, "prometheus-prod", "read", [][2]string{{"cluster1", "ns1"}}),
+		Entry("wildcard and keyMatch2 resources",
+			"", "p, alice, *, *, read\np, alice, *, cluster1/:namespace, read\np, alice, *, invalid, read\n",
+			"alice", nil, "prometheus", "read", [][2]string{{"*", "*"}}),
+		Entry("deny overlapping a role",
+			denyModel, "p, developers, *, */dev-*, read, allow\np, alice, *, cluster1/dev-api, read, allow\np, alice, *, */dev-secret, read, deny\ng, alice, developers\ng, bob, developers\n",
+			"alice", nil, "prometheus", "read", [][2]string{{"cluster1", "dev-api"}}),
+		Entry("deny of another subject",
+			denyModel, "p, developers, *, */dev-*, read, allow\np, alice, *, */dev-secret, read, deny\ng, alice, developers\ng, bob, developers\n",
+			"bob", nil, "prometheus", "read", [][2]string{{"*", "dev-*"}}),
+		Entry("deny of a JWT group",
+			denyModel, "p, alice, *, cluster1/*, read, allow\np, contractors, *, cluster1/billing, read, deny\n",
+			"alice", []string{"contractors"}, "prometheus", "read", nil),
+		Entry("deny on another datasource",
+			denyModel, "p, alice, *, cluster1/*, read, allow\np, alice, loki, cluster1/*, read, deny\n",
+			"alice", nil, "prometheus", "read", [][2]string{{"cluster1", "*"}}),
+		Entry("higher priority deny",
+			priorityModel, "p, 10, developers, *, */dev-*, read, allow\np, 1, alice, *, */dev-secret, read, deny\ng, alice, developers\n",
+			"alice", nil, "prometheus", "read", nil),
+		Entry("higher priority allow",
+			priorityModel, "p, 5, developers, *, */dev-secret, read, deny\np, 10, developers, *, */dev-*, read, allow\np, 1, bob, *, cluster1/dev-secret, read, allow\ng, bob, developers\n",
+			"bob", nil, "prometheus", "read", [][2]string{{"cluster1", "dev-secret"}}),
+	)
+
+	It("should reject a policy the matchers fail on", func() {
+		_, err := newAuthorizer("", "p, alice, *, cluster1/ns1, read\np, alice, prometheus-(, cluster1/ns1, read\n")
+		Expect(err).To(MatchError(ContainSubstring("panic: error parsing regexp: missing closing ): `^prometheus-($`")))
+	})
+
+	It("should evaluate the matchers of the model", func() {
+		// Datasources match exactly rather than with keyMatch2
+		authorizer, err := newAuthorizer(strings.Replace(denyModel,
+			`(keyMatch2(r.dom, p.dom) || globMatch(r.dom, p.dom) || p.dom == "*")`, `r.dom == p.dom`, 1),
+			"p, alice, prometheus-*, cluster1/*, read, allow\np, alice, prometheus-prod, cluster1/ns1, read, allow\n")
+		Expect(err).To(BeNil())
+		pairs, err := authorizer.AllowedPairs(context.Background(), "alice", nil, "prometheus-prod", "read")
+		Expect(err).To(BeNil())
+		Expect(pairs).To(Equal([][2]string{{"cluster1", "ns1"}}))
+	})
+
+	It("should reject an unsupported policy effect", func() {
+		_, err := newAuthorizer(strings.Replace(denyModel,
+			"some(where (p.eft == allow)) && !some(where (p.eft == deny))", "!some(where (p.eft == deny))", 1), "")
+		Expect(err).To(MatchError(ContainSubstring("unsupported policy_effect")))
+	})
+})
+
+var _ = Describe("globOverlap", func() {
+	DescribeTable("overlapping patterns",
+		func(a, b string, expected bool) {
+			Expect(globOverlap(a, b)).To(Equal(expected))
+			Expect(globOverlap(b, a)).To(Equal(expected))
+		},
+		Entry("equal", "dev-api", "dev-api", true),
+		Entry("different", "dev-api", "dev-web", false),
+		Entry("wildcard", "*", "dev-api", true),
+		Entry("prefix and suffix", "dev-*", "*-api", true),
+		Entry("disjoint prefixes", "dev-*", "prod-*", false),
+		Entry("wildcard in the middle", "dev-*-api", "dev-web-*", true),
+	)
 })
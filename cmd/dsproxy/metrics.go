@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dsproxy_requests_total",
+		Help: "Total number of proxied requests by datasource, datasource type and status code.",
+	}, []string{"datasource", "type", "code"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dsproxy_request_duration_seconds",
+		Help:    "Duration of proxied requests by datasource and datasource type.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"datasource", "type"})
+
+	authnFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dsproxy_authn_failures_total",
+		Help: "Total number of rejected bearer tokens by reason.",
+	}, []string{"reason"})
+
+	authzDenialsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dsproxy_authz_denials_total",
+		Help: "Total number of requests denied as no cluster/namespace is allowed, by datasource.",
+	}, []string{"datasource"})
+
+	policyReloadsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dsproxy_policy_reloads_total",
+		Help: "Total number of Casbin policy and model loads by result.",
+	}, []string{"result"})
+
+	policyLastReloadSuccessful = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "dsproxy_policy_last_reload_successful",
+		Help: "Whether the last Casbin policy and model load was successful.",
+	})
+
+	policyLastReloadSuccessTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "dsproxy_policy_last_reload_success_timestamp_seconds",
+		Help: "Timestamp of the last successful Casbin policy and model load.",
+	})
+
+	jwksRefreshesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dsproxy_jwks_refreshes_total",
+		Help: "Total number of JWKS fetches by result.",
+	}, []string{"result"})
+
+	jwksLastRefreshSuccessTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "dsproxy_jwks_last_refresh_success_timestamp_seconds",
+		Help: "Timestamp of the last successful JWKS fetch.",
+	})
+
+	iptablesRules = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "dsproxy_iptables_rules",
+		Help: "Number of redirect rules in place after the last reconciliation, for iptables or nftables.",
+	})
+
+	dnsChangesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dsproxy_dns_changes_total",
+		Help: "Total number of changed addresses of a redirected domain found when resolving it again, by domain.",
+	}, []string{"domain"})
+
+	iptablesRuleErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dsproxy_iptables_rule_errors_total",
+		Help: "Total number of redirect rules that failed to be listed, added or removed, including failed DNS lookups.",
+	})
+)
+
+// metricDatasources are the UIDs of the datasources of the loaded config.
+// Only these are used as the datasource label, as the headers are set by the
+// client before it is authenticated.
+var metricDatasources atomic.Pointer[map[string]bool]
+
+// setMetricDatasources replaces the UIDs of the configured datasources
+func setMetricDatasources(datasources []DatasourceUpstream) {
+	uids := map[string]bool{}
+	for _, ds := range datasources {
+		if ds.UID != "" {
+			uids[ds.UID] = true
+		}
+	}
+	metricDatasources.Store(&uids)
+}
+
+// metricLabels returns the datasource and type labels of a request, which
+// are unknown unless they match a configured datasource and a supported type
+func metricLabels(r *http.Request) (string, string) {
+	datasource := "unknown"
+	if uids := metricDatasources.Load(); uids != nil && (*uids)[r.Header.Get("X-Datasource-Uid")] {
+		datasource = r.Header.Get("X-Datasource-Uid")
+	}
+	dsType := strings.ToLower(r.Header.Get("X-Datasource-Type"))
+	switch dsType {
+	case "":
+		dsType = DataSourceTypePrometheus
+	case DataSourceTypePrometheus, DataSourceTypeLoki, DataSourceTypeTempo:
+	default:
+		dsType = "unknown"
+	}
+	return datasource, dsType
+}
+
+// readiness of the dependencies dsproxy needs before it can serve requests
+var (
+	policyLoaded atomic.Bool
+	jwksLoaded   atomic.Bool
+)
+
+// authnFailureReason maps a bearer token validation error to the reason
+// label of dsproxy_authn_failures_total
+func authnFailureReason(err error) string {
+	switch {
+	case errors.Is(err, errMissingBearerToken):
+		return "missing_token"
+	case errors.Is(err, errJWKSNotInitialized):
+		return "jwks_unavailable"
+	case errors.Is(err, errTokenReviewFailed):
+		return "token_review_failed"
+	case errors.Is(err, errTokenNotAuthenticated):
+		return "token_review_rejected"
+	case errors.Is(err, jwt.ErrTokenMalformed):
+		return "malformed_token"
+	case errors.Is(err, errUnsupportedAlgorithm):
+		return "unsupported_algorithm"
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid), errors.Is(err, jwt.ErrTokenUnverifiable):
+		return "invalid_signature"
+	case errors.Is(err, jwt.ErrTokenRequiredClaimMissing):
+		return "missing_claim"
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return "expired"
+	case errors.Is(err, jwt.ErrTokenNotValidYet):
+		return "not_yet_valid"
+	case errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+		return "issued_in_future"
+	case errors.Is(err, jwt.ErrTokenInvalidIssuer):
+		return "bad_issuer"
+	case errors.Is(err, jwt.ErrTokenInvalidAudience):
+		return "bad_audience"
+	default:
+		return "invalid_token"
+	}
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Flush keeps streaming responses of the reverse proxies working
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// instrumentHandler records dsproxy_requests_total and
+// dsproxy_request_duration_seconds for the requests served by next
+func instrumentHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		datasource, dsType := metricLabels(r)
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		requestDuration.WithLabelValues(datasource, dsType).Observe(time.Since(start).Seconds())
+		requestsTotal.WithLabelValues(datasource, dsType, strconv.Itoa(recorder.status)).Inc()
+	})
+}
+
+// newMetricsMux serves /metrics, /healthz and /readyz. /readyz fails until
+// the policy and the JWKS are loaded.
+func newMetricsMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		var notReady []string
+		if !policyLoaded.Load() {
+			notReady = append(notReady, "policy not loaded")
+		}
+		if !jwksLoaded.Load() {
+			notReady = append(notReady, "jwks not loaded")
+		}
+		if len(notReady) > 0 {
+			http.Error(w, strings.Join(notReady, ", "), http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	return mux
+}
+
+// startMetricsServer serves newMetricsMux on addr
+func startMetricsServer(addr string) *http.Server {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           newMetricsMux(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Println("Starting metrics server on", addr)
+	go func() {
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Metrics server error: %v", err)
+		}
+	}()
+	return server
+}
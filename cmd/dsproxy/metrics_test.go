@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestInstrumentHandler tests request counts by datasource, type and status code
+func TestInstrumentHandler(t *testing.T) {
+	RegisterTestingT(t)
+
+	handler := instrumentHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/forbidden" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		w.(http.Flusher).Flush()
+		_, _ = w.Write([]byte("ok"))
+	}))
+
+	serve := func(path, uid, dsType string) {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("X-Datasource-Uid", uid)
+		req.Header.Set("X-Datasource-Type", dsType)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	defer metricDatasources.Store(metricDatasources.Load())
+	setMetricDatasources([]DatasourceUpstream{{UID: "test-instrument", Type: "prometheus"}})
+
+	ok := testutil.ToFloat64(requestsTotal.WithLabelValues("test-instrument", "prometheus", "200"))
+	forbidden := testutil.ToFloat64(requestsTotal.WithLabelValues("test-instrument", "loki", "403"))
+	unknown := testutil.ToFloat64(requestsTotal.WithLabelValues("unknown", "unknown", "200"))
+	serve("/api/v1/query", "test-instrument", "")
+	serve("/forbidden", "test-instrument", "Loki")
+	Expect(testutil.ToFloat64(requestsTotal.WithLabelValues("test-instrument", "prometheus", "200"))).To(Equal(ok + 1))
+	Expect(testutil.ToFloat64(requestsTotal.WithLabelValues("test-instrument", "loki", "403"))).To(Equal(forbidden + 1))
+
+	// Headers not matching the config do not create new series
+	serve("/api/v1/query", "random-uid-1", "random-type-1")
+	serve("/api/v1/query", "random-uid-2", "random-type-2")
+	Expect(testutil.ToFloat64(requestsTotal.WithLabelValues("unknown", "unknown", "200"))).To(Equal(unknown + 2))
+}
+
+// TestAuthnFailureReason tests the reason label of rejected tokens
+func TestAuthnFailureReason(t *testing.T) {
+	RegisterTestingT(t)
+
+	Expect(authnFailureReason(errMissingBearerToken)).To(Equal("missing_token"))
+	Expect(authnFailureReason(errJWKSNotInitialized)).To(Equal("jwks_unavailable"))
+	Expect(authnFailureReason(fmt.Errorf("token has invalid claims: %w", jwt.ErrTokenExpired))).To(Equal("expired"))
+	Expect(authnFailureReason(fmt.Errorf("token has invalid claims: %w", jwt.ErrTokenInvalidIssuer))).To(Equal("bad_issuer"))
+	Expect(authnFailureReason(fmt.Errorf("%w: %w", jwt.ErrTokenSignatureInvalid, errors.New("crypto/rsa: verification error")))).To(Equal("invalid_signature"))
+	Expect(authnFailureReason(jwt.ErrTokenMalformed)).To(Equal("malformed_token"))
+	Expect(authnFailureReason(errors.New("invalid token"))).To(Equal("invalid_token"))
+
+	missing := testutil.ToFloat64(authnFailuresTotal.WithLabelValues("missing_token"))
+	w := httptest.NewRecorder()
+	authMiddleware(http.NotFoundHandler()).ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/query", nil))
+	Expect(w.Code).To(Equal(http.StatusUnauthorized))
+	Expect(testutil.ToFloat64(authnFailuresTotal.WithLabelValues("missing_token"))).To(Equal(missing + 1))
+}
+
+// TestMetricsMux tests the health, readiness and metrics endpoints
+func TestMetricsMux(t *testing.T) {
+	RegisterTestingT(t)
+
+	defer policyLoaded.Store(policyLoaded.Load())
+	defer jwksLoaded.Store(jwksLoaded.Load())
+	policyLoaded.Store(false)
+	jwksLoaded.Store(false)
+
+	mux := newMetricsMux()
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	Expect(get("/healthz").Code).To(Equal(http.StatusOK))
+	w := get("/readyz")
+	Expect(w.Code).To(Equal(http.StatusServiceUnavailable))
+	Expect(w.Body.String()).To(ContainSubstring("policy not loaded, jwks not loaded"))
+
+	policyLoaded.Store(true)
+	w = get("/readyz")
+	Expect(w.Code).To(Equal(http.StatusServiceUnavailable))
+	Expect(strings.TrimSpace(w.Body.String())).To(Equal("jwks not loaded"))
+
+	jwksLoaded.Store(true)
+	Expect(get("/readyz").Code).To(Equal(http.StatusOK))
+
+	iptablesRules.Set(3)
+	w = get("/metrics")
+	Expect(w.Code).To(Equal(http.StatusOK))
+	Expect(w.Body.String()).To(ContainSubstring("dsproxy_iptables_rules 3"))
+	Expect(w.Body.String()).To(ContainSubstring("dsproxy_iptables_rule_errors_total"))
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+)
+
+const (
+	// nftTable is the table holding the chains and rules of dsproxy
+	nftTable = "inet dsproxy"
+	// tproxyMark marks the packets routed to dsproxy in transparent mode,
+	// and is the routing table delivering them locally
+	tproxyMark = 0x5533
+)
+
+// commandRunner runs a command with input on its stdin and returns its
+// output
+type commandRunner func(input, name string, args ...string) ([]byte, error)
+
+func runCommand(input, name string, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = strings.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// nftAvailable reports whether the nft command works
+func nftAvailable(run commandRunner) bool {
+	_, err := run("", "nft", "list", "tables")
+	return err == nil
+}
+
+// nftablesBackend installs the redirect rules in the inet dsproxy table of
+// nftables, which holds both the IPv4 and IPv6 rules.
+//
+// In transparent mode the traffic is routed to dsproxy with TPROXY rather
+// than REDIRECT, so that the connections keep their original destination:
+// the output chain marks the packets, a policy route delivers the marked
+// packets locally, and the prerouting chain hands them to dsproxy.
+type nftablesBackend struct {
+	run         commandRunner
+	transparent bool
+	// routed are the address families of the policy routes, -4 and -6
+	routed []string
+}
+
+// newNFTablesBackend creates the table and chains, and the policy routes in
+// transparent mode
+func newNFTablesBackend(run commandRunner, transparent bool) (*nftablesBackend, error) {
+	b := &nftablesBackend{run: run, transparent: transparent}
+	script := "add table " + nftTable + "\n"
+	if transparent {
+		script += "add chain " + nftTable + " output { type route hook output priority mangle; policy accept; }\n" +
+			"add chain " + nftTable + " prerouting { type filter hook prerouting priority mangle; policy accept; }\n"
+	} else {
+		script += "add chain " + nftTable + " output { type nat hook output priority dstnat; policy accept; }\n"
+	}
+	if _, err := run(script, "nft", "-f", "-"); err != nil {
+		return nil, err
+	}
+	if transparent {
+		for _, family := range []string{"-4", "-6"} {
+			if err := b.addPolicyRoute(family); err != nil {
+				if family == "-6" {
+					log.Printf("Failed to route marked IPv6 packets locally, IPv6 traffic is not redirected: %v", err)
+					continue
+				}
+				return nil, err
+			}
+			b.routed = append(b.routed, family)
+		}
+	}
+	return b, nil
+}
+
+// addPolicyRoute delivers the packets marked with tproxyMark locally
+func (b *nftablesBackend) addPolicyRoute(family string) error {
+	mark := fmt.Sprintf("%#x", tproxyMark)
+	table := fmt.Sprintf("%d", tproxyMark)
+	out, err := b.run("", "ip", family, "rule", "list", "fwmark", mark)
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(out)) == 0 {
+		if _, err := b.run("", "ip", family, "rule", "add", "fwmark", mark, "lookup", table); err != nil {
+			return err
+		}
+	}
+	_, err = b.run("", "ip", family, "route", "replace", "local", "default", "dev", "lo", "table", table)
+	return err
+}
+
+// nftRule is a rule listed by nft -j
+type nftRule struct {
+	Chain   string `json:"chain"`
+	Handle  int    `json:"handle"`
+	Comment string `json:"comment"`
+}
+
+// listRules lists the rules of the dsproxy table
+func (b *nftablesBackend) listRules() ([]nftRule, error) {
+	out, err := b.run("", "nft", "-j", "list", "table", "inet", "dsproxy")
+	if err != nil {
+		return nil, err
+	}
+	var listing struct {
+		Nftables []struct {
+			Rule *nftRule `json:"rule"`
+		} `json:"nftables"`
+	}
+	if err := json.Unmarshal(out, &listing); err != nil {
+		return nil, fmt.Errorf("failed to parse nft output: %w", err)
+	}
+	var rules []nftRule
+	for _, object := range listing.Nftables {
+		if object.Rule != nil {
+			rules = append(rules, *object.Rule)
+		}
+	}
+	return rules, nil
+}
+
+func (b *nftablesBackend) Rules() ([]redirectRule, error) {
+	listed, err := b.listRules()
+	if err != nil {
+		return nil, err
+	}
+	var rules []redirectRule
+	for _, rule := range listed {
+		if rule.Chain != "output" {
+			continue
+		}
+		if rule, ok := parseRuleComment(rule.Comment); ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+// nftRuleStatements returns the nft statements adding rule, which redirect
+// its traffic to the dsproxy listener of its protocol. Traffic of
+// --exclude-uid, the user dsproxy runs as, is not redirected so that dsproxy
+// can reach the upstream itself.
+func (b *nftablesBackend) nftRuleStatements(rule redirectRule) []string {
+	family, loopback := "ip", "127.0.0.1"
+	if rule.ipv6() {
+		family, loopback = "ip6", "[::1]"
+	}
+	match := fmt.Sprintf("%s daddr %s tcp dport %d", family, rule.IP, rule.Port)
+	owner := ""
+	if f_excludeUID >= 0 {
+		owner = fmt.Sprintf(" meta skuid != %d", f_excludeUID)
+	}
+	comment := fmt.Sprintf(" comment %q", rule.comment())
+
+	if !b.transparent {
+		return []string{
+			fmt.Sprintf("add rule %s output %s%s redirect to :%d%s", nftTable, match, owner, rule.toPort(), comment),
+		}
+	}
+	return []string{
+		fmt.Sprintf("add rule %s output %s%s meta mark set %#x%s", nftTable, match, owner, tproxyMark, comment),
+		fmt.Sprintf("add rule %s prerouting %s meta mark %#x tproxy %s to %s:%d%s", nftTable, match, tproxyMark, family, loopback, rule.toPort(), comment),
+	}
+}
+
+func (b *nftablesBackend) Add(rule redirectRule) error {
+	statements := b.nftRuleStatements(rule)
+	log.Printf("Adding nftables rule: %s", strings.Join(statements, "; "))
+	_, err := b.run(strings.Join(statements, "\n")+"\n", "nft", "-f", "-")
+	return err
+}
+
+// Delete deletes the rules with the comment of rule, regardless of the rest
+// of their statements, e.g. a changed --exclude-uid
+func (b *nftablesBackend) Delete(rule redirectRule) error {
+	listed, err := b.listRules()
+	if err != nil {
+		return err
+	}
+	var script strings.Builder
+	for _, r := range listed {
+		if r.Comment == rule.comment() {
+			fmt.Fprintf(&script, "delete rule %s %s handle %d\n", nftTable, r.Chain, r.Handle)
+		}
+	}
+	if script.Len() == 0 {
+		return nil
+	}
+	log.Printf("Deleting nftables rules of %s", rule)
+	_, err = b.run(script.String(), "nft", "-f", "-")
+	return err
+}
+
+func (b *nftablesBackend) Cleanup() error {
+	var errs []error
+	if _, err := b.run("", "nft", "list", "table", "inet", "dsproxy"); err == nil {
+		if _, err := b.run("", "nft", "delete", "table", "inet", "dsproxy"); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	mark := fmt.Sprintf("%#x", tproxyMark)
+	table := fmt.Sprintf("%d", tproxyMark)
+	for _, family := range b.routed {
+		if _, err := b.run("", "ip", family, "rule", "del", "fwmark", mark, "lookup", table); err != nil {
+			errs = append(errs, err)
+		}
+		if _, err := b.run("", "ip", family, "route", "flush", "table", table); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
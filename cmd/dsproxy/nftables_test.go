@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+// fakeNFT records the commands run by the nftables backend and answers the
+// listing of the dsproxy table with rules
+type fakeNFT struct {
+	commands []string
+	inputs   []string
+	rules    []nftRule
+	// fail makes the commands starting with it fail
+	fail string
+}
+
+func (f *fakeNFT) run(input, name string, args ...string) ([]byte, error) {
+	command := strings.Join(append([]string{name}, args...), " ")
+	f.commands = append(f.commands, command)
+	if input != "" {
+		f.inputs = append(f.inputs, input)
+	}
+	if f.fail != "" && strings.HasPrefix(command, f.fail) {
+		return nil, errors.New("command failed")
+	}
+	if command == "nft -j list table inet dsproxy" {
+		objects := []map[string]any{{"metainfo": map[string]any{"json_schema_version": 1}}, {"table": map[string]any{"family": "inet", "name": "dsproxy"}}}
+		for _, rule := range f.rules {
+			objects = append(objects, map[string]any{"rule": rule})
+		}
+		return json.Marshal(map[string]any{"nftables": objects})
+	}
+	return nil, nil
+}
+
+// TestNFTablesBackend tests the nft commands installing, listing and removing
+// the redirect rules
+func TestNFTablesBackend(t *testing.T) {
+	origExcludeUID := f_excludeUID
+	defer func() { f_excludeUID = origExcludeUID }()
+	f_excludeUID = 1337
+	v4Rule := redirectRule{Domain: "prometheus.example.com", IP: "1.2.3.4", Port: 443}
+	v6Rule := redirectRule{Domain: "prometheus.example.com", IP: "2001:db8::1", Port: 443, TLS: true}
+
+	t.Run("Redirect", func(t *testing.T) {
+		RegisterTestingT(t)
+		nft := &fakeNFT{}
+		backend, err := newNFTablesBackend(nft.run, false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(nft.inputs).To(Equal([]string{
+			"add table inet dsproxy\n" +
+				"add chain inet dsproxy output { type nat hook output priority dstnat; policy accept; }\n",
+		}))
+
+		nft.inputs = nil
+		Expect(backend.Add(v4Rule)).To(Succeed())
+		Expect(backend.Add(v6Rule)).To(Succeed())
+		Expect(nft.inputs).To(Equal([]string{
+			`add rule inet dsproxy output ip daddr 1.2.3.4 tcp dport 443 meta skuid != 1337 redirect to :5533 comment "dsproxy/prometheus.example.com/1.2.3.4/443"` + "\n",
+			`add rule inet dsproxy output ip6 daddr 2001:db8::1 tcp dport 443 meta skuid != 1337 redirect to :5534 comment "dsproxy/prometheus.example.com/2001:db8::1/443/tls"` + "\n",
+		}))
+	})
+
+	t.Run("Transparent", func(t *testing.T) {
+		RegisterTestingT(t)
+		nft := &fakeNFT{}
+		backend, err := newNFTablesBackend(nft.run, true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(nft.inputs[0]).To(ContainSubstring("add chain inet dsproxy output { type route hook output priority mangle; policy accept; }"))
+		Expect(nft.inputs[0]).To(ContainSubstring("add chain inet dsproxy prerouting { type filter hook prerouting priority mangle; policy accept; }"))
+		Expect(nft.commands).To(ContainElements(
+			"ip -4 rule add fwmark 0x5533 lookup 21811",
+			"ip -4 route replace local default dev lo table 21811",
+			"ip -6 rule add fwmark 0x5533 lookup 21811",
+			"ip -6 route replace local default dev lo table 21811",
+		))
+
+		nft.inputs = nil
+		Expect(backend.Add(v6Rule)).To(Succeed())
+		Expect(nft.inputs).To(Equal([]string{
+			`add rule inet dsproxy output ip6 daddr 2001:db8::1 tcp dport 443 meta skuid != 1337 meta mark set 0x5533 comment "dsproxy/prometheus.example.com/2001:db8::1/443/tls"` + "\n" +
+				`add rule inet dsproxy prerouting ip6 daddr 2001:db8::1 tcp dport 443 meta mark 0x5533 tproxy ip6 to [::1]:5534 comment "dsproxy/prometheus.example.com/2001:db8::1/443/tls"` + "\n",
+		}))
+
+		nft.commands = nil
+		Expect(backend.Cleanup()).To(Succeed())
+		Expect(nft.commands).To(ContainElements(
+			"nft delete table inet dsproxy",
+			"ip -4 rule del fwmark 0x5533 lookup 21811",
+			"ip -6 route flush table 21811",
+		))
+	})
+
+	t.Run("TransparentWithoutIPv6", func(t *testing.T) {
+		RegisterTestingT(t)
+		nft := &fakeNFT{fail: "ip -6"}
+		backend, err := newNFTablesBackend(nft.run, true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(backend.routed).To(Equal([]string{"-4"}))
+
+		nft = &fakeNFT{fail: "ip -4"}
+		_, err = newNFTablesBackend(nft.run, true)
+		Expect(err).To(HaveOccurred())
+	})
+
+	t.Run("RulesAndDelete", func(t *testing.T) {
+		RegisterTestingT(t)
+		nft := &fakeNFT{rules: []nftRule{
+			{Chain: "output", Handle: 4, Comment: v4Rule.comment()},
+			{Chain: "prerouting", Handle: 5, Comment: v4Rule.comment()},
+			{Chain: "output", Handle: 6, Comment: v6Rule.comment()},
+			{Chain: "output", Handle: 7, Comment: "added by someone else"},
+		}}
+		backend, err := newNFTablesBackend(nft.run, false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(backend.Rules()).To(Equal([]redirectRule{v4Rule, v6Rule}))
+
+		nft.inputs = nil
+		Expect(backend.Delete(v4Rule)).To(Succeed())
+		Expect(nft.inputs).To(Equal([]string{
+			"delete rule inet dsproxy output handle 4\n" +
+				"delete rule inet dsproxy prerouting handle 5\n",
+		}))
+
+		// Deleting a rule that is not installed runs nothing
+		nft.inputs = nil
+		Expect(backend.Delete(redirectRule{Domain: "other.example.com", IP: "5.6.7.8", Port: 80})).To(Succeed())
+		Expect(nft.inputs).To(BeEmpty())
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		RegisterTestingT(t)
+		_, err := newNFTablesBackend((&fakeNFT{fail: "nft -f"}).run, false)
+		Expect(err).To(HaveOccurred())
+
+		nft := &fakeNFT{}
+		backend, err := newNFTablesBackend(nft.run, false)
+		Expect(err).ToNot(HaveOccurred())
+		nft.fail = "nft"
+		_, err = backend.Rules()
+		Expect(err).To(HaveOccurred())
+		Expect(backend.Add(v4Rule)).ToNot(Succeed())
+		Expect(nftAvailable(nft.run)).To(BeFalse())
+	})
+}
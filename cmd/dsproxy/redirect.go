@@ -0,0 +1,284 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// Firewall backends installing the redirect rules
+const (
+	firewallBackendAuto     = "auto"
+	firewallBackendIPTables = "iptables"
+	firewallBackendNFTables = "nftables"
+)
+
+const (
+	ipTableTarget = "nat"
+	ipTableChain  = "OUTPUT"
+	// iptablesChain holds the redirect rules, it is jumped to from OUTPUT
+	iptablesChain = "DSPROXY"
+	// ruleCommentPrefix tags the rules installed by dsproxy
+	ruleCommentPrefix = "dsproxy"
+)
+
+// redirectRule redirects the TCP traffic to IP:Port, an address of Domain,
+// to dsproxy. TLS traffic is redirected to the HTTPS listener, which
+// terminates it.
+type redirectRule struct {
+	Domain string
+	IP     string
+	Port   int
+	TLS    bool
+}
+
+func (r redirectRule) String() string {
+	if r.TLS {
+		return fmt.Sprintf("%s (%s, tls)", net.JoinHostPort(r.IP, strconv.Itoa(r.Port)), r.Domain)
+	}
+	return fmt.Sprintf("%s (%s)", net.JoinHostPort(r.IP, strconv.Itoa(r.Port)), r.Domain)
+}
+
+// toPort returns the dsproxy port the traffic of the rule is redirected to
+func (r redirectRule) toPort() int {
+	if r.TLS {
+		return redirectPortHTTPS
+	}
+	return redirectPortHTTP
+}
+
+func (r redirectRule) ipv6() bool {
+	return strings.Contains(r.IP, ":")
+}
+
+// comment identifies the rule in the firewall, so that the rules installed
+// by dsproxy are found again after a restart. The comments of TLS rules end
+// in /tls.
+func (r redirectRule) comment() string {
+	comment := fmt.Sprintf("%s/%s/%s/%d", ruleCommentPrefix, r.Domain, r.IP, r.Port)
+	if r.TLS {
+		comment += "/tls"
+	}
+	return comment
+}
+
+// parseRuleComment parses the comment of a rule installed by dsproxy
+func parseRuleComment(comment string) (redirectRule, bool) {
+	parts := strings.Split(strings.Trim(comment, `"`), "/")
+	if len(parts) < 4 || len(parts) > 5 || parts[0] != ruleCommentPrefix || net.ParseIP(parts[2]) == nil {
+		return redirectRule{}, false
+	}
+	port, err := strconv.Atoi(parts[3])
+	if err != nil {
+		return redirectRule{}, false
+	}
+	if len(parts) == 5 && parts[4] != "tls" {
+		return redirectRule{}, false
+	}
+	return redirectRule{Domain: parts[1], IP: parts[2], Port: port, TLS: len(parts) == 5}, true
+}
+
+// ruleBackend installs the redirect rules in the firewall
+type ruleBackend interface {
+	// Rules returns the redirect rules installed by dsproxy
+	Rules() ([]redirectRule, error)
+	Add(rule redirectRule) error
+	Delete(rule redirectRule) error
+	// Cleanup removes all rules and chains installed by dsproxy
+	Cleanup() error
+}
+
+// newRuleBackend creates the named firewall backend. auto selects nftables
+// when the nft command works, and iptables otherwise. The transparent mode
+// is only supported by nftables.
+func newRuleBackend(name string, transparent bool) (ruleBackend, error) {
+	if name == firewallBackendAuto {
+		name = firewallBackendIPTables
+		if nftAvailable(runCommand) {
+			name = firewallBackendNFTables
+		}
+		log.Printf("Selected the %s firewall backend", name)
+	}
+	switch name {
+	case firewallBackendNFTables:
+		return newNFTablesBackend(runCommand, transparent)
+	case firewallBackendIPTables:
+		if transparent {
+			return nil, errors.New("transparent mode requires the nftables backend")
+		}
+		v4, err := iptables.New()
+		if err != nil {
+			return nil, err
+		}
+		// IPv6 rules fail to be added without ip6tables
+		var v6 iptablesInterface
+		if ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv6); err != nil {
+			log.Printf("ip6tables is not available, IPv6 traffic is not redirected: %v", err)
+		} else {
+			v6 = ipt
+		}
+		return newIPTablesBackend(v4, v6)
+	default:
+		return nil, fmt.Errorf("unknown firewall backend %q", name)
+	}
+}
+
+// Interface for iptables operations
+type iptablesInterface interface {
+	Exists(table, chain string, rulespec ...string) (bool, error)
+	AppendUnique(table, chain string, rulespec ...string) error
+	DeleteIfExists(table, chain string, rulespec ...string) error
+	DeleteById(table, chain string, id int) error
+	List(table, chain string) ([]string, error)
+	ChainExists(table, chain string) (bool, error)
+	NewChain(table, chain string) error
+	ClearAndDeleteChain(table, chain string) error
+}
+
+// iptablesBackend installs the redirect rules in the DSPROXY chain of the
+// nat table of iptables and ip6tables
+type iptablesBackend struct {
+	v4 iptablesInterface
+	// v6 is nil when ip6tables is not available
+	v6 iptablesInterface
+}
+
+// newIPTablesBackend creates the DSPROXY chains and jumps to them from
+// OUTPUT
+func newIPTablesBackend(v4, v6 iptablesInterface) (*iptablesBackend, error) {
+	b := &iptablesBackend{v4: v4, v6: v6}
+	for _, ipt := range b.tables() {
+		exists, err := ipt.ChainExists(ipTableTarget, iptablesChain)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			if err := ipt.NewChain(ipTableTarget, iptablesChain); err != nil {
+				return nil, err
+			}
+		}
+		if err := ipt.AppendUnique(ipTableTarget, ipTableChain, "-j", iptablesChain); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func (b *iptablesBackend) tables() []iptablesInterface {
+	if b.v6 == nil {
+		return []iptablesInterface{b.v4}
+	}
+	return []iptablesInterface{b.v4, b.v6}
+}
+
+func (b *iptablesBackend) table(rule redirectRule) (iptablesInterface, error) {
+	if !rule.ipv6() {
+		return b.v4, nil
+	}
+	if b.v6 == nil {
+		return nil, errors.New("ip6tables is not available")
+	}
+	return b.v6, nil
+}
+
+// redirectRuleSpec returns the iptables rule redirecting the traffic of rule
+// to the dsproxy listener of its protocol. Traffic of --exclude-uid, the user dsproxy runs as, is not
+// redirected so that dsproxy can reach the upstream itself.
+func redirectRuleSpec(rule redirectRule) []string {
+	ruleSpec := []string{"-p", "tcp", "-d", rule.IP, "--dport", strconv.Itoa(rule.Port)}
+	if f_excludeUID >= 0 {
+		ruleSpec = append(ruleSpec, "-m", "owner", "!", "--uid-owner", strconv.Itoa(f_excludeUID))
+	}
+	ruleSpec = append(ruleSpec, "-m", "comment", "--comment", rule.comment())
+	return append(ruleSpec, "-j", "REDIRECT", "--to-port", strconv.Itoa(rule.toPort()))
+}
+
+func (b *iptablesBackend) Rules() ([]redirectRule, error) {
+	var rules []redirectRule
+	for _, ipt := range b.tables() {
+		lines, err := ipt.List(ipTableTarget, iptablesChain)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range lines {
+			if rule, ok := parseRuleComment(iptablesComment(line)); ok {
+				rules = append(rules, rule)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// iptablesComment returns the comment of a rule listed by iptables -S,
+// which quotes comments with characters other than [A-Za-z0-9_-]
+func iptablesComment(line string) string {
+	fields := strings.Fields(line)
+	for i, field := range fields {
+		if field == "--comment" && i+1 < len(fields) {
+			return strings.Trim(fields[i+1], `"`)
+		}
+	}
+	return ""
+}
+
+func (b *iptablesBackend) Add(rule redirectRule) error {
+	ipt, err := b.table(rule)
+	if err != nil {
+		return err
+	}
+	ruleSpec := redirectRuleSpec(rule)
+	exists, err := ipt.Exists(ipTableTarget, iptablesChain, ruleSpec...)
+	if err != nil {
+		log.Printf("Error checking for iptables rule %s: %v", rule, err)
+	}
+	if exists {
+		log.Printf("iptables rule already exists for %s", rule)
+		return nil
+	}
+	log.Printf("Adding iptables rule: %s", strings.Join(ruleSpec, " "))
+	return ipt.AppendUnique(ipTableTarget, iptablesChain, ruleSpec...)
+}
+
+// Delete deletes the rules with the comment of rule, regardless of the rest
+// of their spec, e.g. a changed --exclude-uid
+func (b *iptablesBackend) Delete(rule redirectRule) error {
+	ipt, err := b.table(rule)
+	if err != nil {
+		return err
+	}
+	lines, err := ipt.List(ipTableTarget, iptablesChain)
+	if err != nil {
+		return err
+	}
+	// The first line is the chain itself, rule numbers start at 1. Delete
+	// from the bottom so that the numbers of the remaining rules hold.
+	for id := len(lines) - 1; id > 0; id-- {
+		if iptablesComment(lines[id]) != rule.comment() {
+			continue
+		}
+		log.Printf("Deleting iptables rule: %s", lines[id])
+		if err := ipt.DeleteById(ipTableTarget, iptablesChain, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *iptablesBackend) Cleanup() error {
+	var errs []error
+	for _, ipt := range b.tables() {
+		if err := ipt.DeleteIfExists(ipTableTarget, ipTableChain, "-j", iptablesChain); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := ipt.ClearAndDeleteChain(ipTableTarget, iptablesChain); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+// fakeIPTables keeps the rules of the chains as iptables -S would list them
+type fakeIPTables struct {
+	chains    map[string][]string
+	appendErr error
+}
+
+func newFakeIPTables() *fakeIPTables {
+	return &fakeIPTables{chains: map[string][]string{"nat/OUTPUT": nil}}
+}
+
+func (f *fakeIPTables) Exists(table, chain string, rulespec ...string) (bool, error) {
+	return slices.Contains(f.chains[table+"/"+chain], strings.Join(rulespec, " ")), nil
+}
+
+func (f *fakeIPTables) AppendUnique(table, chain string, rulespec ...string) error {
+	if f.appendErr != nil {
+		return f.appendErr
+	}
+	key := table + "/" + chain
+	if _, ok := f.chains[key]; !ok {
+		return fmt.Errorf("chain %s does not exist", chain)
+	}
+	if rule := strings.Join(rulespec, " "); !slices.Contains(f.chains[key], rule) {
+		f.chains[key] = append(f.chains[key], rule)
+	}
+	return nil
+}
+
+func (f *fakeIPTables) DeleteIfExists(table, chain string, rulespec ...string) error {
+	key := table + "/" + chain
+	f.chains[key] = slices.DeleteFunc(f.chains[key], func(rule string) bool { return rule == strings.Join(rulespec, " ") })
+	return nil
+}
+
+func (f *fakeIPTables) DeleteById(table, chain string, id int) error {
+	key := table + "/" + chain
+	if id < 1 || id > len(f.chains[key]) {
+		return fmt.Errorf("no rule %d in chain %s", id, chain)
+	}
+	f.chains[key] = slices.Delete(f.chains[key], id-1, id)
+	return nil
+}
+
+func (f *fakeIPTables) List(table, chain string) ([]string, error) {
+	rules, ok := f.chains[table+"/"+chain]
+	if !ok {
+		return nil, fmt.Errorf("chain %s does not exist", chain)
+	}
+	lines := []string{"-N " + chain}
+	for _, rule := range rules {
+		lines = append(lines, "-A "+chain+" "+quoteIPTablesComment(rule))
+	}
+	return lines, nil
+}
+
+// quoteIPTablesComment quotes the comment of a rule like iptables -S does
+// when it has characters other than [A-Za-z0-9_-]
+func quoteIPTablesComment(rule string) string {
+	fields := strings.Fields(rule)
+	for i, field := range fields {
+		if i > 0 && fields[i-1] == "--comment" && strings.IndexFunc(field, func(r rune) bool {
+			return !(r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' || r == '-')
+		}) >= 0 {
+			fields[i] = `"` + field + `"`
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+func (f *fakeIPTables) ChainExists(table, chain string) (bool, error) {
+	_, ok := f.chains[table+"/"+chain]
+	return ok, nil
+}
+
+func (f *fakeIPTables) NewChain(table, chain string) error {
+	f.chains[table+"/"+chain] = nil
+	return nil
+}
+
+func (f *fakeIPTables) ClearAndDeleteChain(table, chain string) error {
+	delete(f.chains, table+"/"+chain)
+	return nil
+}
+
+// TestRedirectRuleComment tests finding the rules of dsproxy by their comment
+func TestRedirectRuleComment(t *testing.T) {
+	RegisterTestingT(t)
+
+	for _, rule := range []redirectRule{
+		{Domain: "prometheus.example.com", IP: "10.0.0.1", Port: 9090},
+		{Domain: "loki.example.com", IP: "2001:db8::1", Port: 443},
+		{Domain: "tempo.example.com", IP: "10.0.0.2", Port: 8443, TLS: true},
+	} {
+		parsed, ok := parseRuleComment(rule.comment())
+		Expect(ok).To(BeTrue())
+		Expect(parsed).To(Equal(rule))
+		parsed, ok = parseRuleComment(`"` + rule.comment() + `"`)
+		Expect(ok).To(BeTrue())
+		Expect(parsed).To(Equal(rule))
+	}
+	for _, comment := range []string{"", "other/example.com/10.0.0.1/80", "dsproxy/example.com/not-an-ip/80", "dsproxy/example.com/10.0.0.1/http", "dsproxy/example.com/10.0.0.1/443/ssl"} {
+		_, ok := parseRuleComment(comment)
+		Expect(ok).To(BeFalse(), comment)
+	}
+}
+
+// TestIPTablesBackend tests installing, listing and removing the redirect
+// rules in the DSPROXY chains of iptables and ip6tables
+func TestIPTablesBackend(t *testing.T) {
+	origExcludeUID := f_excludeUID
+	defer func() { f_excludeUID = origExcludeUID }()
+	v4Rule := redirectRule{Domain: "prometheus.example.com", IP: "1.2.3.4", Port: 443}
+	v6Rule := redirectRule{Domain: "prometheus.example.com", IP: "2001:db8::1", Port: 443, TLS: true}
+
+	t.Run("RuleSpec", func(t *testing.T) {
+		RegisterTestingT(t)
+		f_excludeUID = 1337
+		Expect(redirectRuleSpec(v4Rule)).To(Equal([]string{
+			"-p", "tcp", "-d", "1.2.3.4", "--dport", "443",
+			"-m", "owner", "!", "--uid-owner", "1337",
+			"-m", "comment", "--comment", "dsproxy/prometheus.example.com/1.2.3.4/443",
+			"-j", "REDIRECT", "--to-port", fmt.Sprintf("%d", redirectPortHTTP),
+		}))
+		Expect(redirectRuleSpec(v6Rule)).To(Equal([]string{
+			"-p", "tcp", "-d", "2001:db8::1", "--dport", "443",
+			"-m", "owner", "!", "--uid-owner", "1337",
+			"-m", "comment", "--comment", "dsproxy/prometheus.example.com/2001:db8::1/443/tls",
+			"-j", "REDIRECT", "--to-port", fmt.Sprintf("%d", redirectPortHTTPS),
+		}))
+		f_excludeUID = -1
+		Expect(redirectRuleSpec(v4Rule)).ToNot(ContainElement("--uid-owner"))
+	})
+
+	t.Run("Chains", func(t *testing.T) {
+		RegisterTestingT(t)
+		v4, v6 := newFakeIPTables(), newFakeIPTables()
+		_, err := newIPTablesBackend(v4, v6)
+		Expect(err).ToNot(HaveOccurred())
+		// Creating the backend again, e.g. after a restart, keeps a single jump
+		_, err = newIPTablesBackend(v4, v6)
+		Expect(err).ToNot(HaveOccurred())
+		for _, ipt := range []*fakeIPTables{v4, v6} {
+			Expect(ipt.chains).To(HaveKey("nat/DSPROXY"))
+			Expect(ipt.chains["nat/OUTPUT"]).To(Equal([]string{"-j DSPROXY"}))
+		}
+	})
+
+	t.Run("AddAndDelete", func(t *testing.T) {
+		RegisterTestingT(t)
+		f_excludeUID = 1337
+		v4, v6 := newFakeIPTables(), newFakeIPTables()
+		backend, err := newIPTablesBackend(v4, v6)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(backend.Add(v4Rule)).To(Succeed())
+		Expect(backend.Add(v4Rule)).To(Succeed())
+		Expect(backend.Add(v6Rule)).To(Succeed())
+		Expect(v4.chains["nat/DSPROXY"]).To(HaveLen(1))
+		Expect(v6.chains["nat/DSPROXY"]).To(HaveLen(1))
+		Expect(backend.Rules()).To(ConsistOf(v4Rule, v6Rule))
+
+		// Rules are deleted by their comment, even if installed with another
+		// excluded UID
+		f_excludeUID = 1000
+		Expect(backend.Delete(v4Rule)).To(Succeed())
+		Expect(backend.Rules()).To(ConsistOf(v6Rule))
+		Expect(backend.Delete(v4Rule)).To(Succeed())
+	})
+
+	t.Run("NoIPv6", func(t *testing.T) {
+		RegisterTestingT(t)
+		backend, err := newIPTablesBackend(newFakeIPTables(), nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(backend.Add(v4Rule)).To(Succeed())
+		Expect(backend.Add(v6Rule)).To(MatchError(ContainSubstring("ip6tables is not available")))
+		Expect(backend.Rules()).To(ConsistOf(v4Rule))
+	})
+
+	t.Run("AddError", func(t *testing.T) {
+		RegisterTestingT(t)
+		v4 := newFakeIPTables()
+		backend, err := newIPTablesBackend(v4, nil)
+		Expect(err).ToNot(HaveOccurred())
+		v4.appendErr = errors.New("append fail")
+		Expect(backend.Add(v4Rule)).ToNot(Succeed())
+	})
+
+	t.Run("Cleanup", func(t *testing.T) {
+		RegisterTestingT(t)
+		v4, v6 := newFakeIPTables(), newFakeIPTables()
+		v4.chains["nat/OUTPUT"] = []string{"-j OTHER"}
+		backend, err := newIPTablesBackend(v4, v6)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(backend.Add(v4Rule)).To(Succeed())
+		Expect(backend.Cleanup()).To(Succeed())
+		Expect(v4.chains).ToNot(HaveKey("nat/DSPROXY"))
+		Expect(v6.chains).ToNot(HaveKey("nat/DSPROXY"))
+		Expect(v4.chains["nat/OUTPUT"]).To(Equal([]string{"-j OTHER"}))
+	})
+}
+
+// TestNewRuleBackend tests the validation of the firewall backend options
+func TestNewRuleBackend(t *testing.T) {
+	RegisterTestingT(t)
+
+	_, err := newRuleBackend("pf", false)
+	Expect(err).To(MatchError(`unknown firewall backend "pf"`))
+	_, err = newRuleBackend(firewallBackendIPTables, true)
+	Expect(err).To(MatchError(ContainSubstring("requires the nftables backend")))
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	flag "github.com/spf13/pflag"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// sarConcurrency limits the SubjectAccessReviews in flight per lookup
+const sarConcurrency = 10
+
+// sarAuthorizer derives the namespaces a user may query from Kubernetes RBAC.
+// A namespace is allowed if the user or one of their groups may get pods in
+// it, or get the namespace itself, i.e. see the project in the console.
+type sarAuthorizer struct {
+	client  kubernetes.Interface
+	cluster string
+	ttl     time.Duration
+	// maxNamespaces bounds the namespaces reviewed per lookup, each costing
+	// up to two SubjectAccessReviews
+	maxNamespaces int
+
+	mu    sync.Mutex
+	cache map[string]sarCacheEntry
+}
+
+type sarCacheEntry struct {
+	pairs   [][2]string
+	expires time.Time
+}
+
+// newSARAuthorizer creates a SubjectAccessReview based authorizer. cluster is
+// the cluster name the allowed namespaces are reported for, ttl how long the
+// namespaces of a user are cached and maxNamespaces the most namespaces a
+// lookup reviews, unlimited when 0.
+func newSARAuthorizer(client kubernetes.Interface, cluster string, ttl time.Duration, maxNamespaces int) *sarAuthorizer {
+	return &sarAuthorizer{
+		client:        client,
+		cluster:       cluster,
+		ttl:           ttl,
+		maxNamespaces: maxNamespaces,
+		cache:         map[string]sarCacheEntry{},
+	}
+}
+
+// newClusterSARAuthorizer creates a SubjectAccessReview based authorizer for
+// the API server dsproxy runs in, or the one of $KUBECONFIG when running
+// outside of a cluster.
+func newClusterSARAuthorizer(cluster string, ttl time.Duration, maxNamespaces int) (*sarAuthorizer, error) {
+	client, err := newKubernetesClient()
+	if err != nil {
+		return nil, err
+	}
+	return newSARAuthorizer(client, cluster, ttl, maxNamespaces), nil
+}
+
+// sarIdentityConfigured reports whether the identity claim was set
+// explicitly. The sar backend reviews the identity as the Kubernetes user
+// name, which the default sub claim rarely is: the API server prefixes it
+// with the issuer unless configured otherwise.
+func sarIdentityConfigured() bool {
+	return flag.CommandLine.Changed("identity-claim") || os.Getenv("DSPROXY_IDENTITY_CLAIM") != ""
+}
+
+// newKubernetesClient creates a client for the API server dsproxy runs in,
+// or the one of $KUBECONFIG when running outside of a cluster.
+func newKubernetesClient() (kubernetes.Interface, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		config, err = clientcmd.BuildConfigFromFlags("", clientcmd.NewDefaultClientConfigLoadingRules().GetDefaultFilename())
+		if err != nil {
+			return nil, fmt.Errorf("failed to load kubernetes client config: %w", err)
+		}
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kubernetes client: %w", err)
+	}
+	return client, nil
+}
+
+// AllowedPairs implements Authorizer. RBAC grants access to the namespaces
+// regardless of the datasource and action.
+func (s *sarAuthorizer) AllowedPairs(ctx context.Context, subject string, groups []string, datasource, action string) ([][2]string, error) {
+	pairs, err := s.allowedPairs(ctx, subject, groups)
+	if err != nil {
+		return nil, fmt.Errorf("subject access review failed: %w", err)
+	}
+	return pairs, nil
+}
+
+// allowedPairs returns the cluster/namespace pairs the user may access. A
+// user allowed to get pods cluster wide gets a single wildcard pair.
+func (s *sarAuthorizer) allowedPairs(ctx context.Context, user string, groups []string) ([][2]string, error) {
+	sortedGroups := append([]string(nil), groups...)
+	sort.Strings(sortedGroups)
+	key := user + "\x00" + strings.Join(sortedGroups, "\x00")
+
+	s.mu.Lock()
+	entry, ok := s.cache[key]
+	s.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.pairs, nil
+	}
+
+	pairs, err := s.lookup(ctx, user, sortedGroups)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	for k, e := range s.cache {
+		if now.After(e.expires) {
+			delete(s.cache, k)
+		}
+	}
+	s.cache[key] = sarCacheEntry{pairs: pairs, expires: now.Add(s.ttl)}
+	s.mu.Unlock()
+	return pairs, nil
+}
+
+func (s *sarAuthorizer) lookup(ctx context.Context, user string, groups []string) ([][2]string, error) {
+	allowed, err := s.review(ctx, user, groups, &authorizationv1.ResourceAttributes{Verb: "get", Resource: "pods"})
+	if err != nil {
+		return nil, err
+	}
+	if allowed {
+		log.Printf("[authz] %s may get pods cluster wide", user)
+		return [][2]string{{s.cluster, "*"}}, nil
+	}
+
+	namespaces, err := s.client.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list namespaces: %w", err)
+	}
+	if s.maxNamespaces > 0 && len(namespaces.Items) > s.maxNamespaces {
+		return nil, fmt.Errorf("%d namespaces exceed the %d reviewed per lookup", len(namespaces.Items), s.maxNamespaces)
+	}
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+		pairs    [][2]string
+	)
+	sem := make(chan struct{}, sarConcurrency)
+	for _, ns := range namespaces.Items {
+		namespace := ns.Name
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			allowed, err := s.namespaceAllowed(ctx, user, groups, namespace)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			if allowed {
+				pairs = append(pairs, [2]string{s.cluster, namespace})
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i][1] < pairs[j][1] })
+	return pairs, nil
+}
+
+func (s *sarAuthorizer) namespaceAllowed(ctx context.Context, user string, groups []string, namespace string) (bool, error) {
+	allowed, err := s.review(ctx, user, groups, &authorizationv1.ResourceAttributes{Namespace: namespace, Verb: "get", Resource: "pods"})
+	if err != nil || allowed {
+		return allowed, err
+	}
+	return s.review(ctx, user, groups, &authorizationv1.ResourceAttributes{Namespace: namespace, Verb: "get", Resource: "namespaces", Name: namespace})
+}
+
+func (s *sarAuthorizer) review(ctx context.Context, user string, groups []string, attributes *authorizationv1.ResourceAttributes) (bool, error) {
+	review := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:               user,
+			Groups:             groups,
+			ResourceAttributes: attributes,
+		},
+	}
+	result, err := s.client.AuthorizationV1().SubjectAccessReviews().Create(ctx, review, metav1.CreateOptions{})
+	if err != nil {
+		return false, fmt.Errorf("failed to create subject access review: %w", err)
+	}
+	return result.Status.Allowed, nil
+}
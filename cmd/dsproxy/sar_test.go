@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newFakeSARClient returns a fake clientset answering SubjectAccessReviews
+// with allow and counting them in reviews
+func newFakeSARClient(allow func(spec authorizationv1.SubjectAccessReviewSpec) bool, reviews *int32, namespaces ...string) *fake.Clientset {
+	var objects []runtime.Object
+	for _, ns := range namespaces {
+		objects = append(objects, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: ns}})
+	}
+	client := fake.NewSimpleClientset(objects...)
+	client.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		atomic.AddInt32(reviews, 1)
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		review.Status.Allowed = allow(review.Spec)
+		return true, review, nil
+	})
+	return client
+}
+
+// TestSARAuthorizer tests deriving allowed namespaces from SubjectAccessReviews
+func TestSARAuthorizer(t *testing.T) {
+	allow := func(spec authorizationv1.SubjectAccessReviewSpec) bool {
+		attrs := spec.ResourceAttributes
+		switch {
+		case spec.User == "admin":
+			return true
+		case attrs.Namespace == "frontend" && attrs.Resource == "pods":
+			return spec.User == "alice"
+		case attrs.Namespace == "backend" && attrs.Resource == "namespaces" && attrs.Name == "backend":
+			for _, group := range spec.Groups {
+				if group == "team-backend" {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	t.Run("Namespaces", func(t *testing.T) {
+		RegisterTestingT(t)
+		var reviews int32
+		sar := newSARAuthorizer(newFakeSARClient(allow, &reviews, "frontend", "backend", "secret"), "local-cluster", time.Minute, 0)
+
+		pairs, err := sar.allowedPairs(context.Background(), "alice", []string{"team-backend"})
+		Expect(err).To(BeNil())
+		Expect(pairs).To(Equal([][2]string{{"local-cluster", "backend"}, {"local-cluster", "frontend"}}))
+	})
+
+	t.Run("ClusterWide", func(t *testing.T) {
+		RegisterTestingT(t)
+		var reviews int32
+		sar := newSARAuthorizer(newFakeSARClient(allow, &reviews, "frontend", "backend"), "local-cluster", time.Minute, 0)
+
+		pairs, err := sar.allowedPairs(context.Background(), "admin", nil)
+		Expect(err).To(BeNil())
+		Expect(pairs).To(Equal([][2]string{{"local-cluster", "*"}}))
+		Expect(reviews).To(Equal(int32(1)))
+	})
+
+	t.Run("Cache", func(t *testing.T) {
+		RegisterTestingT(t)
+		var reviews int32
+		sar := newSARAuthorizer(newFakeSARClient(allow, &reviews, "frontend", "backend"), "local-cluster", time.Minute, 0)
+
+		_, err := sar.allowedPairs(context.Background(), "alice", []string{"b", "a"})
+		Expect(err).To(BeNil())
+		first := atomic.LoadInt32(&reviews)
+
+		// Group order does not matter for the cache key
+		_, err = sar.allowedPairs(context.Background(), "alice", []string{"a", "b"})
+		Expect(err).To(BeNil())
+		Expect(atomic.LoadInt32(&reviews)).To(Equal(first))
+
+		_, err = sar.allowedPairs(context.Background(), "alice", []string{"a"})
+		Expect(err).To(BeNil())
+		Expect(atomic.LoadInt32(&reviews)).To(BeNumerically(">", first))
+	})
+
+	t.Run("MaxNamespaces", func(t *testing.T) {
+		RegisterTestingT(t)
+		var reviews int32
+		sar := newSARAuthorizer(newFakeSARClient(allow, &reviews, "frontend", "backend", "secret"), "local-cluster", time.Minute, 2)
+
+		_, err := sar.allowedPairs(context.Background(), "alice", nil)
+		Expect(err).To(MatchError("3 namespaces exceed the 2 reviewed per lookup"))
+		Expect(reviews).To(Equal(int32(1)))
+
+		// Cluster wide access is reviewed before listing the namespaces
+		pairs, err := sar.allowedPairs(context.Background(), "admin", nil)
+		Expect(err).To(BeNil())
+		Expect(pairs).To(Equal([][2]string{{"local-cluster", "*"}}))
+	})
+
+	t.Run("Expiry", func(t *testing.T) {
+		RegisterTestingT(t)
+		var reviews int32
+		sar := newSARAuthorizer(newFakeSARClient(allow, &reviews, "frontend"), "local-cluster", 0, 0)
+
+		_, err := sar.allowedPairs(context.Background(), "alice", nil)
+		Expect(err).To(BeNil())
+		first := atomic.LoadInt32(&reviews)
+		_, err = sar.allowedPairs(context.Background(), "alice", nil)
+		Expect(err).To(BeNil())
+		Expect(atomic.LoadInt32(&reviews)).To(Equal(2 * first))
+	})
+}
+
+// TestSARAuthzMiddleware tests the authz middleware with the SAR authorizer
+func TestSARAuthzMiddleware(t *testing.T) {
+	RegisterTestingT(t)
+
+	var reviews int32
+	client := newFakeSARClient(func(spec authorizationv1.SubjectAccessReviewSpec) bool {
+		return spec.User == "alice" && spec.ResourceAttributes.Namespace == "frontend"
+	}, &reviews, "frontend", "backend")
+	authzService := &AuthzService{authorizer: newSARAuthorizer(client, "local-cluster", time.Minute, 0)}
+
+	var allowed [][2]string
+	handler := authzService.authzMiddleware("read")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed, _ = r.Context().Value(ContextKeyAllowedClusters).([][2]string)
+	}))
+
+	serve := func(user string) int {
+		req := httptest.NewRequest("GET", "/api/v1/query?query=up", nil)
+		req = req.WithContext(context.WithValue(req.Context(), ContextKeyEmail, user))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	Expect(serve("alice")).To(Equal(http.StatusOK))
+	Expect(allowed).To(Equal([][2]string{{"local-cluster", "frontend"}}))
+
+	Expect(serve("mallory")).To(Equal(http.StatusForbidden))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// StaticPolicy is the YAML file of the static authorization backend.
+// Example static.yaml:
+//
+// rules:
+//   - groups: [team-frontend]
+//     namespaces: ["*/frontend-*"]
+//   - subjects: [alice@example.com]
+//     datasources: [prometheus-prod]
+//     namespaces: [prod-cluster/backend]
+type StaticPolicy struct {
+	Rules []StaticRule `yaml:"rules"`
+}
+
+// StaticRule grants subjects and groups read access to cluster/namespace
+// patterns through a set of datasources, all datasources when empty.
+type StaticRule struct {
+	Subjects    []string `yaml:"subjects"`
+	Groups      []string `yaml:"groups"`
+	Datasources []string `yaml:"datasources"`
+	Namespaces  []string `yaml:"namespaces"`
+}
+
+// staticAuthorizer authorizes with the rules of a StaticPolicy, loaded once
+// at startup.
+type staticAuthorizer struct {
+	rules []StaticRule
+}
+
+func newStaticAuthorizer(path string) (*staticAuthorizer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read static policy: %w", err)
+	}
+	var policy StaticPolicy
+	if err := yaml.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("failed to parse static policy: %w", err)
+	}
+	for i, rule := range policy.Rules {
+		for _, pattern := range rule.Namespaces {
+			if _, _, ok := strings.Cut(pattern, "/"); !ok {
+				return nil, fmt.Errorf("rule %d: namespace %q is not of the form cluster/namespace", i, pattern)
+			}
+		}
+	}
+	return &staticAuthorizer{rules: policy.Rules}, nil
+}
+
+// AllowedPairs implements Authorizer. Static rules only grant read access.
+func (s *staticAuthorizer) AllowedPairs(ctx context.Context, subject string, groups []string, datasource, action string) ([][2]string, error) {
+	if action != "read" {
+		return nil, nil
+	}
+
+	var pairs [][2]string
+	seen := map[[2]string]struct{}{}
+	for _, rule := range s.rules {
+		if !rule.matches(subject, groups, datasource) {
+			continue
+		}
+		for _, pattern := range rule.Namespaces {
+			cluster, namespace, _ := strings.Cut(pattern, "/")
+			pair := [2]string{cluster, namespace}
+			if _, ok := seen[pair]; ok {
+				continue
+			}
+			seen[pair] = struct{}{}
+			pairs = append(pairs, pair)
+		}
+	}
+	return pairs, nil
+}
+
+func (r StaticRule) matches(subject string, groups []string, datasource string) bool {
+	if len(r.Datasources) > 0 {
+		matched := false
+		for _, ds := range r.Datasources {
+			if ds == "*" || ds == datasource {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	for _, s := range r.Subjects {
+		if s == subject {
+			return true
+		}
+	}
+	for _, g := range r.Groups {
+		for _, group := range groups {
+			if g == group {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+const (
+	// DataSourceTypeTempo is the X-Datasource-Type header value selecting Tempo mode
+	DataSourceTypeTempo = "tempo"
+
+	traceQLParam          = "q"
+	tempoResourcePrefix   = "resource."
+	contextKeyTraceFilter = contextKey("trace_filter")
+)
+
+// tempoEndpoint matches the Tempo API endpoints Grafana uses below any path
+// prefix, e.g. the TempoStack gateway /api/traces/v1/<tenant>/tempo.
+var tempoEndpoint = regexp.MustCompile(`/api/(echo|status/buildinfo|search|v2/search/tags|v2/search/tag/[^/]+/values|traces/[^/]+|v2/traces/[^/]+)$`)
+
+// tempoProxy enforces namespace scoping on Tempo datasources. TraceQL
+// queries get a namespace condition added to every spanset filter and
+// trace-by-ID responses are filtered down to resources from authorized
+// namespaces.
+type tempoProxy struct {
+	attribute         string
+	resourceAttribute string
+	proxy             *httputil.ReverseProxy
+	traceProxy        *httputil.ReverseProxy
+}
+
+// newTempoProxy creates a handler for Tempo datasources. attribute is the
+// resource-scoped TraceQL attribute holding the namespace, e.g.
+// resource.k8s.namespace.name.
+func newTempoProxy(upstreamURL, attribute string, transport http.RoundTripper) (http.Handler, error) {
+	upstream, err := url.Parse(upstreamURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse upstream URL: %w", err)
+	}
+	if !strings.HasPrefix(attribute, tempoResourcePrefix) || len(attribute) == len(tempoResourcePrefix) {
+		return nil, fmt.Errorf("tempo namespace attribute %q must be resource scoped (resource.<name>)", attribute)
+	}
+
+	p := &tempoProxy{
+		attribute:         attribute,
+		resourceAttribute: strings.TrimPrefix(attribute, tempoResourcePrefix),
+		proxy:             httputil.NewSingleHostReverseProxy(upstream),
+		traceProxy:        httputil.NewSingleHostReverseProxy(upstream),
+	}
+	p.proxy.Transport = transport
+	p.traceProxy.Transport = transport
+	p.traceProxy.ModifyResponse = p.filterTraceResponse
+	return p, nil
+}
+
+func (p *tempoProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	match := tempoEndpoint.FindStringSubmatch(r.URL.Path)
+	if match == nil || r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	endpoint := match[1]
+	if endpoint == "echo" || endpoint == "status/buildinfo" {
+		p.proxy.ServeHTTP(w, r)
+		return
+	}
+
+	namespaces := allowedNamespaces(r)
+	if len(namespaces) == 0 {
+		http.Error(w, "No authorized namespaces", http.StatusForbidden)
+		return
+	}
+	matcher, err := patternMatcher(p.resourceAttribute, namespaces)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if matcher == nil {
+		log.Printf("[tempo] unrestricted access, forwarding request unchanged")
+		p.proxy.ServeHTTP(w, r)
+		return
+	}
+
+	if strings.HasPrefix(endpoint, "traces/") || strings.HasPrefix(endpoint, "v2/traces/") {
+		// Request plain JSON so the response can be filtered
+		r.Header.Del("Accept-Encoding")
+		r.Header.Set("Accept", "application/json")
+		log.Printf("[tempo] filtering trace %s by %s", r.URL.Path, matcher.String())
+		p.traceProxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKeyTraceFilter, matcher)))
+		return
+	}
+
+	// Tag based search (tags=, minDuration=, ...) bypasses TraceQL
+	if endpoint == "search" && r.URL.Query().Has("tags") {
+		http.Error(w, "tag based search is not supported, use a TraceQL query", http.StatusBadRequest)
+		return
+	}
+
+	condition := p.condition(matcher)
+	err = rewriteRequestParam(r, traceQLParam, true, func(values []string) ([]string, error) {
+		enforced := make([]string, 0, len(values))
+		for _, value := range values {
+			query, err := enforceTraceQL(value, condition)
+			if err != nil {
+				return nil, err
+			}
+			enforced = append(enforced, query)
+		}
+		if len(enforced) == 0 {
+			enforced = append(enforced, fmt.Sprintf("{ %s }", condition))
+		}
+		return enforced, nil
+	})
+	if err != nil {
+		log.Printf("[tempo] rejecting query: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("[tempo] injected %s for %s", condition, r.URL.Path)
+	p.proxy.ServeHTTP(w, r)
+}
+
+// condition renders the TraceQL condition restricting spans to matcher.
+// Regular expressions are anchored explicitly, as older Tempo releases match
+// them unanchored.
+func (p *tempoProxy) condition(matcher *labels.Matcher) string {
+	if matcher.Type == labels.MatchEqual {
+		return fmt.Sprintf("%s = %s", p.attribute, strconv.Quote(matcher.Value))
+	}
+	return fmt.Sprintf("%s =~ %s", p.attribute, strconv.Quote("^(?:"+matcher.Value+")$"))
+}
+
+// filterTraceResponse drops all resource spans of a trace-by-ID response
+// whose namespace is not matched by the request's trace filter. A trace
+// without any authorized spans is reported as not found.
+func (p *tempoProxy) filterTraceResponse(resp *http.Response) error {
+	matcher, ok := resp.Request.Context().Value(contextKeyTraceFilter).(*labels.Matcher)
+	if !ok || resp.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read trace response: %w", err)
+	}
+	filtered, kept, err := filterTrace(body, p.resourceAttribute, matcher)
+	if err != nil {
+		return err
+	}
+	if kept == 0 {
+		filtered = []byte("trace not found\n")
+		resp.StatusCode = http.StatusNotFound
+		resp.Status = "404 Not Found"
+		resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(filtered))
+	resp.ContentLength = int64(len(filtered))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(filtered)))
+	return nil
+}
+
+// filterTrace filters an OTLP JSON trace as returned by /api/traces/<id>
+// ("batches" or "resourceSpans") or /api/v2/traces/<id> (wrapped in "trace")
+// and returns the re-encoded trace and the number of resource spans kept.
+// Unknown response shapes are rejected rather than passed through.
+func filterTrace(body []byte, resourceAttribute string, matcher *labels.Matcher) ([]byte, int, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var doc map[string]any
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode trace response: %w", err)
+	}
+
+	trace := doc
+	_, wrapped := doc["trace"]
+	if wrapped {
+		// A v2 response for a trace without spans has no resource spans at all
+		trace, _ = doc["trace"].(map[string]any)
+	}
+
+	found, kept := false, 0
+	for _, key := range []string{"batches", "resourceSpans"} {
+		raw, ok := trace[key]
+		if !ok {
+			continue
+		}
+		resourceSpans, ok := raw.([]any)
+		if !ok {
+			return nil, 0, fmt.Errorf("unexpected %q in trace response", key)
+		}
+		found = true
+
+		allowed := make([]any, 0, len(resourceSpans))
+		for _, rs := range resourceSpans {
+			if matcher.Matches(resourceAttributeValue(rs, resourceAttribute)) {
+				allowed = append(allowed, rs)
+			}
+		}
+		trace[key] = allowed
+		kept += len(allowed)
+	}
+	if !found && !wrapped {
+		return nil, 0, errors.New("unrecognized trace response")
+	}
+
+	filtered, err := json.Marshal(doc)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to encode trace response: %w", err)
+	}
+	return filtered, kept, nil
+}
+
+// resourceAttributeValue returns the string value of the named attribute of
+// an OTLP JSON resource spans object, or "" when it is not set.
+func resourceAttributeValue(resourceSpans any, name string) string {
+	rs, _ := resourceSpans.(map[string]any)
+	resource, _ := rs["resource"].(map[string]any)
+	attributes, _ := resource["attributes"].([]any)
+	for _, attr := range attributes {
+		kv, _ := attr.(map[string]any)
+		if key, _ := kv["key"].(string); key != name {
+			continue
+		}
+		value, _ := kv["value"].(map[string]any)
+		s, _ := value["stringValue"].(string)
+		return s
+	}
+	return ""
+}
+
+// enforceTraceQL adds condition to every spanset filter of a TraceQL query,
+// so that only spans satisfying it can be selected. Braces outside of string
+// literals only ever delimit spanset filters in TraceQL; string literals are
+// copied verbatim and anything unexpected rejects the whole query.
+func enforceTraceQL(query, condition string) (string, error) {
+	var b strings.Builder
+	filters := 0
+	for i := 0; i < len(query); {
+		switch c := query[i]; c {
+		case '"', '`':
+			end, err := stringLiteralEnd(query, i)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(query[i:end])
+			i = end
+		case '/':
+			if isTraceQLComment(query, i) {
+				return "", fmt.Errorf("%w: comments are not supported", errUnsafeQuery)
+			}
+			b.WriteByte(c)
+			i++
+		case '}':
+			return "", fmt.Errorf("%w: unexpected '}' at position %d", errUnsafeQuery, i)
+		case '{':
+			end, err := spansetFilterEnd(query, i)
+			if err != nil {
+				return "", err
+			}
+			if inner := strings.TrimSpace(query[i+1 : end-1]); inner == "" {
+				fmt.Fprintf(&b, "{ %s }", condition)
+			} else {
+				fmt.Fprintf(&b, "{ (%s) && %s }", inner, condition)
+			}
+			filters++
+			i = end
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	if filters == 0 {
+		return "", fmt.Errorf("%w: query has no spanset filter", errUnsafeQuery)
+	}
+	return b.String(), nil
+}
+
+// spansetFilterEnd returns the index after the closing brace of the spanset
+// filter starting at query[start]. Spanset filters cannot be nested.
+func spansetFilterEnd(query string, start int) (int, error) {
+	for i := start + 1; i < len(query); {
+		switch query[i] {
+		case '"', '`':
+			end, err := stringLiteralEnd(query, i)
+			if err != nil {
+				return 0, err
+			}
+			i = end
+		case '/':
+			if isTraceQLComment(query, i) {
+				return 0, fmt.Errorf("%w: comments are not supported", errUnsafeQuery)
+			}
+			i++
+		case '{':
+			return 0, fmt.Errorf("%w: unexpected '{' at position %d", errUnsafeQuery, i)
+		case '}':
+			return i + 1, nil
+		default:
+			i++
+		}
+	}
+	return 0, fmt.Errorf("%w: unterminated spanset filter", errUnsafeQuery)
+}
+
+func isTraceQLComment(query string, i int) bool {
+	return strings.HasPrefix(query[i:], "//") || strings.HasPrefix(query[i:], "/*")
+}
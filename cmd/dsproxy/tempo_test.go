@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// TestEnforceTraceQL tests namespace condition injection into TraceQL queries
+func TestEnforceTraceQL(t *testing.T) {
+	const condition = `resource.k8s.namespace.name = "frontend"`
+
+	testCases := []struct {
+		name     string
+		query    string
+		expected string
+		errorMsg string
+	}{
+		{
+			name:     "EmptyFilter",
+			query:    `{}`,
+			expected: `{ resource.k8s.namespace.name = "frontend" }`,
+		},
+		{
+			name:     "SimpleFilter",
+			query:    `{ span.http.status_code >= 500 }`,
+			expected: `{ (span.http.status_code >= 500) && resource.k8s.namespace.name = "frontend" }`,
+		},
+		{
+			name:     "DisjunctionIsWrapped",
+			query:    `{ .a = 1 || .b = 2 }`,
+			expected: `{ (.a = 1 || .b = 2) && resource.k8s.namespace.name = "frontend" }`,
+		},
+		{
+			name:     "StructuralQuery",
+			query:    `{ resource.service.name = "web" } >> { status = error }`,
+			expected: `{ (resource.service.name = "web") && resource.k8s.namespace.name = "frontend" } >> { (status = error) && resource.k8s.namespace.name = "frontend" }`,
+		},
+		{
+			name:     "PipelineIsPreserved",
+			query:    `{ name = "GET" } | count() > 2 | select(span.http.url)`,
+			expected: `{ (name = "GET") && resource.k8s.namespace.name = "frontend" } | count() > 2 | select(span.http.url)`,
+		},
+		{
+			name:     "BracesInStrings",
+			query:    `{ span.body = "}{" && span.x = ` + "`{`" + ` }`,
+			expected: `{ (span.body = "}{" && span.x = ` + "`{`" + `) && resource.k8s.namespace.name = "frontend" }`,
+		},
+		{
+			name:     "EscapedQuote",
+			query:    `{ span.msg = "say \"}\"" }`,
+			expected: `{ (span.msg = "say \"}\"") && resource.k8s.namespace.name = "frontend" }`,
+		},
+		{
+			name:     "DivisionIsAllowed",
+			query:    `{ span.a / 2 > 1 }`,
+			expected: `{ (span.a / 2 > 1) && resource.k8s.namespace.name = "frontend" }`,
+		},
+		{
+			name:     "NoFilterRejected",
+			query:    `count() > 1`,
+			errorMsg: "no spanset filter",
+		},
+		{
+			name:     "CommentRejected",
+			query:    `{ .a = 1 // }`,
+			errorMsg: "comments are not supported",
+		},
+		{
+			name:     "NestedFilterRejected",
+			query:    `{ { } }`,
+			errorMsg: "unexpected '{'",
+		},
+		{
+			name:     "UnbalancedBraceRejected",
+			query:    `{ .a = 1 } }`,
+			errorMsg: "unexpected '}'",
+		},
+		{
+			name:     "UnterminatedFilterRejected",
+			query:    `{ .a = 1`,
+			errorMsg: "unterminated spanset filter",
+		},
+		{
+			name:     "UnterminatedStringRejected",
+			query:    `{ .a = "x }`,
+			errorMsg: "unterminated string literal",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			RegisterTestingT(t)
+
+			got, err := enforceTraceQL(tc.query, condition)
+			if tc.errorMsg != "" {
+				Expect(err).ToNot(BeNil())
+				Expect(err.Error()).To(ContainSubstring(tc.errorMsg))
+				return
+			}
+			Expect(err).To(BeNil())
+			Expect(got).To(Equal(tc.expected))
+		})
+	}
+}
+
+// otlpResourceSpans builds a minimal OTLP JSON resource spans object
+func otlpResourceSpans(namespace, spanID string) map[string]any {
+	attributes := []any{
+		map[string]any{"key": "service.name", "value": map[string]any{"stringValue": "svc"}},
+	}
+	if namespace != "" {
+		attributes = append(attributes, map[string]any{"key": "k8s.namespace.name", "value": map[string]any{"stringValue": namespace}})
+	}
+	return map[string]any{
+		"resource": map[string]any{"attributes": attributes},
+		"scopeSpans": []any{
+			map[string]any{"spans": []any{map[string]any{"spanId": spanID, "startTimeUnixNano": "1700000000000000000"}}},
+		},
+	}
+}
+
+// TestFilterTrace tests dropping resource spans from unauthorized namespaces
+func TestFilterTrace(t *testing.T) {
+	matcher := labels.MustNewMatcher(labels.MatchRegexp, "k8s.namespace.name", "backend|frontend")
+
+	t.Run("V1Batches", func(t *testing.T) {
+		RegisterTestingT(t)
+
+		body, _ := json.Marshal(map[string]any{"batches": []any{
+			otlpResourceSpans("frontend", "a"),
+			otlpResourceSpans("secret", "b"),
+			otlpResourceSpans("", "c"),
+			otlpResourceSpans("backend", "d"),
+		}})
+		filtered, kept, err := filterTrace(body, "k8s.namespace.name", matcher)
+		Expect(err).To(BeNil())
+		Expect(kept).To(Equal(2))
+		Expect(string(filtered)).To(ContainSubstring(`"spanId":"a"`))
+		Expect(string(filtered)).To(ContainSubstring(`"spanId":"d"`))
+		Expect(string(filtered)).ToNot(ContainSubstring(`"spanId":"b"`))
+		Expect(string(filtered)).ToNot(ContainSubstring(`"spanId":"c"`))
+		Expect(string(filtered)).To(ContainSubstring(`"startTimeUnixNano":"1700000000000000000"`))
+	})
+
+	t.Run("V2Trace", func(t *testing.T) {
+		RegisterTestingT(t)
+
+		body, _ := json.Marshal(map[string]any{
+			"trace":  map[string]any{"resourceSpans": []any{otlpResourceSpans("secret", "b"), otlpResourceSpans("frontend", "a")}},
+			"status": "COMPLETE",
+		})
+		filtered, kept, err := filterTrace(body, "k8s.namespace.name", matcher)
+		Expect(err).To(BeNil())
+		Expect(kept).To(Equal(1))
+		Expect(string(filtered)).To(ContainSubstring(`"status":"COMPLETE"`))
+		Expect(string(filtered)).ToNot(ContainSubstring(`"spanId":"b"`))
+	})
+
+	t.Run("V2EmptyTrace", func(t *testing.T) {
+		RegisterTestingT(t)
+
+		_, kept, err := filterTrace([]byte(`{"trace":{}}`), "k8s.namespace.name", matcher)
+		Expect(err).To(BeNil())
+		Expect(kept).To(Equal(0))
+	})
+
+	t.Run("UnrecognizedResponse", func(t *testing.T) {
+		RegisterTestingT(t)
+
+		_, _, err := filterTrace([]byte(`{"spans":[]}`), "k8s.namespace.name", matcher)
+		Expect(err).ToNot(BeNil())
+	})
+}
+
+// TestTempoProxy tests the Tempo proxy end to end against a mock upstream
+func TestTempoProxy(t *testing.T) {
+	var received url.Values
+	var receivedPath string
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.URL.Query()
+		receivedPath = r.URL.Path
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/traces/secret":
+			json.NewEncoder(w).Encode(map[string]any{"batches": []any{otlpResourceSpans("secret", "b")}})
+		case "/api/traces/mixed", "/api/traces/v1/dev/tempo/api/traces/mixed":
+			json.NewEncoder(w).Encode(map[string]any{"batches": []any{
+				otlpResourceSpans("frontend", "a"),
+				otlpResourceSpans("secret", "b"),
+			}})
+		default:
+			json.NewEncoder(w).Encode(map[string]any{"traces": []any{}})
+		}
+	}))
+	defer upstreamServer.Close()
+
+	proxy, err := newTempoProxy(upstreamServer.URL, "resource.k8s.namespace.name", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowedPairs := [][2]string{{"", "frontend"}}
+	newRequest := func(target string, pairs [][2]string) *http.Request {
+		req := httptest.NewRequest("GET", target, nil)
+		if pairs != nil {
+			req = req.WithContext(context.WithValue(req.Context(), ContextKeyAllowedClusters, pairs))
+		}
+		return req
+	}
+
+	t.Run("SearchWithQuery", func(t *testing.T) {
+		RegisterTestingT(t)
+		received = nil
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, newRequest("/api/search?limit=20&q="+url.QueryEscape(`{ status = error }`), allowedPairs))
+
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(received.Get("q")).To(Equal(`{ (status = error) && resource.k8s.namespace.name = "frontend" }`))
+		Expect(received.Get("limit")).To(Equal("20"))
+	})
+
+	t.Run("SearchWithoutQuery", func(t *testing.T) {
+		RegisterTestingT(t)
+		received = nil
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, newRequest("/api/search", [][2]string{{"", "frontend"}, {"", "dev-*"}}))
+
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(received.Get("q")).To(Equal(`{ resource.k8s.namespace.name =~ "^(?:dev-.*|frontend)$" }`))
+	})
+
+	t.Run("TagValuesBehindGateway", func(t *testing.T) {
+		RegisterTestingT(t)
+		received = nil
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, newRequest("/api/traces/v1/dev/tempo/api/v2/search/tag/resource.service.name/values", allowedPairs))
+
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(receivedPath).To(Equal("/api/traces/v1/dev/tempo/api/v2/search/tag/resource.service.name/values"))
+		Expect(received.Get("q")).To(Equal(`{ resource.k8s.namespace.name = "frontend" }`))
+	})
+
+	t.Run("TagSearchRejected", func(t *testing.T) {
+		RegisterTestingT(t)
+		received = nil
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, newRequest("/api/search?tags="+url.QueryEscape("service.name=web"), allowedPairs))
+
+		Expect(w.Code).To(Equal(http.StatusBadRequest))
+		Expect(received).To(BeNil())
+	})
+
+	t.Run("TraceByIDIsFiltered", func(t *testing.T) {
+		RegisterTestingT(t)
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, newRequest("/api/traces/v1/dev/tempo/api/traces/mixed", allowedPairs))
+
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(w.Body.String()).To(ContainSubstring(`"spanId":"a"`))
+		Expect(w.Body.String()).ToNot(ContainSubstring(`"spanId":"b"`))
+	})
+
+	t.Run("TraceByIDUnauthorized", func(t *testing.T) {
+		RegisterTestingT(t)
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, newRequest("/api/traces/secret", allowedPairs))
+
+		Expect(w.Code).To(Equal(http.StatusNotFound))
+		Expect(w.Body.String()).ToNot(ContainSubstring(`"spanId"`))
+	})
+
+	t.Run("TraceByIDUnrestricted", func(t *testing.T) {
+		RegisterTestingT(t)
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, newRequest("/api/traces/secret", [][2]string{{"", "*"}}))
+
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(w.Body.String()).To(ContainSubstring(`"spanId":"b"`))
+	})
+
+	t.Run("NoAllowedNamespaces", func(t *testing.T) {
+		RegisterTestingT(t)
+		received = nil
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, newRequest("/api/search", nil))
+
+		Expect(w.Code).To(Equal(http.StatusForbidden))
+		Expect(received).To(BeNil())
+	})
+
+	t.Run("EchoIsForwarded", func(t *testing.T) {
+		RegisterTestingT(t)
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, newRequest("/api/echo", nil))
+
+		Expect(w.Code).To(Equal(http.StatusOK))
+	})
+
+	t.Run("UnknownPath", func(t *testing.T) {
+		RegisterTestingT(t)
+		received = nil
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, newRequest("/api/search/tags", allowedPairs))
+
+		Expect(w.Code).To(Equal(http.StatusNotFound))
+		Expect(received).To(BeNil())
+	})
+}
+
+// TestNewTempoProxy tests validation of the namespace attribute
+func TestNewTempoProxy(t *testing.T) {
+	RegisterTestingT(t)
+
+	_, err := newTempoProxy("http://localhost:3200", "span.k8s.namespace.name", nil)
+	Expect(err).ToNot(BeNil())
+
+	_, err = newTempoProxy("http://localhost:3200", "resource.", nil)
+	Expect(err).ToNot(BeNil())
+
+	_, err = newTempoProxy("http://localhost:3200", "resource.k8s.namespace.name", nil)
+	Expect(err).To(BeNil())
+}
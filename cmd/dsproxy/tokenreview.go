@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// tokenReviewer authenticates the bearer tokens not issued by the OIDC
+// issuer, nil when --token-review is disabled
+var tokenReviewer *tokenReviewAuthenticator
+
+var (
+	errTokenReviewFailed     = errors.New("token review failed")
+	errTokenNotAuthenticated = errors.New("token not authenticated")
+)
+
+// tokenReviewAuthenticator authenticates Kubernetes service account and
+// other opaque tokens with the TokenReview API
+type tokenReviewAuthenticator struct {
+	client    kubernetes.Interface
+	audiences []string
+	// maxTTL caps how long a review is cached, tokens are cached until
+	// their exp claim otherwise
+	maxTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]tokenReviewCacheEntry
+}
+
+type tokenReviewCacheEntry struct {
+	user    authenticationv1.UserInfo
+	expires time.Time
+}
+
+// newTokenReviewAuthenticator creates a TokenReview authenticator. audiences
+// are the audiences the tokens must be valid for, the API server's when
+// empty.
+func newTokenReviewAuthenticator(client kubernetes.Interface, audiences []string, maxTTL time.Duration) *tokenReviewAuthenticator {
+	return &tokenReviewAuthenticator{
+		client:    client,
+		audiences: audiences,
+		maxTTL:    maxTTL,
+		cache:     map[[sha256.Size]byte]tokenReviewCacheEntry{},
+	}
+}
+
+// authenticate returns the user the token belongs to. Authenticated tokens
+// are cached until they expire, at most maxTTL.
+func (a *tokenReviewAuthenticator) authenticate(ctx context.Context, token string) (authenticationv1.UserInfo, error) {
+	key := sha256.Sum256([]byte(token))
+
+	a.mu.Lock()
+	entry, ok := a.cache[key]
+	a.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.user, nil
+	}
+
+	review := &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{
+			Token:     token,
+			Audiences: a.audiences,
+		},
+	}
+	result, err := a.client.AuthenticationV1().TokenReviews().Create(ctx, review, metav1.CreateOptions{})
+	if err != nil {
+		return authenticationv1.UserInfo{}, fmt.Errorf("%w: %w", errTokenReviewFailed, err)
+	}
+	if !result.Status.Authenticated {
+		if result.Status.Error != "" {
+			return authenticationv1.UserInfo{}, fmt.Errorf("%w: %s", errTokenNotAuthenticated, result.Status.Error)
+		}
+		return authenticationv1.UserInfo{}, errTokenNotAuthenticated
+	}
+
+	now := time.Now()
+	expires := now.Add(a.maxTTL)
+	if exp := tokenExpiry(token); !exp.IsZero() && exp.Before(expires) {
+		expires = exp
+	}
+	a.mu.Lock()
+	for k, e := range a.cache {
+		if now.After(e.expires) {
+			delete(a.cache, k)
+		}
+	}
+	a.cache[key] = tokenReviewCacheEntry{user: result.Status.User, expires: expires}
+	a.mu.Unlock()
+	return result.Status.User, nil
+}
+
+// tokenExpiry returns the exp claim of a JWT without verifying it, zero for
+// opaque tokens or tokens without expiry. The token has been validated by
+// the TokenReview already.
+func tokenExpiry(token string) time.Time {
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+	if err != nil {
+		return time.Time{}
+	}
+	exp, err := parsed.Claims.GetExpirationTime()
+	if err != nil || exp == nil {
+		return time.Time{}
+	}
+	return exp.Time
+}
+
+// issuedByOIDC reports whether token is a JWT of the OIDC issuer, which is
+// validated with the JWKS rather than a TokenReview
+func issuedByOIDC(token string) bool {
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+	if err != nil {
+		return false
+	}
+	issuer, err := parsed.Claims.GetIssuer()
+	return err == nil && issuer != "" && knownIssuer(issuer)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	. "github.com/onsi/gomega"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newFakeTokenReviewClient returns a fake clientset authenticating the tokens
+// in users and counting the TokenReviews in reviews
+func newFakeTokenReviewClient(users map[string]authenticationv1.UserInfo, reviews *int32) *fake.Clientset {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		atomic.AddInt32(reviews, 1)
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		if review.Spec.Token == "unavailable" {
+			return true, nil, errors.New("connection refused")
+		}
+		user, ok := users[review.Spec.Token]
+		review.Status.Authenticated = ok
+		review.Status.User = user
+		if !ok {
+			review.Status.Error = "invalid bearer token"
+		}
+		return true, review, nil
+	})
+	return client
+}
+
+// TestTokenReviewAuthenticator tests authenticating tokens with TokenReviews and caching them
+func TestTokenReviewAuthenticator(t *testing.T) {
+	ctx := context.Background()
+	saToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss": "https://kubernetes.default.svc",
+		"sub": "system:serviceaccount:ci:dashboards",
+		"exp": time.Now().Add(time.Second).Unix(),
+	}).SignedString([]byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := map[string]authenticationv1.UserInfo{
+		"opaque": {Username: "system:serviceaccount:ci:alerts", Groups: []string{"system:serviceaccounts", "system:serviceaccounts:ci"}},
+		saToken:  {Username: "system:serviceaccount:ci:dashboards", Groups: []string{"system:serviceaccounts"}},
+	}
+
+	t.Run("Authenticated", func(t *testing.T) {
+		RegisterTestingT(t)
+		var reviews int32
+		authenticator := newTokenReviewAuthenticator(newFakeTokenReviewClient(users, &reviews), []string{"dsproxy"}, time.Minute)
+
+		user, err := authenticator.authenticate(ctx, "opaque")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(user.Username).To(Equal("system:serviceaccount:ci:alerts"))
+		Expect(user.Groups).To(Equal([]string{"system:serviceaccounts", "system:serviceaccounts:ci"}))
+
+		// Cached up to the maximum TTL
+		_, err = authenticator.authenticate(ctx, "opaque")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reviews).To(Equal(int32(1)))
+	})
+
+	t.Run("CachedUntilExpiry", func(t *testing.T) {
+		RegisterTestingT(t)
+		var reviews int32
+		authenticator := newTokenReviewAuthenticator(newFakeTokenReviewClient(users, &reviews), nil, time.Hour)
+
+		_, err := authenticator.authenticate(ctx, saToken)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(authenticator.cache[sha256.Sum256([]byte(saToken))].expires).To(BeTemporally("<=", time.Now().Add(time.Second)))
+
+		// Expire the cached review
+		authenticator.mu.Lock()
+		authenticator.cache[sha256.Sum256([]byte(saToken))] = tokenReviewCacheEntry{expires: time.Now().Add(-time.Second)}
+		authenticator.mu.Unlock()
+		user, err := authenticator.authenticate(ctx, saToken)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(user.Username).To(Equal("system:serviceaccount:ci:dashboards"))
+		Expect(reviews).To(Equal(int32(2)))
+	})
+
+	t.Run("Rejected", func(t *testing.T) {
+		RegisterTestingT(t)
+		var reviews int32
+		authenticator := newTokenReviewAuthenticator(newFakeTokenReviewClient(users, &reviews), nil, time.Minute)
+
+		_, err := authenticator.authenticate(ctx, "forged")
+		Expect(err).To(MatchError(errTokenNotAuthenticated))
+		Expect(authnFailureReason(err)).To(Equal("token_review_rejected"))
+
+		// Rejections are not cached
+		_, err = authenticator.authenticate(ctx, "forged")
+		Expect(err).To(HaveOccurred())
+		Expect(reviews).To(Equal(int32(2)))
+
+		_, err = authenticator.authenticate(ctx, "unavailable")
+		Expect(err).To(MatchError(errTokenReviewFailed))
+		Expect(authnFailureReason(err)).To(Equal("token_review_failed"))
+	})
+
+	t.Run("Middleware", func(t *testing.T) {
+		RegisterTestingT(t)
+		var reviews int32
+		origReviewer := tokenReviewer
+		defer func() { tokenReviewer = origReviewer }()
+		tokenReviewer = newTokenReviewAuthenticator(newFakeTokenReviewClient(users, &reviews), nil, time.Minute)
+		useGivenJWKS(t, "https://dex.example.com", nil)
+
+		handler := authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			Expect(r.Context().Value(ContextKeyEmail)).To(Equal("system:serviceaccount:ci:alerts"))
+			Expect(r.Context().Value(ContextKeyGroups)).To(Equal([]string{"system:serviceaccounts", "system:serviceaccounts:ci"}))
+			Expect(r.Header.Get("Authorization")).To(BeEmpty())
+		}))
+		req := httptest.NewRequest("GET", "/api/v1/query", nil)
+		req.Header.Set("Authorization", "Bearer opaque")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		Expect(w.Code).To(Equal(http.StatusOK))
+
+		req = httptest.NewRequest("GET", "/api/v1/query", nil)
+		req.Header.Set("Authorization", "Bearer forged")
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		Expect(w.Code).To(Equal(http.StatusUnauthorized))
+
+		// Tokens of the OIDC issuer are not sent to the TokenReview API
+		dexToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"iss": "https://dex.example.com"}).
+			SignedString([]byte("0123456789abcdef0123456789abcdef"))
+		Expect(err).ToNot(HaveOccurred())
+		req = httptest.NewRequest("GET", "/api/v1/query", nil)
+		req.Header.Set("Authorization", "Bearer "+dexToken)
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		Expect(w.Code).To(Equal(http.StatusUnauthorized))
+		Expect(reviews).To(Equal(int32(2)))
+	})
+}
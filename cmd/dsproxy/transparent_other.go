@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// transparentControl fails, TPROXY is only available on Linux
+func transparentControl(network, address string, c syscall.RawConn) error {
+	return errors.New("transparent mode is only supported on Linux")
+}
@@ -1,28 +1,29 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
 	"strings"
-	"time"
+	"sync/atomic"
 
-	"github.com/MicahParks/keyfunc/v2"
 	"github.com/golang-jwt/jwt/v5"
 )
 
-var jwks *keyfunc.JWKS
-
-func getTLSConfig() (*tls.Config, error) {
-	if f_caBundle == "" {
-		return nil, nil // Use system certs
-	}
+var (
+	errMissingBearerToken   = errors.New("missing bearer token")
+	errJWKSNotInitialized   = errors.New("jwks is not initialized")
+	errUnsupportedAlgorithm = errors.New("unsupported signing algorithm")
+)
 
-	caCert, err := os.ReadFile(f_caBundle)
+// newTLSConfig creates a TLS config trusting the CA bundle at path
+func newTLSConfig(caBundle string) (*tls.Config, error) {
+	caCert, err := os.ReadFile(caBundle)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read CA bundle: %w", err)
 	}
@@ -37,58 +38,87 @@ func getTLSConfig() (*tls.Config, error) {
 	}, nil
 }
 
-func initJWKS() error {
-	tlsConfig, err := getTLSConfig()
-	if err != nil {
-		return err
-	}
+// caBundleTransport is a transport trusting the CA bundle at path, or the
+// system roots when path is empty. The bundle is reloaded when it changes,
+// so that rotated CAs are trusted without a restart.
+type caBundleTransport struct {
+	path      string
+	transport atomic.Pointer[http.Transport]
+}
 
-	// Fetch from discovery URL
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: tlsConfig,
-		},
+func newCABundleTransport(ctx context.Context, path string) (*caBundleTransport, error) {
+	t := &caBundleTransport{path: path}
+	if err := t.reload(); err != nil {
+		return nil, err
 	}
-	res, err := client.Get(f_jwksURL)
-	if err != nil {
-		return err
+	if path != "" {
+		go watchFile(ctx, path, func() {
+			if err := t.reload(); err != nil {
+				log.Printf("Failed to reload CA bundle %s, keeping the previous one: %v", path, err)
+				return
+			}
+			log.Printf("CA bundle %s reloaded", path)
+		})
 	}
-	defer res.Body.Close()
+	return t, nil
+}
 
-	var config struct {
-		JWKSURI string `json:"jwks_uri"`
+func (t *caBundleTransport) reload() error {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if t.path != "" {
+		tlsConfig, err := newTLSConfig(t.path)
+		if err != nil {
+			return err
+		}
+		transport.TLSClientConfig = tlsConfig
 	}
-	if err := json.NewDecoder(res.Body).Decode(&config); err != nil {
-		return err
+	if previous := t.transport.Swap(transport); previous != nil {
+		previous.CloseIdleConnections()
 	}
+	return nil
+}
 
-	// Use keyfunc to get the key set
-	jwks, err = keyfunc.Get(config.JWKSURI, keyfunc.Options{
-		RefreshInterval: 1 * time.Hour,
-		Client: &http.Client{
-			Transport: &http.Transport{
-				TLSClientConfig: tlsConfig,
-			},
-		},
-	})
-	return err
+func (t *caBundleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.transport.Load().RoundTrip(req)
 }
 
+// verifyBearerToken validates the signature of the bearer token of r and its
+// claims: the algorithm must be in --jwt-algorithms, iss must be the issuer
+// of one of the JWKS providers, whose keys the signature is verified with,
+// aud must contain one of --jwt-audience, exp is required and exp, nbf and
+// iat are checked with a leeway of --jwt-clock-skew.
 func verifyBearerToken(r *http.Request) (*jwt.Token, error) {
-	auth := r.Header.Get("Authorization")
-	if auth == "" || !strings.HasPrefix(auth, "Bearer ") {
-		return nil, errors.New("missing bearer token")
+	tokenStr, err := bearerToken(r)
+	if err != nil {
+		return nil, err
 	}
 
-	tokenStr := strings.TrimPrefix(auth, "Bearer ")
+	// Select the keys by the unverified issuer, which is verified below
+	jwks, err := jwksFor(tokenStr)
+	if err != nil {
+		return nil, err
+	}
 
-	// Prevent nil pointer dereference if jwks is not initialized
-	if jwks == nil {
-		return nil, errors.New("jwks is not initialized")
+	algorithms := splitList(f_jwtAlgorithms)
+	options := []jwt.ParserOption{
+		jwt.WithLeeway(f_jwtClockSkew),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithAudience(splitList(f_jwtAudience)...),
+		jwt.WithIssuer(jwks.issuer),
 	}
 
-	// Validate the token
-	token, err := jwt.Parse(tokenStr, jwks.Keyfunc)
+	// Validate the token, rejecting algorithms that are not allowed before
+	// looking up the key
+	token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (any, error) {
+		alg := token.Method.Alg()
+		for _, allowed := range algorithms {
+			if alg == allowed {
+				return jwks.jwks.Keyfunc(token)
+			}
+		}
+		return nil, fmt.Errorf("%w: %s", errUnsupportedAlgorithm, alg)
+	}, options...)
 	if err != nil {
 		return nil, err
 	}
@@ -99,3 +129,23 @@ func verifyBearerToken(r *http.Request) (*jwt.Token, error) {
 
 	return token, nil
 }
+
+// bearerToken returns the bearer token of the Authorization header of r
+func bearerToken(r *http.Request) (string, error) {
+	auth := r.Header.Get("Authorization")
+	if auth == "" || !strings.HasPrefix(auth, "Bearer ") {
+		return "", errMissingBearerToken
+	}
+	return strings.TrimPrefix(auth, "Bearer "), nil
+}
+
+// splitList splits a comma separated flag value, dropping empty elements
+func splitList(value string) []string {
+	var list []string
+	for _, element := range strings.Split(value, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			list = append(list, element)
+		}
+	}
+	return list
+}
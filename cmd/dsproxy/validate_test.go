@@ -1,19 +1,34 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/MicahParks/keyfunc/v2"
 	"github.com/golang-jwt/jwt/v5"
 	. "github.com/onsi/gomega"
 )
 
+// useGivenJWKS replaces the JWKS providers by a single issuer with the given
+// keys for the duration of the test
+func useGivenJWKS(t *testing.T, issuer string, keys map[string]keyfunc.GivenKey) {
+	origProviders := jwtProviders
+	provider := &jwksProvider{issuer: issuer}
+	provider.state.Store(&jwksState{issuer: issuer, jwks: keyfunc.NewGiven(keys)})
+	jwtProviders = []*jwksProvider{provider}
+	t.Cleanup(func() { jwtProviders = origProviders })
+}
+
 func TestInitJWKSAndVerifyBearerToken(t *testing.T) {
 	RegisterTestingT(t)
 
@@ -32,26 +47,34 @@ func TestInitJWKSAndVerifyBearerToken(t *testing.T) {
 
 	// Mock OIDC discovery endpoint
 	discoverySrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		resp := map[string]string{"jwks_uri": jwksSrv.URL}
+		resp := map[string]string{"issuer": "https://example.com", "jwks_uri": jwksSrv.URL}
 		_ = json.NewEncoder(w).Encode(resp)
 	}))
 	defer discoverySrv.Close()
 
-	// Patch global jwksURL to point to our mock discovery endpoint
-	origJWKSURL := f_jwksURL
-	f_jwksURL = discoverySrv.URL
-	defer func() { f_jwksURL = origJWKSURL }()
+	origProviders := jwtProviders
+	defer func() { jwtProviders = origProviders }()
+	origAlgorithms := f_jwtAlgorithms
+	f_jwtAlgorithms = "HS256"
+	defer func() { f_jwtAlgorithms = origAlgorithms }()
 
-	// Call initJWKS and expect no error
-	err = initJWKS()
+	// Call initJWKS with our mock discovery endpoint and wait for the keys
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	providers, err := newJWKSProviders([]string{discoverySrv.URL}, "", "", http.DefaultClient)
 	Expect(err).To(BeNil())
-	Expect(jwks).ToNot(BeNil())
+	initJWKS(ctx, providers)
+	Eventually(jwksLoaded.Load).Should(BeTrue())
+	Expect(providers[0].state.Load().issuer).To(Equal("https://example.com"))
 
 	// Create a valid JWT signed with the test key
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"sub":  "1234567890",
 		"name": "John Doe",
+		"iss":  "https://example.com",
+		"aud":  f_jwtAudience,
 		"iat":  time.Now().Unix(),
+		"exp":  time.Now().Add(time.Hour).Unix(),
 	})
 	// Set the "kid" header to match the key in the JWKS
 	token.Header["kid"] = "test"
@@ -84,3 +107,187 @@ func TestInitJWKSAndVerifyBearerToken(t *testing.T) {
 	_, err = verifyBearerToken(req4)
 	Expect(err).ToNot(BeNil())
 }
+
+// TestJWKSProviderIssuer tests the issuer taken from the discovery document or --jwt-issuer
+func TestJWKSProviderIssuer(t *testing.T) {
+	RegisterTestingT(t)
+
+	jwksSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"keys":[]}`)
+	}))
+	defer jwksSrv.Close()
+	var issuer string
+	discoverySrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{"issuer": issuer, "jwks_uri": jwksSrv.URL})
+	}))
+	defer discoverySrv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Without an issuer tokens cannot be validated
+	provider := &jwksProvider{discoveryURL: discoverySrv.URL, client: http.DefaultClient}
+	Expect(provider.load(ctx)).To(MatchError(ContainSubstring("no issuer")))
+
+	provider.issuer = "https://override.example.com"
+	Expect(provider.load(ctx)).To(Succeed())
+	Expect(provider.state.Load().issuer).To(Equal("https://override.example.com"))
+
+	issuer = "https://dex.example.com"
+	provider.issuer = ""
+	Expect(provider.load(ctx)).To(Succeed())
+	Expect(provider.state.Load().issuer).To(Equal("https://dex.example.com"))
+}
+
+// TestVerifyBearerTokenClaims tests every rejection path of the token validation
+func TestVerifyBearerTokenClaims(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	origAudience, origSkew, origAlgorithms := f_jwtAudience, f_jwtClockSkew, f_jwtAlgorithms
+	defer func() {
+		f_jwtAudience, f_jwtClockSkew, f_jwtAlgorithms = origAudience, origSkew, origAlgorithms
+	}()
+	useGivenJWKS(t, "https://dex.example.com", map[string]keyfunc.GivenKey{
+		"test":  keyfunc.NewGivenHMAC(key, keyfunc.GivenKeyOptions{Algorithm: "HS256"}),
+		"test2": keyfunc.NewGivenHMAC(key, keyfunc.GivenKeyOptions{Algorithm: "HS384"}),
+	})
+	f_jwtAudience = "grafana, grafana-secondary"
+	f_jwtClockSkew = 30 * time.Second
+	f_jwtAlgorithms = "HS256"
+
+	now := time.Now()
+	validClaims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"sub": "alice",
+			"iss": "https://dex.example.com",
+			"aud": "grafana",
+			"iat": now.Unix(),
+			"nbf": now.Unix(),
+			"exp": now.Add(time.Hour).Unix(),
+		}
+	}
+	sign := func(method jwt.SigningMethod, kid string, signingKey []byte, claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(method, claims)
+		token.Header["kid"] = kid
+		tokenStr, err := token.SignedString(signingKey)
+		Expect(err).ToNot(HaveOccurred())
+		return tokenStr
+	}
+	with := func(key string, value any) jwt.MapClaims {
+		claims := validClaims()
+		if value == nil {
+			delete(claims, key)
+		} else {
+			claims[key] = value
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name   string
+		token  func() string
+		reason string
+	}{
+		{"valid", func() string { return sign(jwt.SigningMethodHS256, "test", key, validClaims()) }, ""},
+		{"audience array", func() string {
+			return sign(jwt.SigningMethodHS256, "test", key, with("aud", []string{"other", "grafana-secondary"}))
+		}, ""},
+		{"expired within clock skew", func() string {
+			return sign(jwt.SigningMethodHS256, "test", key, with("exp", now.Add(-10*time.Second).Unix()))
+		}, ""},
+		{"unsupported algorithm", func() string { return sign(jwt.SigningMethodHS384, "test2", key, validClaims()) }, "unsupported_algorithm"},
+		{"none algorithm", func() string {
+			token := jwt.NewWithClaims(jwt.SigningMethodNone, validClaims())
+			tokenStr, err := token.SignedString(jwt.UnsafeAllowNoneSignatureType)
+			Expect(err).ToNot(HaveOccurred())
+			return tokenStr
+		}, "unsupported_algorithm"},
+		{"invalid signature", func() string {
+			return sign(jwt.SigningMethodHS256, "test", []byte("another-key-another-key-another!!"), validClaims())
+		}, "invalid_signature"},
+		{"unknown key", func() string { return sign(jwt.SigningMethodHS256, "unknown", key, validClaims()) }, "invalid_signature"},
+		{"malformed", func() string { return "not.a.token" }, "malformed_token"},
+		{"missing expiry", func() string { return sign(jwt.SigningMethodHS256, "test", key, with("exp", nil)) }, "missing_claim"},
+		{"expired", func() string {
+			return sign(jwt.SigningMethodHS256, "test", key, with("exp", now.Add(-time.Minute).Unix()))
+		}, "expired"},
+		{"not yet valid", func() string {
+			return sign(jwt.SigningMethodHS256, "test", key, with("nbf", now.Add(time.Minute).Unix()))
+		}, "not_yet_valid"},
+		{"issued in the future", func() string {
+			return sign(jwt.SigningMethodHS256, "test", key, with("iat", now.Add(time.Minute).Unix()))
+		}, "issued_in_future"},
+		{"missing issuer", func() string { return sign(jwt.SigningMethodHS256, "test", key, with("iss", nil)) }, "missing_claim"},
+		{"wrong issuer", func() string {
+			return sign(jwt.SigningMethodHS256, "test", key, with("iss", "https://evil.example.com"))
+		}, "bad_issuer"},
+		{"missing audience", func() string { return sign(jwt.SigningMethodHS256, "test", key, with("aud", nil)) }, "missing_claim"},
+		{"wrong audience", func() string { return sign(jwt.SigningMethodHS256, "test", key, with("aud", "other")) }, "bad_audience"},
+		{"wrong audience array", func() string {
+			return sign(jwt.SigningMethodHS256, "test", key, with("aud", []string{"other", "another"}))
+		}, "bad_audience"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			RegisterTestingT(t)
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token())
+			token, err := verifyBearerToken(req)
+			if tt.reason == "" {
+				Expect(err).ToNot(HaveOccurred())
+				Expect(token.Valid).To(BeTrue())
+				return
+			}
+			Expect(err).To(HaveOccurred())
+			Expect(authnFailureReason(err)).To(Equal(tt.reason))
+		})
+	}
+}
+
+// TestCABundleTransport tests that the CA bundle trusted for the discovery
+// document and JWKS is reloaded when it changes
+func TestCABundleTransport(t *testing.T) {
+	RegisterTestingT(t)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "OK")
+	}))
+	defer server.Close()
+	otherCA, otherKey := generateTempTLSFiles()
+	defer os.Remove(otherCA)
+	defer os.Remove(otherKey)
+	otherCAData, err := os.ReadFile(otherCA)
+	Expect(err).ToNot(HaveOccurred())
+
+	path := filepath.Join(t.TempDir(), "ca.crt")
+	Expect(os.WriteFile(path, otherCAData, 0644)).To(Succeed())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	transport, err := newCABundleTransport(ctx, path)
+	Expect(err).ToNot(HaveOccurred())
+	client := &http.Client{Transport: transport}
+
+	_, err = client.Get(server.URL)
+	Expect(err).To(MatchError(ContainSubstring("certificate")))
+
+	// The rotated CA is trusted without a restart
+	Expect(os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644)).To(Succeed())
+	Eventually(func() error {
+		res, err := client.Get(server.URL)
+		if err == nil {
+			res.Body.Close()
+		}
+		return err
+	}).Should(Succeed())
+
+	// An invalid bundle keeps the previous one
+	Expect(os.WriteFile(path, []byte("not a certificate"), 0644)).To(Succeed())
+	Consistently(func() error {
+		res, err := client.Get(server.URL)
+		if err == nil {
+			res.Body.Close()
+		}
+		return err
+	}, 500*time.Millisecond).Should(Succeed())
+
+	_, err = newCABundleTransport(ctx, filepath.Join(t.TempDir(), "missing.crt"))
+	Expect(err).To(MatchError(ContainSubstring("failed to read CA bundle")))
+}
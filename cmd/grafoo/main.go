@@ -198,6 +198,10 @@ func main() {
 			setupLog.Error(err, "unable to create webhook", "webhook", "Grafana")
 			os.Exit(1)
 		}
+		if err = (&grafoov1alpha1.GrafanaAccessPolicy{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "GrafanaAccessPolicy")
+			os.Exit(1)
+		}
 	}
 	//+kubebuilder:scaffold:builder
 
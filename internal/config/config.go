@@ -4,4 +4,5 @@ var (
 	DexImage       = "docker.io/dexidp/dex:v2.39.1-distroless"
 	GrafanaVersion = "9.5.17"
 	MariaDBImage   = "registry.redhat.io/rhel9/mariadb-1011:1-12"
+	DSProxyImage   = "quay.io/cldmnky/grafoo-dsproxy:latest"
 )
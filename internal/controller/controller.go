@@ -29,11 +29,14 @@ import (
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 
@@ -81,9 +84,10 @@ type GrafanaReconciler struct {
 	client.Client
 	Scheme    *runtime.Scheme
 	Clientset *kubernetes.Clientset
-	Dynamic   *dynamic.DynamicClient
+	Dynamic   dynamic.Interface
 }
 
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
 // +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=get;list;watch;create;update;patch;delete
@@ -95,9 +99,11 @@ type GrafanaReconciler struct {
 // +kubebuilder:rbac:groups=config.openshift.io,resources=ingresses,verbs=get;list;watch
 // +kubebuilder:rbac:groups=grafana.integreatly.org,resources=grafanadatasources,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=grafana.integreatly.org,resources=grafanas,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=grafoo.cloudmonkey.org,resources=grafanaaccesspolicies,verbs=get;list;watch
 // +kubebuilder:rbac:groups=grafoo.cloudmonkey.org,resources=grafanas,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=grafoo.cloudmonkey.org,resources=grafanas/finalizers,verbs=update
 // +kubebuilder:rbac:groups=grafoo.cloudmonkey.org,resources=grafanas/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=loki.grafana.com,resources=lokistacks,verbs=get;list;watch
 // +kubebuilder:rbac:groups=loki.grafana.com,resources=application,resourceNames=logs,verbs=get
 // +kubebuilder:rbac:groups=loki.grafana.com,resources=audit,resourceNames=logs,verbs=get
 // +kubebuilder:rbac:groups=loki.grafana.com,resources=infrastructure,resourceNames=logs,verbs=get
@@ -106,9 +112,9 @@ type GrafanaReconciler struct {
 // +kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=clusterrolebindings,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=clusterroles,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=authorization.k8s.io,resources=subjectaccessreviews,verbs=create
-// +kubebuilder:rbac:groups=authorization.k8s.io,resources=tokenreviews,verbs=create
-// +kubebuilder:rbac:groups=tempo.grafana.com,resources=dev,resourceNames=traces,verbs=get
-// +kubebuilder:rbac:groups=tempo.grafana.com,resources=prod,resourceNames=traces,verbs=get
+// +kubebuilder:rbac:groups=authentication.k8s.io,resources=tokenreviews,verbs=create
+// +kubebuilder:rbac:groups=tempo.grafana.com,resources=tempostacks,verbs=get;list;watch
+// +kubebuilder:rbac:groups=tempo.grafana.com,resources=*,resourceNames=traces,verbs=get
 // +kubebuilder:rbac:groups=logging.openshift.io,resources=clusterloggings,verbs=get;list;watch
 // +kubebuilder:rbac:groups=logging.openshift.io,resources=clusterloggings/status,verbs=get;list;watch
 
@@ -293,14 +299,20 @@ func (r *GrafanaReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 			Reason:  "DataSourcesNotReconciled",
 			Message: "Failed to reconcile DataSources",
 		})
-	} else {
-		// Update status
+	} else if statuses, err := r.ProbeDataSources(ctx, grafooInstance); err != nil {
+		logger.Error(err, "Failed to probe datasources")
+		GrafanaReconcilerErrors.WithLabelValues(req.Namespace, req.Name, "datasources_probe_failed").Inc()
+		// status
 		meta.SetStatusCondition(&grafooInstance.Status.Conditions, metav1.Condition{
 			Type:    typeDataSourcesReady,
-			Status:  metav1.ConditionTrue,
-			Reason:  "DataSourcesReconciled",
-			Message: "DataSources have been reconciled",
+			Status:  metav1.ConditionUnknown,
+			Reason:  "DataSourcesNotProbed",
+			Message: "Failed to probe DataSources",
 		})
+	} else {
+		// Update status
+		grafooInstance.Status.DataSources = statuses
+		setDataSourcesCondition(grafooInstance, statuses)
 	}
 	// Update overall status
 	meta.SetStatusCondition(&grafooInstance.Status.Conditions, metav1.Condition{
@@ -331,22 +343,42 @@ func (r *GrafanaReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 			requeueAfter = 0
 		}
 	}
+	// Requeue at the latest when the datasources are to be probed again
+	if requeueAfter > dataSourceProbeInterval {
+		requeueAfter = dataSourceProbeInterval
+	}
 	logger.Info("Requeuing reconciliation", "after", requeueAfter)
 	return ctrl.Result{Requeue: true, RequeueAfter: requeueAfter}, nil
 }
 
 // SetupWithManager sets up the controller with the Manager.
+// LokiStacks and TempoStacks are watched when their CRDs are installed.
 func (r *GrafanaReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
+	builder := ctrl.NewControllerManagedBy(mgr)
+	for _, gvk := range []schema.GroupVersionKind{lokiStackGVK, tempoStackGVK} {
+		if _, err := mgr.GetRESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version); err != nil {
+			if !meta.IsNoMatchError(err) {
+				return err
+			}
+			log.Log.Info("Not watching stacks, the CRD is not installed", "kind", gvk.Kind)
+			continue
+		}
+		stack := &unstructured.Unstructured{}
+		stack.SetGroupVersionKind(gvk)
+		builder = builder.Watches(stack, handler.EnqueueRequestsFromMapFunc(r.grafanasForStack))
+	}
+	return builder.
 		For(&grafoov1alpha1.Grafana{}).
 		Owns(&grafanav1beta1.Grafana{}).
 		Owns(&grafanav1beta1.GrafanaDatasource{}).
 		Owns(&appsv1.Deployment{}).
 		Owns(&corev1.Secret{}).
+		Owns(&corev1.ConfigMap{}).
 		Owns(&corev1.ServiceAccount{}).
 		Owns(&corev1.Service{}).
 		Owns(&rbacv1.ClusterRoleBinding{}).
 		Owns(&networkingv1.Ingress{}).
+		Watches(&grafoov1alpha1.GrafanaAccessPolicy{}, handler.EnqueueRequestsFromMapFunc(r.grafanasForAccessPolicy)).
 		WithEventFilter(predicate.GenerationChangedPredicate{}).
 		WithEventFilter(predicate.ResourceVersionChangedPredicate{}).
 		Complete(r)
@@ -4,9 +4,12 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
 
 	grafanav1beta1 "github.com/grafana/grafana-operator/v5/api/v1beta1"
 	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -17,6 +20,9 @@ import (
 	grafoov1alpha1 "github.com/cldmnky/grafoo/api/v1alpha1"
 )
 
+// dataSourceTokenKey is the key of the token in the datasource token Secret
+const dataSourceTokenKey = "token"
+
 func (r *GrafanaReconciler) ReconcileDataSources(ctx context.Context, instance *grafoov1alpha1.Grafana, needsRefresh bool) error {
 	logger := log.FromContext(ctx)
 	var token string
@@ -34,17 +40,6 @@ func (r *GrafanaReconciler) ReconcileDataSources(ctx context.Context, instance *
 		logger.Info("Created token for datasources", "token expiration", resp.Status.ExpirationTimestamp.Time)
 		token = resp.Status.Token
 	}
-	/*gvr := schema.GroupVersionResource{
-		Group:    "loki.grafana.com",
-		Version:  "v1",
-		Resource: "lokistacks",
-	}
-	l, err := r.Dynamic.Resource(gvr).Namespace("default").List(context.Background(), v1.ListOptions{})
-	if err != nil {
-		return err
-	}
-	logger.Info("Loki stacks", "loki", l)
-	*/
 	// Get all datasources
 	datasources := &grafanav1beta1.GrafanaDatasourceList{}
 	dsSelector := labels.SelectorFromSet(labels.Set{
@@ -55,45 +50,61 @@ func (r *GrafanaReconciler) ReconcileDataSources(ctx context.Context, instance *
 		return err
 	}
 
-	var reconciledDatasources = make(map[string]bool)
-	for _, ds := range instance.Spec.DataSources {
-		if token == "" {
-			logger.Info("No token found for datasource", "datasource", ds.Name)
-			for _, gds := range datasources.Items {
-				if gds.Name == r.generateNameForComponent(instance, ds.GetDataSourceNameHash()) {
-					logger.Info("Getting datasource", "name", gds.Name)
-					// Extract the token from the existing datasource
-					token, err = extractTokenFromSecureJSONData(gds.Spec.Datasource.SecureJSONData)
-					if err != nil {
-						return err
-					}
-				}
-			}
+	caCert, err := r.getDataSourceCA(ctx, instance)
+	if err != nil {
+		return err
+	}
+	// Datasources of LokiStacks and TempoStacks are expanded per tenant
+	resolvedDatasources, err := r.resolveDataSources(ctx, instance)
+	if err != nil {
+		return err
+	}
+
+	if token == "" {
+		token, err = r.getDataSourceToken(ctx, instance, datasources.Items)
+		if err != nil {
+			return err
 		}
+	}
+	if token == "" {
+		logger.Info("No token found for datasources")
+	} else if err := r.reconcileDataSourceTokenSecret(ctx, instance, token); err != nil {
+		return err
+	}
+
+	var reconciledDatasources = make(map[string]bool)
+	for _, ds := range resolvedDatasources {
 		switch ds.Type {
 		case "prometheus-incluster":
-			err = r.reconcilePrometheusDataSource(ctx, instance, ds, token)
+			err = r.reconcilePrometheusDataSource(ctx, instance, ds, token, caCert)
 			if err != nil {
 				return err
 			}
 			// add the datasource to the list of reconciled datasources
 			reconciledDatasources[r.generateNameForComponent(instance, ds.GetDataSourceNameHash())] = true
 		case "loki-incluster":
-			err = r.reconcileLokiDataSource(ctx, instance, ds, token)
+			err = r.reconcileLokiDataSource(ctx, instance, ds, token, caCert)
 			if err != nil {
 				return err
 			}
 			// add the datasource to the list of reconciled datasources
 			reconciledDatasources[r.generateNameForComponent(instance, ds.GetDataSourceNameHash())] = true
 		case "tempo-incluster":
-			err = r.reconcileTempoDataSource(ctx, instance, ds, token)
+			err = r.reconcileTempoDataSource(ctx, instance, ds, token, caCert)
 			if err != nil {
 				return err
 			}
 			// add the datasource to the list of reconciled datasources
 			reconciledDatasources[r.generateNameForComponent(instance, ds.GetDataSourceNameHash())] = true
 		case "prometheus-mcoo":
-			err = r.reconcilePrometheusDataSource(ctx, instance, ds, token)
+			err = r.reconcilePrometheusDataSource(ctx, instance, ds, token, caCert)
+			if err != nil {
+				return err
+			}
+			// add the datasource to the list of reconciled datasources
+			reconciledDatasources[r.generateNameForComponent(instance, ds.GetDataSourceNameHash())] = true
+		case "custom":
+			err = r.reconcileCustomDataSource(ctx, instance, ds)
 			if err != nil {
 				return err
 			}
@@ -115,7 +126,7 @@ func (r *GrafanaReconciler) ReconcileDataSources(ctx context.Context, instance *
 	return nil
 }
 
-func (r *GrafanaReconciler) reconcilePrometheusDataSource(ctx context.Context, instance *grafoov1alpha1.Grafana, ds grafoov1alpha1.DataSource, token string) error {
+func (r *GrafanaReconciler) reconcilePrometheusDataSource(ctx context.Context, instance *grafoov1alpha1.Grafana, ds grafoov1alpha1.DataSource, token, caCert string) error {
 	logger := log.FromContext(ctx)
 	promDataSource := &grafanav1beta1.GrafanaDatasource{
 		ObjectMeta: metav1.ObjectMeta{
@@ -142,13 +153,25 @@ func (r *GrafanaReconciler) reconcilePrometheusDataSource(ctx context.Context, i
 			Access:         "proxy",
 			IsDefault:      isDefault,
 			URL:            ds.Prometheus.URL,
-			JSONData:       json.RawMessage(`{"httpHeaderName1": "Authorization", "tlsSkipVerify": true}`),
+			JSONData:       json.RawMessage(`{"httpHeaderName1": "Authorization"}`),
 			SecureJSONData: secureJSONData,
 		},
 		InstanceSelector: &metav1.LabelSelector{
 			MatchLabels: r.generateLabelsForComponent(instance, "grafana"),
 		},
 	}
+	datasource := promDataSourceSpec.Datasource
+	var err error
+	datasource.JSONData, datasource.SecureJSONData, err = withTLSVerification(ds, caCert, datasource.JSONData, datasource.SecureJSONData)
+	if err != nil {
+		return err
+	}
+	if dsproxyEnabled(instance) {
+		datasource.JSONData, datasource.SecureJSONData, err = withDSProxyHeaders(promDataSource.Name, datasource.Type, datasource.JSONData, datasource.SecureJSONData)
+		if err != nil {
+			return err
+		}
+	}
 	op, err := CreateOrUpdateWithRetries(ctx, r.Client, promDataSource, func() error {
 		promDataSource.ObjectMeta.Labels = r.generateLabelsForComponent(instance, "prometheus")
 		promDataSource.Spec = promDataSourceSpec
@@ -165,7 +188,7 @@ func (r *GrafanaReconciler) reconcilePrometheusDataSource(ctx context.Context, i
 	return nil
 }
 
-func (r *GrafanaReconciler) reconcileLokiDataSource(ctx context.Context, instance *grafoov1alpha1.Grafana, ds grafoov1alpha1.DataSource, token string) error {
+func (r *GrafanaReconciler) reconcileLokiDataSource(ctx context.Context, instance *grafoov1alpha1.Grafana, ds grafoov1alpha1.DataSource, token, caCert string) error {
 	logger := log.FromContext(ctx)
 	lokiDataSource := &grafanav1beta1.GrafanaDatasource{
 		ObjectMeta: metav1.ObjectMeta{
@@ -181,13 +204,25 @@ func (r *GrafanaReconciler) reconcileLokiDataSource(ctx context.Context, instanc
 			Access:         "proxy",
 			IsDefault:      boolPtr(false),
 			URL:            ds.Loki.URL,
-			JSONData:       json.RawMessage(`{"httpHeaderName1": "Authorization", "tlsSkipVerify": true}`),
+			JSONData:       json.RawMessage(`{"httpHeaderName1": "Authorization"}`),
 			SecureJSONData: json.RawMessage(`{"httpHeaderValue1": "Bearer ` + token + `"}`),
 		},
 		InstanceSelector: &metav1.LabelSelector{
 			MatchLabels: r.generateLabelsForComponent(instance, "grafana"),
 		},
 	}
+	datasource := lokiDataSourceSpec.Datasource
+	var err error
+	datasource.JSONData, datasource.SecureJSONData, err = withTLSVerification(ds, caCert, datasource.JSONData, datasource.SecureJSONData)
+	if err != nil {
+		return err
+	}
+	if dsproxyEnabled(instance) {
+		datasource.JSONData, datasource.SecureJSONData, err = withDSProxyHeaders(lokiDataSource.Name, datasource.Type, datasource.JSONData, datasource.SecureJSONData)
+		if err != nil {
+			return err
+		}
+	}
 	op, err := CreateOrUpdateWithRetries(ctx, r.Client, lokiDataSource, func() error {
 		lokiDataSource.ObjectMeta.Labels = r.generateLabelsForComponent(instance, "loki")
 		lokiDataSource.Spec = lokiDataSourceSpec
@@ -205,7 +240,7 @@ func (r *GrafanaReconciler) reconcileLokiDataSource(ctx context.Context, instanc
 }
 
 // reconcileTempoDataSource
-func (r *GrafanaReconciler) reconcileTempoDataSource(ctx context.Context, instance *grafoov1alpha1.Grafana, ds grafoov1alpha1.DataSource, token string) error {
+func (r *GrafanaReconciler) reconcileTempoDataSource(ctx context.Context, instance *grafoov1alpha1.Grafana, ds grafoov1alpha1.DataSource, token, caCert string) error {
 	logger := log.FromContext(ctx)
 	tempoDataSource := &grafanav1beta1.GrafanaDatasource{
 		ObjectMeta: metav1.ObjectMeta{
@@ -221,13 +256,25 @@ func (r *GrafanaReconciler) reconcileTempoDataSource(ctx context.Context, instan
 			Access:         "proxy",
 			IsDefault:      boolPtr(false),
 			URL:            ds.Tempo.URL,
-			JSONData:       json.RawMessage(`{"httpHeaderName1": "Authorization", "tlsSkipVerify": true}`),
+			JSONData:       json.RawMessage(`{"httpHeaderName1": "Authorization"}`),
 			SecureJSONData: json.RawMessage(`{"httpHeaderValue1": "Bearer ` + token + `"}`),
 		},
 		InstanceSelector: &metav1.LabelSelector{
 			MatchLabels: r.generateLabelsForComponent(instance, "grafana"),
 		},
 	}
+	datasource := tempoDataSourceSpec.Datasource
+	var err error
+	datasource.JSONData, datasource.SecureJSONData, err = withTLSVerification(ds, caCert, datasource.JSONData, datasource.SecureJSONData)
+	if err != nil {
+		return err
+	}
+	if dsproxyEnabled(instance) {
+		datasource.JSONData, datasource.SecureJSONData, err = withDSProxyHeaders(tempoDataSource.Name, datasource.Type, datasource.JSONData, datasource.SecureJSONData)
+		if err != nil {
+			return err
+		}
+	}
 	op, err := CreateOrUpdateWithRetries(ctx, r.Client, tempoDataSource, func() error {
 		tempoDataSource.ObjectMeta.Labels = r.generateLabelsForComponent(instance, "tempo")
 		tempoDataSource.Spec = tempoDataSourceSpec
@@ -244,6 +291,138 @@ func (r *GrafanaReconciler) reconcileTempoDataSource(ctx context.Context, instan
 	return nil
 }
 
+// reconcileCustomDataSource reconciles a datasource of any Grafana type from
+// its custom config. The secureJsonData values are referenced with valuesFrom,
+// which the grafana-operator resolves from the Secrets, so that they are not
+// copied into the GrafanaDatasource.
+func (r *GrafanaReconciler) reconcileCustomDataSource(ctx context.Context, instance *grafoov1alpha1.Grafana, ds grafoov1alpha1.DataSource) error {
+	logger := log.FromContext(ctx)
+	if ds.Custom == nil {
+		return fmt.Errorf("missing custom config for datasource %s", ds.Name)
+	}
+	customDataSource := &grafanav1beta1.GrafanaDatasource{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      r.generateNameForComponent(instance, ds.GetDataSourceNameHash()),
+			Namespace: instance.Namespace,
+			Labels:    r.generateLabelsForComponent(instance, "grafana"),
+		},
+	}
+
+	jsonData := ds.Custom.JSONData
+	if len(jsonData) == 0 {
+		jsonData = json.RawMessage(`{}`)
+	}
+	secureData := map[string]string{}
+	var valuesFrom []grafanav1beta1.GrafanaDatasourceValueFrom
+	keys := make([]string, 0, len(ds.Custom.SecureJSONData))
+	for key := range ds.Custom.SecureJSONData {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		ref := ds.Custom.SecureJSONData[key]
+		// Replaced by the value of the Secret key
+		secureData[key] = "${" + ref.Key + "}"
+		valuesFrom = append(valuesFrom, grafanav1beta1.GrafanaDatasourceValueFrom{
+			TargetPath: "secureJsonData." + key,
+			ValueFrom:  grafanav1beta1.GrafanaDatasourceValueFromSource{SecretKeyRef: &ref},
+		})
+	}
+	secureJSONData, err := json.Marshal(secureData)
+	if err != nil {
+		return err
+	}
+	// The upstreams are not necessarily in the cluster, so the system roots
+	// are trusted unless jsonData configures a CA
+	jsonData, secureJSONData, err = withTLSVerification(ds, "", jsonData, secureJSONData)
+	if err != nil {
+		return fmt.Errorf("invalid jsonData for datasource %s: %w", ds.Name, err)
+	}
+
+	customDataSourceSpec := grafanav1beta1.GrafanaDatasourceSpec{
+		Datasource: &grafanav1beta1.GrafanaDatasourceInternal{
+			Name:           ds.Name,
+			Type:           ds.Custom.Type,
+			Access:         "proxy",
+			IsDefault:      boolPtr(false),
+			URL:            ds.Custom.URL,
+			Database:       ds.Custom.Database,
+			User:           ds.Custom.User,
+			BasicAuthUser:  ds.Custom.BasicAuthUser,
+			JSONData:       jsonData,
+			SecureJSONData: secureJSONData,
+		},
+		InstanceSelector: &metav1.LabelSelector{
+			MatchLabels: r.generateLabelsForComponent(instance, "grafana"),
+		},
+		ValuesFrom: valuesFrom,
+	}
+	if ds.Custom.BasicAuth {
+		customDataSourceSpec.Datasource.BasicAuth = boolPtr(true)
+	}
+	op, err := CreateOrUpdateWithRetries(ctx, r.Client, customDataSource, func() error {
+		customDataSource.ObjectMeta.Labels = r.generateLabelsForComponent(instance, "custom")
+		customDataSource.Spec = customDataSourceSpec
+		return ctrl.SetControllerReference(instance, customDataSource, r.Scheme)
+	})
+	if err != nil {
+		return err
+	}
+	if op == ctrlutil.OperationResultCreated {
+		logger.Info("Created custom datasource", "type", ds.Custom.Type)
+	} else if op == ctrlutil.OperationResultUpdated {
+		logger.Info("Updated custom datasource", "type", ds.Custom.Type)
+	}
+	return nil
+}
+
+// anyTokenFromDataSources returns the token of the first of datasources
+// carrying one, or an empty string
+func anyTokenFromDataSources(datasources []grafanav1beta1.GrafanaDatasource) string {
+	for _, gds := range datasources {
+		if gds.Spec.Datasource == nil {
+			continue
+		}
+		if token, err := extractTokenFromSecureJSONData(gds.Spec.Datasource.SecureJSONData); err == nil {
+			return token
+		}
+	}
+	return ""
+}
+
+// getDataSourceToken returns the token the datasources were last reconciled
+// with, from the datasource token Secret or, when it does not exist yet, from
+// the existing datasources
+func (r *GrafanaReconciler) getDataSourceToken(ctx context.Context, instance *grafoov1alpha1.Grafana, datasources []grafanav1beta1.GrafanaDatasource) (string, error) {
+	secret := &corev1.Secret{}
+	err := r.Get(ctx, client.ObjectKey{Name: r.generateNameForComponent(instance, "datasource-token"), Namespace: instance.Namespace}, secret)
+	if apierrors.IsNotFound(err) {
+		return anyTokenFromDataSources(datasources), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(secret.Data[dataSourceTokenKey]), nil
+}
+
+// reconcileDataSourceTokenSecret stores the token of the datasources in the
+// <name>-datasource-token Secret, which dsproxy authenticates to the
+// upstreams with in place of the token of the user
+func (r *GrafanaReconciler) reconcileDataSourceTokenSecret(ctx context.Context, instance *grafoov1alpha1.Grafana, token string) error {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      r.generateNameForComponent(instance, "datasource-token"),
+			Namespace: instance.Namespace,
+		},
+	}
+	_, err := CreateOrUpdateWithRetries(ctx, r.Client, secret, func() error {
+		secret.ObjectMeta.Labels = r.generateLabelsForComponent(instance, "grafana")
+		secret.Data = map[string][]byte{dataSourceTokenKey: []byte(token)}
+		return ctrl.SetControllerReference(instance, secret, r.Scheme)
+	})
+	return err
+}
+
 // helper function to extract the token value from json.RawMessage(`{"httpHeaderValue1": json.RawMessage(`{"httpHeaderValue1": "Bearer ` + token + `"}`),}`),
 func extractTokenFromSecureJSONData(secureJSONData json.RawMessage) (string, error) {
 	var data map[string]string
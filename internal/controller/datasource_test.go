@@ -2,14 +2,20 @@ package controller
 
 import (
 	"context"
+	"encoding/json"
+	"testing"
 	"time"
 
 	grafanav1beta1 "github.com/grafana/grafana-operator/v5/api/v1beta1"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	clientfake "sigs.k8s.io/controller-runtime/pkg/client/fake"
 
 	grafoov1alpha1 "github.com/cldmnky/grafoo/api/v1alpha1"
 )
@@ -185,3 +191,158 @@ var _ = Describe("extractTokenFromSecureJSONData", func() {
 		})
 	})
 })
+
+// Test_reconcileCustomDataSource tests reconciling and pruning custom datasources
+func Test_reconcileCustomDataSource(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	_ = grafoov1alpha1.AddToScheme(scheme)
+	_ = grafanav1beta1.AddToScheme(scheme)
+	ctx := context.TODO()
+
+	instance := &grafoov1alpha1.Grafana{
+		Spec: grafoov1alpha1.GrafanaSpec{
+			DataSources: []grafoov1alpha1.DataSource{
+				{
+					Name:    "Elasticsearch",
+					Type:    grafoov1alpha1.Custom,
+					Enabled: true,
+					Custom: &grafoov1alpha1.CustomDS{
+						Type:          "elasticsearch",
+						URL:           "https://elasticsearch.example.com:9200",
+						BasicAuth:     true,
+						BasicAuthUser: "grafana",
+						JSONData:      json.RawMessage(`{"index": "logs-*", "timeField": "@timestamp"}`),
+						SecureJSONData: map[string]corev1.SecretKeySelector{
+							"basicAuthPassword": {
+								LocalObjectReference: corev1.LocalObjectReference{Name: "elasticsearch"},
+								Key:                  "password",
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	instance.Name = "test-grafana"
+	instance.Namespace = "test-namespace"
+
+	stale := &grafanav1beta1.GrafanaDatasource{}
+	stale.Name = "test-grafana-stale"
+	stale.Namespace = "test-namespace"
+	stale.Labels = map[string]string{"app.kubernetes.io/instance": "test-grafana"}
+	fakeClient := clientfake.NewClientBuilder().WithScheme(scheme).WithObjects(instance, stale).Build()
+	r := &GrafanaReconciler{Client: fakeClient, Scheme: scheme}
+
+	assert.NoError(t, r.ReconcileDataSources(ctx, instance, false))
+
+	ds := &grafanav1beta1.GrafanaDatasource{}
+	name := r.generateNameForComponent(instance, instance.Spec.DataSources[0].GetDataSourceNameHash())
+	assert.NoError(t, fakeClient.Get(ctx, types.NamespacedName{Name: name, Namespace: "test-namespace"}, ds))
+	assert.Equal(t, "elasticsearch", ds.Spec.Datasource.Type)
+	assert.Equal(t, "https://elasticsearch.example.com:9200", ds.Spec.Datasource.URL)
+	assert.Equal(t, "grafana", ds.Spec.Datasource.BasicAuthUser)
+	assert.True(t, *ds.Spec.Datasource.BasicAuth)
+	assert.JSONEq(t, `{"index": "logs-*", "timeField": "@timestamp"}`, string(ds.Spec.Datasource.JSONData))
+	// The password stays in the Secret
+	assert.JSONEq(t, `{"basicAuthPassword": "${password}"}`, string(ds.Spec.Datasource.SecureJSONData))
+	assert.Equal(t, []grafanav1beta1.GrafanaDatasourceValueFrom{{
+		TargetPath: "secureJsonData.basicAuthPassword",
+		ValueFrom: grafanav1beta1.GrafanaDatasourceValueFromSource{SecretKeyRef: &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: "elasticsearch"},
+			Key:                  "password",
+		}},
+	}}, ds.Spec.ValuesFrom)
+	assert.Len(t, ds.OwnerReferences, 1)
+
+	err := fakeClient.Get(ctx, types.NamespacedName{Name: "test-grafana-stale", Namespace: "test-namespace"}, stale)
+	assert.True(t, errors.IsNotFound(err))
+
+	// Opting out of the TLS verification
+	instance.Spec.DataSources[0].TLSSkipVerify = true
+	assert.NoError(t, r.ReconcileDataSources(ctx, instance, false))
+	assert.NoError(t, fakeClient.Get(ctx, types.NamespacedName{Name: name, Namespace: "test-namespace"}, ds))
+	assert.JSONEq(t, `{"index": "logs-*", "timeField": "@timestamp", "tlsSkipVerify": true}`, string(ds.Spec.Datasource.JSONData))
+}
+
+// Test_ReconcileDataSourcesDSProxy tests that the datasources forward the
+// OAuth token of the user to dsproxy instead of the datasource token
+func Test_ReconcileDataSourcesDSProxy(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	_ = grafoov1alpha1.AddToScheme(scheme)
+	_ = grafanav1beta1.AddToScheme(scheme)
+	ctx := context.TODO()
+
+	instance := &grafoov1alpha1.Grafana{
+		Spec: grafoov1alpha1.GrafanaSpec{
+			DataSources: []grafoov1alpha1.DataSource{
+				{
+					Name:       "Prometheus",
+					Type:       grafoov1alpha1.PrometheusInCluster,
+					Enabled:    true,
+					Prometheus: &grafoov1alpha1.PrometheusDS{URL: "https://thanos-querier.openshift-monitoring.svc.cluster.local:9091"},
+				},
+				{
+					Name:    "Loki",
+					Type:    grafoov1alpha1.LokiInCluster,
+					Enabled: true,
+					Loki:    &grafoov1alpha1.LokiDS{URL: "https://logging-loki-gateway-http.openshift-logging.svc.cluster.local:8080/api/logs/v1/application/"},
+				},
+				{
+					Name:    "Tempo",
+					Type:    grafoov1alpha1.TempoInCluster,
+					Enabled: true,
+					Tempo:   &grafoov1alpha1.TempoDS{URL: "https://tempo-tempo-gateway.tempo.svc.cluster.local:8080/api/traces/v1/dev/tempo"},
+				},
+			},
+		},
+	}
+	instance.Name = "test-grafana"
+	instance.Namespace = "test-namespace"
+
+	// A datasource reconciled before the token Secret existed
+	existing := &grafanav1beta1.GrafanaDatasource{
+		Spec: grafanav1beta1.GrafanaDatasourceSpec{Datasource: &grafanav1beta1.GrafanaDatasourceInternal{
+			SecureJSONData: json.RawMessage(`{"httpHeaderValue1": "Bearer sa-token"}`),
+		}},
+	}
+	existing.Name = "test-grafana-" + instance.Spec.DataSources[0].GetDataSourceNameHash()
+	existing.Namespace = "test-namespace"
+	existing.Labels = map[string]string{"app.kubernetes.io/instance": "test-grafana"}
+	fakeClient := clientfake.NewClientBuilder().WithScheme(scheme).WithObjects(instance, existing).Build()
+	r := &GrafanaReconciler{Client: fakeClient, Scheme: scheme}
+
+	getDataSource := func(ds grafoov1alpha1.DataSource) *grafanav1beta1.GrafanaDatasource {
+		gds := &grafanav1beta1.GrafanaDatasource{}
+		name := r.generateNameForComponent(instance, ds.GetDataSourceNameHash())
+		assert.NoError(t, fakeClient.Get(ctx, types.NamespacedName{Name: name, Namespace: "test-namespace"}, gds))
+		return gds
+	}
+
+	// Without dsproxy the datasources authenticate with the token
+	assert.NoError(t, r.ReconcileDataSources(ctx, instance, false))
+	gds := getDataSource(instance.Spec.DataSources[1])
+	assert.JSONEq(t, `{"httpHeaderName1": "Authorization"}`, string(gds.Spec.Datasource.JSONData))
+	assert.JSONEq(t, `{"httpHeaderValue1": "Bearer sa-token"}`, string(gds.Spec.Datasource.SecureJSONData))
+
+	// The token is kept for dsproxy
+	secret := &corev1.Secret{}
+	assert.NoError(t, fakeClient.Get(ctx, types.NamespacedName{Name: "test-grafana-datasource-token", Namespace: "test-namespace"}, secret))
+	assert.Equal(t, "sa-token", string(secret.Data[dataSourceTokenKey]))
+
+	instance.Spec.DSProxy = &grafoov1alpha1.DSProxy{Enabled: true}
+	assert.NoError(t, r.ReconcileDataSources(ctx, instance, false))
+	for _, ds := range instance.Spec.DataSources {
+		gds := getDataSource(ds)
+		assert.JSONEq(t, `{"oauthPassThru": true, "httpHeaderName1": "X-Datasource-Uid", "httpHeaderName2": "X-Datasource-Type"}`, string(gds.Spec.Datasource.JSONData), ds.Name)
+		assert.JSONEq(t, `{"httpHeaderValue1": "`+gds.Name+`", "httpHeaderValue2": "`+gds.Spec.Datasource.Type+`"}`, string(gds.Spec.Datasource.SecureJSONData), ds.Name)
+		assert.NotContains(t, string(gds.Spec.Datasource.SecureJSONData), "sa-token", ds.Name)
+	}
+
+	// Disabling dsproxy restores the token from the Secret
+	instance.Spec.DSProxy.Enabled = false
+	assert.NoError(t, r.ReconcileDataSources(ctx, instance, false))
+	gds = getDataSource(instance.Spec.DataSources[2])
+	assert.JSONEq(t, `{"httpHeaderValue1": "Bearer sa-token"}`, string(gds.Spec.Datasource.SecureJSONData))
+}
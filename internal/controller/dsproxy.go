@@ -0,0 +1,698 @@
+package controller
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	grafanav1beta1 "github.com/grafana/grafana-operator/v5/api/v1beta1"
+	"gopkg.in/yaml.v3"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	grafoov1alpha1 "github.com/cldmnky/grafoo/api/v1alpha1"
+)
+
+const (
+	dsproxyContainerName     = "dsproxy"
+	dsproxyInitContainerName = "dsproxy-init"
+	// dsproxyUID is the UID the dsproxy sidecar runs as. Its traffic is
+	// excluded from the iptables redirect so it can reach the upstreams.
+	dsproxyUID        = int64(1337)
+	dsproxyConfigDir  = "/etc/dsproxy/config"
+	dsproxyConfigFile = "dsproxy.yaml"
+	dsproxyPolicyDir  = "/etc/dsproxy/policy"
+	dsproxyTLSDir     = "/etc/dsproxy/tls"
+	dsproxyTokenDir   = "/etc/dsproxy/token"
+	// dsproxyMetricsPort serves /metrics, /healthz and /readyz
+	dsproxyMetricsPort = 5535
+	// dsproxyCAValidity is the validity of the CA dsproxy issues the
+	// certificates of the intercepted hosts with
+	dsproxyCAValidity = 365 * 24 * time.Hour
+)
+
+// dsproxyModel is the Casbin model evaluated by dsproxy, see cmd/dsproxy/authz/model.conf
+const dsproxyModel = `[request_definition]
+r = sub, dom, obj, act
+
+[policy_definition]
+p = sub, dom, obj, act
+
+[role_definition]
+g = _, _
+
+[policy_effect]
+e = some(where (p.eft == allow))
+
+[matchers]
+m = (g(r.sub, p.sub) || r.sub == p.sub) && \
+    (keyMatch2(r.dom, p.dom) || globMatch(r.dom, p.dom) || p.dom == "*") && \
+    (keyMatch2(r.obj, p.obj) || globMatch(r.obj, p.obj) || p.obj == "*") && \
+    r.act == p.act
+`
+
+// dsproxyConfig mirrors the dsproxy config file format
+type dsproxyConfig struct {
+	Proxies     []dsproxyProxyRule  `yaml:"proxies"`
+	Datasources []dsproxyDatasource `yaml:"datasources"`
+}
+
+type dsproxyProxyRule struct {
+	Domain  string         `yaml:"domain"`
+	Proxies []dsproxyPorts `yaml:"proxies"`
+}
+
+type dsproxyPorts struct {
+	HTTP  []int `yaml:"http,omitempty"`
+	HTTPS []int `yaml:"https,omitempty"`
+}
+
+type dsproxyDatasource struct {
+	UID            string `yaml:"uid"`
+	Type           string `yaml:"type"`
+	URL            string `yaml:"url"`
+	InjectionLabel string `yaml:"injectionLabel,omitempty"`
+	ClusterLabel   string `yaml:"clusterLabel,omitempty"`
+	CABundle       string `yaml:"caBundle,omitempty"`
+	TLSSkipVerify  bool   `yaml:"tlsSkipVerify,omitempty"`
+}
+
+// dsproxyEnabled returns true if the dsproxy sidecar is enabled for the instance
+func dsproxyEnabled(instance *grafoov1alpha1.Grafana) bool {
+	return instance.Spec.DSProxy != nil && instance.Spec.DSProxy.Enabled
+}
+
+// ReconcileDSProxy reconciles the config, policy and TLS material of the
+// dsproxy sidecar, which verifies the upstreams with caBundle. It returns a
+// checksum of the config, the CA certificate and caBundle, which is set on
+// the Grafana pod template so that their changes roll the pods, as the
+// iptables rules are only applied by the init container. The policy is left
+// out, dsproxy reloads it from the ConfigMap without a restart.
+func (r *GrafanaReconciler) ReconcileDSProxy(ctx context.Context, instance *grafoov1alpha1.Grafana, caBundle string) (string, error) {
+	logger := log.FromContext(ctx)
+
+	if !dsproxyEnabled(instance) {
+		return "", r.cleanupDSProxy(ctx, instance)
+	}
+	logger.Info("Reconciling dsproxy")
+
+	// The access policies may refer to the datasources by name
+	var datasources []grafoov1alpha1.DataSource
+	dataSourceUIDs := map[string][]string{}
+	for _, ds := range instance.Spec.DataSources {
+		resolved, err := r.resolveDataSource(ctx, instance, ds)
+		if err != nil {
+			return "", err
+		}
+		for _, rds := range resolved {
+			uid := r.generateNameForComponent(instance, rds.GetDataSourceNameHash())
+			dataSourceUIDs[ds.Name] = append(dataSourceUIDs[ds.Name], uid)
+			if rds.Name != ds.Name {
+				dataSourceUIDs[rds.Name] = append(dataSourceUIDs[rds.Name], uid)
+			}
+			dataSourceUIDs[uid] = []string{uid}
+		}
+		datasources = append(datasources, resolved...)
+	}
+	config, err := r.generateDSProxyConfig(instance, datasources, caBundle != "")
+	if err != nil {
+		return "", err
+	}
+	policy := instance.Spec.DSProxy.Policy
+	if policy == "" {
+		policy = grafoov1alpha1.DSProxyPolicy
+	}
+	accessPolicies, err := r.getAccessPolicies(ctx, instance)
+	if err != nil {
+		return "", err
+	}
+	policy = strings.TrimRight(policy, "\n") + "\n" + renderAccessPolicies(ctx, accessPolicies, dataSourceUIDs)
+
+	if err := r.reconcileDSProxyConfigMap(ctx, instance, "dsproxy-config", map[string]string{
+		dsproxyConfigFile: config,
+	}); err != nil {
+		return "", err
+	}
+	if err := r.reconcileDSProxyConfigMap(ctx, instance, "dsproxy-policy", map[string]string{
+		"model.conf": dsproxyModel,
+		"policy.csv": policy,
+	}); err != nil {
+		return "", err
+	}
+	cert, err := r.reconcileDSProxyCASecret(ctx, instance)
+	if err != nil {
+		return "", err
+	}
+
+	return sha256ForSecret(config + cert + caBundle), nil
+}
+
+// cleanupDSProxy removes all dsproxy resources when disabled
+func (r *GrafanaReconciler) cleanupDSProxy(ctx context.Context, instance *grafoov1alpha1.Grafana) error {
+	resources := []struct {
+		name string
+		obj  client.Object
+	}{
+		{"configmap", &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      r.generateNameForComponent(instance, "dsproxy-config"),
+				Namespace: instance.Namespace,
+			},
+		}},
+		{"configmap", &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      r.generateNameForComponent(instance, "dsproxy-policy"),
+				Namespace: instance.Namespace,
+			},
+		}},
+		{"secret", &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      r.generateNameForComponent(instance, "dsproxy-tls"),
+				Namespace: instance.Namespace,
+			},
+		}},
+	}
+
+	for _, res := range resources {
+		if err := r.deleteResourceIfExists(ctx, res.obj, instance, res.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// generateDSProxyConfig generates the dsproxy config file for the enabled
+// datasources, resolved from the ones of the instance. Every datasource is routed by its
+// GrafanaDatasource name, which Grafana sends as X-Datasource-Uid. Its
+// upstream is verified with the mounted CA bundle, if there is one, unless
+// it opts out with tlsSkipVerify.
+func (r *GrafanaReconciler) generateDSProxyConfig(instance *grafoov1alpha1.Grafana, datasources []grafoov1alpha1.DataSource, caBundle bool) (string, error) {
+	cfg := dsproxyConfig{}
+	ports := map[string]*dsproxyPorts{}
+	// dsproxy configures the upstream TLS per host
+	skipVerify := map[string]bool{}
+
+	for _, ds := range datasources {
+		if !ds.Enabled {
+			continue
+		}
+		dsType, dsURL := dataSourceTypeAndURL(ds)
+		if dsType == "" {
+			continue
+		}
+		u, err := url.Parse(dsURL)
+		if err != nil || u.Hostname() == "" {
+			return "", fmt.Errorf("invalid url %q for datasource %s", dsURL, ds.Name)
+		}
+
+		port := 80
+		if u.Scheme == "https" {
+			port = 443
+		}
+		if u.Port() != "" {
+			if port, err = strconv.Atoi(u.Port()); err != nil {
+				return "", fmt.Errorf("invalid port in url %q for datasource %s", dsURL, ds.Name)
+			}
+		}
+		p, ok := ports[u.Hostname()]
+		if !ok {
+			p = &dsproxyPorts{}
+			ports[u.Hostname()] = p
+		}
+		if u.Scheme == "https" {
+			p.HTTPS = appendUniqueInt(p.HTTPS, port)
+		} else {
+			p.HTTP = appendUniqueInt(p.HTTP, port)
+		}
+
+		datasource := dsproxyDatasource{
+			UID:  r.generateNameForComponent(instance, ds.GetDataSourceNameHash()),
+			Type: dsType,
+			URL:  fmt.Sprintf("%s://%s", u.Scheme, u.Host),
+		}
+		if dsType == "prometheus" {
+			datasource.InjectionLabel = instance.Spec.DSProxy.InjectionLabel
+		}
+		if ds.Type == grafoov1alpha1.PrometheusMcoo {
+			datasource.ClusterLabel = "cluster"
+		}
+		if previous, ok := skipVerify[u.Host]; ok && previous != ds.TLSSkipVerify {
+			return "", fmt.Errorf("datasource %s: all datasources on %s must set the same tlsSkipVerify", ds.Name, u.Host)
+		}
+		skipVerify[u.Host] = ds.TLSSkipVerify
+		if ds.TLSSkipVerify {
+			datasource.TLSSkipVerify = true
+		} else if caBundle && u.Scheme == "https" {
+			datasource.CABundle = dsproxyCABundleDir + "/" + caBundleKey
+		}
+		cfg.Datasources = append(cfg.Datasources, datasource)
+	}
+
+	hosts := make([]string, 0, len(ports))
+	for host := range ports {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		cfg.Proxies = append(cfg.Proxies, dsproxyProxyRule{Domain: host, Proxies: []dsproxyPorts{*ports[host]}})
+	}
+
+	out, err := yaml.Marshal(cfg)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// getAccessPolicies returns the valid GrafanaAccessPolicies selecting the
+// instance, sorted by name. Invalid policies are skipped, as they could
+// otherwise inject arbitrary lines into policy.csv, and so are policies with
+// wildcards unless the instance allows them, as the webhook may be disabled
+// or the instance changed since.
+func (r *GrafanaReconciler) getAccessPolicies(ctx context.Context, instance *grafoov1alpha1.Grafana) ([]grafoov1alpha1.GrafanaAccessPolicy, error) {
+	logger := log.FromContext(ctx)
+	policyList := &grafoov1alpha1.GrafanaAccessPolicyList{}
+	if err := r.Client.List(ctx, policyList, client.InNamespace(instance.Namespace)); err != nil {
+		return nil, err
+	}
+
+	var policies []grafoov1alpha1.GrafanaAccessPolicy
+	for _, policy := range policyList.Items {
+		if err := policy.Validate(); err != nil {
+			logger.Error(err, "Skipping invalid access policy", "name", policy.Name)
+			continue
+		}
+		if !policy.Selects(instance) {
+			continue
+		}
+		if policy.HasWildcards() && !instance.Spec.DSProxy.AccessPolicyWildcards {
+			logger.Error(nil, "Skipping access policy with wildcards, which spec.dsproxy.accessPolicyWildcards does not allow", "name", policy.Name)
+			continue
+		}
+		policies = append(policies, policy)
+	}
+	sort.Slice(policies, func(i, j int) bool {
+		return policies[i].Name < policies[j].Name
+	})
+	return policies, nil
+}
+
+// renderAccessPolicies renders the rules of policies as policy.csv lines.
+// Their datasources are mapped to the UIDs dsproxy routes on by
+// dataSourceUIDs, datasources it does not know are skipped.
+func renderAccessPolicies(ctx context.Context, policies []grafoov1alpha1.GrafanaAccessPolicy, dataSourceUIDs map[string][]string) string {
+	logger := log.FromContext(ctx)
+	var b strings.Builder
+	for _, policy := range policies {
+		fmt.Fprintf(&b, "\n# GrafanaAccessPolicy %s\n", policy.Name)
+		for _, rule := range policy.Spec.Rules {
+			var datasources []string
+			for _, datasource := range rule.DataSources {
+				if datasource == "*" {
+					datasources = appendUniqueString(datasources, datasource)
+					continue
+				}
+				uids, ok := dataSourceUIDs[datasource]
+				if !ok {
+					logger.Info("Skipping unknown datasource of access policy", "name", policy.Name, "datasource", datasource)
+					continue
+				}
+				for _, uid := range uids {
+					datasources = appendUniqueString(datasources, uid)
+				}
+			}
+			if len(rule.DataSources) == 0 {
+				datasources = []string{"*"}
+			}
+			for _, subject := range append(append([]string{}, rule.Subjects...), rule.Groups...) {
+				for _, datasource := range datasources {
+					for _, pattern := range rule.Namespaces {
+						fmt.Fprintf(&b, "p, %s, %s, %s, read\n", subject, datasource, pattern)
+					}
+				}
+			}
+		}
+	}
+	return b.String()
+}
+
+// grafanasForAccessPolicy maps a GrafanaAccessPolicy to the Grafana instances
+// in its namespace, whose policy.csv has to be rendered again
+func (r *GrafanaReconciler) grafanasForAccessPolicy(ctx context.Context, obj client.Object) []reconcile.Request {
+	grafanas := &grafoov1alpha1.GrafanaList{}
+	if err := r.Client.List(ctx, grafanas, client.InNamespace(obj.GetNamespace())); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list Grafana instances for access policy", "name", obj.GetName())
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, grafana := range grafanas.Items {
+		if dsproxyEnabled(&grafana) {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: grafana.Name, Namespace: grafana.Namespace}})
+		}
+	}
+	return requests
+}
+
+// dataSourceTypeAndURL returns the Grafana datasource type and the URL of ds,
+// or an empty type for unknown datasource types.
+func dataSourceTypeAndURL(ds grafoov1alpha1.DataSource) (string, string) {
+	switch ds.Type {
+	case grafoov1alpha1.PrometheusInCluster, grafoov1alpha1.PrometheusMcoo:
+		if ds.Prometheus != nil {
+			return "prometheus", ds.Prometheus.URL
+		}
+	case grafoov1alpha1.LokiInCluster:
+		if ds.Loki != nil {
+			return "loki", ds.Loki.URL
+		}
+	case grafoov1alpha1.TempoInCluster:
+		if ds.Tempo != nil {
+			return "tempo", ds.Tempo.URL
+		}
+	}
+	return "", ""
+}
+
+func appendUniqueString(values []string, value string) []string {
+	for _, v := range values {
+		if v == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
+
+func appendUniqueInt(values []int, value int) []int {
+	for _, v := range values {
+		if v == value {
+			return values
+		}
+	}
+	values = append(values, value)
+	sort.Ints(values)
+	return values
+}
+
+func (r *GrafanaReconciler) reconcileDSProxyConfigMap(ctx context.Context, instance *grafoov1alpha1.Grafana, component string, data map[string]string) error {
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      r.generateNameForComponent(instance, component),
+			Namespace: instance.Namespace,
+		},
+	}
+	_, err := CreateOrUpdateWithRetries(ctx, r.Client, configMap, func() error {
+		configMap.ObjectMeta.Labels = r.generateLabelsForComponent(instance, "dsproxy")
+		configMap.Data = data
+		return ctrl.SetControllerReference(instance, configMap, r.Scheme)
+	})
+	return err
+}
+
+// reconcileDSProxyCASecret ensures the secret with the CA dsproxy issues the
+// certificates of the intercepted HTTPS hosts with, by the server name the
+// client sends. The CA is reissued when it is about to expire. It returns the
+// PEM encoded CA certificate.
+func (r *GrafanaReconciler) reconcileDSProxyCASecret(ctx context.Context, instance *grafoov1alpha1.Grafana) (string, error) {
+	logger := log.FromContext(ctx)
+	caSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      r.generateNameForComponent(instance, "dsproxy-tls"),
+			Namespace: instance.Namespace,
+		},
+	}
+	_, err := CreateOrUpdateWithRetries(ctx, r.Client, caSecret, func() error {
+		caSecret.ObjectMeta.Labels = r.generateLabelsForComponent(instance, "dsproxy")
+		if !caCertificateValid(caSecret.Data[corev1.TLSCertKey]) {
+			logger.Info("Issuing dsproxy CA")
+			cert, key, err := generateCACertificate(instance.Name + "-dsproxy-ca")
+			if err != nil {
+				return err
+			}
+			caSecret.Type = corev1.SecretTypeTLS
+			caSecret.Data = map[string][]byte{
+				corev1.TLSCertKey:       cert,
+				corev1.TLSPrivateKeyKey: key,
+			}
+		}
+		return ctrl.SetControllerReference(instance, caSecret, r.Scheme)
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(caSecret.Data[corev1.TLSCertKey]), nil
+}
+
+// caCertificateValid returns true if certPEM holds a CA certificate that is
+// valid for at least another 30 days
+func caCertificateValid(certPEM []byte) bool {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return false
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return false
+	}
+	return cert.IsCA && time.Now().Add(30*24*time.Hour).Before(cert.NotAfter)
+}
+
+// generateCACertificate generates a PEM encoded self-signed CA certificate
+// and key
+func generateCACertificate(commonName string) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(dsproxyCAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// generateDSProxyPodTemplate generates the Grafana pod template override
+// adding the dsproxy sidecar and the init container setting up the iptables
+// redirect of the datasource traffic to it. The CA bundle volume is added by
+// withCABundleVolume.
+//
+// The redirect rules are static: only the init container runs as root with
+// NET_ADMIN and NET_RAW, the sidecar does not manage them, so neither
+// re-resolves the datasource hosts nor removes stale rules. Changes to the
+// datasources roll the pods through the checksum, changed addresses of their
+// hosts need a rollout. The init container needs the grafoo-dsproxy SCC on
+// OpenShift, see cmd/dsproxy/README.md.
+func (r *GrafanaReconciler) generateDSProxyPodTemplate(ctx context.Context, instance *grafoov1alpha1.Grafana, checksum, caBundle string) *grafanav1beta1.DeploymentV1PodTemplateSpec {
+	image := instance.Spec.DSProxy.Image
+	if image == "" {
+		image = grafoov1alpha1.DSProxyImage
+	}
+	volumeMounts := []corev1.VolumeMount{
+		{Name: "dsproxy-config", MountPath: dsproxyConfigDir, ReadOnly: true},
+		{Name: "dsproxy-policy", MountPath: dsproxyPolicyDir, ReadOnly: true},
+		{Name: "dsproxy-tls", MountPath: dsproxyTLSDir, ReadOnly: true},
+		{Name: "dsproxy-token", MountPath: dsproxyTokenDir, ReadOnly: true},
+	}
+	if caBundle != "" {
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{Name: caBundleVolume, MountPath: dsproxyCABundleDir, ReadOnly: true})
+	}
+	configArg := "--config=" + dsproxyConfigDir + "/" + dsproxyConfigFile
+	args := []string{
+		// The redirect rules of the init container are static
+		"--iptables=false",
+		configArg,
+		"--policy-path=" + dsproxyPolicyDir,
+		// Certificates are issued by SNI, connections without one fail
+		"--tls-cert=",
+		"--tls-key=",
+		"--tls-ca-cert=" + dsproxyTLSDir + "/" + corev1.TLSCertKey,
+		"--tls-ca-key=" + dsproxyTLSDir + "/" + corev1.TLSPrivateKeyKey,
+		"--jwks-url=" + r.generateRouteUriForComponent(ctx, instance, "dex") + "/.well-known/openid-configuration",
+		"--jwt-audience=grafana",
+		// Replaces the forwarded OAuth token of the user
+		"--upstream-token-file=" + dsproxyTokenDir + "/" + dataSourceTokenKey,
+		fmt.Sprintf("--metrics-addr=:%d", dsproxyMetricsPort),
+	}
+	if instance.Spec.DSProxy.InjectionLabel != "" {
+		args = append(args, "--injection-label="+instance.Spec.DSProxy.InjectionLabel)
+	}
+	if instance.Spec.DSProxy.TokenReview {
+		args = append(args, "--token-review")
+	}
+
+	return &grafanav1beta1.DeploymentV1PodTemplateSpec{
+		ObjectMeta: grafanav1beta1.ObjectMeta{
+			Annotations: map[string]string{
+				"checksum/dsproxy": checksum,
+			},
+		},
+		Spec: &grafanav1beta1.DeploymentV1PodSpec{
+			InitContainers: []corev1.Container{
+				{
+					Name:  dsproxyInitContainerName,
+					Image: image,
+					Args: []string{
+						"--init",
+						"--iptables",
+						fmt.Sprintf("--exclude-uid=%d", dsproxyUID),
+						configArg,
+					},
+					SecurityContext: &corev1.SecurityContext{
+						AllowPrivilegeEscalation: boolPtr(false),
+						Capabilities: &corev1.Capabilities{
+							Add:  []corev1.Capability{"NET_ADMIN", "NET_RAW"},
+							Drop: []corev1.Capability{"ALL"},
+						},
+						RunAsUser:    int64Ptr(0),
+						RunAsNonRoot: boolPtr(false),
+					},
+					VolumeMounts: volumeMounts[:1],
+				},
+			},
+			Containers: []corev1.Container{
+				{
+					Name:  dsproxyContainerName,
+					Image: image,
+					Args:  args,
+					Ports: []corev1.ContainerPort{
+						{
+							ContainerPort: dsproxyMetricsPort,
+							Protocol:      corev1.ProtocolTCP,
+							Name:          "dsproxy-metrics",
+						},
+					},
+					LivenessProbe: &corev1.Probe{
+						ProbeHandler: corev1.ProbeHandler{
+							HTTPGet: &corev1.HTTPGetAction{
+								Path: "/healthz",
+								Port: intstr.FromInt(dsproxyMetricsPort),
+							},
+						},
+					},
+					// Keeps Grafana out of its Service until dsproxy has
+					// loaded the policy and the JWKS
+					ReadinessProbe: &corev1.Probe{
+						ProbeHandler: corev1.ProbeHandler{
+							HTTPGet: &corev1.HTTPGetAction{
+								Path: "/readyz",
+								Port: intstr.FromInt(dsproxyMetricsPort),
+							},
+						},
+					},
+					SecurityContext: &corev1.SecurityContext{
+						AllowPrivilegeEscalation: boolPtr(false),
+						Capabilities: &corev1.Capabilities{
+							Drop: []corev1.Capability{"ALL"},
+						},
+						RunAsUser:    int64Ptr(dsproxyUID),
+						RunAsNonRoot: boolPtr(true),
+					},
+					VolumeMounts: volumeMounts,
+				},
+			},
+			Volumes: []corev1.Volume{
+				{
+					Name: "dsproxy-config",
+					VolumeSource: corev1.VolumeSource{
+						ConfigMap: &corev1.ConfigMapVolumeSource{
+							LocalObjectReference: corev1.LocalObjectReference{Name: r.generateNameForComponent(instance, "dsproxy-config")},
+						},
+					},
+				},
+				{
+					Name: "dsproxy-policy",
+					VolumeSource: corev1.VolumeSource{
+						ConfigMap: &corev1.ConfigMapVolumeSource{
+							LocalObjectReference: corev1.LocalObjectReference{Name: r.generateNameForComponent(instance, "dsproxy-policy")},
+						},
+					},
+				},
+				{
+					Name: "dsproxy-tls",
+					VolumeSource: corev1.VolumeSource{
+						Secret: &corev1.SecretVolumeSource{
+							SecretName: r.generateNameForComponent(instance, "dsproxy-tls"),
+						},
+					},
+				},
+				{
+					// Created with the first token of the datasources,
+					// dsproxy fails requests until then
+					Name: "dsproxy-token",
+					VolumeSource: corev1.VolumeSource{
+						Secret: &corev1.SecretVolumeSource{
+							SecretName: r.generateNameForComponent(instance, "datasource-token"),
+							Optional:   boolPtr(true),
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// withDSProxyHeaders makes Grafana forward the OAuth token of the user, which
+// dsproxy authorizes the query with and replaces by the datasource token,
+// instead of the static Authorization header. It adds the X-Datasource-Uid
+// and X-Datasource-Type headers dsproxy routes on in the freed header slots.
+func withDSProxyHeaders(uid, dsType string, jsonData, secureJSONData json.RawMessage) (json.RawMessage, json.RawMessage, error) {
+	var data map[string]any
+	if err := json.Unmarshal(jsonData, &data); err != nil {
+		return nil, nil, err
+	}
+	var secureData map[string]string
+	if err := json.Unmarshal(secureJSONData, &secureData); err != nil {
+		return nil, nil, err
+	}
+	data["oauthPassThru"] = true
+	data["httpHeaderName1"] = "X-Datasource-Uid"
+	secureData["httpHeaderValue1"] = uid
+	data["httpHeaderName2"] = "X-Datasource-Type"
+	secureData["httpHeaderValue2"] = dsType
+
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	secureJSONData, err = json.Marshal(secureData)
+	if err != nil {
+		return nil, nil, err
+	}
+	return jsonData, secureJSONData, nil
+}
@@ -0,0 +1,278 @@
+package controller
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	clientfake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	grafoov1alpha1 "github.com/cldmnky/grafoo/api/v1alpha1"
+)
+
+// Test_generateDSProxyConfig tests the dsproxy config generated from the datasources
+func Test_generateDSProxyConfig(t *testing.T) {
+	instance := &grafoov1alpha1.Grafana{
+		Spec: grafoov1alpha1.GrafanaSpec{
+			DSProxy: &grafoov1alpha1.DSProxy{
+				Enabled:        true,
+				InjectionLabel: "namespace",
+			},
+			DataSources: append(append([]grafoov1alpha1.DataSource{}, grafoov1alpha1.DataSources...), grafoov1alpha1.DataSourceMcoo...),
+		},
+	}
+	instance.Name = "test-grafana"
+	instance.Spec.DataSources = append(instance.Spec.DataSources, grafoov1alpha1.DataSource{
+		Name:       "Disabled",
+		Type:       grafoov1alpha1.PrometheusInCluster,
+		Prometheus: &grafoov1alpha1.PrometheusDS{URL: "https://disabled.example.com"},
+	})
+	// The Loki datasources share their host
+	for i := 1; i <= 3; i++ {
+		instance.Spec.DataSources[i].TLSSkipVerify = true
+	}
+
+	r := &GrafanaReconciler{}
+	config, err := r.generateDSProxyConfig(instance, instance.Spec.DataSources, true)
+	assert.NoError(t, err)
+
+	var cfg dsproxyConfig
+	assert.NoError(t, yaml.Unmarshal([]byte(config), &cfg))
+	assert.Len(t, cfg.Proxies, 4)
+	var hosts []string
+	for _, proxy := range cfg.Proxies {
+		hosts = append(hosts, proxy.Domain)
+	}
+	assert.Equal(t, []string{
+		"logging-loki-gateway-http.openshift-logging.svc.cluster.local",
+		"rbac-query-proxy.open-cluster-management-observability.svc.cluster.local",
+		"tempo-tempo-gateway.openshift-tempo-operator.svc.cluster.local",
+		"thanos-querier.openshift-monitoring.svc.cluster.local",
+	}, hosts)
+	assert.Equal(t, []dsproxyPorts{{HTTPS: []int{8080}}}, cfg.Proxies[0].Proxies)
+	assert.Equal(t, []dsproxyPorts{{HTTP: []int{8080}}}, cfg.Proxies[1].Proxies)
+	assert.Equal(t, []dsproxyPorts{{HTTPS: []int{9091}}}, cfg.Proxies[3].Proxies)
+
+	assert.Len(t, cfg.Datasources, 7)
+	assert.Equal(t, dsproxyDatasource{
+		UID:            r.generateNameForComponent(instance, grafoov1alpha1.DataSources[0].GetDataSourceNameHash()),
+		Type:           "prometheus",
+		URL:            "https://thanos-querier.openshift-monitoring.svc.cluster.local:9091",
+		InjectionLabel: "namespace",
+		CABundle:       "/etc/dsproxy/ca/ca-bundle.crt",
+	}, cfg.Datasources[0])
+	assert.Equal(t, "loki", cfg.Datasources[1].Type)
+	assert.Equal(t, "https://logging-loki-gateway-http.openshift-logging.svc.cluster.local:8080", cfg.Datasources[1].URL)
+	assert.Empty(t, cfg.Datasources[1].InjectionLabel)
+	assert.True(t, cfg.Datasources[1].TLSSkipVerify)
+	assert.Empty(t, cfg.Datasources[1].CABundle)
+	assert.Equal(t, "tempo", cfg.Datasources[4].Type)
+	assert.Equal(t, "cluster", cfg.Datasources[6].ClusterLabel)
+	// Plain HTTP upstreams have nothing to verify
+	assert.Empty(t, cfg.Datasources[6].CABundle)
+
+	// Without a CA bundle the upstreams are verified with the system roots
+	config, err = r.generateDSProxyConfig(instance, instance.Spec.DataSources, false)
+	assert.NoError(t, err)
+	assert.NoError(t, yaml.Unmarshal([]byte(config), &cfg))
+	assert.Empty(t, cfg.Datasources[0].CABundle)
+
+	instance.Spec.DataSources[3].TLSSkipVerify = false
+	_, err = r.generateDSProxyConfig(instance, instance.Spec.DataSources, true)
+	assert.ErrorContains(t, err, "must set the same tlsSkipVerify")
+}
+
+// Test_withDSProxyHeaders tests adding the dsproxy routing headers to a datasource
+func Test_withDSProxyHeaders(t *testing.T) {
+	jsonData, secureJSONData, err := withDSProxyHeaders("test-grafana-abc123", "loki",
+		json.RawMessage(`{"httpHeaderName1": "Authorization", "tlsSkipVerify": true}`),
+		json.RawMessage(`{"httpHeaderValue1": "Bearer token"}`))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"oauthPassThru": true, "httpHeaderName1": "X-Datasource-Uid", "httpHeaderName2": "X-Datasource-Type", "tlsSkipVerify": true}`, string(jsonData))
+	assert.JSONEq(t, `{"httpHeaderValue1": "test-grafana-abc123", "httpHeaderValue2": "loki"}`, string(secureJSONData))
+
+	// The token of the datasources does not reach Grafana
+	_, err = extractTokenFromSecureJSONData(secureJSONData)
+	assert.Error(t, err)
+}
+
+// Test_generateDSProxyPodTemplate tests that TokenReview is only enabled on request
+func Test_generateDSProxyPodTemplate(t *testing.T) {
+	instance := &grafoov1alpha1.Grafana{
+		Spec: grafoov1alpha1.GrafanaSpec{
+			IngressDomain: "apps.example.com",
+			DSProxy:       &grafoov1alpha1.DSProxy{Enabled: true},
+		},
+	}
+	instance.Name = "test-grafana"
+	instance.Namespace = "test-namespace"
+	r := &GrafanaReconciler{}
+
+	template := r.generateDSProxyPodTemplate(context.TODO(), instance, "checksum", "")
+	args := template.Spec.Containers[0].Args
+	assert.Contains(t, args, "--upstream-token-file=/etc/dsproxy/token/token")
+	assert.NotContains(t, args, "--token-review")
+	assert.Contains(t, template.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{Name: "dsproxy-token", MountPath: dsproxyTokenDir, ReadOnly: true})
+	// Only the init container manages the redirect rules, without escalating
+	assert.Contains(t, args, "--iptables=false")
+	assert.Equal(t, boolPtr(false), template.Spec.InitContainers[0].SecurityContext.AllowPrivilegeEscalation)
+
+	instance.Spec.DSProxy.TokenReview = true
+	template = r.generateDSProxyPodTemplate(context.TODO(), instance, "checksum", "")
+	assert.Contains(t, template.Spec.Containers[0].Args, "--token-review")
+}
+
+// Test_ReconcileDSProxy tests that policy changes do not change the checksum
+// rolling the Grafana pods, as dsproxy reloads the policy
+func Test_ReconcileDSProxy(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	_ = grafoov1alpha1.AddToScheme(scheme)
+	ctx := context.TODO()
+
+	instance := &grafoov1alpha1.Grafana{
+		Spec: grafoov1alpha1.GrafanaSpec{
+			DSProxy:     &grafoov1alpha1.DSProxy{Enabled: true},
+			DataSources: grafoov1alpha1.DataSources[:1],
+		},
+	}
+	instance.Name = "test-grafana"
+	instance.Namespace = "test-namespace"
+	fakeClient := clientfake.NewClientBuilder().WithScheme(scheme).WithObjects(instance).Build()
+	r := &GrafanaReconciler{Client: fakeClient, Scheme: scheme}
+
+	checksum, err := r.ReconcileDSProxy(ctx, instance, "")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, checksum)
+
+	policy := &grafoov1alpha1.GrafanaAccessPolicy{Spec: grafoov1alpha1.GrafanaAccessPolicySpec{
+		Rules: []grafoov1alpha1.AccessRule{{Groups: []string{"team-frontend"}, DataSources: []string{grafoov1alpha1.DataSources[0].Name}, Namespaces: []string{"local-cluster/frontend"}}},
+	}}
+	policy.Name = "frontend"
+	policy.Namespace = "test-namespace"
+	assert.NoError(t, fakeClient.Create(ctx, policy))
+	policyChecksum, err := r.ReconcileDSProxy(ctx, instance, "")
+	assert.NoError(t, err)
+	assert.Equal(t, checksum, policyChecksum)
+	configMap := &corev1.ConfigMap{}
+	assert.NoError(t, fakeClient.Get(ctx, client.ObjectKey{Name: "test-grafana-dsproxy-policy", Namespace: "test-namespace"}, configMap))
+	uid := r.generateNameForComponent(instance, grafoov1alpha1.DataSources[0].GetDataSourceNameHash())
+	assert.Contains(t, configMap.Data["policy.csv"], "p, team-frontend, "+uid+", local-cluster/frontend, read")
+
+	// Changes of the CA bundle roll the pods
+	caChecksum, err := r.ReconcileDSProxy(ctx, instance, "ca")
+	assert.NoError(t, err)
+	assert.NotEqual(t, checksum, caChecksum)
+}
+
+// Test_generateCACertificate tests the CA dsproxy issues certificates with
+func Test_generateCACertificate(t *testing.T) {
+	cert, key, err := generateCACertificate("test-grafana-dsproxy-ca")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, key)
+	assert.True(t, caCertificateValid(cert))
+	assert.False(t, caCertificateValid(nil))
+
+	// The pair loads as dsproxy loads its --tls-ca-cert and --tls-ca-key
+	_, err = tls.X509KeyPair(cert, key)
+	assert.NoError(t, err)
+}
+
+// Test_getAccessPolicies tests aggregating GrafanaAccessPolicies into policy.csv lines
+func Test_getAccessPolicies(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = grafoov1alpha1.AddToScheme(scheme)
+
+	instance := &grafoov1alpha1.Grafana{
+		Spec: grafoov1alpha1.GrafanaSpec{
+			DSProxy: &grafoov1alpha1.DSProxy{Enabled: true},
+		},
+	}
+	instance.Name = "test-grafana"
+	instance.Namespace = "test-namespace"
+	instance.Labels = map[string]string{"env": "prod"}
+
+	newPolicy := func(name, namespace string, selector map[string]string, rules ...grafoov1alpha1.AccessRule) *grafoov1alpha1.GrafanaAccessPolicy {
+		policy := &grafoov1alpha1.GrafanaAccessPolicy{Spec: grafoov1alpha1.GrafanaAccessPolicySpec{Rules: rules}}
+		policy.Name = name
+		policy.Namespace = namespace
+		if selector != nil {
+			policy.Spec.InstanceSelector = &metav1.LabelSelector{MatchLabels: selector}
+		}
+		return policy
+	}
+	fakeClient := clientfake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		newPolicy("frontend", "test-namespace", nil, grafoov1alpha1.AccessRule{
+			Groups:     []string{"team-frontend"},
+			Namespaces: []string{"*/frontend-*"},
+		}),
+		newPolicy("backend", "test-namespace", map[string]string{"env": "prod"}, grafoov1alpha1.AccessRule{
+			Subjects:    []string{"alice@example.com"},
+			Groups:      []string{"team-backend"},
+			DataSources: []string{"Prometheus", "Loki", "test-grafana-1a2b3c", "Unknown"},
+			Namespaces:  []string{"prod-cluster/backend", "prod-cluster/db"},
+		}, grafoov1alpha1.AccessRule{
+			Groups:      []string{"team-db"},
+			DataSources: []string{"Unknown"},
+			Namespaces:  []string{"prod-cluster/db"},
+		}),
+		newPolicy("dev-only", "test-namespace", map[string]string{"env": "dev"}, grafoov1alpha1.AccessRule{
+			Groups:     []string{"developers"},
+			Namespaces: []string{"*/*"},
+		}),
+		newPolicy("injection", "test-namespace", nil, grafoov1alpha1.AccessRule{
+			Groups:     []string{"mallory, *, */*, read\np"},
+			Namespaces: []string{"*/*"},
+		}),
+		newPolicy("other-namespace", "other-namespace", nil, grafoov1alpha1.AccessRule{
+			Groups:     []string{"other"},
+			Namespaces: []string{"*/*"},
+		}),
+	).Build()
+
+	r := &GrafanaReconciler{Client: fakeClient}
+	dataSourceUIDs := map[string][]string{
+		"Prometheus":          {"test-grafana-1a2b3c"},
+		"test-grafana-1a2b3c": {"test-grafana-1a2b3c"},
+		"Loki":                {"test-grafana-4d5e6f", "test-grafana-7a8b9c"},
+		"Loki (application)":  {"test-grafana-4d5e6f"},
+	}
+
+	// Wildcards are not allowed by default
+	policies, err := r.getAccessPolicies(context.TODO(), instance)
+	assert.NoError(t, err)
+	assert.Len(t, policies, 1)
+	assert.Equal(t, "backend", policies[0].Name)
+
+	instance.Spec.DSProxy.AccessPolicyWildcards = true
+	policies, err = r.getAccessPolicies(context.TODO(), instance)
+	assert.NoError(t, err)
+	assert.Len(t, policies, 2)
+
+	// Datasources are mapped to their UIDs, unknown ones grant nothing
+	assert.Equal(t, `
+# GrafanaAccessPolicy backend
+p, alice@example.com, test-grafana-1a2b3c, prod-cluster/backend, read
+p, alice@example.com, test-grafana-1a2b3c, prod-cluster/db, read
+p, alice@example.com, test-grafana-4d5e6f, prod-cluster/backend, read
+p, alice@example.com, test-grafana-4d5e6f, prod-cluster/db, read
+p, alice@example.com, test-grafana-7a8b9c, prod-cluster/backend, read
+p, alice@example.com, test-grafana-7a8b9c, prod-cluster/db, read
+p, team-backend, test-grafana-1a2b3c, prod-cluster/backend, read
+p, team-backend, test-grafana-1a2b3c, prod-cluster/db, read
+p, team-backend, test-grafana-4d5e6f, prod-cluster/backend, read
+p, team-backend, test-grafana-4d5e6f, prod-cluster/db, read
+p, team-backend, test-grafana-7a8b9c, prod-cluster/backend, read
+p, team-backend, test-grafana-7a8b9c, prod-cluster/db, read
+
+# GrafanaAccessPolicy frontend
+p, team-frontend, *, */frontend-*, read
+`, renderAccessPolicies(context.TODO(), policies, dataSourceUIDs))
+}
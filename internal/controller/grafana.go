@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"net/url"
+	"sort"
+	"strings"
 
 	grafanav1beta1 "github.com/grafana/grafana-operator/v5/api/v1beta1"
 	corev1 "k8s.io/api/core/v1"
@@ -28,11 +30,29 @@ func (r *GrafanaReconciler) ReconcileGrafana(ctx context.Context, instance *graf
 		return err
 	}
 
+	// Reconcile the CA bundle the upstream certificates are verified with
+	caBundle, err := r.ReconcileCABundle(ctx, instance)
+	if err != nil {
+		return err
+	}
+
+	// Reconcile dsproxy config, policy and TLS material
+	dsproxyChecksum, err := r.ReconcileDSProxy(ctx, instance, caBundle)
+	if err != nil {
+		return err
+	}
+
 	// Build GrafanaSpec
-	grafanaSpec, err := r.buildGrafanaSpec(ctx, instance, clientSecret, databaseConfig)
+	grafanaSpec, err := r.buildGrafanaSpec(ctx, instance, clientSecret, databaseConfig, caBundle)
 	if err != nil {
 		return err
 	}
+	if dsproxyEnabled(instance) {
+		grafanaSpec.Deployment.Spec.Template = r.generateDSProxyPodTemplate(ctx, instance, dsproxyChecksum, caBundle)
+	}
+	if caBundle != "" {
+		grafanaSpec.Deployment.Spec.Template = r.withCABundleVolume(instance, grafanaSpec.Deployment.Spec.Template, caBundle)
+	}
 
 	// Create or update Grafana resource
 	if err := r.createOrUpdateGrafanaResource(ctx, instance, grafanaSpec); err != nil {
@@ -111,12 +131,13 @@ func (r *GrafanaReconciler) getDatabaseConfig(ctx context.Context, instance *gra
 //	instance - The Grafana instance for which the spec is being built.
 //	clientSecret - The client secret for OAuth authentication.
 //	databaseConfig - A map containing database configuration settings.
+//	caBundle - The CA bundle the OAuth client trusts, the system roots when empty, unless spec.dex.tlsSkipVerify is set.
 //
 // Returns:
 //
 //	grafanav1beta1.GrafanaSpec - The constructed Grafana specification.
 //	error - An error if any occurred during the construction of the spec.
-func (r *GrafanaReconciler) buildGrafanaSpec(ctx context.Context, instance *grafoov1alpha1.Grafana, clientSecret string, databaseConfig map[string]string) (grafanav1beta1.GrafanaSpec, error) {
+func (r *GrafanaReconciler) buildGrafanaSpec(ctx context.Context, instance *grafoov1alpha1.Grafana, clientSecret string, databaseConfig map[string]string, caBundle string) (grafanav1beta1.GrafanaSpec, error) {
 	grafanaRouteURI := r.generateRouteUriForComponent(ctx, instance, "grafana")
 	u, err := url.Parse(grafanaRouteURI)
 	if err != nil {
@@ -124,6 +145,26 @@ func (r *GrafanaReconciler) buildGrafanaSpec(ctx context.Context, instance *graf
 	}
 	grafanaRouteDomain := u.Hostname()
 
+	oauthConfig := map[string]string{
+		"enabled":             "true",
+		"name":                "Dex SSO",
+		"allow_sign_up":       "true",
+		"client_id":           "grafana",
+		"client_secret":       clientSecret,
+		"scopes":              "openid email groups",
+		"auth_url":            r.generateRouteUriForComponent(ctx, instance, "dex") + "/auth",
+		"token_url":           r.generateRouteUriForComponent(ctx, instance, "dex") + "/token",
+		"api_url":             r.generateRouteUriForComponent(ctx, instance, "dex") + "/userinfo",
+		"role_attribute_path": "contains(groups[*], 'system:cluster-admins') && 'Admin' || contains(groups[*], 'system:authenticated') && 'Editor' || 'Viewer'",
+	}
+	switch {
+	case instance.Spec.Dex != nil && instance.Spec.Dex.TLSSkipVerify:
+		oauthConfig["tls_skip_verify_insecure"] = "true"
+	case caBundle != "":
+		// The Dex route is served with the ingress certificate
+		oauthConfig["tls_client_ca"] = grafanaCABundleDir + "/" + caBundleKey
+	}
+
 	return grafanav1beta1.GrafanaSpec{
 		Version: instance.Spec.Version,
 		Deployment: &grafanav1beta1.DeploymentV1{
@@ -147,20 +188,8 @@ func (r *GrafanaReconciler) buildGrafanaSpec(ctx context.Context, instance *graf
 			"auth": {
 				"disable_login_form": "false",
 			},
-			"auth.generic_oauth": {
-				"enabled":                  "true",
-				"name":                     "Dex SSO",
-				"allow_sign_up":            "true",
-				"client_id":                "grafana",
-				"client_secret":            clientSecret,
-				"scopes":                   "openid email groups",
-				"auth_url":                 r.generateRouteUriForComponent(ctx, instance, "dex") + "/auth",
-				"token_url":                r.generateRouteUriForComponent(ctx, instance, "dex") + "/token",
-				"api_url":                  r.generateRouteUriForComponent(ctx, instance, "dex") + "/userinfo",
-				"tls_skip_verify_insecure": "true",
-				"role_attribute_path":      "contains(groups[*], 'system:cluster-admins') && 'Admin' || contains(groups[*], 'system:authenticated') && 'Editor' || 'Viewer'",
-			},
-			"database": databaseConfig,
+			"auth.generic_oauth": oauthConfig,
+			"database":           databaseConfig,
 		},
 	}, nil
 }
@@ -185,9 +214,23 @@ func (r *GrafanaReconciler) createAuthReviewerResources(ctx context.Context, ins
 	rules := []rbacv1.PolicyRule{
 		{
 			APIGroups: []string{"authorization.k8s.io"},
-			Resources: []string{"subjectaccessreviews", "tokenreviews"},
+			Resources: []string{"subjectaccessreviews"},
 			Verbs:     []string{"create"},
 		},
+		{
+			// dsproxy lists namespaces to review access to each of them
+			APIGroups: []string{""},
+			Resources: []string{"namespaces"},
+			Verbs:     []string{"list"},
+		},
+	}
+	if dsproxyEnabled(instance) && instance.Spec.DSProxy.TokenReview {
+		// dsproxy authenticates service account tokens with TokenReviews
+		rules = append(rules, rbacv1.PolicyRule{
+			APIGroups: []string{"authentication.k8s.io"},
+			Resources: []string{"tokenreviews"},
+			Verbs:     []string{"create"},
+		})
 	}
 	if err := r.createClusterRole(ctx, instance, roleName, rules); err != nil {
 		return err
@@ -195,12 +238,26 @@ func (r *GrafanaReconciler) createAuthReviewerResources(ctx context.Context, ins
 	return r.createClusterRoleBinding(ctx, instance, roleName, roleName, subjects)
 }
 
+// createTempoStackResources grants reading the traces of the tenants of the
+// enabled Tempo datasources. The ClusterRole and its binding are removed when
+// there are none.
 func (r *GrafanaReconciler) createTempoStackResources(ctx context.Context, instance *grafoov1alpha1.Grafana, subjects []rbacv1.Subject) error {
 	roleName := r.generateNameForComponent(instance, "tempostack-traces-reader")
+	datasources, err := r.resolveDataSources(ctx, instance)
+	if err != nil {
+		return err
+	}
+	tenants := tempoTenants(datasources)
+	if len(tenants) == 0 {
+		if err := r.deleteResourceIfExists(ctx, &rbacv1.ClusterRoleBinding{ObjectMeta: metav1.ObjectMeta{Name: roleName}}, instance, "clusterrolebinding"); err != nil {
+			return err
+		}
+		return r.deleteResourceIfExists(ctx, &rbacv1.ClusterRole{ObjectMeta: metav1.ObjectMeta{Name: roleName}}, instance, "clusterrole")
+	}
 	rules := []rbacv1.PolicyRule{
 		{
 			APIGroups:     []string{"tempo.grafana.com"},
-			Resources:     []string{"dev"},
+			Resources:     tenants,
 			ResourceNames: []string{"traces"},
 			Verbs:         []string{"get"},
 		},
@@ -211,6 +268,44 @@ func (r *GrafanaReconciler) createTempoStackResources(ctx context.Context, insta
 	return r.createClusterRoleBinding(ctx, instance, roleName, roleName, subjects)
 }
 
+// tempoTenants returns the sorted tenants of the enabled Tempo datasources,
+// from their tenant or parsed from their gateway URL
+func tempoTenants(datasources []grafoov1alpha1.DataSource) []string {
+	seen := map[string]bool{}
+	var tenants []string
+	for _, ds := range datasources {
+		if !ds.Enabled || ds.Type != grafoov1alpha1.TempoInCluster || ds.Tempo == nil {
+			continue
+		}
+		tenant := ds.Tempo.Tenant
+		if tenant == "" {
+			tenant = tenantFromGatewayURL(ds.Tempo.URL, "traces")
+		}
+		if tenant != "" && !seen[tenant] {
+			seen[tenant] = true
+			tenants = append(tenants, tenant)
+		}
+	}
+	sort.Strings(tenants)
+	return tenants
+}
+
+// tenantFromGatewayURL returns the tenant of a gateway URL with the path
+// /api/<signal>/v1/<tenant>/..., or an empty string
+func tenantFromGatewayURL(rawURL, signal string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	for i := 0; i+3 < len(segments); i++ {
+		if segments[i] == "api" && segments[i+1] == signal && segments[i+2] == "v1" {
+			return segments[i+3]
+		}
+	}
+	return ""
+}
+
 func (r *GrafanaReconciler) createMonitoringViewBinding(ctx context.Context, instance *grafoov1alpha1.Grafana, subjects []rbacv1.Subject) error {
 	bindingName := r.generateNameForComponent(instance, "cluster-monitoring-view")
 	return r.createClusterRoleBinding(ctx, instance, bindingName, "cluster-monitoring-view", subjects)
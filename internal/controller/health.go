@@ -0,0 +1,245 @@
+package controller
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	grafanav1beta1 "github.com/grafana/grafana-operator/v5/api/v1beta1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	grafoov1alpha1 "github.com/cldmnky/grafoo/api/v1alpha1"
+)
+
+const (
+	// dataSourceProbeInterval is how often the datasources are probed
+	dataSourceProbeInterval = 5 * time.Minute
+	// dataSourceProbeTimeout bounds a single probe
+	dataSourceProbeTimeout = 10 * time.Second
+)
+
+// dataSourceHealthPaths are the health endpoints of the datasource types,
+// relative to the datasource URL. They are API endpoints rather than the
+// readiness endpoints of the components, which the tenant paths of the
+// LokiStack and TempoStack gateways do not route. Custom datasources have
+// none and are not probed.
+var dataSourceHealthPaths = map[grafoov1alpha1.DataSourceType]string{
+	grafoov1alpha1.PrometheusInCluster: "api/v1/status/buildinfo",
+	grafoov1alpha1.PrometheusMcoo:      "api/v1/status/buildinfo",
+	grafoov1alpha1.LokiInCluster:       "loki/api/v1/labels",
+	grafoov1alpha1.TempoInCluster:      "api/echo",
+}
+
+// ProbeDataSources probes the health endpoint of every enabled datasource
+// with the token of the Grafana service account, and returns their status.
+// The upstreams are verified with the CA bundle, as Grafana does without
+// dsproxy. Datasources without a health endpoint are listed as not probed.
+// The datasources are probed at most every dataSourceProbeInterval, unless
+// they changed, otherwise the current status is returned.
+func (r *GrafanaReconciler) ProbeDataSources(ctx context.Context, instance *grafoov1alpha1.Grafana) ([]grafoov1alpha1.DataSourceStatus, error) {
+	resolved, err := r.resolveDataSources(ctx, instance)
+	if err != nil {
+		return nil, err
+	}
+	var datasources []grafoov1alpha1.DataSource
+	for _, ds := range resolved {
+		if ds.Enabled {
+			datasources = append(datasources, ds)
+		}
+	}
+	if !dataSourcesProbeDue(instance.Status.DataSources, datasources, time.Now()) {
+		return instance.Status.DataSources, nil
+	}
+
+	caBundle, err := r.getCABundle(ctx, instance)
+	if err != nil {
+		return nil, err
+	}
+	// The token is the one the datasources were reconciled with
+	grafanaDatasources := &grafanav1beta1.GrafanaDatasourceList{}
+	err = r.Client.List(ctx, grafanaDatasources, &client.ListOptions{
+		Namespace:     instance.Namespace,
+		LabelSelector: labels.SelectorFromSet(labels.Set{"app.kubernetes.io/instance": instance.Name}),
+	})
+	if err != nil {
+		return nil, err
+	}
+	token, err := r.getDataSourceToken(ctx, instance, grafanaDatasources.Items)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]grafoov1alpha1.DataSourceStatus, len(datasources))
+	var wg sync.WaitGroup
+	for i, ds := range datasources {
+		if _, ok := dataSourceHealthPaths[ds.Type]; !ok {
+			statuses[i] = newDataSourceStatus(ds)
+			statuses[i].Reason = fmt.Sprintf("not probed: no health endpoint for type %s", customDataSourceType(ds))
+			continue
+		}
+		wg.Add(1)
+		go func(i int, ds grafoov1alpha1.DataSource) {
+			defer wg.Done()
+			httpClient, err := newProbeClient(caBundle, ds.TLSSkipVerify)
+			if err != nil {
+				statuses[i] = newDataSourceStatus(ds)
+				statuses[i].LastError = err.Error()
+				statuses[i].LastProbeTime = &metav1.Time{Time: time.Now()}
+				return
+			}
+			statuses[i] = probeDataSource(ctx, httpClient, ds, token)
+		}(i, ds)
+	}
+	wg.Wait()
+	return statuses, nil
+}
+
+// dataSourcesProbeDue returns true when the datasources changed since the
+// previous statuses, or any of them was last probed dataSourceProbeInterval
+// ago
+func dataSourcesProbeDue(previous []grafoov1alpha1.DataSourceStatus, datasources []grafoov1alpha1.DataSource, now time.Time) bool {
+	if len(previous) != len(datasources) {
+		return true
+	}
+	for i, ds := range datasources {
+		expected := newDataSourceStatus(ds)
+		if previous[i].Name != expected.Name || previous[i].Type != expected.Type || previous[i].URL != expected.URL {
+			return true
+		}
+		if _, ok := dataSourceHealthPaths[ds.Type]; !ok {
+			continue
+		}
+		if previous[i].LastProbeTime == nil || now.Sub(previous[i].LastProbeTime.Time) >= dataSourceProbeInterval {
+			return true
+		}
+	}
+	return false
+}
+
+// newDataSourceStatus returns the status of a datasource before probing it
+func newDataSourceStatus(ds grafoov1alpha1.DataSource) grafoov1alpha1.DataSourceStatus {
+	status := grafoov1alpha1.DataSourceStatus{
+		Name: ds.Name,
+		Type: ds.Type,
+	}
+	if path, ok := dataSourceHealthPaths[ds.Type]; ok {
+		status.URL = strings.TrimSuffix(dataSourceURL(ds), "/") + "/" + path
+	} else {
+		status.URL = dataSourceURL(ds)
+	}
+	return status
+}
+
+// customDataSourceType returns the Grafana type of a custom datasource, or
+// the type of the datasource
+func customDataSourceType(ds grafoov1alpha1.DataSource) string {
+	if ds.Custom != nil {
+		return ds.Custom.Type
+	}
+	return string(ds.Type)
+}
+
+// probeDataSource probes the health endpoint of a datasource. Any response
+// other than a 2xx, e.g. a 403 of a token lacking permissions, makes it
+// unreachable.
+func probeDataSource(ctx context.Context, httpClient *http.Client, ds grafoov1alpha1.DataSource, token string) grafoov1alpha1.DataSourceStatus {
+	status := newDataSourceStatus(ds)
+	status.LastProbeTime = &metav1.Time{Time: time.Now()}
+	ctx, cancel := context.WithTimeout(ctx, dataSourceProbeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, status.URL, nil)
+	if err != nil {
+		status.LastError = err.Error()
+		return status
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	start := time.Now()
+	resp, err := httpClient.Do(req)
+	status.Latency = &metav1.Duration{Duration: time.Since(start).Round(time.Millisecond)}
+	if err != nil {
+		status.LastError = err.Error()
+		return status
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	status.HTTPStatus = int32(resp.StatusCode)
+	status.Reachable = resp.StatusCode >= 200 && resp.StatusCode < 300
+	if !status.Reachable {
+		status.LastError = fmt.Sprintf("unexpected status %s", resp.Status)
+	}
+	return status
+}
+
+// dataSourceURL returns the URL of a datasource
+func dataSourceURL(ds grafoov1alpha1.DataSource) string {
+	switch {
+	case ds.Prometheus != nil:
+		return ds.Prometheus.URL
+	case ds.Loki != nil:
+		return ds.Loki.URL
+	case ds.Tempo != nil:
+		return ds.Tempo.URL
+	case ds.Custom != nil:
+		return ds.Custom.URL
+	}
+	return ""
+}
+
+// newProbeClient returns a client verifying TLS with the system roots and
+// caBundle, unless skipVerify is set
+func newProbeClient(caBundle string, skipVerify bool) (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: skipVerify}
+	if !skipVerify && caBundle != "" {
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM([]byte(caBundle)) {
+			return nil, fmt.Errorf("failed to append CA bundle to cert pool")
+		}
+		tlsConfig.RootCAs = roots
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
+
+// setDataSourcesCondition sets the DataSourcesReady condition from the
+// probed datasources, which is only true when all of them are reachable.
+// Datasources that are not probed do not count.
+func setDataSourcesCondition(instance *grafoov1alpha1.Grafana, statuses []grafoov1alpha1.DataSourceStatus) {
+	var unreachable []string
+	for _, status := range statuses {
+		if status.Reason == "" && !status.Reachable {
+			unreachable = append(unreachable, status.Name)
+		}
+	}
+	if len(unreachable) > 0 {
+		meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+			Type:    typeDataSourcesReady,
+			Status:  metav1.ConditionFalse,
+			Reason:  "DataSourcesUnreachable",
+			Message: fmt.Sprintf("DataSources are unreachable: %s", strings.Join(unreachable, ", ")),
+		})
+		return
+	}
+	meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+		Type:    typeDataSourcesReady,
+		Status:  metav1.ConditionTrue,
+		Reason:  "DataSourcesReachable",
+		Message: "DataSources have been reconciled and are reachable",
+	})
+}
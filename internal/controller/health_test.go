@@ -0,0 +1,202 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	grafanav1beta1 "github.com/grafana/grafana-operator/v5/api/v1beta1"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientfake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	grafoov1alpha1 "github.com/cldmnky/grafoo/api/v1alpha1"
+)
+
+// Test_probeDataSource tests probing the health endpoints of the datasources
+func Test_probeDataSource(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		// The routes of the Prometheus API and of the tenants of the
+		// LokiStack and TempoStack gateways
+		switch r.URL.Path {
+		case "/api/v1/status/buildinfo",
+			"/api/logs/v1/application/loki/api/v1/labels",
+			"/api/traces/v1/dev/tempo/api/echo":
+			w.WriteHeader(http.StatusOK)
+		case "/api/logs/v1/infrastructure/loki/api/v1/labels":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	httpClient, err := newProbeClient("", false)
+	assert.NoError(t, err)
+	ctx := context.TODO()
+
+	prometheus := grafoov1alpha1.DataSource{
+		Name:       "Prometheus",
+		Type:       grafoov1alpha1.PrometheusInCluster,
+		Prometheus: &grafoov1alpha1.PrometheusDS{URL: server.URL},
+	}
+	status := probeDataSource(ctx, httpClient, prometheus, "token")
+	assert.True(t, status.Reachable)
+	assert.Equal(t, int32(http.StatusOK), status.HTTPStatus)
+	assert.Empty(t, status.LastError)
+	assert.NotNil(t, status.Latency)
+	assert.Equal(t, server.URL+"/api/v1/status/buildinfo", status.URL)
+
+	tempo := grafoov1alpha1.DataSource{
+		Name:  "Tempo",
+		Type:  grafoov1alpha1.TempoInCluster,
+		Tempo: &grafoov1alpha1.TempoDS{URL: server.URL + "/api/traces/v1/dev/tempo"},
+	}
+	assert.True(t, probeDataSource(ctx, httpClient, tempo, "token").Reachable)
+
+	loki := grafoov1alpha1.DataSource{
+		Name: "Loki",
+		Type: grafoov1alpha1.LokiInCluster,
+		Loki: &grafoov1alpha1.LokiDS{URL: server.URL + "/api/logs/v1/application/"},
+	}
+	status = probeDataSource(ctx, httpClient, loki, "token")
+	assert.True(t, status.Reachable)
+	assert.Equal(t, server.URL+"/api/logs/v1/application/loki/api/v1/labels", status.URL)
+
+	loki.Loki.URL = server.URL + "/api/logs/v1/infrastructure"
+	status = probeDataSource(ctx, httpClient, loki, "token")
+	assert.False(t, status.Reachable)
+	assert.Equal(t, int32(http.StatusServiceUnavailable), status.HTTPStatus)
+	assert.Equal(t, "unexpected status 503 Service Unavailable", status.LastError)
+
+	// Responses to a token lacking permissions are unhealthy
+	status = probeDataSource(ctx, httpClient, prometheus, "")
+	assert.False(t, status.Reachable)
+	assert.Equal(t, int32(http.StatusUnauthorized), status.HTTPStatus)
+
+	assert.Equal(t, []string{
+		"/api/v1/status/buildinfo",
+		"/api/traces/v1/dev/tempo/api/echo",
+		"/api/logs/v1/application/loki/api/v1/labels",
+		"/api/logs/v1/infrastructure/loki/api/v1/labels",
+		"/api/v1/status/buildinfo",
+	}, paths)
+
+	server.Close()
+	status = probeDataSource(ctx, httpClient, prometheus, "token")
+	assert.False(t, status.Reachable)
+	assert.Zero(t, status.HTTPStatus)
+	assert.NotEmpty(t, status.LastError)
+}
+
+// Test_ProbeDataSources tests listing the datasources that are not probed and
+// probing at most every dataSourceProbeInterval
+func Test_ProbeDataSources(t *testing.T) {
+	probes := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes++
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	_ = grafoov1alpha1.AddToScheme(scheme)
+	_ = grafanav1beta1.AddToScheme(scheme)
+	ctx := context.TODO()
+
+	instance := &grafoov1alpha1.Grafana{
+		Spec: grafoov1alpha1.GrafanaSpec{
+			DataSources: []grafoov1alpha1.DataSource{
+				{
+					Name:       "Prometheus",
+					Type:       grafoov1alpha1.PrometheusInCluster,
+					Enabled:    true,
+					Prometheus: &grafoov1alpha1.PrometheusDS{URL: server.URL},
+				},
+				{
+					Name:    "Elasticsearch",
+					Type:    grafoov1alpha1.Custom,
+					Enabled: true,
+					Custom: &grafoov1alpha1.CustomDS{
+						Type: "elasticsearch",
+						URL:  "https://elasticsearch.example.com:9200",
+					},
+				},
+				{
+					Name: "Disabled",
+					Type: grafoov1alpha1.PrometheusInCluster,
+				},
+			},
+		},
+	}
+	instance.Name = "test-grafana"
+	instance.Namespace = "test-namespace"
+	fakeClient := clientfake.NewClientBuilder().WithScheme(scheme).WithObjects(instance).Build()
+	r := &GrafanaReconciler{Client: fakeClient, Scheme: scheme}
+
+	statuses, err := r.ProbeDataSources(ctx, instance)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, probes)
+	assert.Len(t, statuses, 2)
+	assert.True(t, statuses[0].Reachable)
+	assert.NotNil(t, statuses[0].LastProbeTime)
+	assert.Equal(t, grafoov1alpha1.DataSourceStatus{
+		Name:   "Elasticsearch",
+		Type:   grafoov1alpha1.Custom,
+		URL:    "https://elasticsearch.example.com:9200",
+		Reason: "not probed: no health endpoint for type elasticsearch",
+	}, statuses[1])
+
+	// Within the interval the datasources are not probed again
+	instance.Status.DataSources = statuses
+	statuses, err = r.ProbeDataSources(ctx, instance)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, probes)
+	assert.Equal(t, instance.Status.DataSources, statuses)
+
+	// After the interval they are
+	instance.Status.DataSources[0].LastProbeTime = &metav1.Time{Time: time.Now().Add(-dataSourceProbeInterval)}
+	_, err = r.ProbeDataSources(ctx, instance)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, probes)
+
+	// And as soon as they change
+	instance.Status.DataSources = statuses
+	instance.Spec.DataSources[0].Prometheus.URL = server.URL + "/"
+	instance.Spec.DataSources[2].Enabled = true
+	instance.Spec.DataSources[2].Prometheus = &grafoov1alpha1.PrometheusDS{URL: server.URL}
+	statuses, err = r.ProbeDataSources(ctx, instance)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, probes)
+	assert.Len(t, statuses, 3)
+}
+
+// Test_setDataSourcesCondition tests aggregating the health of the datasources
+func Test_setDataSourcesCondition(t *testing.T) {
+	instance := &grafoov1alpha1.Grafana{}
+	setDataSourcesCondition(instance, []grafoov1alpha1.DataSourceStatus{
+		{Name: "Prometheus", Reachable: true},
+		{Name: "Loki (application)"},
+		{Name: "Tempo"},
+		{Name: "Elasticsearch", Reason: "not probed: no health endpoint for type elasticsearch"},
+	})
+	condition := meta.FindStatusCondition(instance.Status.Conditions, typeDataSourcesReady)
+	assert.Equal(t, metav1.ConditionFalse, condition.Status)
+	assert.Equal(t, "DataSourcesUnreachable", condition.Reason)
+	assert.Equal(t, "DataSources are unreachable: Loki (application), Tempo", condition.Message)
+
+	setDataSourcesCondition(instance, []grafoov1alpha1.DataSourceStatus{{Name: "Prometheus", Reachable: true}})
+	condition = meta.FindStatusCondition(instance.Status.Conditions, typeDataSourcesReady)
+	assert.Equal(t, metav1.ConditionTrue, condition.Status)
+	assert.Equal(t, "DataSourcesReachable", condition.Reason)
+}
@@ -0,0 +1,222 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	grafoov1alpha1 "github.com/cldmnky/grafoo/api/v1alpha1"
+)
+
+var (
+	lokiStackGVK  = schema.GroupVersionKind{Group: "loki.grafana.com", Version: "v1", Kind: "LokiStack"}
+	lokiStackGVR  = schema.GroupVersionResource{Group: "loki.grafana.com", Version: "v1", Resource: "lokistacks"}
+	tempoStackGVK = schema.GroupVersionKind{Group: "tempo.grafana.com", Version: "v1alpha1", Kind: "TempoStack"}
+	tempoStackGVR = schema.GroupVersionResource{Group: "tempo.grafana.com", Version: "v1alpha1", Resource: "tempostacks"}
+)
+
+// lokiStackLoggingTenants are the tenants of a LokiStack in openshift-logging mode
+var lokiStackLoggingTenants = []string{"application", "infrastructure", "audit"}
+
+// resolveDataSources returns the datasources of the instance, with the Loki
+// and Tempo datasources referencing or discovering stacks expanded into a
+// datasource per stack and tenant of its gateway. Stacks that do not exist
+// (anymore) expand to no datasources, so that theirs are pruned.
+func (r *GrafanaReconciler) resolveDataSources(ctx context.Context, instance *grafoov1alpha1.Grafana) ([]grafoov1alpha1.DataSource, error) {
+	var datasources []grafoov1alpha1.DataSource
+	for _, ds := range instance.Spec.DataSources {
+		resolved, err := r.resolveDataSource(ctx, instance, ds)
+		if err != nil {
+			return nil, err
+		}
+		datasources = append(datasources, resolved...)
+	}
+	return datasources, nil
+}
+
+// resolveDataSource resolves a datasource of the instance, see
+// resolveDataSources
+func (r *GrafanaReconciler) resolveDataSource(ctx context.Context, instance *grafoov1alpha1.Grafana, ds grafoov1alpha1.DataSource) ([]grafoov1alpha1.DataSource, error) {
+	var datasources []grafoov1alpha1.DataSource
+	switch {
+	case ds.Type == grafoov1alpha1.LokiInCluster && ds.Loki != nil && (ds.Loki.LokiStack != nil || ds.Loki.Discover):
+		var ref *types.NamespacedName
+		if ds.Loki.LokiStack != nil {
+			ref = stackRef(instance, ds.Loki.LokiStack.Name, ds.Loki.LokiStack.Namespace)
+		}
+		stacks, err := r.getStacks(ctx, lokiStackGVR, ref)
+		if err != nil {
+			return nil, err
+		}
+		for _, stack := range stacks {
+			for _, tenant := range lokiStackTenants(ctx, stack) {
+				resolved := ds
+				resolved.Name = stackDataSourceName(ds.Name, stack, tenant, ref == nil)
+				resolved.Loki = &grafoov1alpha1.LokiDS{
+					URL: fmt.Sprintf("https://%s-gateway-http.%s.svc.cluster.local:8080/api/logs/v1/%s/", stack.GetName(), stack.GetNamespace(), tenant),
+				}
+				datasources = append(datasources, resolved)
+			}
+		}
+	case ds.Type == grafoov1alpha1.TempoInCluster && ds.Tempo != nil && (ds.Tempo.TempoStack != nil || ds.Tempo.Discover):
+		var ref *types.NamespacedName
+		if ds.Tempo.TempoStack != nil {
+			ref = stackRef(instance, ds.Tempo.TempoStack.Name, ds.Tempo.TempoStack.Namespace)
+		}
+		stacks, err := r.getStacks(ctx, tempoStackGVR, ref)
+		if err != nil {
+			return nil, err
+		}
+		for _, stack := range stacks {
+			for _, tenant := range tempoStackTenants(ctx, stack) {
+				resolved := ds
+				resolved.Name = stackDataSourceName(ds.Name, stack, tenant, ref == nil)
+				resolved.Tempo = &grafoov1alpha1.TempoDS{
+					URL:    fmt.Sprintf("https://tempo-%s-gateway.%s.svc.cluster.local:8080/api/traces/v1/%s/tempo", stack.GetName(), stack.GetNamespace(), tenant),
+					Tenant: tenant,
+				}
+				datasources = append(datasources, resolved)
+			}
+		}
+	default:
+		datasources = append(datasources, ds)
+	}
+	return datasources, nil
+}
+
+// stackRef returns the name of a referenced stack, which defaults to the
+// namespace of the instance
+func stackRef(instance *grafoov1alpha1.Grafana, name, namespace string) *types.NamespacedName {
+	if namespace == "" {
+		namespace = instance.Namespace
+	}
+	return &types.NamespacedName{Name: name, Namespace: namespace}
+}
+
+// getStacks returns the referenced stack, or all stacks in the cluster sorted
+// by namespace and name when ref is nil. A missing stack or CRD is not an
+// error, it results in no stacks.
+func (r *GrafanaReconciler) getStacks(ctx context.Context, gvr schema.GroupVersionResource, ref *types.NamespacedName) ([]unstructured.Unstructured, error) {
+	logger := log.FromContext(ctx)
+	if ref != nil {
+		stack, err := r.Dynamic.Resource(gvr).Namespace(ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) || meta.IsNoMatchError(err) {
+			logger.Info("Referenced stack not found", "resource", gvr.Resource, "name", ref.String())
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return []unstructured.Unstructured{*stack}, nil
+	}
+
+	list, err := r.Dynamic.Resource(gvr).List(ctx, metav1.ListOptions{})
+	if apierrors.IsNotFound(err) || meta.IsNoMatchError(err) {
+		logger.Info("Stacks are not available in the cluster", "resource", gvr.Resource)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	stacks := list.Items
+	sort.Slice(stacks, func(i, j int) bool {
+		if stacks[i].GetNamespace() != stacks[j].GetNamespace() {
+			return stacks[i].GetNamespace() < stacks[j].GetNamespace()
+		}
+		return stacks[i].GetName() < stacks[j].GetName()
+	})
+	return stacks, nil
+}
+
+// stackDataSourceName names the datasource of a stack tenant. Discovered
+// stacks are named by namespace and name, as there can be several.
+func stackDataSourceName(name string, stack unstructured.Unstructured, tenant string, discovered bool) string {
+	if discovered {
+		return fmt.Sprintf("%s %s/%s (%s)", name, stack.GetNamespace(), stack.GetName(), tenant)
+	}
+	return fmt.Sprintf("%s (%s)", name, tenant)
+}
+
+// lokiStackTenants returns the tenants of the gateway of a LokiStack, which
+// has none without a tenants mode
+func lokiStackTenants(ctx context.Context, stack unstructured.Unstructured) []string {
+	mode, _, _ := unstructured.NestedString(stack.Object, "spec", "tenants", "mode")
+	switch mode {
+	case "openshift-logging":
+		return lokiStackLoggingTenants
+	case "openshift-network":
+		return []string{"network"}
+	case "":
+		log.FromContext(ctx).Info("LokiStack has no gateway, skipping it", "name", stack.GetNamespace()+"/"+stack.GetName())
+		return nil
+	default:
+		return authenticationTenants(stack)
+	}
+}
+
+// tempoStackTenants returns the tenants of the gateway of a TempoStack, which
+// has none when the gateway is disabled
+func tempoStackTenants(ctx context.Context, stack unstructured.Unstructured) []string {
+	enabled, _, _ := unstructured.NestedBool(stack.Object, "spec", "template", "gateway", "enabled")
+	if !enabled {
+		log.FromContext(ctx).Info("TempoStack has no gateway, skipping it", "name", stack.GetNamespace()+"/"+stack.GetName())
+		return nil
+	}
+	return authenticationTenants(stack)
+}
+
+// authenticationTenants returns the tenant names of spec.tenants.authentication
+// of a stack
+func authenticationTenants(stack unstructured.Unstructured) []string {
+	authentication, _, _ := unstructured.NestedSlice(stack.Object, "spec", "tenants", "authentication")
+	var tenants []string
+	for _, a := range authentication {
+		entry, ok := a.(map[string]any)
+		if !ok {
+			continue
+		}
+		if tenant, _, _ := unstructured.NestedString(entry, "tenantName"); tenant != "" {
+			tenants = append(tenants, tenant)
+		}
+	}
+	return tenants
+}
+
+// grafanasForStack maps a LokiStack or TempoStack to the Grafana instances
+// with datasources discovering stacks of its kind or referencing it
+func (r *GrafanaReconciler) grafanasForStack(ctx context.Context, obj client.Object) []reconcile.Request {
+	grafanas := &grafoov1alpha1.GrafanaList{}
+	if err := r.Client.List(ctx, grafanas); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list Grafana instances for stack", "name", obj.GetName())
+		return nil
+	}
+	isLoki := obj.GetObjectKind().GroupVersionKind().GroupKind() == lokiStackGVK.GroupKind()
+	stack := types.NamespacedName{Name: obj.GetName(), Namespace: obj.GetNamespace()}
+
+	var requests []reconcile.Request
+	for _, grafana := range grafanas.Items {
+		for _, ds := range grafana.Spec.DataSources {
+			var matches bool
+			if isLoki && ds.Loki != nil {
+				matches = ds.Loki.Discover || (ds.Loki.LokiStack != nil && *stackRef(&grafana, ds.Loki.LokiStack.Name, ds.Loki.LokiStack.Namespace) == stack)
+			} else if !isLoki && ds.Tempo != nil {
+				matches = ds.Tempo.Discover || (ds.Tempo.TempoStack != nil && *stackRef(&grafana, ds.Tempo.TempoStack.Name, ds.Tempo.TempoStack.Namespace) == stack)
+			}
+			if matches {
+				requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: grafana.Name, Namespace: grafana.Namespace}})
+				break
+			}
+		}
+	}
+	return requests
+}
@@ -0,0 +1,246 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	clientfake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	grafoov1alpha1 "github.com/cldmnky/grafoo/api/v1alpha1"
+)
+
+// newStack returns a LokiStack or TempoStack with spec
+func newStack(gvk schema.GroupVersionKind, namespace, name string, spec map[string]any) *unstructured.Unstructured {
+	stack := &unstructured.Unstructured{Object: map[string]any{"spec": spec}}
+	stack.SetGroupVersionKind(gvk)
+	stack.SetNamespace(namespace)
+	stack.SetName(name)
+	return stack
+}
+
+// Test_resolveDataSources tests expanding the datasources of stacks per tenant
+func Test_resolveDataSources(t *testing.T) {
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{
+			lokiStackGVR:  "LokiStackList",
+			tempoStackGVR: "TempoStackList",
+		},
+		newStack(lokiStackGVK, "openshift-logging", "logging-loki", map[string]any{
+			"tenants": map[string]any{"mode": "openshift-logging"},
+		}),
+		newStack(tempoStackGVK, "tracing", "simplest", map[string]any{
+			"template": map[string]any{"gateway": map[string]any{"enabled": true}},
+			"tenants": map[string]any{
+				"mode": "openshift",
+				"authentication": []any{
+					map[string]any{"tenantName": "dev", "tenantId": "1"},
+					map[string]any{"tenantName": "prod", "tenantId": "2"},
+				},
+			},
+		}),
+		newStack(tempoStackGVK, "observability", "no-gateway", map[string]any{}),
+	)
+
+	instance := &grafoov1alpha1.Grafana{
+		Spec: grafoov1alpha1.GrafanaSpec{
+			DataSources: []grafoov1alpha1.DataSource{
+				{
+					Name:       "Prometheus",
+					Type:       grafoov1alpha1.PrometheusInCluster,
+					Enabled:    true,
+					Prometheus: &grafoov1alpha1.PrometheusDS{URL: "https://thanos-querier.openshift-monitoring.svc.cluster.local:9091"},
+				},
+				{
+					Name:          "Loki",
+					Type:          grafoov1alpha1.LokiInCluster,
+					Enabled:       true,
+					TLSSkipVerify: true,
+					Loki: &grafoov1alpha1.LokiDS{LokiStack: &grafoov1alpha1.LokiStack{
+						Name:      "logging-loki",
+						Namespace: "openshift-logging",
+					}},
+				},
+				{
+					Name:    "Missing",
+					Type:    grafoov1alpha1.LokiInCluster,
+					Enabled: true,
+					Loki:    &grafoov1alpha1.LokiDS{LokiStack: &grafoov1alpha1.LokiStack{Name: "missing"}},
+				},
+				{
+					Name:    "Tempo",
+					Type:    grafoov1alpha1.TempoInCluster,
+					Enabled: true,
+					Tempo:   &grafoov1alpha1.TempoDS{Discover: true},
+				},
+			},
+		},
+	}
+	instance.Name = "test-grafana"
+	instance.Namespace = "test-namespace"
+
+	r := &GrafanaReconciler{Dynamic: dynamicClient}
+	datasources, err := r.resolveDataSources(context.TODO(), instance)
+	assert.NoError(t, err)
+
+	var names, urls []string
+	for _, ds := range datasources {
+		names = append(names, ds.Name)
+		switch ds.Type {
+		case grafoov1alpha1.PrometheusInCluster:
+			urls = append(urls, ds.Prometheus.URL)
+		case grafoov1alpha1.LokiInCluster:
+			assert.True(t, ds.TLSSkipVerify)
+			urls = append(urls, ds.Loki.URL)
+		case grafoov1alpha1.TempoInCluster:
+			urls = append(urls, ds.Tempo.URL)
+		}
+	}
+	assert.Equal(t, []string{
+		"Prometheus",
+		"Loki (application)",
+		"Loki (infrastructure)",
+		"Loki (audit)",
+		"Tempo tracing/simplest (dev)",
+		"Tempo tracing/simplest (prod)",
+	}, names)
+	assert.Equal(t, []string{
+		"https://thanos-querier.openshift-monitoring.svc.cluster.local:9091",
+		"https://logging-loki-gateway-http.openshift-logging.svc.cluster.local:8080/api/logs/v1/application/",
+		"https://logging-loki-gateway-http.openshift-logging.svc.cluster.local:8080/api/logs/v1/infrastructure/",
+		"https://logging-loki-gateway-http.openshift-logging.svc.cluster.local:8080/api/logs/v1/audit/",
+		"https://tempo-simplest-gateway.tracing.svc.cluster.local:8080/api/traces/v1/dev/tempo",
+		"https://tempo-simplest-gateway.tracing.svc.cluster.local:8080/api/traces/v1/prod/tempo",
+	}, urls)
+	// The spec of the instance is left untouched
+	assert.NotNil(t, instance.Spec.DataSources[1].Loki.LokiStack)
+}
+
+// Test_grafanasForStack tests mapping stacks to the Grafana instances using them
+func Test_grafanasForStack(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = grafoov1alpha1.AddToScheme(scheme)
+
+	newGrafana := func(name string, datasources ...grafoov1alpha1.DataSource) *grafoov1alpha1.Grafana {
+		grafana := &grafoov1alpha1.Grafana{Spec: grafoov1alpha1.GrafanaSpec{DataSources: datasources}}
+		grafana.Name = name
+		grafana.Namespace = "openshift-logging"
+		return grafana
+	}
+	fakeClient := clientfake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		newGrafana("referencing", grafoov1alpha1.DataSource{
+			Type: grafoov1alpha1.LokiInCluster,
+			Loki: &grafoov1alpha1.LokiDS{LokiStack: &grafoov1alpha1.LokiStack{Name: "logging-loki"}},
+		}),
+		newGrafana("discovering", grafoov1alpha1.DataSource{
+			Type: grafoov1alpha1.LokiInCluster,
+			Loki: &grafoov1alpha1.LokiDS{Discover: true},
+		}),
+		newGrafana("other", grafoov1alpha1.DataSource{
+			Type: grafoov1alpha1.LokiInCluster,
+			Loki: &grafoov1alpha1.LokiDS{LokiStack: &grafoov1alpha1.LokiStack{Name: "other-loki"}},
+		}),
+		newGrafana("tempo", grafoov1alpha1.DataSource{
+			Type:  grafoov1alpha1.TempoInCluster,
+			Tempo: &grafoov1alpha1.TempoDS{Discover: true},
+		}),
+	).Build()
+
+	r := &GrafanaReconciler{Client: fakeClient}
+	requests := r.grafanasForStack(context.TODO(), newStack(lokiStackGVK, "openshift-logging", "logging-loki", nil))
+	var names []types.NamespacedName
+	for _, request := range requests {
+		names = append(names, request.NamespacedName)
+	}
+	assert.ElementsMatch(t, []types.NamespacedName{
+		{Name: "referencing", Namespace: "openshift-logging"},
+		{Name: "discovering", Namespace: "openshift-logging"},
+	}, names)
+
+	requests = r.grafanasForStack(context.TODO(), newStack(tempoStackGVK, "tracing", "simplest", nil))
+	assert.Len(t, requests, 1)
+	assert.Equal(t, "tempo", requests[0].Name)
+}
+
+// Test_createTempoStackResources tests granting reading the traces of the
+// tenants of the Tempo datasources
+func Test_createTempoStackResources(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = rbacv1.AddToScheme(scheme)
+	_ = grafoov1alpha1.AddToScheme(scheme)
+	ctx := context.TODO()
+
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{tempoStackGVR: "TempoStackList"},
+		newStack(tempoStackGVK, "tracing", "simplest", map[string]any{
+			"template": map[string]any{"gateway": map[string]any{"enabled": true}},
+			"tenants": map[string]any{
+				"authentication": []any{map[string]any{"tenantName": "staging"}},
+			},
+		}),
+	)
+	fakeClient := clientfake.NewClientBuilder().WithScheme(scheme).Build()
+	r := &GrafanaReconciler{Client: fakeClient, Scheme: scheme, Dynamic: dynamicClient}
+
+	instance := &grafoov1alpha1.Grafana{
+		Spec: grafoov1alpha1.GrafanaSpec{
+			DataSources: []grafoov1alpha1.DataSource{
+				{
+					Name:    "Tempo (Dev)",
+					Type:    grafoov1alpha1.TempoInCluster,
+					Enabled: true,
+					Tempo:   &grafoov1alpha1.TempoDS{URL: "https://tempo-tempo-gateway.tempo.svc.cluster.local:8080/api/traces/v1/dev/tempo"},
+				},
+				{
+					Name:    "Tempo (Prod)",
+					Type:    grafoov1alpha1.TempoInCluster,
+					Enabled: true,
+					Tempo:   &grafoov1alpha1.TempoDS{URL: "https://tempo.example.com/tempo", Tenant: "prod"},
+				},
+				{
+					Name:    "Tempo (QA)",
+					Type:    grafoov1alpha1.TempoInCluster,
+					Enabled: false,
+					Tempo:   &grafoov1alpha1.TempoDS{URL: "https://tempo-tempo-gateway.tempo.svc.cluster.local:8080/api/traces/v1/qa/tempo"},
+				},
+				{
+					Name:    "Tempo",
+					Type:    grafoov1alpha1.TempoInCluster,
+					Enabled: true,
+					Tempo:   &grafoov1alpha1.TempoDS{Discover: true},
+				},
+			},
+		},
+	}
+	instance.Name = "test-grafana"
+	instance.Namespace = "test-namespace"
+	subjects := []rbacv1.Subject{{Kind: "ServiceAccount", Name: "test-grafana-sa", Namespace: "test-namespace"}}
+	key := types.NamespacedName{Name: "test-grafana-tempostack-traces-reader"}
+
+	assert.NoError(t, r.createTempoStackResources(ctx, instance, subjects))
+	clusterRole := &rbacv1.ClusterRole{}
+	assert.NoError(t, fakeClient.Get(ctx, key, clusterRole))
+	assert.Len(t, clusterRole.Rules, 1)
+	assert.Equal(t, []string{"dev", "prod", "staging"}, clusterRole.Rules[0].Resources)
+	assert.Equal(t, []string{"traces"}, clusterRole.Rules[0].ResourceNames)
+	assert.NoError(t, fakeClient.Get(ctx, key, &rbacv1.ClusterRoleBinding{}))
+
+	// Removing a datasource removes its tenant
+	instance.Spec.DataSources = instance.Spec.DataSources[:1]
+	assert.NoError(t, r.createTempoStackResources(ctx, instance, subjects))
+	assert.NoError(t, fakeClient.Get(ctx, key, clusterRole))
+	assert.Equal(t, []string{"dev"}, clusterRole.Rules[0].Resources)
+
+	// Without tenants there is nothing to grant
+	instance.Spec.DataSources = nil
+	assert.NoError(t, r.createTempoStackResources(ctx, instance, subjects))
+	assert.True(t, apierrors.IsNotFound(fakeClient.Get(ctx, key, &rbacv1.ClusterRole{})))
+	assert.True(t, apierrors.IsNotFound(fakeClient.Get(ctx, key, &rbacv1.ClusterRoleBinding{})))
+}
@@ -0,0 +1,183 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	grafanav1beta1 "github.com/grafana/grafana-operator/v5/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	grafoov1alpha1 "github.com/cldmnky/grafoo/api/v1alpha1"
+)
+
+const (
+	// serviceCAInjectAnnotation makes the OpenShift service CA operator
+	// inject the service CA into a ConfigMap as service-ca.crt
+	serviceCAInjectAnnotation = "service.beta.openshift.io/inject-cabundle"
+	serviceCAKey              = "service-ca.crt"
+	// ingressCANamespace and ingressCAName hold the CA of the default
+	// ingress certificate, which the routes are served with
+	ingressCANamespace = "openshift-config-managed"
+	ingressCAName      = "default-ingress-cert"
+	caBundleKey        = "ca-bundle.crt"
+	caBundleVolume     = "ca-bundle"
+	grafanaCABundleDir = "/etc/grafana/ca"
+	dsproxyCABundleDir = "/etc/dsproxy/ca"
+)
+
+// ReconcileCABundle reconciles the CA bundle the upstream TLS certificates
+// are verified with: the OpenShift service CA, injected into an annotated
+// ConfigMap, and the CA of the cluster ingress. Both are concatenated into
+// the <name>-ca-bundle ConfigMap, which is mounted into the Grafana pods.
+// It returns the bundle, which is empty until the service CA is injected
+// and outside of OpenShift.
+func (r *GrafanaReconciler) ReconcileCABundle(ctx context.Context, instance *grafoov1alpha1.Grafana) (string, error) {
+	serviceCA := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      r.generateNameForComponent(instance, "service-ca"),
+			Namespace: instance.Namespace,
+		},
+	}
+	// The data is owned by the service CA operator and left untouched
+	_, err := CreateOrUpdateWithRetries(ctx, r.Client, serviceCA, func() error {
+		serviceCA.ObjectMeta.Labels = r.generateLabelsForComponent(instance, "grafana")
+		if serviceCA.ObjectMeta.Annotations == nil {
+			serviceCA.ObjectMeta.Annotations = map[string]string{}
+		}
+		serviceCA.ObjectMeta.Annotations[serviceCAInjectAnnotation] = "true"
+		return ctrl.SetControllerReference(instance, serviceCA, r.Scheme)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	ingressCA := &corev1.ConfigMap{}
+	err = r.Get(ctx, client.ObjectKey{Name: ingressCAName, Namespace: ingressCANamespace}, ingressCA)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return "", err
+	}
+	bundle := concatPEM(serviceCA.Data[serviceCAKey], ingressCA.Data[caBundleKey])
+
+	caBundle := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      r.generateNameForComponent(instance, "ca-bundle"),
+			Namespace: instance.Namespace,
+		},
+	}
+	_, err = CreateOrUpdateWithRetries(ctx, r.Client, caBundle, func() error {
+		caBundle.ObjectMeta.Labels = r.generateLabelsForComponent(instance, "grafana")
+		caBundle.Data = map[string]string{caBundleKey: bundle}
+		return ctrl.SetControllerReference(instance, caBundle, r.Scheme)
+	})
+	if err != nil {
+		return "", err
+	}
+	return bundle, nil
+}
+
+// getDataSourceCA returns the CA the datasources verify their upstream with.
+// With dsproxy, Grafana only trusts the dsproxy CA, so that a connection
+// bypassing the interception fails instead of reaching the upstream.
+func (r *GrafanaReconciler) getDataSourceCA(ctx context.Context, instance *grafoov1alpha1.Grafana) (string, error) {
+	if dsproxyEnabled(instance) {
+		secret := &corev1.Secret{}
+		err := r.Get(ctx, client.ObjectKey{Name: r.generateNameForComponent(instance, "dsproxy-tls"), Namespace: instance.Namespace}, secret)
+		if err != nil {
+			return "", client.IgnoreNotFound(err)
+		}
+		return string(secret.Data[corev1.TLSCertKey]), nil
+	}
+	return r.getCABundle(ctx, instance)
+}
+
+// getCABundle returns the CA bundle reconciled by ReconcileCABundle
+func (r *GrafanaReconciler) getCABundle(ctx context.Context, instance *grafoov1alpha1.Grafana) (string, error) {
+	configMap := &corev1.ConfigMap{}
+	err := r.Get(ctx, client.ObjectKey{Name: r.generateNameForComponent(instance, "ca-bundle"), Namespace: instance.Namespace}, configMap)
+	if err != nil {
+		return "", client.IgnoreNotFound(err)
+	}
+	return configMap.Data[caBundleKey], nil
+}
+
+// concatPEM concatenates PEM encoded certificates, skipping empty ones
+func concatPEM(certs ...string) string {
+	var b strings.Builder
+	for _, cert := range certs {
+		cert = strings.TrimSpace(cert)
+		if cert == "" {
+			continue
+		}
+		b.WriteString(cert)
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// withTLSVerification configures how the datasource verifies the TLS
+// certificate of its upstream: with caCert, or the system roots when it is
+// empty, unless the datasource opts out with tlsSkipVerify.
+func withTLSVerification(ds grafoov1alpha1.DataSource, caCert string, jsonData, secureJSONData json.RawMessage) (json.RawMessage, json.RawMessage, error) {
+	var data map[string]any
+	if err := json.Unmarshal(jsonData, &data); err != nil {
+		return nil, nil, err
+	}
+	var secureData map[string]string
+	if err := json.Unmarshal(secureJSONData, &secureData); err != nil {
+		return nil, nil, err
+	}
+	if ds.TLSSkipVerify {
+		data["tlsSkipVerify"] = true
+	} else if caCert != "" {
+		data["tlsAuthWithCACert"] = true
+		secureData["tlsCACert"] = caCert
+	}
+
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	secureJSONData, err = json.Marshal(secureData)
+	if err != nil {
+		return nil, nil, err
+	}
+	return jsonData, secureJSONData, nil
+}
+
+// withCABundleVolume adds the CA bundle to the Grafana pod template override
+// and mounts it into the Grafana container, whose OAuth client trusts it.
+// The checksum rolls the pods when the bundle changes, as Grafana only reads
+// it on startup.
+func (r *GrafanaReconciler) withCABundleVolume(instance *grafoov1alpha1.Grafana, template *grafanav1beta1.DeploymentV1PodTemplateSpec, bundle string) *grafanav1beta1.DeploymentV1PodTemplateSpec {
+	if template == nil {
+		template = &grafanav1beta1.DeploymentV1PodTemplateSpec{}
+	}
+	if template.ObjectMeta.Annotations == nil {
+		template.ObjectMeta.Annotations = map[string]string{}
+	}
+	template.ObjectMeta.Annotations["checksum/ca-bundle"] = sha256ForSecret(bundle)
+	if template.Spec == nil {
+		template.Spec = &grafanav1beta1.DeploymentV1PodSpec{}
+	}
+	// Merged into the container of the grafana-operator by name
+	template.Spec.Containers = append(template.Spec.Containers, corev1.Container{
+		Name: "grafana",
+		VolumeMounts: []corev1.VolumeMount{
+			{Name: caBundleVolume, MountPath: grafanaCABundleDir, ReadOnly: true},
+		},
+	})
+	template.Spec.Volumes = append(template.Spec.Volumes, corev1.Volume{
+		Name: caBundleVolume,
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: r.generateNameForComponent(instance, "ca-bundle")},
+			},
+		},
+	})
+	return template
+}
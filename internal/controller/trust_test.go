@@ -0,0 +1,114 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientfake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	grafoov1alpha1 "github.com/cldmnky/grafoo/api/v1alpha1"
+)
+
+// Test_ReconcileCABundle tests combining the service and ingress CAs
+func Test_ReconcileCABundle(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	_ = grafoov1alpha1.AddToScheme(scheme)
+	ctx := context.TODO()
+
+	instance := &grafoov1alpha1.Grafana{}
+	instance.Name = "test-grafana"
+	instance.Namespace = "test-namespace"
+
+	t.Run("Not injected yet", func(t *testing.T) {
+		fakeClient := clientfake.NewClientBuilder().WithScheme(scheme).Build()
+		r := &GrafanaReconciler{Client: fakeClient, Scheme: scheme}
+		bundle, err := r.ReconcileCABundle(ctx, instance)
+		assert.NoError(t, err)
+		assert.Empty(t, bundle)
+
+		serviceCA := &corev1.ConfigMap{}
+		assert.NoError(t, fakeClient.Get(ctx, types.NamespacedName{Name: "test-grafana-service-ca", Namespace: "test-namespace"}, serviceCA))
+		assert.Equal(t, "true", serviceCA.Annotations[serviceCAInjectAnnotation])
+	})
+
+	t.Run("Service and ingress CA", func(t *testing.T) {
+		serviceCA := &corev1.ConfigMap{Data: map[string]string{serviceCAKey: "service-ca\n"}}
+		serviceCA.Name = "test-grafana-service-ca"
+		serviceCA.Namespace = "test-namespace"
+		ingressCA := &corev1.ConfigMap{Data: map[string]string{caBundleKey: "ingress-ca"}}
+		ingressCA.Name = ingressCAName
+		ingressCA.Namespace = ingressCANamespace
+		fakeClient := clientfake.NewClientBuilder().WithScheme(scheme).WithObjects(serviceCA, ingressCA).Build()
+		r := &GrafanaReconciler{Client: fakeClient, Scheme: scheme}
+
+		bundle, err := r.ReconcileCABundle(ctx, instance)
+		assert.NoError(t, err)
+		assert.Equal(t, "service-ca\ningress-ca\n", bundle)
+
+		// The injected service CA is kept
+		assert.NoError(t, fakeClient.Get(ctx, types.NamespacedName{Name: "test-grafana-service-ca", Namespace: "test-namespace"}, serviceCA))
+		assert.Equal(t, "service-ca\n", serviceCA.Data[serviceCAKey])
+
+		caBundle := &corev1.ConfigMap{}
+		assert.NoError(t, fakeClient.Get(ctx, types.NamespacedName{Name: "test-grafana-ca-bundle", Namespace: "test-namespace"}, caBundle))
+		assert.Equal(t, bundle, caBundle.Data[caBundleKey])
+
+		ca, err := r.getDataSourceCA(ctx, instance)
+		assert.NoError(t, err)
+		assert.Equal(t, bundle, ca)
+	})
+}
+
+// Test_withTLSVerification tests the TLS settings of the generated datasources
+func Test_withTLSVerification(t *testing.T) {
+	jsonData := json.RawMessage(`{"httpHeaderName1": "Authorization"}`)
+	secureJSONData := json.RawMessage(`{"httpHeaderValue1": "Bearer token"}`)
+
+	data, secureData, err := withTLSVerification(grafoov1alpha1.DataSource{}, "ca", jsonData, secureJSONData)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"httpHeaderName1": "Authorization", "tlsAuthWithCACert": true}`, string(data))
+	assert.JSONEq(t, `{"httpHeaderValue1": "Bearer token", "tlsCACert": "ca"}`, string(secureData))
+
+	// Without a CA the system roots are used
+	data, secureData, err = withTLSVerification(grafoov1alpha1.DataSource{}, "", jsonData, secureJSONData)
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(jsonData), string(data))
+	assert.JSONEq(t, string(secureJSONData), string(secureData))
+
+	data, secureData, err = withTLSVerification(grafoov1alpha1.DataSource{TLSSkipVerify: true}, "ca", jsonData, secureJSONData)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"httpHeaderName1": "Authorization", "tlsSkipVerify": true}`, string(data))
+	assert.JSONEq(t, string(secureJSONData), string(secureData))
+}
+
+// Test_buildGrafanaSpecOAuthTLS tests the TLS settings of the OAuth client
+func Test_buildGrafanaSpecOAuthTLS(t *testing.T) {
+	r := &GrafanaReconciler{}
+	ctx := context.TODO()
+	instance := &grafoov1alpha1.Grafana{Spec: grafoov1alpha1.GrafanaSpec{IngressDomain: "example.com"}}
+	instance.Name = "test-grafana"
+	instance.Namespace = "test-namespace"
+
+	spec, err := r.buildGrafanaSpec(ctx, instance, "secret", map[string]string{}, "ca")
+	assert.NoError(t, err)
+	assert.Equal(t, grafanaCABundleDir+"/"+caBundleKey, spec.Config["auth.generic_oauth"]["tls_client_ca"])
+	assert.NotContains(t, spec.Config["auth.generic_oauth"], "tls_skip_verify_insecure")
+
+	// Without a CA the system roots are used
+	spec, err = r.buildGrafanaSpec(ctx, instance, "secret", map[string]string{}, "")
+	assert.NoError(t, err)
+	assert.NotContains(t, spec.Config["auth.generic_oauth"], "tls_client_ca")
+	assert.NotContains(t, spec.Config["auth.generic_oauth"], "tls_skip_verify_insecure")
+
+	instance.Spec.Dex = &grafoov1alpha1.Dex{Enabled: true, TLSSkipVerify: true}
+	spec, err = r.buildGrafanaSpec(ctx, instance, "secret", map[string]string{}, "ca")
+	assert.NoError(t, err)
+	assert.Equal(t, "true", spec.Config["auth.generic_oauth"]["tls_skip_verify_insecure"])
+	assert.NotContains(t, spec.Config["auth.generic_oauth"], "tls_client_ca")
+}